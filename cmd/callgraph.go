@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/geckoboard/prism/tools"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	errInvalidCallGraphFormat = errors.New(`unsupported callgraph format; supported formats are "tree", "dot" and "json"`)
+)
+
+// The callgraph for a profile target.
+type targetCallGraph struct {
+	Target  string          `json:"target"`
+	Pattern string          `json:"pattern,omitempty"`
+	Nodes   tools.CallGraph `json:"nodes"`
+}
+
+// PrintCallGraph analyzes a go package and prints the callgraph for each
+// profile target, i.e. the set of functions that the profile command would
+// instrument. The callgraph can be displayed as a tree or exported in DOT or
+// JSON format.
+func PrintCallGraph(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return errMissingPathToProject
+	}
+
+	profileFuncs := ctx.StringSlice("profile-target")
+	if len(profileFuncs) == 0 {
+		return errNoProfileTargets
+	}
+
+	var writeFn func(io.Writer, []targetCallGraph) error
+	switch ctx.String("format") {
+	case "", "tree":
+		writeFn = writeCallGraphTree
+	case "dot":
+		writeFn = writeCallGraphDOT
+	case "json":
+		writeFn = writeCallGraphJSON
+	default:
+		return errInvalidCallGraphFormat
+	}
+
+	absProjPath, err := absProjectPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	goPackage, err := tools.NewGoPackage(absProjPath, parseBuildTags(ctx.String("tags"))...)
+	if err != nil {
+		return err
+	}
+
+	profileTargets, err := goPackage.Find(profileFuncs...)
+	if err != nil {
+		return err
+	}
+
+	callgraphFilter, err := newCallGraphFilter(ctx)
+	if err != nil {
+		return err
+	}
+
+	graphs := make([]targetCallGraph, len(profileTargets))
+	for index, target := range profileTargets {
+		graphs[index] = targetCallGraph{
+			Target:  target.QualifiedName,
+			Pattern: target.Pattern,
+			Nodes:   callgraphFilter.Prune(target.CallGraph()),
+		}
+	}
+
+	err = writeFn(os.Stdout, graphs)
+	if err != nil {
+		return err
+	}
+
+	if callgraphFilter != nil {
+		included, excluded := callgraphFilter.Counts()
+		fmt.Fprintf(os.Stderr, "callgraph: filters included %d and excluded %d functions\n", included, excluded)
+	}
+	return nil
+}
+
+// Write the callgraph for each target as an indented tree. Each line includes
+// the depth of the node relative to the profile target.
+func writeCallGraphTree(w io.Writer, graphs []targetCallGraph) error {
+	for index, graph := range graphs {
+		maxDepth := 0
+		for _, node := range graph.Nodes {
+			if node.Depth > maxDepth {
+				maxDepth = node.Depth
+			}
+		}
+
+		if index > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "callgraph: %s (%d functions, max depth %d)\n", graph.Target, len(graph.Nodes), maxDepth)
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "depth\tfunction\n")
+		for _, node := range graph.Nodes {
+			fmt.Fprintf(tw, "%d\t%s- %s\n", node.Depth, strings.Repeat("| ", node.Depth), node.Name)
+		}
+		err := tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write the callgraphs for all targets as a single directed graph in DOT
+// format. Profile targets are rendered using a bold outline. Edges to functions
+// that are not part of any callgraph (e.g. pruned functions) are omitted.
+func writeCallGraphDOT(w io.Writer, graphs []targetCallGraph) error {
+	fmt.Fprintf(w, "digraph callgraph {\n")
+	fmt.Fprintf(w, "  node [shape=box];\n")
+
+	graphNodes := make(map[string]struct{}, 0)
+	for _, graph := range graphs {
+		for _, node := range graph.Nodes {
+			graphNodes[node.Name] = struct{}{}
+		}
+	}
+
+	seenNodes := make(map[string]struct{}, 0)
+	for _, graph := range graphs {
+		fmt.Fprintf(w, "  %s [style=bold];\n", strconv.Quote(graph.Target))
+		seenNodes[graph.Target] = struct{}{}
+	}
+
+	seenEdges := make(map[string]struct{}, 0)
+	for _, graph := range graphs {
+		for _, node := range graph.Nodes {
+			if _, exists := seenNodes[node.Name]; !exists {
+				fmt.Fprintf(w, "  %s;\n", strconv.Quote(node.Name))
+				seenNodes[node.Name] = struct{}{}
+			}
+
+			for _, callee := range node.Callees {
+				if _, exists := graphNodes[callee]; !exists {
+					continue
+				}
+
+				edge := strconv.Quote(node.Name) + " -> " + strconv.Quote(callee)
+				if _, exists := seenEdges[edge]; exists {
+					continue
+				}
+				seenEdges[edge] = struct{}{}
+				fmt.Fprintf(w, "  %s;\n", edge)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// Write the callgraph for each target in JSON format.
+func writeCallGraphJSON(w io.Writer, graphs []targetCallGraph) error {
+	data, err := json.MarshalIndent(graphs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
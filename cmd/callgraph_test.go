@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/geckoboard/prism/tools"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestPrintCallGraph(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	specs := []struct {
+		Format    string
+		ExpOutput string
+	}{
+		{
+			"tree",
+			`callgraph: ` + pkgName + `/main (4 functions, max depth 3)
+depth  function
+0      - ` + pkgName + `/main
+1      | - ` + pkgName + `/DoStuff
+2      | | - ` + pkgName + `/A.DoStuff
+3      | | | - ` + pkgName + `/other/DoStuff
+`,
+		},
+		{
+			"dot",
+			`digraph callgraph {
+  node [shape=box];
+  "` + pkgName + `/main" [style=bold];
+  "` + pkgName + `/main" -> "` + pkgName + `/DoStuff";
+  "` + pkgName + `/DoStuff";
+  "` + pkgName + `/DoStuff" -> "` + pkgName + `/A.DoStuff";
+  "` + pkgName + `/A.DoStuff";
+  "` + pkgName + `/A.DoStuff" -> "` + pkgName + `/other/DoStuff";
+  "` + pkgName + `/other/DoStuff";
+}
+`,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		output, err := captureCallGraphOutput(pkgDir, spec.Format, []string{pkgName + "/main"})
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if output != spec.ExpOutput {
+			t.Errorf("[spec %d] expected output to be:\n%s\ngot:\n%s", specIndex, spec.ExpOutput, output)
+		}
+	}
+}
+
+func TestPrintCallGraphJSON(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	output, err := captureCallGraphOutput(pkgDir, "json", []string{pkgName + "/*DoStuff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var export []targetCallGraph
+	err = json.Unmarshal([]byte(output), &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expExport := []targetCallGraph{
+		{
+			Target:  pkgName + "/A.DoStuff",
+			Pattern: pkgName + "/*DoStuff",
+			Nodes: tools.CallGraph{
+				{Name: pkgName + "/A.DoStuff", Depth: 0, Callees: []string{pkgName + "/other/DoStuff"}},
+				{Name: pkgName + "/other/DoStuff", Depth: 1},
+			},
+		},
+		{
+			Target:  pkgName + "/DoStuff",
+			Pattern: pkgName + "/*DoStuff",
+			Nodes: tools.CallGraph{
+				{Name: pkgName + "/DoStuff", Depth: 0, Callees: []string{pkgName + "/A.DoStuff"}},
+				{Name: pkgName + "/A.DoStuff", Depth: 1, Callees: []string{pkgName + "/other/DoStuff"}},
+				{Name: pkgName + "/other/DoStuff", Depth: 2},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(export, expExport) {
+		t.Fatalf("expected JSON export to be:\n%v\ngot:\n%s", expExport, output)
+	}
+}
+
+func TestPrintCallGraphWithFilters(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	specs := []struct {
+		Flags     []string
+		ExpOutput string
+	}{
+		{
+			[]string{"--max-depth", "1"},
+			`callgraph: ` + pkgName + `/main (2 functions, max depth 1)
+depth  function
+0      - ` + pkgName + `/main
+1      | - ` + pkgName + `/DoStuff
+callgraph: filters included 2 and excluded 2 functions
+`,
+		},
+		{
+			[]string{"--exclude-fn", `A\.DoStuff$`, "--exclude-pkg", "/other$"},
+			`callgraph: ` + pkgName + `/main (2 functions, max depth 1)
+depth  function
+0      - ` + pkgName + `/main
+1      | - ` + pkgName + `/DoStuff
+callgraph: filters included 2 and excluded 2 functions
+`,
+		},
+		{
+			// Profile targets are never pruned
+			[]string{"--exclude-fn", "main"},
+			`callgraph: ` + pkgName + `/main (4 functions, max depth 3)
+depth  function
+0      - ` + pkgName + `/main
+1      | - ` + pkgName + `/DoStuff
+2      | | - ` + pkgName + `/A.DoStuff
+3      | | | - ` + pkgName + `/other/DoStuff
+callgraph: filters included 4 and excluded 0 functions
+`,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		output, err := captureCallGraphOutput(pkgDir, "tree", []string{pkgName + "/main"}, spec.Flags...)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if output != spec.ExpOutput {
+			t.Errorf("[spec %d] expected output to be:\n%s\ngot:\n%s", specIndex, spec.ExpOutput, output)
+		}
+	}
+
+	_, err := captureCallGraphOutput(pkgDir, "tree", []string{pkgName + "/main"}, "--max-depth", "-1")
+	if err != errInvalidMaxDepth {
+		t.Fatalf("expected to get errInvalidMaxDepth; got %v", err)
+	}
+}
+
+func TestPrintCallGraphInvalidFormat(t *testing.T) {
+	_, err := captureCallGraphOutput("/tmp", "svg", []string{"foo/main"})
+	if err != errInvalidCallGraphFormat {
+		t.Fatalf("expected to get errInvalidCallGraphFormat; got %v", err)
+	}
+}
+
+func TestWriteCallGraphTreeWithMultipleTargets(t *testing.T) {
+	graphs := []targetCallGraph{
+		{Target: "foo/A", Nodes: tools.CallGraph{{Name: "foo/A"}}},
+		{Target: "foo/B", Nodes: tools.CallGraph{{Name: "foo/B"}}},
+	}
+
+	var buf bytes.Buffer
+	err := writeCallGraphTree(&buf, graphs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := `callgraph: foo/A (1 functions, max depth 0)
+depth  function
+0      - foo/A
+
+callgraph: foo/B (1 functions, max depth 0)
+depth  function
+0      - foo/B
+`
+	if output := buf.String(); output != expOutput {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", expOutput, output)
+	}
+}
+
+// Invoke PrintCallGraph for the supplied targets and command-line flags and
+// return its combined output.
+func captureCallGraphOutput(pkgDir, format string, targetList []string, flags ...string) (string, error) {
+	set := flag.NewFlagSet("test", 0)
+	set.String("format", format, "")
+	set.Int("max-depth", 0, "")
+	excludeFn := cli.StringSlice{}
+	set.Var(&excludeFn, "exclude-fn", "")
+	excludePkg := cli.StringSlice{}
+	set.Var(&excludePkg, "exclude-pkg", "")
+	set.Parse(append(flags, pkgDir))
+	targets := cli.StringSlice(targetList)
+	targetFlag := &cli.StringSliceFlag{
+		Name:  "profile-target",
+		Value: &targets,
+	}
+	targetFlag.Apply(set)
+	ctx := cli.NewContext(nil, set, nil)
+
+	return captureOutput(func() error {
+		return PrintCallGraph(ctx)
+	})
+}
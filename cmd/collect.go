@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/geckoboard/prism/profiler"
+	"github.com/geckoboard/prism/profiler/sink"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// The buffer size for the file sink that stores received profiles.
+	collectSinkBufferSize = 100
+)
+
+var (
+	errMissingListenAddr = errors.New("listen address not specified")
+)
+
+// CollectProfiles starts an HTTP server that receives profiles sent by the
+// HTTP sink of patched projects and stores them to the folder specified by the
+// profile-dir flag. The server runs until prism receives SIGINT or SIGTERM.
+func CollectProfiles(ctx *cli.Context) error {
+	listenAddr := ctx.String("listen")
+	if listenAddr == "" {
+		return errMissingListenAddr
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stopChan)
+
+	return runCollector(listener, ctx.String("profile-dir"), stopChan)
+}
+
+// Serve profile batches on the supplied listener and store received profiles to
+// profileDir until a value is received from stopChan.
+func runCollector(listener net.Listener, profileDir string, stopChan <-chan os.Signal) error {
+	fileSink := sink.NewFileSink(profileDir)
+	err := fileSink.Open(collectSinkBufferSize)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: sink.NewHTTPReceiver(fileSink)}
+	serveErrChan := make(chan error, 1)
+	go func() {
+		serveErrChan <- server.Serve(listener)
+	}()
+	fmt.Printf("collect: listening for profiles on %s\n", listener.Addr())
+
+	select {
+	case <-stopChan:
+		// Wait for in-flight requests to complete before closing the sink
+		err = server.Shutdown(context.Background())
+	case err = <-serveErrChan:
+	}
+
+	if closeErr := fileSink.Close(); err == nil {
+		err = closeErr
+	}
+
+	stats := fileSink.(profiler.StatsReporter).Stats()
+	fmt.Printf("collect: received %d profiles; written: %d, errored: %d\n", stats.Received, stats.Written, stats.Errored)
+	return err
+}
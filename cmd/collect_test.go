@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+	"github.com/geckoboard/prism/profiler/sink"
+)
+
+func TestCollectProfiles(t *testing.T) {
+	profileDir, err := ioutil.TempDir("", "prism-collect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := captureOutput(func() error {
+		stopChan := make(chan os.Signal, 1)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- runCollector(listener, profileDir, stopChan)
+		}()
+
+		httpSink := sink.NewHTTPSink("http://"+listener.Addr().String(), sink.HTTPSinkOptions{})
+		err := httpSink.Open(1)
+		if err != nil {
+			return err
+		}
+		for id := 0; id < 2; id++ {
+			httpSink.Input() <- &profiler.Profile{
+				ID:        uint64(id),
+				CreatedAt: time.Now(),
+				Label:     "collected",
+				Target:    &profiler.CallMetrics{FnName: "main/foo", Invocations: 1},
+			}
+		}
+		httpSink.Close()
+
+		stopChan <- syscall.SIGINT
+		return <-errChan
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := "collect: received 2 profiles; written: 2, errored: 0"
+	if !strings.Contains(output, expOutput) {
+		t.Errorf("expected output to contain %q; got:\n%s", expOutput, output)
+	}
+
+	files, err := filepath.Glob(filepath.Join(profileDir, "profile-main_foo-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected collector to store 2 profiles; got %d", len(files))
+	}
+
+	profile, err := loadProfile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Label != "collected" || profile.Target.FnName != "main/foo" {
+		t.Errorf("unexpected stored profile %+v", profile)
+	}
+}
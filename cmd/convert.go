@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/geckoboard/prism/profiler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	errNoProfilesToConvert = errors.New(`"convert" requires at least one profile argument`)
+	errConvertMultiOutput  = errors.New("the output option can only be used when converting a single profile")
+)
+
+// ConvertProfiles translates a set of profiles into the format specified by the
+// format flag. Each converted profile is written next to the original profile
+// using the file extension of the selected format unless an output file is
+// specified. JSON Lines profile streams are merged before being converted.
+func ConvertProfiles(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) == 0 {
+		return errNoProfilesToConvert
+	}
+
+	format, err := profiler.ParseProfileFormat(ctx.String("format"))
+	if err != nil {
+		return err
+	}
+
+	files, err := expandProfilePaths(args...)
+	if err != nil {
+		return err
+	}
+
+	outputFile := ctx.String("output")
+	if outputFile != "" && len(files) > 1 {
+		return errConvertMultiOutput
+	}
+
+	for _, file := range files {
+		dstFile := outputFile
+		if dstFile == "" {
+			dstFile = convertedProfilePath(file, format.Extension())
+		}
+		if dstFile == file {
+			return fmt.Errorf("profile %q is already stored in %s format", file, format)
+		}
+
+		profile, err := loadProfile(file)
+		if err != nil {
+			return err
+		}
+
+		err = saveProfile(dstFile, profile, format)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "convert: %s (%d bytes) -> %s (%d bytes)\n", file, fileSize(file), dstFile, fileSize(dstFile))
+	}
+
+	return nil
+}
+
+// Get the path for storing a converted profile by replacing the extension of
+// the original profile with the specified extension.
+func convertedProfilePath(file, ext string) string {
+	basePath := strings.TrimSuffix(file, ".jsonl")
+	if srcFormat, knownExt := profiler.ProfileFormatFromPath(file); knownExt {
+		basePath = strings.TrimSuffix(file, "."+srcFormat.Extension())
+	}
+
+	return basePath + "." + ext
+}
+
+// Write a profile to disk using the specified format.
+func saveProfile(file string, profile *profiler.Profile, format profiler.ProfileFormat) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	err = profiler.EncodeProfile(f, profile, format)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
+
+// Get the size of a file or 0 if it cannot be accessed.
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestConvertProfiles(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	// Convert all profiles to the binary format
+	set := flag.NewFlagSet("test", 0)
+	set.String("format", "binary", "")
+	set.String("output", "", "")
+	set.Parse([]string{filepath.Join(profileDir, "profile-*.json")})
+	ctx := cli.NewContext(nil, set, nil)
+
+	_, err := captureOutput(func() error { return ConvertProfiles(ctx) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, profileFile := range profileFiles {
+		binFile := strings.TrimSuffix(profileFile, ".json") + ".prism"
+		assertSameProfile(t, profileFile, binFile)
+
+		// Convert the binary profile back to gzipped JSON
+		gzFile := filepath.Join(profileDir, "converted.json.gz")
+		set = flag.NewFlagSet("test", 0)
+		set.String("format", "json.gz", "")
+		set.String("output", gzFile, "")
+		set.Parse([]string{binFile})
+		ctx = cli.NewContext(nil, set, nil)
+
+		_, err = captureOutput(func() error { return ConvertProfiles(ctx) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameProfile(t, profileFile, gzFile)
+	}
+}
+
+func TestConvertProfilesErrors(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	specs := []struct {
+		args   []string
+		format string
+		output string
+		expErr string
+	}{
+		{nil, "binary", "", errNoProfilesToConvert.Error()},
+		{profileFiles, "xml", "", `unsupported profile format; supported formats are "json", "json.gz" and "binary"`},
+		{profileFiles, "binary", "out.prism", errConvertMultiOutput.Error()},
+		{profileFiles[:1], "json", "", fmt.Sprintf("profile %q is already stored in json format", profileFiles[0])},
+	}
+
+	for specIndex, spec := range specs {
+		set := flag.NewFlagSet("test", 0)
+		set.String("format", spec.format, "")
+		set.String("output", spec.output, "")
+		set.Parse(spec.args)
+		ctx := cli.NewContext(nil, set, nil)
+
+		err := ConvertProfiles(ctx)
+		if err == nil || err.Error() != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %q; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func assertSameProfile(t *testing.T, expFile, file string) {
+	expProfile, err := loadProfile(expFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := loadProfile(file)
+	if err != nil {
+		t.Fatalf("could not load converted profile %q: %v", file, err)
+	}
+
+	expJSON, _ := json.Marshal(expProfile)
+	profileJSON, _ := json.Marshal(profile)
+	if string(expJSON) != string(profileJSON) {
+		t.Errorf("expected converted profile %q to be:\n%s\ngot:\n%s", file, expJSON, profileJSON)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"time"
 	"unicode/utf8"
 
 	"github.com/geckoboard/cli-table"
@@ -51,7 +50,9 @@ type correlatedMetrics struct {
 	metrics []*profiler.CallMetrics
 }
 
-// DiffProfiles pretty prints a n-way diff between two or more profiles.
+// DiffProfiles pretty prints a n-way diff between two or more profiles. Each
+// argument may also be a glob pattern in which case all matching profiles are
+// merged together and displayed as a single profile.
 func DiffProfiles(ctx *cli.Context) error {
 	var err error
 
@@ -79,7 +80,7 @@ func DiffProfiles(ctx *cli.Context) error {
 
 	profiles := make([]*profiler.Profile, len(args))
 	for index, arg := range args {
-		profiles[index], err = loadProfile(arg)
+		profiles[index], err = loadMergedProfile(arg)
 		if err != nil {
 			return err
 		}
@@ -280,7 +281,6 @@ func (dp *diffPrinter) appendRow(correlation *correlatedMetrics) {
 // detectTimeUnit iterates through the list of correlated metrics and tries to
 // figure out best displayUnit that can represent all displayable values.
 func (dp *diffPrinter) detectTimeUnit(correlations []*correlatedMetrics) displayUnit {
-	var val time.Duration
 	var unit displayUnit = displayUnitMs
 
 	for _, correlation := range correlations {
@@ -289,26 +289,8 @@ func (dp *diffPrinter) detectTimeUnit(correlations []*correlatedMetrics) display
 				continue
 			}
 			for _, dType := range dp.columns {
-				switch dType {
-				case tableColTotal:
-					val = metrics.TotalTime
-				case tableColMin:
-					val = metrics.MinTime
-				case tableColMax:
-					val = metrics.MaxTime
-				case tableColMean:
-					val = metrics.MeanTime
-				case tableColMedian:
-					val = metrics.MedianTime
-				case tableColP50:
-					val = metrics.P50Time
-				case tableColP75:
-					val = metrics.P75Time
-				case tableColP90:
-					val = metrics.P90Time
-				case tableColP99:
-					val = metrics.P99Time
-				default:
+				val, isTime := dType.TimeValue(metrics)
+				if !isTime {
 					continue
 				}
 
@@ -327,45 +309,15 @@ func (dp *diffPrinter) detectTimeUnit(correlations []*correlatedMetrics) display
 // This method treats lower values as better. If the abs delta difference
 // of the two values is less than the threshold then fmtDiff returns an empty string.
 func (dp *diffPrinter) fmtDiff(baseLine, candidate *profiler.CallMetrics, metricType tableColumnType) string {
-	var baseVal, candVal time.Duration
-
 	if candidate == nil {
 		return ""
 	}
 
-	switch metricType {
-	case tableColInvocations:
-		return fmt.Sprintf("%d", candidate.Invocations)
-	case tableColStdDev:
-		return fmt.Sprintf("%3.3f", candidate.StdDev)
-	case tableColTotal:
-		baseVal = baseLine.TotalTime
-		candVal = candidate.TotalTime
-	case tableColMin:
-		baseVal = baseLine.MinTime
-		candVal = candidate.MinTime
-	case tableColMax:
-		baseVal = baseLine.MaxTime
-		candVal = candidate.MaxTime
-	case tableColMean:
-		baseVal = baseLine.MeanTime
-		candVal = candidate.MeanTime
-	case tableColMedian:
-		baseVal = baseLine.MedianTime
-		candVal = candidate.MedianTime
-	case tableColP50:
-		baseVal = baseLine.P50Time
-		candVal = candidate.P50Time
-	case tableColP75:
-		baseVal = baseLine.P75Time
-		candVal = candidate.P75Time
-	case tableColP90:
-		baseVal = baseLine.P90Time
-		candVal = candidate.P90Time
-	case tableColP99:
-		baseVal = baseLine.P99Time
-		candVal = candidate.P99Time
+	candVal, isTime := metricType.TimeValue(candidate)
+	if !isTime {
+		return metricType.FormatValue(candidate)
 	}
+	baseVal, _ := metricType.TimeValue(baseLine)
 
 	// Convert value to the appropriate unit
 	baseTime := dp.unit.Convert(baseVal)
@@ -125,14 +125,14 @@ func TestDiffWithProfileLabel(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------+----------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-|            | With Label - baseline                                                                                                                                                   | With Label                                                                                                                                                                                                                                                                 |
-+------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------+----------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-| call stack |          total |            min |            max |           mean |         median | invoc |            p50 |            p75 |            p90 |            p99 | stddev |                     total |                       min |                       max |                      mean |                    median | invoc |                       p50 |                       p75 |                       p90 |                       p99 | stddev |
-+------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+
-| - main     | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |     1 | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |  0.000 | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |     1 | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |  0.000 |
-| | + foo    | 120,000,000 ns |  10,000,000 ns | 110,000,000 ns |  60,000,000 ns |  60,000,000 ns |     2 |  10,000,000 ns |  10,000,000 ns |  10,000,000 ns | 120,000,000 ns | 70.711 | 10,000,000 ns (↓ 1100.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1733.3%) |  5,000,000 ns (↓ 1100.0%) |  5,000,000 ns (↓ 1100.0%) |     2 |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1900.0%) |  1.414 |
-+------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+
+	expOutput := `+------------+--------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+|            | With Label - baseline                                                                                                                                                                                                          | With Label                                                                                                                                                                                                                                                                                                                                              |
++------------+--------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+| call stack |          total |            min |            max |           mean |         median | invoc |            p50 |            p75 |            p90 |            p99 | stddev | async wait |           self |     self mean | self % |                     total |                       min |                       max |                      mean |                    median | invoc |                       p50 |                       p75 |                       p90 |                       p99 | stddev | async wait |                      self |                self mean | self % |
++------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+------------+----------------+---------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+------------+---------------------------+--------------------------+--------+
+| - main     | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |     1 | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |  0.000 |       0 ns |           0 ns |          0 ns |   0.0% | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |     1 | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |  0.000 |  0 ns (--) |          0 ns        (--) |         0 ns        (--) |   0.0% |
+| | + foo    | 120,000,000 ns |  10,000,000 ns | 110,000,000 ns |  60,000,000 ns |  60,000,000 ns |     2 |  10,000,000 ns |  10,000,000 ns |  10,000,000 ns | 120,000,000 ns | 70.711 |       0 ns | 120,000,000 ns | 60,000,000 ns | 100.0% | 10,000,000 ns (↓ 1100.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1733.3%) |  5,000,000 ns (↓ 1100.0%) |  5,000,000 ns (↓ 1100.0%) |     2 |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1900.0%) |  1.414 |  0 ns (--) | 10,000,000 ns (↓ 1100.0%) | 5,000,000 ns (↓ 1100.0%) | 100.0% |
++------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+------------+----------------+---------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+------------+---------------------------+--------------------------+--------+
 `
 
 	if expOutput != output {
@@ -175,14 +175,14 @@ func TestDiffWithProfileLabelAndAutoUnitDetection(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+------------+----------------------------------------------------------------------------------------------------------------------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-|            | With Label - baseline                                                                                                      | With Label                                                                                                                                                                                                                    |
-+------------+----------------------------------------------------------------------------------------------------------------------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-| call stack |     total |       min |       max |      mean |    median | invoc |       p50 |       p75 |       p90 |       p99 | stddev |                total |                  min |                  max |                 mean |               median | invoc |                  p50 |                  p75 |                  p90 |                  p99 | stddev |
-+------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+----------------------+----------------------+----------------------+----------------------+----------------------+-------+----------------------+----------------------+----------------------+----------------------+--------+
-| - main     | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |     1 | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |  0.000 | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) |     1 | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) | 10.00 ms (↓ 1100.0%) |  0.000 |
-| | + foo    | 120.00 ms |  10.00 ms | 110.00 ms |  60.00 ms |  60.00 ms |     2 |  10.00 ms |  10.00 ms |  10.00 ms | 120.00 ms | 70.711 | 10.00 ms (↓ 1100.0%) |  4.00 ms        (--) |  6.00 ms (↓ 1733.3%) |  5.00 ms (↓ 1100.0%) |  5.00 ms (↓ 1100.0%) |     2 |  4.00 ms        (--) |  4.00 ms        (--) |  4.00 ms        (--) |  6.00 ms (↓ 1900.0%) |  1.414 |
-+------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+----------------------+----------------------+----------------------+----------------------+----------------------+-------+----------------------+----------------------+----------------------+----------------------+--------+
+	expOutput := `+------------+--------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+|            | With Label - baseline                                                                                                                                                                                                          | With Label                                                                                                                                                                                                                                                                                                                                              |
++------------+--------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+| call stack |          total |            min |            max |           mean |         median | invoc |            p50 |            p75 |            p90 |            p99 | stddev | async wait |           self |     self mean | self % |                     total |                       min |                       max |                      mean |                    median | invoc |                       p50 |                       p75 |                       p90 |                       p99 | stddev | async wait |                      self |                self mean | self % |
++------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+------------+----------------+---------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+------------+---------------------------+--------------------------+--------+
+| - main     | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |     1 | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns | 120,000,000 ns |  0.000 |       0 ns |           0 ns |          0 ns |   0.0% | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |     1 | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) | 10,000,000 ns (↓ 1100.0%) |  0.000 |  0 ns (--) |          0 ns        (--) |         0 ns        (--) |   0.0% |
+| | + foo    | 120,000,000 ns |  10,000,000 ns | 110,000,000 ns |  60,000,000 ns |  60,000,000 ns |     2 |  10,000,000 ns |  10,000,000 ns |  10,000,000 ns | 120,000,000 ns | 70.711 |       0 ns | 120,000,000 ns | 60,000,000 ns | 100.0% | 10,000,000 ns (↓ 1100.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1733.3%) |  5,000,000 ns (↓ 1100.0%) |  5,000,000 ns (↓ 1100.0%) |     2 |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  4,000,000 ns  (↓ 150.0%) |  6,000,000 ns (↓ 1900.0%) |  1.414 |  0 ns (--) | 10,000,000 ns (↓ 1100.0%) | 5,000,000 ns (↓ 1100.0%) | 100.0% |
++------------+----------------+----------------+----------------+----------------+----------------+-------+----------------+----------------+----------------+----------------+--------+------------+----------------+---------------+--------+---------------------------+---------------------------+---------------------------+---------------------------+---------------------------+-------+---------------------------+---------------------------+---------------------------+---------------------------+--------+------------+---------------------------+--------------------------+--------+
 `
 
 	if expOutput != output {
@@ -230,14 +230,14 @@ func TestDiffWithoutProfileLabel(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+------------+----------------------------------------------------------------------------------------------------------------------------------------------------------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-|            | baseline                                                                                                                                                       | profile 1                                                                                                                                                                                                                                                         |
-+------------+----------------------------------------------------------------------------------------------------------------------------------------------------------------+-------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
-| call stack |         total |           min |           max |          mean |        median | invoc |           p50 |           p75 |           p90 |           p99 | stddev |                    total |                      min |                      max |                     mean |                   median | invoc |                      p50 |                      p75 |                      p90 |                      p99 | stddev |
-+------------+---------------+---------------+---------------+---------------+---------------+-------+---------------+---------------+---------------+---------------+--------+--------------------------+--------------------------+--------------------------+--------------------------+--------------------------+-------+--------------------------+--------------------------+--------------------------+--------------------------+--------+
-| - main     | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us |     1 | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us |  0.000 | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) |     1 | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) |  0.000 |
-| | + foo    | 120,000.00 us |  10,000.00 us | 110,000.00 us |  60,000.00 us |  60,000.00 us |     2 |  10,000.00 us |  10,000.00 us |  10,000.00 us | 120,000.00 us | 70.711 | 10,000.00 us (↓ 1100.0%) |  4,000.00 us  (↓ 150.0%) |  6,000.00 us (↓ 1733.3%) |  5,000.00 us (↓ 1100.0%) |  5,000.00 us (↓ 1100.0%) |     2 |  4,000.00 us  (↓ 150.0%) |  4,000.00 us  (↓ 150.0%) |  4,000.00 us  (↓ 150.0%) |  6,000.00 us (↓ 1900.0%) |  1.414 |
-+------------+---------------+---------------+---------------+---------------+---------------+-------+---------------+---------------+---------------+---------------+--------+--------------------------+--------------------------+--------------------------+--------------------------+--------------------------+-------+--------------------------+--------------------------+--------------------------+--------------------------+--------+
+	expOutput := `+------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+|            | baseline                                                                                                                                                                                                            | profile 1                                                                                                                                                                                                                                                                                                                                      |
++------------+---------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------+
+| call stack |         total |           min |           max |          mean |        median | invoc |           p50 |           p75 |           p90 |           p99 | stddev | async wait |          self |    self mean | self % |                    total |                      min |                      max |                     mean |                   median | invoc |                      p50 |                      p75 |                      p90 |                      p99 | stddev |   async wait |                     self |               self mean | self % |
++------------+---------------+---------------+---------------+---------------+---------------+-------+---------------+---------------+---------------+---------------+--------+------------+---------------+--------------+--------+--------------------------+--------------------------+--------------------------+--------------------------+--------------------------+-------+--------------------------+--------------------------+--------------------------+--------------------------+--------+--------------+--------------------------+-------------------------+--------+
+| - main     | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us |     1 | 120,000.00 us | 120,000.00 us | 120,000.00 us | 120,000.00 us |  0.000 |    0.00 us |       0.00 us |      0.00 us |   0.0% | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) |     1 | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) | 10,000.00 us (↓ 1100.0%) |  0.000 | 0.00 us (--) |      0.00 us        (--) |     0.00 us        (--) |   0.0% |
+| | + foo    | 120,000.00 us |  10,000.00 us | 110,000.00 us |  60,000.00 us |  60,000.00 us |     2 |  10,000.00 us |  10,000.00 us |  10,000.00 us | 120,000.00 us | 70.711 |    0.00 us | 120,000.00 us | 60,000.00 us | 100.0% | 10,000.00 us (↓ 1100.0%) |  4,000.00 us  (↓ 150.0%) |  6,000.00 us (↓ 1733.3%) |  5,000.00 us (↓ 1100.0%) |  5,000.00 us (↓ 1100.0%) |     2 |  4,000.00 us  (↓ 150.0%) |  4,000.00 us  (↓ 150.0%) |  4,000.00 us  (↓ 150.0%) |  6,000.00 us (↓ 1900.0%) |  1.414 | 0.00 us (--) | 10,000.00 us (↓ 1100.0%) | 5,000.00 us (↓ 1100.0%) | 100.0% |
++------------+---------------+---------------+---------------+---------------+---------------+-------+---------------+---------------+---------------+---------------+--------+------------+---------------+--------------+--------+--------------------------+--------------------------+--------------------------+--------------------------+--------------------------+-------+--------------------------+--------------------------+--------------------------+--------------------------+--------+--------------+--------------------------+-------------------------+--------+
 `
 
 	if expOutput != output {
@@ -310,6 +310,14 @@ func TestAlignAndAppendRows(t *testing.T) {
 	}
 }
 
+func mockHistogram(samples ...time.Duration) *profiler.Histogram {
+	hist := &profiler.Histogram{}
+	for _, sample := range samples {
+		hist.Record(sample)
+	}
+	return hist
+}
+
 func mockProfiles(t *testing.T, useLabel bool) (profileDir string, profileFiles []string) {
 	label := ""
 	if useLabel {
@@ -331,20 +339,24 @@ func mockProfiles(t *testing.T, useLabel bool) (profileDir string, profileFiles
 				P99Time:     120 * time.Millisecond,
 				StdDev:      0.0,
 				Invocations: 1,
+				Histogram:   mockHistogram(120 * time.Millisecond),
 				NestedCalls: []*profiler.CallMetrics{
 					{
-						FnName:      "foo",
-						TotalTime:   120 * time.Millisecond,
-						MeanTime:    60 * time.Millisecond,
-						MedianTime:  60 * time.Millisecond,
-						MinTime:     10 * time.Millisecond,
-						MaxTime:     110 * time.Millisecond,
-						P50Time:     10 * time.Millisecond,
-						P75Time:     10 * time.Millisecond,
-						P90Time:     10 * time.Millisecond,
-						P99Time:     120 * time.Millisecond,
-						StdDev:      70.71068,
-						Invocations: 2,
+						FnName:       "foo",
+						TotalTime:    120 * time.Millisecond,
+						MeanTime:     60 * time.Millisecond,
+						MedianTime:   60 * time.Millisecond,
+						MinTime:      10 * time.Millisecond,
+						MaxTime:      110 * time.Millisecond,
+						P50Time:      10 * time.Millisecond,
+						P75Time:      10 * time.Millisecond,
+						P90Time:      10 * time.Millisecond,
+						P99Time:      120 * time.Millisecond,
+						StdDev:       70.71068,
+						Invocations:  2,
+						SelfTime:     120 * time.Millisecond,
+						SelfMeanTime: 60 * time.Millisecond,
+						Histogram:    mockHistogram(10*time.Millisecond, 110*time.Millisecond),
 					},
 				},
 			},
@@ -364,20 +376,24 @@ func mockProfiles(t *testing.T, useLabel bool) (profileDir string, profileFiles
 				P99Time:     10 * time.Millisecond,
 				StdDev:      0.0,
 				Invocations: 1,
+				Histogram:   mockHistogram(10 * time.Millisecond),
 				NestedCalls: []*profiler.CallMetrics{
 					{
-						FnName:      "foo",
-						TotalTime:   10 * time.Millisecond,
-						MeanTime:    5 * time.Millisecond,
-						MinTime:     4 * time.Millisecond,
-						MaxTime:     6 * time.Millisecond,
-						MedianTime:  5 * time.Millisecond,
-						P50Time:     4 * time.Millisecond,
-						P75Time:     4 * time.Millisecond,
-						P90Time:     4 * time.Millisecond,
-						P99Time:     6 * time.Millisecond,
-						StdDev:      1.41421,
-						Invocations: 2,
+						FnName:       "foo",
+						TotalTime:    10 * time.Millisecond,
+						MeanTime:     5 * time.Millisecond,
+						MinTime:      4 * time.Millisecond,
+						MaxTime:      6 * time.Millisecond,
+						MedianTime:   5 * time.Millisecond,
+						P50Time:      4 * time.Millisecond,
+						P75Time:      4 * time.Millisecond,
+						P90Time:      4 * time.Millisecond,
+						P99Time:      6 * time.Millisecond,
+						StdDev:       1.41421,
+						Invocations:  2,
+						SelfTime:     10 * time.Millisecond,
+						SelfMeanTime: 5 * time.Millisecond,
+						Histogram:    mockHistogram(4*time.Millisecond, 6*time.Millisecond),
 					},
 				},
 			},
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/geckoboard/prism/profiler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// The extension for exported pprof profiles.
+	pprofExtension = "pb.gz"
+)
+
+var (
+	errNoProfilesToExport  = errors.New(`"export" requires at least one profile argument`)
+	errExportMultiOutput   = errors.New("the output option can only be used when exporting a single profile")
+	errInvalidExportFormat = errors.New(`unsupported export format; supported formats are "pprof"`)
+)
+
+// ExportProfiles translates a set of profiles into a format that can be
+// consumed by third-party tools. Currently, only the pprof format is supported.
+// Each exported profile is written next to the original profile unless an
+// output file is specified.
+func ExportProfiles(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) == 0 {
+		return errNoProfilesToExport
+	}
+
+	if ctx.String("format") != "pprof" {
+		return errInvalidExportFormat
+	}
+
+	files, err := expandProfilePaths(args...)
+	if err != nil {
+		return err
+	}
+
+	outputFile := ctx.String("output")
+	if outputFile != "" && len(files) > 1 {
+		return errExportMultiOutput
+	}
+
+	for _, file := range files {
+		dstFile := outputFile
+		if dstFile == "" {
+			dstFile = convertedProfilePath(file, pprofExtension)
+		}
+
+		profile, err := loadProfile(file)
+		if err != nil {
+			return err
+		}
+
+		err = savePprofProfile(dstFile, profile)
+		if err != nil {
+			return fmt.Errorf("could not export profile %q: %s", file, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "export: %s -> %s\n", file, dstFile)
+	}
+
+	return nil
+}
+
+// Write a profile to disk in the pprof format. The output file is removed if
+// the profile cannot be written.
+func savePprofProfile(file string, profile *profiler.Profile) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	err = writePprofProfile(f, profile)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
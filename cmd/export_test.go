@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestExportProfilesToPprof(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("format", "pprof", "")
+	set.String("output", "", "")
+	set.Parse(profileFiles[:1])
+	ctx := cli.NewContext(nil, set, nil)
+
+	_, err := captureOutput(func() error { return ExportProfiles(ctx) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pprof := decodePprofFile(t, strings.TrimSuffix(profileFiles[0], ".json")+".pb.gz")
+
+	expSampleTypes := []string{"time/nanoseconds"}
+	if !reflect.DeepEqual(pprof.sampleTypes, expSampleTypes) {
+		t.Errorf("expected sample types to be %v; got %v", expSampleTypes, pprof.sampleTypes)
+	}
+	if pprof.defaultSampleType != "time" {
+		t.Errorf("expected default sample type to be %q; got %q", "time", pprof.defaultSampleType)
+	}
+
+	var samples []string
+	for _, sample := range pprof.samples {
+		samples = append(samples, fmt.Sprintf("%s %v %v", strings.Join(sample.stack, "<"), sample.values, sample.labels))
+	}
+	expSamples := []string{
+		"main [0] [invocations=1 count]",
+		fmt.Sprintf("foo<main [%d] [invocations=2 count]", 120*time.Millisecond),
+	}
+	if !reflect.DeepEqual(samples, expSamples) {
+		t.Errorf("expected samples to be:\n%v\ngot:\n%v", expSamples, samples)
+	}
+
+	expComments := []string{"label: With Label"}
+	if !reflect.DeepEqual(pprof.comments, expComments) {
+		t.Errorf("expected comments to be %v; got %v", expComments, pprof.comments)
+	}
+}
+
+func TestExportProfilesToPprofCumulativeTime(t *testing.T) {
+	profileDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	genMetrics := func(fnName string, total, self time.Duration, nestedCalls ...*profiler.CallMetrics) *profiler.CallMetrics {
+		return &profiler.CallMetrics{
+			FnName:      fnName,
+			TotalTime:   total,
+			SelfTime:    self,
+			Invocations: 1,
+			NestedCalls: nestedCalls,
+		}
+	}
+	profile := &profiler.Profile{
+		Target: genMetrics("main", 100*time.Millisecond, 10*time.Millisecond,
+			genMetrics("A", 60*time.Millisecond, 20*time.Millisecond,
+				genMetrics("B", 40*time.Millisecond, 40*time.Millisecond),
+			),
+			genMetrics("C", 30*time.Millisecond, 30*time.Millisecond),
+		),
+	}
+
+	// Async calls run concurrently with main and are not part of its total time
+	asyncCall := genMetrics("D", 50*time.Millisecond, 20*time.Millisecond,
+		genMetrics("E", 30*time.Millisecond, 30*time.Millisecond),
+	)
+	asyncCall.Async = true
+	profile.Target.NestedCalls = append(profile.Target.NestedCalls, asyncCall)
+
+	pprofFile := filepath.Join(profileDir, "profile.pb.gz")
+	err = savePprofProfile(pprofFile, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pprof := decodePprofFile(t, pprofFile)
+
+	// Emulate the way that pprof computes cumulative values by summing the
+	// values of all samples whose call stack includes a function
+	specs := []struct {
+		fnName string
+		expCum time.Duration
+	}{
+		{"main", 100 * time.Millisecond},
+		{"A", 60 * time.Millisecond},
+		{"B", 40 * time.Millisecond},
+		{"C", 30 * time.Millisecond},
+		{"D", 50 * time.Millisecond},
+		{"E", 30 * time.Millisecond},
+		{"async main", 50 * time.Millisecond},
+	}
+	for specIndex, spec := range specs {
+		var cum time.Duration
+		for _, sample := range pprof.samples {
+			for _, fnName := range sample.stack {
+				if fnName == spec.fnName {
+					cum += time.Duration(sample.values[0])
+					break
+				}
+			}
+		}
+
+		if cum != spec.expCum {
+			t.Errorf("[spec %d] expected cumulative time for %q to be %v; got %v", specIndex, spec.fnName, spec.expCum, cum)
+		}
+	}
+}
+
+func TestSavePprofProfileRemovesPartialFile(t *testing.T) {
+	profileDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	pprofFile := filepath.Join(profileDir, "profile.pb.gz")
+	err = savePprofProfile(pprofFile, &profiler.Profile{})
+	if err == nil {
+		t.Fatal("expected exporting a profile without call metrics to fail")
+	}
+	if _, err = os.Stat(pprofFile); !os.IsNotExist(err) {
+		t.Errorf("expected output file to be removed; got %v", err)
+	}
+}
+
+func TestExportProfilesErrors(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	specs := []struct {
+		args   []string
+		format string
+		output string
+		expErr string
+	}{
+		{nil, "pprof", "", errNoProfilesToExport.Error()},
+		{profileFiles, "callgrind", "", errInvalidExportFormat.Error()},
+		{profileFiles, "pprof", "out.pb.gz", errExportMultiOutput.Error()},
+		{profileFiles[:1], "pprof", filepath.Join(profileDir, "missing", "out.pb.gz"), fmt.Sprintf("could not export profile %q", profileFiles[0])},
+	}
+
+	for specIndex, spec := range specs {
+		set := flag.NewFlagSet("test", 0)
+		set.String("format", spec.format, "")
+		set.String("output", spec.output, "")
+		set.Parse(spec.args)
+		ctx := cli.NewContext(nil, set, nil)
+
+		err := ExportProfiles(ctx)
+		if err == nil || !strings.HasPrefix(err.Error(), spec.expErr) {
+			t.Errorf("[spec %d] expected to get error %q; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestPprofAsyncCallLabels(t *testing.T) {
+	profile := &profiler.Profile{
+		Target: &profiler.CallMetrics{
+			FnName: "main",
+			NestedCalls: []*profiler.CallMetrics{
+				{FnName: "worker", Async: true},
+			},
+		},
+	}
+
+	b := &pprofBuilder{
+		strings:     []string{""},
+		stringIndex: map[string]int64{"": 0},
+		locationIDs: make(map[string]uint64, 0),
+	}
+	b.addCall(profile.Target, nil)
+
+	if len(b.samples) != 2 {
+		t.Fatalf("expected 2 samples; got %d", len(b.samples))
+	}
+	if b.samples[0].async || !b.samples[1].async {
+		t.Errorf("expected only the worker sample to be flagged as async")
+	}
+	if exp := []string{"worker", "async main"}; !reflect.DeepEqual(b.stack(b.samples[1]), exp) {
+		t.Errorf("expected worker sample stack to be %v; got %v", exp, b.stack(b.samples[1]))
+	}
+}
+
+// Get the function names for the call stack of a sample.
+func (b *pprofBuilder) stack(sample pprofSample) []string {
+	fnNames := make([]string, len(sample.locationIDs))
+	for index, id := range sample.locationIDs {
+		fnNames[index] = b.fnNames[id-1]
+	}
+	return fnNames
+}
+
+// A decoded pprof profile.
+type decodedPprof struct {
+	sampleTypes       []string
+	defaultSampleType string
+	samples           []decodedPprofSample
+	comments          []string
+}
+
+type decodedPprofSample struct {
+	// Function names for the sample call stack starting with the callee.
+	stack  []string
+	values []uint64
+	// Labels formatted as key=value for string labels and key=num unit for
+	// numeric labels.
+	labels []string
+}
+
+// Decode a gzip-compressed pprof profile.
+func decodePprofFile(t *testing.T, file string) decodedPprof {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := decodeProtoFields(t, data)
+	var stringTable []string
+	for _, field := range fields[pprofProfileStringTable] {
+		stringTable = append(stringTable, string(field.bytes))
+	}
+	if len(stringTable) == 0 || stringTable[0] != "" {
+		t.Fatalf("expected first string table entry to be empty; got %q", stringTable)
+	}
+
+	var pprof decodedPprof
+	for _, field := range fields[pprofProfileSampleType] {
+		valueType := decodeProtoFields(t, field.bytes)
+		pprof.sampleTypes = append(pprof.sampleTypes, stringTable[valueType[pprofValueTypeType][0].varint]+"/"+stringTable[valueType[pprofValueTypeUnit][0].varint])
+	}
+	pprof.defaultSampleType = stringTable[fields[pprofProfileDefaultSampleType][0].varint]
+	for _, field := range fields[pprofProfileComment] {
+		pprof.comments = append(pprof.comments, stringTable[field.varint])
+	}
+
+	fnNames := make(map[uint64]string, 0)
+	for _, field := range fields[pprofProfileFunction] {
+		function := decodeProtoFields(t, field.bytes)
+		fnNames[function[pprofFunctionID][0].varint] = stringTable[function[pprofFunctionName][0].varint]
+	}
+	locationFns := make(map[uint64]string, 0)
+	for _, field := range fields[pprofProfileLocation] {
+		location := decodeProtoFields(t, field.bytes)
+		line := decodeProtoFields(t, location[pprofLocationLine][0].bytes)
+		locationFns[location[pprofLocationID][0].varint] = fnNames[line[pprofLineFunctionID][0].varint]
+	}
+
+	for _, field := range fields[pprofProfileSample] {
+		sample := decodeProtoFields(t, field.bytes)
+		var decoded decodedPprofSample
+		for _, locationID := range decodePackedVarints(t, sample[pprofSampleLocationID][0].bytes) {
+			decoded.stack = append(decoded.stack, locationFns[locationID])
+		}
+		decoded.values = decodePackedVarints(t, sample[pprofSampleValue][0].bytes)
+		for _, labelField := range sample[pprofSampleLabel] {
+			label := decodeProtoFields(t, labelField.bytes)
+			key := stringTable[label[pprofLabelKey][0].varint]
+			if str, isStr := label[pprofLabelStr]; isStr {
+				decoded.labels = append(decoded.labels, key+"="+stringTable[str[0].varint])
+				continue
+			}
+			var num uint64
+			if numField, hasNum := label[pprofLabelNum]; hasNum {
+				num = numField[0].varint
+			}
+			decoded.labels = append(decoded.labels, fmt.Sprintf("%s=%d %s", key, num, stringTable[label[pprofLabelNumUnit][0].varint]))
+		}
+		pprof.samples = append(pprof.samples, decoded)
+	}
+
+	return pprof
+}
+
+type protoField struct {
+	varint uint64
+	bytes  []byte
+}
+
+// Decode the varint and length-delimited fields of a protobuf message.
+func decodeProtoFields(t *testing.T, data []byte) map[int][]protoField {
+	fields := make(map[int][]protoField, 0)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("malformed protobuf field key")
+		}
+		data = data[n:]
+
+		var field protoField
+		switch key & 7 {
+		case 0:
+			field.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatal("malformed protobuf varint")
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatal("malformed protobuf length")
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("unexpected protobuf wire type %d", key&7)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], field)
+	}
+	return fields
+}
+
+func decodePackedVarints(t *testing.T, data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("malformed packed varint")
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values
+}
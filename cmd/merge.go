@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/geckoboard/prism/profiler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	errNoProfilesToMerge = errors.New(`"merge" requires at least one profile argument`)
+)
+
+// MergeProfiles combines a set of profiles captured for the same target into
+// a single profile and writes it to the file specified by the output flag or
+// to stdout if no output file is specified. The output file is encoded using
+// the format matching its extension (JSON for unrecognized extensions).
+func MergeProfiles(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) == 0 {
+		return errNoProfilesToMerge
+	}
+
+	profile, err := loadMergedProfile(args...)
+	if err != nil {
+		return err
+	}
+
+	if label := ctx.String("label"); label != "" {
+		profile.Label = label
+	}
+
+	outputFile := ctx.String("output")
+	if outputFile == "" {
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+		return err
+	}
+
+	// Files without a recognized extension are written as JSON
+	format, _ := profiler.ProfileFormatFromPath(outputFile)
+	err = saveProfile(outputFile, profile, format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "merge: merged %d profiles into %s\n", profile.MergedProfiles, outputFile)
+	return nil
+}
+
+// Expand any glob patterns in the supplied list of profile paths. Paths
+// without any glob meta-characters are returned as-is so that loadProfile can
+// report any errors when accessing them.
+func expandProfilePaths(patterns ...string) ([]string, error) {
+	files := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, `*?[`) {
+			files = append(files, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile pattern %q: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no profiles matching pattern %q", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// Load the profiles matching the supplied list of paths and glob patterns. If
+// more than one profile is matched, the profiles are merged together and the
+// merged profile is returned.
+func loadMergedProfile(patterns ...string) (*profiler.Profile, error) {
+	files, err := expandProfilePaths(patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make([]*profiler.Profile, len(files))
+	for index, file := range files {
+		profiles[index], err = loadProfile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(profiles) == 1 {
+		return profiles[0], nil
+	}
+
+	return profiler.MergeProfiles(profiles...)
+}
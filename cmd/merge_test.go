@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/geckoboard/prism/profiler"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestMergeProfilesCommand(t *testing.T) {
+	profileDir, _ := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	outputFile := filepath.Join(profileDir, "merged.json")
+
+	// Mock args
+	set := flag.NewFlagSet("test", 0)
+	set.String("output", outputFile, "")
+	set.String("label", "Merged", "")
+	set.Parse([]string{filepath.Join(profileDir, "profile-*.json")})
+	ctx := cli.NewContext(nil, set, nil)
+
+	err := MergeProfiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := loadProfile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Label != "Merged" {
+		t.Errorf("expected merged profile label to be %q; got %q", "Merged", merged.Label)
+	}
+	if merged.MergedProfiles != 2 {
+		t.Errorf("expected merged profile count to be 2; got %d", merged.MergedProfiles)
+	}
+	if merged.Target.Invocations != 2 {
+		t.Errorf("expected merged target invocations to be 2; got %d", merged.Target.Invocations)
+	}
+	if len(merged.Target.NestedCalls) != 1 || merged.Target.NestedCalls[0].Invocations != 4 {
+		t.Errorf("expected merged target to contain a single nested call with 4 invocations; got %v", merged.Target.NestedCalls)
+	}
+}
+
+func TestMergeProfilesCommandOutputFormats(t *testing.T) {
+	profileDir, _ := mockProfiles(t, true)
+	defer os.RemoveAll(profileDir)
+
+	for _, outputName := range []string{"merged.json.gz", "merged.prism"} {
+		outputFile := filepath.Join(profileDir, outputName)
+
+		set := flag.NewFlagSet("test", 0)
+		set.String("output", outputFile, "")
+		set.String("label", "", "")
+		set.Parse([]string{filepath.Join(profileDir, "profile-*.json")})
+		ctx := cli.NewContext(nil, set, nil)
+
+		_, err := captureOutput(func() error { return MergeProfiles(ctx) })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !profiler.IsEncodedProfile(data) {
+			t.Errorf("[%s] expected merged profile to be stored in a compressed or binary format", outputName)
+		}
+
+		merged, err := loadProfile(outputFile)
+		if err != nil {
+			t.Fatalf("[%s] could not load merged profile: %v", outputName, err)
+		}
+		if merged.MergedProfiles != 2 {
+			t.Errorf("[%s] expected merged profile count to be 2; got %d", outputName, merged.MergedProfiles)
+		}
+	}
+}
+
+func TestMergeProfilesCommandErrors(t *testing.T) {
+	set := flag.NewFlagSet("test", 0)
+	set.Parse([]string{})
+	ctx := cli.NewContext(nil, set, nil)
+
+	err := MergeProfiles(ctx)
+	if err != errNoProfilesToMerge {
+		t.Fatalf("expected to get error %v; got %v", errNoProfilesToMerge, err)
+	}
+}
+
+func TestExpandProfilePaths(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, false)
+	defer os.RemoveAll(profileDir)
+
+	files, err := expandProfilePaths(filepath.Join(profileDir, "*.json"), "no-such-file.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expFiles := append(profileFiles, "no-such-file.json")
+	if strings.Join(files, ",") != strings.Join(expFiles, ",") {
+		t.Fatalf("expected expanded paths to be %v; got %v", expFiles, files)
+	}
+
+	expErr := `no profiles matching pattern "` + filepath.Join(profileDir, "*.yml") + `"`
+	_, err = expandProfilePaths(filepath.Join(profileDir, "*.yml"))
+	if err == nil || err.Error() != expErr {
+		t.Fatalf("expected to get error %q; got %v", expErr, err)
+	}
+}
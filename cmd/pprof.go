@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+// Field numbers for the pprof profile.proto messages. See
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	pprofProfileSampleType        = 1
+	pprofProfileSample            = 2
+	pprofProfileMapping           = 3
+	pprofProfileLocation          = 4
+	pprofProfileFunction          = 5
+	pprofProfileStringTable       = 6
+	pprofProfileTimeNanos         = 9
+	pprofProfileDurationNanos     = 10
+	pprofProfileComment           = 13
+	pprofProfileDefaultSampleType = 14
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+	pprofSampleLabel      = 3
+
+	pprofLabelKey     = 1
+	pprofLabelStr     = 2
+	pprofLabelNum     = 3
+	pprofLabelNumUnit = 4
+
+	pprofMappingID           = 1
+	pprofMappingFilename     = 5
+	pprofMappingHasFunctions = 7
+
+	pprofLocationID        = 1
+	pprofLocationMappingID = 2
+	pprofLocationLine      = 4
+
+	pprofLineFunctionID = 1
+
+	pprofFunctionID         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+)
+
+// The sample values recorded for each call in an exported profile. Each call
+// in the profile call graph is exported as a sample whose time value is the
+// call's self time. As pprof aggregates sample values over all call stacks
+// that include a function, the flat and cumulative time reported by pprof
+// match the self and total time of the call.
+//
+// Invocation counts cannot be aggregated in the same way so they are attached
+// to each sample as a numeric label instead.
+var pprofSampleTypes = []struct {
+	typ  string
+	unit string
+}{
+	{"time", "nanoseconds"},
+}
+
+const (
+	pprofDefaultSampleType = "time"
+
+	// The prefix for the synthetic frame at the root of the call stacks of
+	// async calls.
+	pprofAsyncFramePrefix = "async "
+)
+
+// A sample for a single call in the profile call graph.
+type pprofSample struct {
+	// The location IDs for the call stack with the call at index 0.
+	locationIDs []uint64
+	values      []int64
+	invocations int64
+	async       bool
+}
+
+// pprofBuilder converts a prism profile into the protobuf-encoded pprof
+// format. Each distinct function in the profile call graph is mapped to a
+// single function and location.
+type pprofBuilder struct {
+	strings     []string
+	stringIndex map[string]int64
+
+	locationIDs map[string]uint64
+	fnNames     []string
+
+	samples []pprofSample
+}
+
+// Write a profile to w as a gzip-compressed pprof profile.
+func writePprofProfile(w io.Writer, profile *profiler.Profile) error {
+	if profile.Target == nil {
+		return fmt.Errorf("profile does not contain any call metrics")
+	}
+
+	b := &pprofBuilder{
+		strings:     []string{""},
+		stringIndex: map[string]int64{"": 0},
+		locationIDs: make(map[string]uint64, 0),
+	}
+	b.addCall(profile.Target, nil)
+
+	zw := gzip.NewWriter(w)
+	_, err := zw.Write(b.encode(profile))
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Add a sample for cm and its nested calls. The stack contains the location
+// IDs of the callers of cm, starting with the closest one.
+//
+// Async calls run concurrently with the call that forked them and their time
+// is not included in its total time. To ensure that the cumulative time of the
+// forking call matches its total time, the call stacks of async calls are
+// rooted at a synthetic "async <caller>" frame instead of the forking call.
+func (b *pprofBuilder) addCall(cm *profiler.CallMetrics, stack []uint64) {
+	locationIDs := make([]uint64, 0, len(stack)+1)
+	locationIDs = append(locationIDs, b.locationID(cm.FnName))
+	locationIDs = append(locationIDs, stack...)
+
+	b.samples = append(b.samples, pprofSample{
+		locationIDs: locationIDs,
+		values: []int64{
+			int64(cm.SelfTime),
+		},
+		invocations: int64(cm.Invocations),
+		async:       cm.Async,
+	})
+
+	for _, nestedCall := range cm.NestedCalls {
+		if nestedCall.Async {
+			b.addCall(nestedCall, []uint64{b.locationID(pprofAsyncFramePrefix + cm.FnName)})
+			continue
+		}
+		b.addCall(nestedCall, locationIDs)
+	}
+}
+
+// Get the location ID for a function, allocating a new one if required. The
+// same ID is used for the function and its location.
+func (b *pprofBuilder) locationID(fnName string) uint64 {
+	id, exists := b.locationIDs[fnName]
+	if !exists {
+		b.fnNames = append(b.fnNames, fnName)
+		id = uint64(len(b.fnNames))
+		b.locationIDs[fnName] = id
+	}
+	return id
+}
+
+// Get the string table index for s, adding it to the table if required.
+func (b *pprofBuilder) stringID(s string) int64 {
+	index, exists := b.stringIndex[s]
+	if !exists {
+		index = int64(len(b.strings))
+		b.strings = append(b.strings, s)
+		b.stringIndex[s] = index
+	}
+	return index
+}
+
+// Encode the collected samples as a pprof Profile message.
+func (b *pprofBuilder) encode(profile *profiler.Profile) []byte {
+	var out protoBuffer
+
+	for _, sampleType := range pprofSampleTypes {
+		var valueType protoBuffer
+		valueType.int64Field(pprofValueTypeType, b.stringID(sampleType.typ))
+		valueType.int64Field(pprofValueTypeUnit, b.stringID(sampleType.unit))
+		out.messageField(pprofProfileSampleType, &valueType)
+	}
+
+	for _, sample := range b.samples {
+		var msg protoBuffer
+		msg.packedField(pprofSampleLocationID, sample.locationIDs)
+		values := make([]uint64, len(sample.values))
+		for index, value := range sample.values {
+			values[index] = uint64(value)
+		}
+		msg.packedField(pprofSampleValue, values)
+		var invocations protoBuffer
+		invocations.int64Field(pprofLabelKey, b.stringID("invocations"))
+		invocations.int64Field(pprofLabelNum, sample.invocations)
+		invocations.int64Field(pprofLabelNumUnit, b.stringID("count"))
+		msg.messageField(pprofSampleLabel, &invocations)
+		if sample.async {
+			var label protoBuffer
+			label.int64Field(pprofLabelKey, b.stringID("async"))
+			label.int64Field(pprofLabelStr, b.stringID("true"))
+			msg.messageField(pprofSampleLabel, &label)
+		}
+		out.messageField(pprofProfileSample, &msg)
+	}
+
+	// All functions are already symbolized so a single mapping flagged as
+	// having function information prevents pprof from trying to symbolize
+	// the exported locations.
+	var mapping protoBuffer
+	mapping.uint64Field(pprofMappingID, 1)
+	mapping.int64Field(pprofMappingFilename, b.stringID("prism"))
+	mapping.boolField(pprofMappingHasFunctions, true)
+	out.messageField(pprofProfileMapping, &mapping)
+
+	for index, fnName := range b.fnNames {
+		id := uint64(index + 1)
+
+		var line protoBuffer
+		line.uint64Field(pprofLineFunctionID, id)
+
+		var location protoBuffer
+		location.uint64Field(pprofLocationID, id)
+		location.uint64Field(pprofLocationMappingID, 1)
+		location.messageField(pprofLocationLine, &line)
+		out.messageField(pprofProfileLocation, &location)
+
+		var function protoBuffer
+		function.uint64Field(pprofFunctionID, id)
+		function.int64Field(pprofFunctionName, b.stringID(fnName))
+		function.int64Field(pprofFunctionSystemName, b.stringID(fnName))
+		out.messageField(pprofProfileFunction, &function)
+	}
+
+	if !profile.CreatedAt.IsZero() {
+		out.int64Field(pprofProfileTimeNanos, profile.CreatedAt.UnixNano())
+	}
+	duration := profile.WallTime
+	if duration == 0 {
+		duration = profile.Target.TotalTime
+	}
+	out.int64Field(pprofProfileDurationNanos, int64(duration))
+
+	for _, comment := range pprofComments(profile) {
+		out.int64Field(pprofProfileComment, b.stringID(comment))
+	}
+	out.int64Field(pprofProfileDefaultSampleType, b.stringID(pprofDefaultSampleType))
+
+	// The string table must be encoded last as the fields above may add
+	// new entries to it.
+	for _, s := range b.strings {
+		out.bytesField(pprofProfileStringTable, []byte(s))
+	}
+
+	return out.data
+}
+
+// Get the comments for an exported profile describing its label, tags and any
+// sampling or merge information.
+func pprofComments(profile *profiler.Profile) []string {
+	comments := make([]string, 0)
+	if profile.Label != "" {
+		comments = append(comments, fmt.Sprintf("label: %s", profile.Label))
+	}
+
+	tagKeys := make([]string, 0, len(profile.Tags))
+	for key := range profile.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		comments = append(comments, fmt.Sprintf("tag: %s=%s", key, profile.Tags[key]))
+	}
+
+	if profile.MergedProfiles > 0 {
+		comments = append(comments, fmt.Sprintf("merged profiles: %d", profile.MergedProfiles))
+	}
+	if profile.SampleRate > 0 {
+		comments = append(comments, fmt.Sprintf("sample rate: %g", profile.SampleRate))
+	}
+
+	return comments
+}
+
+// protoBuffer encodes protobuf message fields. Scalar fields with a zero value
+// are omitted as per the proto3 encoding rules.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	b.data = append(b.data, buf[:n]...)
+}
+
+func (b *protoBuffer) key(field int, wireType uint64) {
+	b.varint(uint64(field)<<3 | wireType)
+}
+
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.uint64Field(field, uint64(v))
+}
+
+func (b *protoBuffer) boolField(field int, v bool) {
+	if v {
+		b.uint64Field(field, 1)
+	}
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packedField(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytesField(field, packed.data)
+}
+
+func (b *protoBuffer) messageField(field int, msg *protoBuffer) {
+	b.bytesField(field, msg.data)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
@@ -19,12 +18,14 @@ var (
 	errNoPrintColumnsSpecified = errors.New("no table columns specified for printing profile")
 )
 
-// PrintProfile displays a captured profile in tabular form.
+// PrintProfile displays a captured profile in tabular form. If more than one
+// profile is specified (either explicitly or via glob patterns), the profiles
+// are merged together before being displayed.
 func PrintProfile(ctx *cli.Context) error {
 	var err error
 
 	args := ctx.Args()
-	if len(args) != 1 {
+	if len(args) == 0 {
 		return errNoProfile
 	}
 
@@ -50,7 +51,7 @@ func PrintProfile(ctx *cli.Context) error {
 
 	pp.clipThreshold = ctx.Float64("display-threshold")
 
-	profile, err := loadProfile(args[0])
+	profile, err := loadMergedProfile(args...)
 	if err != nil {
 		return err
 	}
@@ -75,27 +76,42 @@ type profilePrinter struct {
 	clipThreshold float64
 }
 
-// Create a table with profile details.
+// Create a table with profile details. If the profile was sampled, the
+// displayed totals are extrapolated using the profile's sample rate.
 func (pp *profilePrinter) Tabularize(profile *profiler.Profile) *table.Table {
+	target := profile.Target
+	if profile.SampleRate > 1 {
+		target = target.Extrapolate(profile.SampleRate)
+	}
+
 	if pp.unit == displayUnitAuto {
-		pp.unit = pp.detectTimeUnit(profile.Target)
+		pp.unit = pp.detectTimeUnit(target)
 	}
 
 	t := table.New(len(pp.columns) + 1)
 	t.SetPadding(1)
 
 	// Setup headers and alignment settings
+	header := "call stack"
 	if profile.Label != "" {
-		t.SetHeader(0, fmt.Sprintf("%s - call stack", profile.Label), table.AlignLeft)
-	} else {
-		t.SetHeader(0, "call stack", table.AlignLeft)
+		header = fmt.Sprintf("%s - call stack", profile.Label)
+	}
+	if profile.MergedProfiles > 1 {
+		header += fmt.Sprintf(" (merged %d profiles)", profile.MergedProfiles)
+	}
+	if profile.WallTime > 0 {
+		header += fmt.Sprintf(" (wall time: %s)", pp.unit.Format(pp.unit.Convert(profile.WallTime)))
+	}
+	if profile.SampleRate > 1 {
+		header += fmt.Sprintf(" (sampled 1 in %.1f; totals extrapolated)", profile.SampleRate)
 	}
+	t.SetHeader(0, header, table.AlignLeft)
 	for dIndex, dType := range pp.columns {
 		t.SetHeader(dIndex+1, dType.Header(), table.AlignRight)
 	}
 
 	// Populate rows
-	pp.appendRow(0, profile.Target, profile.Target, t)
+	pp.appendRow(0, target, target, t)
 
 	return t
 }
@@ -128,29 +144,10 @@ func (pp *profilePrinter) appendRow(depth int, rootMetrics, rowMetrics *profiler
 // detectTimeUnit iterates through the list of displayable metrics and tries to
 // figure out best displayUnit that can represent all displayable values.
 func (pp *profilePrinter) detectTimeUnit(metrics *profiler.CallMetrics) displayUnit {
-	var val time.Duration
 	var unit displayUnit = displayUnitMs
 	for _, dType := range pp.columns {
-		switch dType {
-		case tableColTotal:
-			val = metrics.TotalTime
-		case tableColMin:
-			val = metrics.MinTime
-		case tableColMax:
-			val = metrics.MaxTime
-		case tableColMean:
-			val = metrics.MeanTime
-		case tableColMedian:
-			val = metrics.MedianTime
-		case tableColP50:
-			val = metrics.P50Time
-		case tableColP75:
-			val = metrics.P75Time
-		case tableColP90:
-			val = metrics.P90Time
-		case tableColP99:
-			val = metrics.P99Time
-		default:
+		val, isTime := dType.TimeValue(metrics)
+		if !isTime {
 			continue
 		}
 
@@ -174,41 +171,11 @@ func (pp *profilePrinter) detectTimeUnit(metrics *profiler.CallMetrics) displayU
 // Format metric entry. An empty string will be returned if the entry is of
 // time.Duration type and its value is less than the specified threshold.
 func (pp *profilePrinter) fmtEntry(rootMetrics, metrics *profiler.CallMetrics, metricType tableColumnType) string {
-	var val, rootVal time.Duration
-
-	switch metricType {
-	case tableColInvocations:
-		return fmt.Sprintf("%d", metrics.Invocations)
-	case tableColStdDev:
-		return fmt.Sprintf("%3.3f", metrics.StdDev)
-	case tableColTotal:
-		val = metrics.TotalTime
-		rootVal = rootMetrics.TotalTime
-	case tableColMin:
-		val = metrics.MinTime
-		rootVal = rootMetrics.MinTime
-	case tableColMax:
-		val = metrics.MaxTime
-		rootVal = rootMetrics.MaxTime
-	case tableColMean:
-		val = metrics.MeanTime
-		rootVal = rootMetrics.MeanTime
-	case tableColMedian:
-		val = metrics.MedianTime
-		rootVal = rootMetrics.MedianTime
-	case tableColP50:
-		val = metrics.P50Time
-		rootVal = rootMetrics.P50Time
-	case tableColP75:
-		val = metrics.P75Time
-		rootVal = rootMetrics.P75Time
-	case tableColP90:
-		val = metrics.P90Time
-		rootVal = rootMetrics.P90Time
-	case tableColP99:
-		val = metrics.P99Time
-		rootVal = rootMetrics.P99Time
+	val, isTime := metricType.TimeValue(metrics)
+	if !isTime {
+		return metricType.FormatValue(metrics)
 	}
+	rootVal := metricType.PercentBase(rootMetrics)
 
 	// Convert value to the proper unit
 	rootTime := pp.unit.Convert(rootVal)
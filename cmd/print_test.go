@@ -2,17 +2,36 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/geckoboard/cli-table"
+	"github.com/geckoboard/prism/profiler"
 	"gopkg.in/urfave/cli.v1"
 )
 
 func TestLoadProfileErrors(t *testing.T) {
-	expErr := `unrecognized profile extension ".yml" for "foo.yml"; only json profiles are currently supported`
-	_, err := loadProfile("foo.yml")
+	profileDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	ymlFile := filepath.Join(profileDir, "foo.yml")
+	err = ioutil.WriteFile(ymlFile, []byte("target: main\n"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expErr := fmt.Sprintf(`unrecognized profile format for %q; supported formats are json, jsonl, json.gz and binary`, ymlFile)
+	_, err = loadProfile(ymlFile)
 	if err == nil || err.Error() != expErr {
 		t.Fatalf("expected to get error %q; got %v", expErr, err)
 	}
@@ -23,6 +42,68 @@ func TestLoadProfileErrors(t *testing.T) {
 	}
 }
 
+func TestLoadProfileStream(t *testing.T) {
+	profileDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	var stream bytes.Buffer
+	for _, sample := range []time.Duration{10 * time.Millisecond, 30 * time.Millisecond} {
+		hist := mockHistogram(sample)
+		data, err := json.Marshal(&profiler.Profile{
+			Label: "stream",
+			Target: &profiler.CallMetrics{
+				FnName:      "main",
+				TotalTime:   sample,
+				Invocations: 1,
+				Histogram:   hist,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(append(data, '\n'))
+	}
+
+	streamFile := filepath.Join(profileDir, "profile-main.jsonl")
+	err = ioutil.WriteFile(streamFile, stream.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := loadProfile(streamFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.MergedProfiles != 2 || profile.Target.Invocations != 2 || profile.Target.TotalTime != 40*time.Millisecond {
+		t.Errorf("expected stream profiles to be merged; got %d profiles with %d invocations and total time %v", profile.MergedProfiles, profile.Target.Invocations, profile.Target.TotalTime)
+	}
+
+	for _, badLine := range []string{"null", "{}"} {
+		badFile := filepath.Join(profileDir, "profile-bad.jsonl")
+		err = ioutil.WriteFile(badFile, append(stream.Bytes(), badLine+"\n"...), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expErr := fmt.Sprintf("could not decode profile stream %q: line 3: profile does not contain any call metrics", badFile)
+		if _, err = loadProfile(badFile); err == nil || err.Error() != expErr {
+			t.Errorf("expected to get error %q; got %v", expErr, err)
+		}
+	}
+
+	emptyFile := filepath.Join(profileDir, "profile-empty.jsonl")
+	err = ioutil.WriteFile(emptyFile, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expErr := fmt.Sprintf("profile stream %q does not contain any profiles", emptyFile)
+	if _, err = loadProfile(emptyFile); err == nil || err.Error() != expErr {
+		t.Errorf("expected to get error %q; got %v", expErr, err)
+	}
+}
+
 func TestPrintWithProfileLabel(t *testing.T) {
 	profileDir, profileFiles := mockProfiles(t, true)
 	defer os.RemoveAll(profileDir)
@@ -64,12 +145,12 @@ func TestPrintWithProfileLabel(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+
-| With Label - call stack |     total |       min |       max |      mean |    median | invoc |       p50 |       p75 |       p90 |       p99 | stddev |
-+-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+
-| + main                  | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |     1 | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |  0.000 |
-| | - foo                 | 120.00 ms |           | 110.00 ms |  60.00 ms |  60.00 ms |     2 |           |           |           | 120.00 ms | 70.711 |
-+-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+
+	expOutput := `+-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+------------+-----------+-----------+--------+
+| With Label - call stack |     total |       min |       max |      mean |    median | invoc |       p50 |       p75 |       p90 |       p99 | stddev | async wait |      self | self mean | self % |
++-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+------------+-----------+-----------+--------+
+| + main                  | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |     1 | 120.00 ms | 120.00 ms | 120.00 ms | 120.00 ms |  0.000 |            |           |           |   0.0% |
+| | - foo                 | 120.00 ms |           | 110.00 ms |  60.00 ms |  60.00 ms |     2 |           |           |           | 120.00 ms | 70.711 |            | 120.00 ms |  60.00 ms | 100.0% |
++-------------------------+-----------+-----------+-----------+-----------+-----------+-------+-----------+-----------+-----------+-----------+--------+------------+-----------+-----------+--------+
 `
 
 	if expOutput != output {
@@ -118,12 +199,12 @@ func TestPrintWithoutProfileLabel(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+
-| call stack |    total |      min |      max |     mean |   median | invoc |      p50 |      p75 |      p90 |      p99 | stddev |
-+------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+
-| + main     | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms |     1 | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms |  0.000 |
-| | - foo    | 10.00 ms |  4.00 ms |  6.00 ms |  5.00 ms |  5.00 ms |     2 |  4.00 ms |  4.00 ms |  4.00 ms |  6.00 ms |  1.414 |
-+------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+
+	expOutput := `+------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+------------+----------+-----------+--------+
+| call stack |    total |      min |      max |     mean |   median | invoc |      p50 |      p75 |      p90 |      p99 | stddev | async wait |     self | self mean | self % |
++------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+------------+----------+-----------+--------+
+| + main     | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms |     1 | 10.00 ms | 10.00 ms | 10.00 ms | 10.00 ms |  0.000 |    0.00 ms |  0.00 ms |   0.00 ms |   0.0% |
+| | - foo    | 10.00 ms |  4.00 ms |  6.00 ms |  5.00 ms |  5.00 ms |     2 |  4.00 ms |  4.00 ms |  4.00 ms |  6.00 ms |  1.414 |    0.00 ms | 10.00 ms |   5.00 ms | 100.0% |
++------------+----------+----------+----------+----------+----------+-------+----------+----------+----------+----------+--------+------------+----------+-----------+--------+
 `
 
 	if expOutput != output {
@@ -172,15 +253,132 @@ func TestPrintWithoutProfileLabelAndPercentOutput(t *testing.T) {
 	os.Stdout = stdOut
 
 	output := buf.String()
-	expOutput := `+------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+
-| call stack |  total |    min |    max |   mean | median | invoc |    p50 |    p75 |    p90 |    p99 | stddev |
-+------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+
-| + main     | 100.0% | 100.0% | 100.0% | 100.0% | 100.0% |     1 | 100.0% | 100.0% | 100.0% | 100.0% |  0.000 |
-| | - foo    | 100.0% |        |  60.0% |  50.0% |  50.0% |     2 |        |        |        |  60.0% |  1.414 |
-+------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+
+	expOutput := `+------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+------------+--------+-----------+--------+
+| call stack |  total |    min |    max |   mean | median | invoc |    p50 |    p75 |    p90 |    p99 | stddev | async wait |   self | self mean | self % |
++------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+------------+--------+-----------+--------+
+| + main     | 100.0% | 100.0% | 100.0% | 100.0% | 100.0% |     1 | 100.0% | 100.0% | 100.0% | 100.0% |  0.000 |            |        |           |   0.0% |
+| | - foo    | 100.0% |        |  60.0% |  50.0% |  50.0% |     2 |        |        |        |  60.0% |  1.414 |            | 100.0% |     50.0% | 100.0% |
++------------+--------+--------+--------+--------+--------+-------+--------+--------+--------+--------+--------+------------+--------+-----------+--------+
 `
 
 	if expOutput != output {
 		t.Fatalf("tabularized print output mismatch; expected:\n%s\n\ngot:\n%s", expOutput, output)
 	}
 }
+
+func TestPrintAsyncProfile(t *testing.T) {
+	profile := &profiler.Profile{
+		WallTime: 30 * time.Millisecond,
+		Target: &profiler.CallMetrics{
+			FnName:        "main",
+			TotalTime:     20 * time.Millisecond,
+			AsyncWaitTime: 15 * time.Millisecond,
+			Invocations:   1,
+			NestedCalls: []*profiler.CallMetrics{
+				{
+					FnName:      "go worker",
+					TotalTime:   25 * time.Millisecond,
+					Invocations: 1,
+					Async:       true,
+				},
+			},
+		},
+	}
+
+	pp := &profilePrinter{
+		format:  displayTime,
+		unit:    displayUnitMs,
+		columns: []tableColumnType{tableColTotal, tableColAsyncWait},
+	}
+
+	var buf bytes.Buffer
+	pp.Tabularize(profile).Write(&buf, table.StripAnsi)
+
+	output := buf.String()
+	expOutput := `+----------------------------------+----------+------------+
+| call stack (wall time: 30.00 ms) |    total | async wait |
++----------------------------------+----------+------------+
+| + main                           | 20.00 ms |   15.00 ms |
+| | - go worker                    | 25.00 ms |    0.00 ms |
++----------------------------------+----------+------------+
+`
+	if expOutput != output {
+		t.Fatalf("tabularized print output mismatch; expected:\n%s\n\ngot:\n%s", expOutput, output)
+	}
+}
+
+func TestPrintMergedProfiles(t *testing.T) {
+	profileDir, profileFiles := mockProfiles(t, false)
+	defer os.RemoveAll(profileDir)
+
+	profile, err := loadMergedProfile(profileFiles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pp := &profilePrinter{
+		format:  displayTime,
+		unit:    displayUnitMs,
+		columns: []tableColumnType{tableColTotal, tableColMedian, tableColMax, tableColInvocations},
+	}
+
+	var buf bytes.Buffer
+	pp.Tabularize(profile).Write(&buf, table.StripAnsi)
+
+	output := buf.String()
+	expOutput := `+--------------------------------+-----------+----------+-----------+-------+
+| call stack (merged 2 profiles) |     total |   median |       max | invoc |
++--------------------------------+-----------+----------+-----------+-------+
+| + main                         | 130.00 ms | 64.90 ms | 120.00 ms |     2 |
+| | - foo                        | 130.00 ms |  8.00 ms | 110.00 ms |     4 |
++--------------------------------+-----------+----------+-----------+-------+
+`
+	if expOutput != output {
+		t.Fatalf("tabularized print output mismatch; expected:\n%s\n\ngot:\n%s", expOutput, output)
+	}
+}
+
+func TestPrintSampledProfile(t *testing.T) {
+	profile := &profiler.Profile{
+		SampleRate: 10,
+		Target: &profiler.CallMetrics{
+			FnName:      "main",
+			TotalTime:   20 * time.Millisecond,
+			MeanTime:    10 * time.Millisecond,
+			Invocations: 2,
+			NestedCalls: []*profiler.CallMetrics{
+				{
+					FnName:      "foo",
+					TotalTime:   5 * time.Millisecond,
+					MeanTime:    1 * time.Millisecond,
+					Invocations: 5,
+				},
+			},
+		},
+	}
+
+	pp := &profilePrinter{
+		format:  displayTime,
+		unit:    displayUnitMs,
+		columns: []tableColumnType{tableColTotal, tableColMean, tableColInvocations},
+	}
+
+	var buf bytes.Buffer
+	pp.Tabularize(profile).Write(&buf, table.StripAnsi)
+
+	output := buf.String()
+	expOutput := `+-----------------------------------------------------+-----------+----------+-------+
+| call stack (sampled 1 in 10.0; totals extrapolated) |     total |     mean | invoc |
++-----------------------------------------------------+-----------+----------+-------+
+| + main                                              | 200.00 ms | 10.00 ms |    20 |
+| | - foo                                             |  50.00 ms |  1.00 ms |    50 |
++-----------------------------------------------------+-----------+----------+-------+
+`
+	if expOutput != output {
+		t.Fatalf("tabularized print output mismatch; expected:\n%s\n\ngot:\n%s", expOutput, output)
+	}
+
+	if profile.Target.TotalTime != 20*time.Millisecond {
+		t.Fatal("expected extrapolation not to modify the original profile")
+	}
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,16 +21,28 @@ import (
 	"gopkg.in/urfave/cli.v1"
 )
 
+const (
+	// The name of the file (relative to the temp folder created by the
+	// profile command) where the patched project writes its run summary.
+	runSummaryFile = "prism-summary.json"
+)
+
 var (
 	errMissingPathToProject = errors.New("missing path_to_project argument")
 	errNoProfileTargets     = errors.New("no profile targets specified")
 	errMissingRunCmd        = errors.New("run-cmd not specified")
+	errInvalidMaxDepth      = errors.New("max-depth must be a non-negative integer")
+	errInvalidCalibration   = errors.New(`unsupported calibration mode; supported modes are "init" and "skip"`)
+	errInvalidSampling      = errors.New("sample-every and sample-rate must be non-negative numbers")
 
 	tokenizeRegex = regexp.MustCompile("'.+?'|\".+?\"|\\S+")
+	buildTagRegex = regexp.MustCompile(`[\s,]+`)
 )
 
 // ProfileProject clones a go package, injects profile hooks, builds and runs
-// the project to collect profiling information.
+// the project to collect profiling information. If the overlay option is
+// specified, the project is not cloned; instead, the patched files are
+// written to a separate folder and the project is built using a go build overlay.
 func ProfileProject(ctx *cli.Context) error {
 	args := ctx.Args()
 	if len(args) != 1 {
@@ -45,17 +59,20 @@ func ProfileProject(ctx *cli.Context) error {
 		return errMissingRunCmd
 	}
 
-	if !strings.HasSuffix("/", args[0]) {
-		args[0] += "/"
-	}
-	absProjPath, err := filepath.Abs(filepath.Dir(args[0]))
+	absProjPath, err := absProjectPath(args[0])
 	if err != nil {
 		return err
 	}
-	absProjPath += "/"
 
-	// Clone project
-	tmpDir, tmpAbsProjPath, err := cloneProject(absProjPath, ctx.String("output-dir"))
+	// Clone project or setup an overlay folder for the patched files
+	useOverlay := ctx.Bool("overlay")
+	var tmpDir, tmpAbsProjPath string
+	if useOverlay {
+		tmpDir, err = createOverlayDir(ctx.String("output-dir"))
+		tmpAbsProjPath = absProjPath
+	} else {
+		tmpDir, tmpAbsProjPath, err = cloneProject(absProjPath, ctx.String("output-dir"))
+	}
 	if err != nil {
 		return err
 	}
@@ -64,7 +81,20 @@ func ProfileProject(ctx *cli.Context) error {
 	}
 
 	// Analyze project
-	goPackage, err := tools.NewGoPackage(tmpAbsProjPath)
+	goPackage, err := tools.NewGoPackage(tmpAbsProjPath, parseBuildTags(ctx.String("tags"))...)
+	if err != nil {
+		return err
+	}
+
+	if useOverlay {
+		err = goPackage.EnableOverlay(tmpDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ensure that the injected profiler imports can be resolved
+	err = goPackage.LinkProfiler(tmpDir)
 	if err != nil {
 		return err
 	}
@@ -74,8 +104,28 @@ func ProfileProject(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	for _, target := range profileTargets {
+		if target.Pattern != "" {
+			fmt.Printf("profile: target pattern %q selected %s\n", target.Pattern, target.QualifiedName)
+		}
+	}
+
+	callgraphFilter, err := newCallGraphFilter(ctx)
+	if err != nil {
+		return err
+	}
+
+	summaryFile := filepath.Join(tmpDir, runSummaryFile)
+	bootstrapOpts, err := newBootstrapOptions(ctx, summaryFile)
+	if err != nil {
+		return err
+	}
 
 	// Inject profiler hooks and bootstrap code to main()
+	injectFn := tools.InjectProfiler()
+	if ctx.Bool("async") {
+		injectFn = tools.InjectAsyncProfiler()
+	}
 	bootstrapTargets := []tools.ProfileTarget{
 		tools.ProfileTarget{
 			QualifiedName: goPackage.PkgPrefix + "/main",
@@ -84,29 +134,156 @@ func ProfileProject(ctx *cli.Context) error {
 	}
 	updatedFiles, patchCount, err := goPackage.Patch(
 		ctx.StringSlice("profile-vendored-pkg"),
-		tools.PatchCmd{Targets: profileTargets, PatchFn: tools.InjectProfiler()},
-		tools.PatchCmd{Targets: bootstrapTargets, PatchFn: tools.InjectProfilerBootstrap(ctx.String("profile-dir"), ctx.String("profile-label"))},
+		tools.PatchCmd{Targets: profileTargets, PatchFn: injectFn, Filter: callgraphFilter},
+		tools.PatchCmd{Targets: bootstrapTargets, PatchFn: tools.InjectProfilerBootstrap(bootstrapOpts)},
 	)
 	if err != nil {
 		return err
 	}
+	if callgraphFilter != nil {
+		included, excluded := callgraphFilter.Counts()
+		fmt.Printf("profile: call graph filters included %d and excluded %d functions\n", included, excluded)
+	}
 	fmt.Printf("profile: updated %d files and applied %d patches\n", updatedFiles, patchCount)
 
 	// Handle build step if a build command is specified
 	buildCmd := ctx.String("build-cmd")
 	if buildCmd != "" {
-		err = buildProject(goPackage.GOPATH, tmpAbsProjPath, buildCmd, ctx.Bool("no-ansi"))
+		err = buildProject(projectEnv(goPackage), tmpAbsProjPath, buildCmd, ctx.Bool("no-ansi"))
 		if err != nil {
 			return err
 		}
 	}
 
-	return runProject(goPackage.GOPATH, tmpAbsProjPath, runCmd, ctx.Bool("no-ansi"))
+	err = runProject(projectEnv(goPackage), tmpAbsProjPath, runCmd, ctx.Bool("no-ansi"))
+	reportRunSummary(summaryFile)
+	return err
+}
+
+// Read the run summary written by the profiler when the patched project
+// shuts down and report the number of captured and lost profiles.
+func reportRunSummary(summaryFile string) {
+	data, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		fmt.Printf("profile: [WARNING] no run summary available; the patched project may have exited without invoking profiler.Shutdown\n")
+		return
+	}
+
+	var stats profiler.RunStats
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		fmt.Printf("profile: [WARNING] could not parse run summary: %s\n", err.Error())
+		return
+	}
+
+	fmt.Printf(
+		"profile: sink received %d profiles; written: %d, dropped: %d, errored: %d\n",
+		stats.Sink.Received, stats.Sink.Written, stats.Sink.Dropped, stats.Sink.Errored,
+	)
+	if stats.Dropped > 0 {
+		fmt.Printf("profile: profiler dropped %d profiles before they reached the sink\n", stats.Dropped)
+	}
+	if lost := stats.Lost(); lost > 0 {
+		fmt.Printf("profile: [WARNING] %d profiles were lost; see the run output for details\n", lost)
+	}
+}
+
+// Create a callgraph filter from the max-depth, exclude-fn and exclude-pkg
+// options. If none of these options is specified, a nil filter is returned.
+func newCallGraphFilter(ctx *cli.Context) (*tools.CallGraphFilter, error) {
+	maxDepth := -1
+	if ctx.IsSet("max-depth") {
+		maxDepth = ctx.Int("max-depth")
+		if maxDepth < 0 {
+			return nil, errInvalidMaxDepth
+		}
+	}
+
+	return tools.NewCallGraphFilter(maxDepth, ctx.StringSlice("exclude-fn"), ctx.StringSlice("exclude-pkg"))
+}
+
+// Create the profiler options for the injected bootstrap code from the cli options.
+func newBootstrapOptions(ctx *cli.Context, summaryFile string) (tools.BootstrapOptions, error) {
+	opts := tools.BootstrapOptions{
+		ProfileDir:       ctx.String("profile-dir"),
+		MaxFiles:         ctx.Int("profile-max-files"),
+		MaxBytes:         ctx.Int64("profile-max-bytes"),
+		MaxAge:           ctx.Duration("profile-max-age"),
+		JSONLines:        ctx.Bool("profile-jsonl"),
+		Label:            ctx.String("profile-label"),
+		SummaryFile:      summaryFile,
+		BufferSize:       ctx.Int("profile-buffer-size"),
+		CalibrationCache: ctx.String("calibration-cache"),
+		SampleEvery:      ctx.Int("sample-every"),
+		SampleRate:       ctx.Float64("sample-rate"),
+	}
+
+	if formatName := ctx.String("profile-format"); formatName != "" {
+		format, err := profiler.ParseProfileFormat(formatName)
+		if err != nil {
+			return opts, err
+		}
+		opts.Format = format
+	}
+
+	switch ctx.String("calibration") {
+	case "", "init":
+	case "skip":
+		opts.SkipCalibration = true
+	default:
+		return opts, errInvalidCalibration
+	}
+
+	if opts.SampleEvery < 0 || opts.SampleRate < 0 {
+		return opts, errInvalidSampling
+	}
+
+	for _, tag := range ctx.StringSlice("profile-tag") {
+		sepIndex := strings.Index(tag, "=")
+		if sepIndex < 1 {
+			return opts, fmt.Errorf("invalid profile-tag %q; tags should be specified as key=value", tag)
+		}
+
+		if opts.Tags == nil {
+			opts.Tags = make(map[string]string, 0)
+		}
+		opts.Tags[tag[:sepIndex]] = tag[sepIndex+1:]
+	}
+
+	return opts, nil
+}
+
+// Convert the path_to_project argument into an absolute path with a trailing slash.
+func absProjectPath(pathToProject string) (string, error) {
+	if !strings.HasSuffix(pathToProject, "/") {
+		pathToProject += "/"
+	}
+	absProjPath, err := filepath.Abs(filepath.Dir(pathToProject))
+	if err != nil {
+		return "", err
+	}
+
+	return absProjPath + "/", nil
 }
 
-// Clone project and return path to the cloned project.
+// Clone project and return path to the cloned project. If the project is part
+// of a go module, the entire module is cloned so that the copy can still
+// resolve the module's go.mod file and any sibling packages. Otherwise, the
+// project is copied into a temporary go workspace.
 func cloneProject(absProjPath, dest string) (tmpDir, tmpAbsProjPath string, err error) {
+	moduleRoot, err := tools.FindModuleRoot(absProjPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	copyRoot := absProjPath
 	skipLen := strings.Index(absProjPath, "/src/")
+	if moduleRoot != "" {
+		copyRoot = moduleRoot
+		skipLen = len(filepath.Dir(moduleRoot))
+	} else if skipLen == -1 {
+		return "", "", fmt.Errorf("profile: %s is neither part of a go module nor located inside a go workspace", absProjPath)
+	}
 
 	tmpDir, err = ioutil.TempDir(dest, "prism-")
 	if err != nil {
@@ -115,7 +292,7 @@ func cloneProject(absProjPath, dest string) (tmpDir, tmpAbsProjPath string, err
 
 	fmt.Printf("profile: copying project to %s\n", tmpDir)
 
-	err = filepath.Walk(absProjPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(copyRoot, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -154,6 +331,61 @@ func cloneProject(absProjPath, dest string) (tmpDir, tmpAbsProjPath string, err
 		nil
 }
 
+// Create a temp folder for storing the patched project files when building
+// the project using an overlay.
+func createOverlayDir(dest string) (string, error) {
+	tmpDir, err := ioutil.TempDir(dest, "prism-")
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("profile: writing patched files to %s\n", tmpDir)
+	return tmpDir, nil
+}
+
+// Generate the environment for building and running the patched project.
+// Projects that are part of a go module are built in module-aware mode and
+// rely on the replace directive added by GoPackage.LinkProfiler to resolve
+// the profiler imports. We also allow the go tool to update the module's
+// go.mod and bypass any vendored dependencies as the original vendor/modules.txt
+// does not list the profiler module. Any flags required for building the
+// project using an overlay are appended to GOFLAGS.
+func projectEnv(goPackage *tools.GoPackage) []string {
+	var env []string
+	goFlags := goPackage.BuildFlags()
+	if goPackage.ModuleRoot == "" {
+		env = setEnvVar(overrideGoPath(goPackage.GOPATH), "GO111MODULE", "off")
+	} else {
+		env = setEnvVar(os.Environ(), "GO111MODULE", "on")
+		goFlags = append([]string{"-mod=mod"}, goFlags...)
+	}
+
+	if len(goFlags) == 0 {
+		return env
+	}
+
+	for _, envVar := range env {
+		if strings.HasPrefix(envVar, "GOFLAGS=") {
+			goFlags = append([]string{strings.TrimPrefix(envVar, "GOFLAGS=")}, goFlags...)
+			break
+		}
+	}
+	return setEnvVar(env, "GOFLAGS", strings.TrimSpace(strings.Join(goFlags, " ")))
+}
+
+// Set the value of an environment variable in env, replacing any existing value.
+func setEnvVar(env []string, name, value string) []string {
+	prefix := name + "="
+	for index, envVar := range env {
+		if strings.HasPrefix(envVar, prefix) {
+			env[index] = prefix + value
+			return env
+		}
+	}
+
+	return append(env, prefix+value)
+}
+
 // Update GOPATH so that the workspace containing the cloned package is included
 // first. This ensures that go will pick up subpackages from the cloned folder.
 func overrideGoPath(adjustedGoPath string) []string {
@@ -169,7 +401,7 @@ func overrideGoPath(adjustedGoPath string) []string {
 }
 
 // Build patched project copy.
-func buildProject(adjustedGoPath, tmpAbsProjPath, buildCmd string, stripAnsi bool) error {
+func buildProject(env []string, tmpAbsProjPath, buildCmd string, stripAnsi bool) error {
 	fmt.Printf("profile: building patched project (%s)\n", buildCmd)
 
 	color := "\033[32m"
@@ -190,7 +422,7 @@ func buildProject(adjustedGoPath, tmpAbsProjPath, buildCmd string, stripAnsi boo
 		execCmd = exec.Command(tokens[0])
 	}
 	execCmd.Dir = tmpAbsProjPath
-	execCmd.Env = overrideGoPath(adjustedGoPath)
+	execCmd.Env = env
 	execCmd.Stdin = os.Stdin
 	execCmd.Stdout = stdout
 	execCmd.Stderr = stderr
@@ -208,7 +440,7 @@ func buildProject(adjustedGoPath, tmpAbsProjPath, buildCmd string, stripAnsi boo
 }
 
 // Run patched project to collect profiler data.
-func runProject(adjustedGoPath, tmpAbsProjPath, runCmd string, stripAnsi bool) error {
+func runProject(env []string, tmpAbsProjPath, runCmd string, stripAnsi bool) error {
 	fmt.Printf("profile: running patched project (%s)\n", runCmd)
 
 	color := "\033[32m"
@@ -229,7 +461,7 @@ func runProject(adjustedGoPath, tmpAbsProjPath, runCmd string, stripAnsi bool) e
 		execCmd = exec.Command(tokens[0])
 	}
 	execCmd.Dir = tmpAbsProjPath
-	execCmd.Env = overrideGoPath(adjustedGoPath)
+	execCmd.Env = env
 	execCmd.Stdin = os.Stdin
 	execCmd.Stdout = stdout
 	execCmd.Stderr = stderr
@@ -273,28 +505,90 @@ func tokenizeArgs(args string) []string {
 	return tokenizeRegex.FindAllString(args, -1)
 }
 
-// loadProfile reads a profile from disk.
-func loadProfile(file string) (*profiler.Profile, error) {
-	if !strings.HasSuffix(file, ".json") {
-		return nil, fmt.Errorf(
-			"unrecognized profile extension %q for %q; only json profiles are currently supported",
-			filepath.Ext(file),
-			file,
-		)
+// Split a comma or space delimited list of build tags.
+func parseBuildTags(tags string) []string {
+	buildTags := make([]string, 0)
+	for _, tag := range buildTagRegex.Split(tags, -1) {
+		if tag != "" {
+			buildTags = append(buildTags, tag)
+		}
 	}
 
+	return buildTags
+}
+
+// loadProfile reads a profile from disk. The profile format is detected using
+// the file extension; files with other extensions are only accepted if they
+// start with the magic bytes of the binary or gzip-encoded formats. JSON Lines
+// profile streams (written by the file sink when the JSONLines option is
+// enabled) are loaded by merging all profiles in the stream.
+func loadProfile(file string) (*profiler.Profile, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	data, err := ioutil.ReadAll(f)
+	if strings.HasSuffix(file, ".jsonl") {
+		return loadProfileStream(file, f)
+	}
+
+	if _, knownExt := profiler.ProfileFormatFromPath(file); !knownExt {
+		header := make([]byte, 8)
+		n, _ := io.ReadFull(f, header)
+		if !profiler.IsEncodedProfile(header[:n]) {
+			return nil, fmt.Errorf(
+				"unrecognized profile format for %q; supported formats are json, jsonl, json.gz and binary",
+				file,
+			)
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	profile, err := profiler.DecodeProfile(f)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not load profile %q: %s", file, err)
+	}
+	return profile, nil
+}
+
+// Decode the profiles in a JSON Lines stream and merge them together.
+func loadProfileStream(file string, r io.Reader) (*profiler.Profile, error) {
+	profiles := make([]*profiler.Profile, 0)
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not read profile stream %q: %s", file, err)
+		}
+
+		if len(bytes.TrimSpace(line)) != 0 {
+			var profile *profiler.Profile
+			decodeErr := json.Unmarshal(line, &profile)
+			if decodeErr != nil {
+				return nil, fmt.Errorf("could not decode profile stream %q: line %d: %s", file, lineNum, decodeErr)
+			}
+			if profile == nil || profile.Target == nil {
+				return nil, fmt.Errorf("could not decode profile stream %q: line %d: profile does not contain any call metrics", file, lineNum)
+			}
+			profiles = append(profiles, profile)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	switch len(profiles) {
+	case 0:
+		return nil, fmt.Errorf("profile stream %q does not contain any profiles", file)
+	case 1:
+		return profiles[0], nil
 	}
 
-	var profile *profiler.Profile
-	err = json.Unmarshal(data, &profile)
-	return profile, err
+	return profiler.MergeProfiles(profiles...)
 }
@@ -7,9 +7,14 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/geckoboard/prism/profiler"
+	"github.com/geckoboard/prism/tools"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -63,7 +68,7 @@ func TestProfile(t *testing.T) {
 	os.Stderr = stdErr
 
 	outputLines := strings.Split(strings.Trim(buf.String(), "\n"), "\n")
-	expLines := 5
+	expLines := 6
 	if len(outputLines) != expLines {
 		t.Fatalf("expected profile cmd output to emit %d output lines; got %d", expLines, len(outputLines))
 	}
@@ -76,6 +81,7 @@ func TestProfile(t *testing.T) {
 		{2, "profile: building patched project (go build -o artifact)"},
 		{3, "profile: running patched project (./artifact)"},
 		{4, fmt.Sprintf("profile: [run] > profiler: saving profiles to %s", wsDir)},
+		{5, "profile: sink received 1 profiles; written: 1, dropped: 0, errored: 0"},
 	}
 
 	for _, spec := range specs {
@@ -85,14 +91,390 @@ func TestProfile(t *testing.T) {
 	}
 }
 
+func TestProfileModule(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	profileDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(profileDir)
+
+	output, err := captureProfileOutput(
+		pkgDir,
+		map[string]string{
+			"profile-dir": profileDir,
+			"build-cmd":   "go build -o artifact",
+			"run-cmd":     "./artifact",
+		},
+		pkgName+"/main",
+	)
+	if err != nil {
+		t.Fatalf("%s; output:\n%s", err, output)
+	}
+
+	// The original module sources should not be modified
+	modData, err := ioutil.ReadFile(filepath.Join(moduleDir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(modData), "replace") {
+		t.Fatal("expected original go.mod file to remain unmodified")
+	}
+
+	profiles, err := filepath.Glob(filepath.Join(profileDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expProfiles := 1
+	if len(profiles) != expProfiles {
+		t.Fatalf("expected profile cmd to capture %d profiles; got %d; output:\n%s", expProfiles, len(profiles), output)
+	}
+
+	outputLines := strings.Split(strings.Trim(output, "\n"), "\n")
+	expText := "profile: updated 2 files and applied 5 patches"
+	if len(outputLines) < 2 || outputLines[1] != expText {
+		t.Fatalf("expected output line 1 to match %q; got output:\n%s", expText, output)
+	}
+}
+
+func TestProfileWithOverlay(t *testing.T) {
+	moduleDir, modulePkgDir, modulePkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+	wsDir, wsPkgDir, wsPkgName := mockPackageWithVendoredDeps(t, false)
+	defer os.RemoveAll(wsDir)
+
+	specs := []struct {
+		PkgDir  string
+		PkgName string
+	}{
+		{modulePkgDir, modulePkgName},
+		{wsPkgDir, wsPkgName},
+	}
+
+	for specIndex, spec := range specs {
+		tmpDir, err := ioutil.TempDir("", "prism-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		origFiles, err := snapshotDir(spec.PkgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		artifact := filepath.Join(tmpDir, "artifact")
+		output, err := captureProfileOutput(
+			spec.PkgDir,
+			map[string]string{
+				"profile-dir": tmpDir,
+				"output-dir":  tmpDir,
+				"build-cmd":   "go build -o " + artifact,
+				"run-cmd":     artifact,
+				"overlay":     "true",
+			},
+			spec.PkgName+"/main",
+		)
+		if err != nil {
+			t.Errorf("[spec %d] %s; output:\n%s", specIndex, err, output)
+			continue
+		}
+
+		// The project sources should not be modified
+		curFiles, err := snapshotDir(spec.PkgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(origFiles, curFiles) {
+			t.Errorf("[spec %d] expected project files to remain unmodified", specIndex)
+		}
+
+		profiles, err := filepath.Glob(filepath.Join(tmpDir, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expProfiles := 1
+		if len(profiles) != expProfiles {
+			t.Errorf("[spec %d] expected profile cmd to capture %d profiles; got %d; output:\n%s", specIndex, expProfiles, len(profiles), output)
+		}
+
+		expText := "profile: writing patched files to " + tmpDir + "/prism-"
+		if !strings.HasPrefix(output, expText) {
+			t.Errorf("[spec %d] expected output to begin with %q; got output:\n%s", specIndex, expText, output)
+		}
+	}
+}
+
+func TestProfileWithAsync(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockAsyncModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	artifact := filepath.Join(tmpDir, "artifact")
+	output, err := captureProfileOutput(
+		pkgDir,
+		map[string]string{
+			"profile-dir": tmpDir,
+			"output-dir":  tmpDir,
+			"build-cmd":   "go build -o " + artifact,
+			"run-cmd":     artifact,
+			"overlay":     "true",
+			"async":       "true",
+		},
+		pkgName+"/DoStuff",
+	)
+	if err != nil {
+		t.Fatalf("%s; output:\n%s", err, output)
+	}
+
+	profiles, err := filepath.Glob(filepath.Join(tmpDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expProfiles := 1
+	if len(profiles) != expProfiles {
+		t.Fatalf("expected profile cmd to capture %d profiles; got %d; output:\n%s", expProfiles, len(profiles), output)
+	}
+
+	profile, err := loadProfile(profiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.WallTime == 0 {
+		t.Error("expected profile wall time to be populated")
+	}
+
+	expAsyncCalls := map[string]string{
+		"go work":         pkgName + "/work",
+		"go func literal": pkgName + "/DoStuff$1",
+	}
+	for _, call := range profile.Target.NestedCalls {
+		expNestedCall, found := expAsyncCalls[call.FnName]
+		if !found || !call.Async {
+			t.Errorf("unexpected nested call %q (async: %t)", call.FnName, call.Async)
+			continue
+		}
+		delete(expAsyncCalls, call.FnName)
+
+		if len(call.NestedCalls) != 1 || call.NestedCalls[0].FnName != expNestedCall {
+			t.Errorf("expected async call %q to include nested call %q", call.FnName, expNestedCall)
+		}
+	}
+	if len(expAsyncCalls) != 0 {
+		t.Errorf("expected profile to include async calls %v", expAsyncCalls)
+	}
+}
+
+// Invoke ProfileProject with the supplied flags and return its combined output.
+func captureProfileOutput(pkgDir string, flags map[string]string, targetList ...string) (string, error) {
+	set := flag.NewFlagSet("test", 0)
+	for name, value := range flags {
+		switch value {
+		case "true":
+			set.Bool(name, true, "")
+		default:
+			set.String(name, value, "")
+		}
+	}
+	set.Bool("no-ansi", true, "")
+	set.Parse([]string{pkgDir})
+	targets := cli.StringSlice(targetList)
+	targetFlag := &cli.StringSliceFlag{
+		Name:  "profile-target",
+		Value: &targets,
+	}
+	targetFlag.Apply(set)
+	ctx := cli.NewContext(nil, set, nil)
+
+	return captureOutput(func() error {
+		return ProfileProject(ctx)
+	})
+}
+
+// Invoke fn and return back its combined stdout and stderr output.
+func captureOutput(fn func() error) (string, error) {
+	// Redirect stdout and stderr
+	stdOut := os.Stdout
+	stdErr := os.Stderr
+	pRead, pWrite, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	os.Stdout = pWrite
+	os.Stderr = pWrite
+
+	// Drain pipe while the command is running
+	var buf bytes.Buffer
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(&buf, pRead)
+		pRead.Close()
+		close(drained)
+	}()
+
+	err = fn()
+
+	// Restore stdout/err
+	pWrite.Close()
+	<-drained
+	os.Stdout = stdOut
+	os.Stderr = stdErr
+
+	return buf.String(), err
+}
+
+// Map the path of each file inside dir to its contents.
+func snapshotDir(dir string) (map[string]string, error) {
+	snapshot := make(map[string]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		snapshot[path] = string(data)
+		return nil
+	})
+
+	return snapshot, err
+}
+
+func TestParseBuildTags(t *testing.T) {
+	specs := []struct {
+		Input   string
+		ExpTags []string
+	}{
+		{"", []string{}},
+		{"foo", []string{"foo"}},
+		{"foo,bar", []string{"foo", "bar"}},
+		{" foo, bar  baz ", []string{"foo", "bar", "baz"}},
+	}
+
+	for specIndex, spec := range specs {
+		tags := parseBuildTags(spec.Input)
+		if !reflect.DeepEqual(tags, spec.ExpTags) {
+			t.Errorf("[spec %d] expected parsed tags to be %v; got %v", specIndex, spec.ExpTags, tags)
+		}
+	}
+}
+
+func TestNewBootstrapOptions(t *testing.T) {
+	specs := []struct {
+		flags   []string
+		expOpts tools.BootstrapOptions
+		expErr  string
+	}{
+		{
+			nil,
+			tools.BootstrapOptions{SummaryFile: "summary.json"},
+			"",
+		},
+		{
+			[]string{"--profile-label", "label", "--profile-buffer-size", "10", "--calibration", "skip", "--profile-tag", "host=box", "--profile-tag", "query=a=b"},
+			tools.BootstrapOptions{
+				Label:           "label",
+				SummaryFile:     "summary.json",
+				BufferSize:      10,
+				SkipCalibration: true,
+				Tags:            map[string]string{"host": "box", "query": "a=b"},
+			},
+			"",
+		},
+		{
+			[]string{"--calibration-cache", "cache.json", "--sample-every", "5", "--sample-rate", "0.5"},
+			tools.BootstrapOptions{SummaryFile: "summary.json", CalibrationCache: "cache.json", SampleEvery: 5, SampleRate: 0.5},
+			"",
+		},
+		{
+			[]string{"--profile-max-files", "100", "--profile-max-bytes", "1048576", "--profile-max-age", "24h", "--profile-jsonl"},
+			tools.BootstrapOptions{SummaryFile: "summary.json", MaxFiles: 100, MaxBytes: 1048576, MaxAge: 24 * time.Hour, JSONLines: true},
+			"",
+		},
+		{
+			[]string{"--profile-format", "binary"},
+			tools.BootstrapOptions{SummaryFile: "summary.json", Format: profiler.FormatBinary},
+			"",
+		},
+		{
+			[]string{"--profile-format", "xml"},
+			tools.BootstrapOptions{},
+			`unsupported profile format; supported formats are "json", "json.gz" and "binary"`,
+		},
+		{
+			[]string{"--calibration", "always"},
+			tools.BootstrapOptions{},
+			errInvalidCalibration.Error(),
+		},
+		{
+			[]string{"--sample-every", "-1"},
+			tools.BootstrapOptions{},
+			errInvalidSampling.Error(),
+		},
+		{
+			[]string{"--profile-tag", "=box"},
+			tools.BootstrapOptions{},
+			`invalid profile-tag "=box"; tags should be specified as key=value`,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		set := flag.NewFlagSet("test", 0)
+		set.String("profile-dir", "", "")
+		set.String("profile-label", "", "")
+		set.Int("profile-max-files", 0, "")
+		set.Int64("profile-max-bytes", 0, "")
+		set.Duration("profile-max-age", 0, "")
+		set.Bool("profile-jsonl", false, "")
+		set.String("profile-format", "json", "")
+		set.Int("profile-buffer-size", 0, "")
+		set.String("calibration", "init", "")
+		set.String("calibration-cache", "", "")
+		set.Int("sample-every", 0, "")
+		set.Float64("sample-rate", 0, "")
+		profileTags := cli.StringSlice{}
+		set.Var(&profileTags, "profile-tag", "")
+		set.Parse(spec.flags)
+		ctx := cli.NewContext(nil, set, nil)
+
+		opts, err := newBootstrapOptions(ctx, "summary.json")
+		if spec.expErr != "" {
+			if err == nil || err.Error() != spec.expErr {
+				t.Errorf("[spec %d] expected error %q; got %v", specIndex, spec.expErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(opts, spec.expOpts) {
+			t.Errorf("[spec %d] expected bootstrap options to be %+v; got %+v", specIndex, spec.expOpts, opts)
+		}
+	}
+}
+
 func mockPackageWithVendoredDeps(t *testing.T, useGodeps bool) (workspaceDir, pkgDir, pkgName string) {
-	var otherPkgName string
+	var otherPkgName, otherPkgImport string
 	pkgName = "prism-mock"
 
 	if useGodeps {
 		otherPkgName = pkgName + "/Godeps/_workspace/other/pkg"
+		otherPkgImport = otherPkgName
 	} else {
+		// Packages in the vendor folder are imported using their original path
 		otherPkgName = pkgName + "/vendor/other/pkg"
+		otherPkgImport = "other/pkg"
 	}
 
 	pkgData := map[string]string{
@@ -105,7 +487,7 @@ func DoStuff(){
 		pkgName: `
 package main
 
-import other "` + otherPkgName + `"
+import other "` + otherPkgImport + `"
 
 type A struct {
 }
@@ -152,3 +534,113 @@ func main(){
 	pkgDir = workspaceDir + "/src/" + pkgName + "/"
 	return workspaceDir, pkgDir, pkgName
 }
+
+func mockModule(t *testing.T) (moduleDir, pkgDir, pkgName string) {
+	pkgName = "github.com/geckoboard/prism-mock"
+	pkgData := map[string]string{
+		"go.mod": `
+module ` + pkgName + `
+
+go 1.16
+`,
+		"other/src.go": `
+package other
+
+func DoStuff(){
+}
+	`,
+		"src.go": `
+package main
+
+import "` + pkgName + `/other"
+
+type A struct {
+}
+
+func(a *A) DoStuff(){
+	other.DoStuff()
+}
+
+func DoStuff(){
+	a := &A{}
+	a.DoStuff()
+
+	// The callgraph generator should not visit this function a second time
+	a.DoStuff()
+}
+
+func main(){
+	DoStuff()
+}
+`,
+	}
+
+	moduleDir = writeMockModule(t, pkgData)
+	return moduleDir, moduleDir + "/", pkgName
+}
+
+func mockAsyncModule(t *testing.T) (moduleDir, pkgDir, pkgName string) {
+	pkgName = "github.com/geckoboard/prism-mock"
+	pkgData := map[string]string{
+		"go.mod": `
+module ` + pkgName + `
+
+go 1.18
+`,
+		"src.go": `
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+func work(wg *sync.WaitGroup, d time.Duration) {
+	defer wg.Done()
+	time.Sleep(d)
+}
+
+func DoStuff(){
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go work(&wg, 10 * time.Millisecond)
+	go func(){
+		work(&wg, 20 * time.Millisecond)
+	}()
+	wg.Wait()
+}
+
+func main(){
+	DoStuff()
+}
+`,
+	}
+
+	moduleDir = writeMockModule(t, pkgData)
+	return moduleDir, moduleDir + "/", pkgName
+}
+
+// Write the files in pkgData to a temp folder and return back its path.
+func writeMockModule(t *testing.T, pkgData map[string]string) string {
+	moduleDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, src := range pkgData {
+		file := moduleDir + "/" + name
+		err = os.MkdirAll(filepath.Dir(file), os.ModeDir|os.ModePerm)
+		if err != nil {
+			os.RemoveAll(moduleDir)
+			t.Fatalf("error creating module folder for %q: %s", name, err)
+		}
+
+		err = ioutil.WriteFile(file, []byte(src), os.ModePerm)
+		if err != nil {
+			os.RemoveAll(moduleDir)
+			t.Fatalf("error creating module contents for %q: %s", name, err)
+		}
+	}
+
+	return moduleDir
+}
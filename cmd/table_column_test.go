@@ -18,6 +18,10 @@ func TestParseTableColumnList(t *testing.T) {
 		"p90":         "p90",
 		"p99":         "p99",
 		"stddev":      "stddev",
+		"async_wait":  "async wait",
+		"self":        "self",
+		"self_mean":   "self mean",
+		"self_pct":    "self %",
 	}
 
 	for colName, expHeader := range colNamesToHeaderNames {
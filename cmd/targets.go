@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/geckoboard/prism/tools"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	errInvalidTargetsArgs = errors.New(`"targets" requires a path_to_project and an optional filter argument`)
+)
+
+// ListTargets analyzes a go package and lists the fully qualified names of all
+// functions that can be used as profile targets together with their location.
+// If a filter argument is specified, only targets that fuzzy-match it are listed.
+func ListTargets(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return errInvalidTargetsArgs
+	}
+
+	absProjPath, err := absProjectPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	goPackage, err := tools.NewGoPackage(absProjPath, parseBuildTags(ctx.String("tags"))...)
+	if err != nil {
+		return err
+	}
+
+	candidates := goPackage.Candidates()
+	if len(args) == 2 {
+		candidates = tools.FuzzyFilter(candidates, args[1])
+		if len(candidates) == 0 {
+			fmt.Fprintf(os.Stderr, "targets: no profile targets matching %q\n", args[1])
+			return nil
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\n", candidate.QualifiedName, fmtTargetLocation(absProjPath, candidate))
+	}
+	return w.Flush()
+}
+
+// Format the location of a target candidate as file:line. Files inside the
+// project folder are displayed using a path relative to the project folder.
+func fmtTargetLocation(absProjPath string, candidate tools.TargetCandidate) string {
+	if candidate.Position.Filename == "" {
+		return "(synthetic)"
+	}
+
+	file := candidate.Position.Filename
+	if relPath, err := filepath.Rel(absProjPath, file); err == nil && !strings.HasPrefix(relPath, "..") {
+		file = relPath
+	}
+
+	return fmt.Sprintf("%s:%d", file, candidate.Position.Line)
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestListTargets(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	specs := []struct {
+		Args     []string
+		ExpLines []string
+	}{
+		{
+			[]string{pkgDir},
+			[]string{
+				pkgName + "/A.DoStuff src.go:9",
+				pkgName + "/DoStuff src.go:13",
+				pkgName + "/init (synthetic)",
+				pkgName + "/main src.go:21",
+				pkgName + "/other/DoStuff other/src.go:4",
+				pkgName + "/other/init (synthetic)",
+			},
+		},
+		{
+			[]string{pkgDir, "a.do"},
+			[]string{
+				pkgName + "/A.DoStuff src.go:9",
+			},
+		},
+		{
+			[]string{pkgDir, "other"},
+			[]string{
+				pkgName + "/other/DoStuff other/src.go:4",
+				pkgName + "/other/init (synthetic)",
+			},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		set := flag.NewFlagSet("test", 0)
+		set.Parse(spec.Args)
+		ctx := cli.NewContext(nil, set, nil)
+
+		output, err := captureOutput(func() error {
+			return ListTargets(ctx)
+		})
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		// Collapse column padding before comparing lines
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		for index, line := range lines {
+			lines[index] = strings.Join(strings.Fields(line), " ")
+		}
+
+		if !reflect.DeepEqual(lines, spec.ExpLines) {
+			t.Errorf("[spec %d] expected output lines to be %v; got output:\n%s", specIndex, spec.ExpLines, output)
+		}
+	}
+}
+
+func TestListTargetsWithoutMatches(t *testing.T) {
+	moduleDir, pkgDir, _ := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	set := flag.NewFlagSet("test", 0)
+	set.Parse([]string{pkgDir, "missing"})
+	ctx := cli.NewContext(nil, set, nil)
+
+	output, err := captureOutput(func() error {
+		return ListTargets(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expOutput := "targets: no profile targets matching \"missing\"\n"
+	if output != expOutput {
+		t.Fatalf("expected output to be %q; got %q", expOutput, output)
+	}
+}
+
+func TestListTargetsInvalidArgs(t *testing.T) {
+	set := flag.NewFlagSet("test", 0)
+	set.Parse([]string{})
+	ctx := cli.NewContext(nil, set, nil)
+
+	err := ListTargets(ctx)
+	if err != errInvalidTargetsArgs {
+		t.Fatalf("expected to get errInvalidTargetsArgs; got %v", err)
+	}
+}
@@ -42,10 +42,14 @@ func main() {
 					Name:  "preserve-output",
 					Usage: "preserve patched project post build",
 				},
+				cli.BoolFlag{
+					Name:  "overlay",
+					Usage: "instead of cloning the project, write patched files to output-dir and build the project using a go build overlay (requires go 1.16+)",
+				},
 				cli.StringSliceFlag{
 					Name:  "profile-target, t",
 					Value: &cli.StringSlice{},
-					Usage: "fully qualified function name to profile",
+					Usage: `fully qualified function name to profile; glob patterns (e.g. "github.com/foo/bar/*.Serve*") and regular expressions prefixed with "re:" are expanded to all matching functions`,
 				},
 				cli.StringFlag{
 					Name:  "profile-dir",
@@ -56,6 +60,75 @@ func main() {
 					Name:  "profile-label",
 					Usage: `specify a label to be attached to captured profiles and displayed when using the "print" or "diff" commands`,
 				},
+				cli.IntFlag{
+					Name:  "profile-max-files",
+					Usage: "delete the oldest profiles in profile-dir once it contains more than this number of profile files",
+				},
+				cli.Int64Flag{
+					Name:  "profile-max-bytes",
+					Usage: "delete the oldest profiles in profile-dir once the total size of its profile files exceeds this number of bytes",
+				},
+				cli.DurationFlag{
+					Name:  "profile-max-age",
+					Usage: "delete profiles in profile-dir that are older than this duration (e.g. 24h)",
+				},
+				cli.StringFlag{
+					Name:  "profile-format",
+					Value: "json",
+					Usage: `the encoding for captured profiles; supported formats: json, json.gz, binary`,
+				},
+				cli.BoolFlag{
+					Name:  "profile-jsonl",
+					Usage: "append the profiles for each target to a single JSON Lines file (rotated every 10MB) instead of writing one file per profile",
+				},
+				cli.StringSliceFlag{
+					Name:  "profile-tag",
+					Usage: "attach a key=value tag to captured profiles. This option may be specified multiple times",
+					Value: &cli.StringSlice{},
+				},
+				cli.IntFlag{
+					Name:  "profile-buffer-size",
+					Usage: "the number of captured profiles that can be buffered by the profiler before writing them to disk; if left unspecified, the profiler default (100) is used",
+				},
+				cli.StringFlag{
+					Name:  "calibration",
+					Usage: `set to "skip" to disable the profiler calibration loop that runs when the patched project starts; the hook overhead is then not subtracted from the captured timings`,
+					Value: "init",
+				},
+				cli.StringFlag{
+					Name:  "calibration-cache",
+					Usage: "load the profiler calibration results from this file; if the file does not exist, the calibration results are written to it so that subsequent runs can skip the calibration loop",
+				},
+				cli.IntFlag{
+					Name:  "sample-every",
+					Usage: "only profile one in every N invocations of each profile target",
+				},
+				cli.Float64Flag{
+					Name:  "sample-rate",
+					Usage: "profile at most N invocations per second of each profile target",
+				},
+				cli.StringFlag{
+					Name:  "tags",
+					Usage: "a comma-separated list of build tags to consider when analyzing the project; the tags are not applied to build-cmd and run-cmd",
+				},
+				cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "only instrument functions whose distance from a profile target is at most max-depth call hops; if left unspecified, there is no depth limit",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-fn",
+					Usage: "do not instrument functions whose fully qualified name matches this regex; profile targets are never excluded. This option may be specified multiple times",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-pkg",
+					Usage: "do not instrument functions in packages whose fully qualified name matches this regex; profile targets are never excluded. This option may be specified multiple times",
+					Value: &cli.StringSlice{},
+				},
+				cli.BoolFlag{
+					Name:  "async",
+					Usage: "propagate active profiles to go-routines spawned by instrumented functions so that their calls are included as async calls in the captured profiles (requires go 1.18+)",
+				},
 				cli.StringSliceFlag{
 					Name:  "profile-vendored-pkg",
 					Usage: "inject profile hooks to any vendored packages matching this regex. If left unspecified, no vendored packages will be hooked",
@@ -67,11 +140,79 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:        "collect",
+			Usage:       "receive profiles over HTTP",
+			Description: `Start an HTTP server that receives profiles sent by patched projects that use the HTTP sink (sink.NewHTTPSink) and store them to disk. The server runs until prism is interrupted.`,
+			Action:      cmd.CollectProfiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8090",
+					Usage: "the address to listen for incoming profiles",
+				},
+				cli.StringFlag{
+					Name:  "profile-dir",
+					Usage: "specify the output dir for received profiles",
+					Value: defaultOutputDir(),
+				},
+			},
+		},
+		{
+			Name:        "targets",
+			Usage:       "list functions that can be used as profile targets",
+			Description: `Analyze a go project and list the fully qualified names and locations of all functions that can be used as profile targets. If a filter is specified, only targets that fuzzy-match it will be listed.`,
+			ArgsUsage:   "path_to_project [filter]",
+			Action:      cmd.ListTargets,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tags",
+					Usage: "a comma-separated list of build tags to consider when analyzing the project",
+				},
+			},
+		},
+		{
+			Name:        "callgraph",
+			Usage:       "display the functions that will be instrumented for a set of profile targets",
+			Description: `Analyze a go project and display the callgraph of functions reachable from each profile target. The callgraph can be printed as a tree or exported in DOT or JSON format.`,
+			ArgsUsage:   "path_to_project",
+			Action:      cmd.PrintCallGraph,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "profile-target, t",
+					Value: &cli.StringSlice{},
+					Usage: `fully qualified function name to analyze; glob patterns and regular expressions prefixed with "re:" are expanded to all matching functions`,
+				},
+				cli.IntFlag{
+					Name:  "max-depth",
+					Usage: "only instrument functions whose distance from a profile target is at most max-depth call hops; if left unspecified, there is no depth limit",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-fn",
+					Usage: "do not instrument functions whose fully qualified name matches this regex; profile targets are never excluded. This option may be specified multiple times",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-pkg",
+					Usage: "do not instrument functions in packages whose fully qualified name matches this regex; profile targets are never excluded. This option may be specified multiple times",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "tree",
+					Usage: "set the output format; supported options: tree, dot, json",
+				},
+				cli.StringFlag{
+					Name:  "tags",
+					Usage: "a comma-separated list of build tags to consider when analyzing the project",
+				},
+			},
+		},
 		{
 			Name:        "print",
 			Usage:       "pretty-print profile",
-			Description: ``,
-			ArgsUsage:   "profile",
+			Description: `Display a captured profile in tabular form. If more than one profile or a glob pattern (e.g. "profiles/*.json") is specified, the matching profiles are merged together before being displayed.`,
+			ArgsUsage:   "profile [...profile_n]",
 			Action:      cmd.PrintProfile,
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -100,10 +241,63 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:        "merge",
+			Usage:       "merge profiles",
+			Description: `Combine multiple profiles captured for the same target into a single profile. Metrics for the merged profile are computed from the per-invocation samples of all merged profiles.`,
+			ArgsUsage:   "profile1 [...profile_n]",
+			Action:      cmd.MergeProfiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the merged profile to this file instead of stdout; the .json.gz and .prism extensions select the gzip and binary formats",
+				},
+				cli.StringFlag{
+					Name:  "label",
+					Usage: "override the label for the merged profile",
+				},
+			},
+		},
+		{
+			Name:        "convert",
+			Usage:       "convert profiles between formats",
+			Description: `Translate profiles between the json, json.gz and compact binary formats. Each converted profile is written next to the original profile using the extension of the selected format (.json, .json.gz or .prism). Each argument may be a glob pattern.`,
+			ArgsUsage:   "profile1 [...profile_n]",
+			Action:      cmd.ConvertProfiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "binary",
+					Usage: "the format to convert profiles to; supported formats: json, json.gz, binary",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the converted profile to this file; only supported when converting a single profile",
+				},
+			},
+		},
+		{
+			Name:        "export",
+			Usage:       "export profiles for use with third-party tools",
+			Description: `Export profiles to a format supported by third-party tools. The pprof format maps the profile call graph to call stacks whose sample value is the self time of each call, with invocation counts attached as labels, allowing exported profiles to be explored using "go tool pprof". Each exported profile is written next to the original profile using the .pb.gz extension. Each argument may be a glob pattern.`,
+			ArgsUsage:   "profile1 [...profile_n]",
+			Action:      cmd.ExportProfiles,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "pprof",
+					Usage: "the export format; supported formats: pprof",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write the exported profile to this file; only supported when exporting a single profile",
+				},
+			},
+		},
 		{
 			Name:        "diff",
 			Usage:       "visually compare profiles",
-			Description: ``,
+			Description: `Compare two or more profiles. Each argument may be a glob pattern (e.g. "before/*.json") in which case all matching profiles are merged together and compared as a single profile.`,
 			ArgsUsage:   "profile1 profile2 [...profile_n]",
 			Action:      cmd.DiffProfiles,
 			Flags: []cli.Flag{
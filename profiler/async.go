@@ -0,0 +1,122 @@
+//go:build go1.18
+// +build go1.18
+
+package profiler
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Async wraps fn so that any profiled calls made while fn executes are recorded
+// as an async call tree nested under the call that is currently active in the
+// calling go-routine. It is meant to be used for propagating profiles to
+// go-routines spawned by a profiled function, e.g:
+//
+//	go prismProfiler.Async(worker, "go worker")(arg1, arg2)
+//
+// As the function and its arguments are evaluated by the calling go-routine,
+// the semantics of the go statement are preserved. The callName is used as the
+// name of the async call in the captured profile.
+//
+// If the calling go-routine has no active profile, Async returns back fn.
+// Profiles that include async calls are only shipped once all async calls
+// complete. Shutdown waits for a limited time for any pending async calls.
+func Async[F any](fn F, callName string) F {
+	tick := time.Now()
+	tid := threadID()
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	forkCall := shard.calls[tid]
+	shard.Unlock()
+	if forkCall == nil {
+		// No active profile for this threadID; skip
+		return fn
+	}
+
+	// Functions without arguments (e.g. go-routines spawned using a function
+	// literal) are wrapped directly; any other function type is wrapped via
+	// reflection.
+	var wrapper F
+	switch typedFn := any(fn).(type) {
+	case func():
+		if typedFn == nil {
+			return fn
+		}
+		wrapper = any(func() {
+			asyncCall := beginAsync(forkCall, callName)
+			defer endAsync(asyncCall)
+			typedFn()
+		}).(F)
+	default:
+		fnVal := reflect.ValueOf(fn)
+		if fnVal.Kind() != reflect.Func || fnVal.IsNil() {
+			return fn
+		}
+		wrapper = reflect.MakeFunc(fnVal.Type(), func(args []reflect.Value) []reflect.Value {
+			asyncCall := beginAsync(forkCall, callName)
+			defer endAsync(asyncCall)
+
+			if fnVal.Type().IsVariadic() {
+				return fnVal.CallSlice(args)
+			}
+			return fnVal.Call(args)
+		}).Interface().(F)
+	}
+
+	// From now on, this go-routine must lock the call tree when modifying it
+	forkRoot := forkCall.root
+	forkRoot.hasAsync = true
+	forkRoot.treeMutex.Lock()
+	forkRoot.pendingAsync++
+	for call := forkCall; call != nil; call = call.parent {
+		if call.nestedProfile {
+			call.pendingAsync++
+		}
+	}
+	forkRoot.treeMutex.Unlock()
+	atomic.AddInt64(&pendingAsyncCalls, 1)
+
+	forkCall.profilerOverhead += timeNowOverhead + timeSinceOverhead + fnCallOverhead + time.Since(tick)
+	return wrapper
+}
+
+// Create the root call for an async call tree forked by forkCall and make it
+// the active call for the current go-routine.
+func beginAsync(forkCall *fnCall, callName string) *fnCall {
+	tick := time.Now()
+	tid := threadID()
+
+	asyncCall := makeFnCall(callName)
+	asyncCall.enteredAt = tick
+	asyncCall.asyncParent = forkCall
+
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	shard.calls[tid] = asyncCall
+	shard.Unlock()
+
+	asyncCall.profilerOverhead += timeNowOverhead + timeSinceOverhead + fnCallOverhead + time.Since(tick)
+	return asyncCall
+}
+
+// Exit the root call of an async call tree and attach the call tree to the call
+// that forked it.
+func endAsync(asyncCall *fnCall) {
+	tick := time.Now()
+	tid := threadID()
+
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	if shard.calls[tid] == asyncCall {
+		delete(shard.calls, tid)
+	}
+	shard.Unlock()
+
+	asyncCall.exitedAt = time.Now()
+	asyncCall.profilerOverhead += 2*timeNowOverhead + timeSinceOverhead + deferredFnOverhead + time.Since(tick)
+	finalizeCallTree(tid, asyncCall)
+
+	atomic.AddInt64(&pendingAsyncCalls, -1)
+}
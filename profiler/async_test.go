@@ -0,0 +1,191 @@
+//go:build go1.18
+// +build go1.18
+
+package profiler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncWithoutActiveProfile(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+	defer Shutdown()
+
+	invoked := false
+	fn := func() { invoked = true }
+	Async(fn, "go fn")()
+	if !invoked {
+		t.Fatal("expected wrapped function to be invoked")
+	}
+
+	var nilFn func()
+	if Async(nilFn, "go nilFn") != nil {
+		t.Fatal("expected Async to return back a nil function")
+	}
+}
+
+func TestAsyncProfile(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+
+	var wg sync.WaitGroup
+	worker := func(id int, tags ...string) {
+		defer wg.Done()
+		Enter("work")
+		time.Sleep(20 * time.Millisecond)
+		Leave()
+	}
+
+	BeginProfile("func1")
+	Enter("spawner")
+	wg.Add(2)
+	go Async(worker, "go worker")(1, "a", "b")
+	go Async(worker, "go worker")(2)
+	time.Sleep(5 * time.Millisecond)
+	Leave()
+	EndProfile()
+
+	wg.Wait()
+	Shutdown()
+
+	expEntries := 1
+	if len(sink.buffer) != expEntries {
+		t.Fatalf("expected sink to capture %d entries; got %d", expEntries, len(sink.buffer))
+	}
+
+	profile := sink.buffer[0]
+	if profile.WallTime < 20*time.Millisecond {
+		t.Errorf("expected profile wall time to be at least 20ms; got %s", profile.WallTime)
+	}
+	if profile.WallTime <= profile.Target.TotalTime {
+		t.Errorf("expected profile wall time %s to exceed the target total time %s", profile.WallTime, profile.Target.TotalTime)
+	}
+
+	if len(profile.Target.NestedCalls) != 1 {
+		t.Fatalf("expected profile target to capture 1 nested call; got %d", len(profile.Target.NestedCalls))
+	}
+	spawner := profile.Target.NestedCalls[0]
+	if spawner.FnName != "spawner" {
+		t.Fatalf("expected nested call to be %q; got %q", "spawner", spawner.FnName)
+	}
+	if spawner.AsyncWaitTime <= 0 || spawner.AsyncWaitTime >= 20*time.Millisecond {
+		t.Errorf("expected spawner async wait time to be in (0, 20ms); got %s", spawner.AsyncWaitTime)
+	}
+
+	if len(spawner.NestedCalls) != 1 {
+		t.Fatalf("expected spawner to capture 1 nested call; got %d", len(spawner.NestedCalls))
+	}
+	asyncCall := spawner.NestedCalls[0]
+	if asyncCall.FnName != "go worker" || !asyncCall.Async || asyncCall.Invocations != 2 {
+		t.Fatalf("expected spawner to capture 2 invocations of async call %q; got %d invocations of %q (async: %t)", "go worker", asyncCall.Invocations, asyncCall.FnName, asyncCall.Async)
+	}
+	if len(asyncCall.NestedCalls) != 1 || asyncCall.NestedCalls[0].FnName != "work" || asyncCall.NestedCalls[0].Invocations != 2 {
+		t.Fatal("expected async call to include 2 invocations of nested call work")
+	}
+}
+
+func TestNestedAsyncProfile(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+
+	var wg sync.WaitGroup
+	var leaf func()
+	leaf = func() {
+		defer wg.Done()
+		Enter("leaf")
+		time.Sleep(10 * time.Millisecond)
+		Leave()
+	}
+	branch := func() {
+		defer wg.Done()
+		Enter("branch")
+		wg.Add(1)
+		go Async(leaf, "go leaf")()
+		Leave()
+	}
+
+	BeginProfile("func1")
+	wg.Add(1)
+	go Async(branch, "go branch")()
+	EndProfile()
+
+	wg.Wait()
+	Shutdown()
+
+	expEntries := 1
+	if len(sink.buffer) != expEntries {
+		t.Fatalf("expected sink to capture %d entries; got %d", expEntries, len(sink.buffer))
+	}
+
+	expCallPath := []string{"func1", "go branch", "branch", "go leaf", "leaf"}
+	metrics := sink.buffer[0].Target
+	for depth, expFnName := range expCallPath {
+		if metrics.FnName != expFnName {
+			t.Fatalf("expected call at depth %d to be %q; got %q", depth, expFnName, metrics.FnName)
+		}
+		if depth == len(expCallPath)-1 {
+			break
+		}
+		if len(metrics.NestedCalls) != 1 {
+			t.Fatalf("expected call %q to capture 1 nested call; got %d", metrics.FnName, len(metrics.NestedCalls))
+		}
+		metrics = metrics.NestedCalls[0]
+	}
+}
+
+func TestNestedProfileWithPendingAsyncCalls(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		Enter("work")
+		time.Sleep(20 * time.Millisecond)
+		Leave()
+	}
+
+	BeginProfile("func1")
+	BeginNestedProfile("func2")
+	wg.Add(1)
+	go Async(worker, "go worker")()
+	EndNestedProfile()
+	EndProfile()
+
+	wg.Wait()
+	Shutdown()
+
+	expEntries := 2
+	if len(sink.buffer) != expEntries {
+		t.Fatalf("expected sink to capture %d entries; got %d", expEntries, len(sink.buffer))
+	}
+
+	// The nested profile should only be shipped once the async call that
+	// it forked completes so both profiles should include it
+	for _, profile := range sink.buffer {
+		metrics := profile.Target
+		if metrics.FnName == "func1" {
+			if len(metrics.NestedCalls) != 1 {
+				t.Fatalf("expected profile %q to capture 1 nested call; got %d", profile.Target.FnName, len(metrics.NestedCalls))
+			}
+			metrics = metrics.NestedCalls[0]
+		}
+
+		if metrics.FnName != "func2" || len(metrics.NestedCalls) != 1 {
+			t.Fatalf("expected profile %q to include call func2 with 1 nested call", profile.Target.FnName)
+		}
+		asyncCall := metrics.NestedCalls[0]
+		if asyncCall.FnName != "go worker" || !asyncCall.Async {
+			t.Fatalf("expected profile %q to include async call %q; got %q", profile.Target.FnName, "go worker", asyncCall.FnName)
+		}
+		if len(asyncCall.NestedCalls) != 1 || asyncCall.NestedCalls[0].FnName != "work" {
+			t.Fatalf("expected async call in profile %q to include nested call work", profile.Target.FnName)
+		}
+		if profile.WallTime < 20*time.Millisecond {
+			t.Errorf("expected profile %q wall time to be at least 20ms; got %s", profile.Target.FnName, profile.WallTime)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package profiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	numCalibrationCalls = 10000000
+)
+
+// CalibrationMode controls how the profiler estimates the overhead introduced
+// by its hooks.
+type CalibrationMode int
+
+const (
+	// CalibrationOnce runs the calibration loop the first time that Init
+	// is invoked and reuses the results for any subsequent Init calls.
+	CalibrationOnce CalibrationMode = iota
+
+	// CalibrationSkip disables calibration. The overhead of the profiler
+	// hooks is not subtracted from the captured call times.
+	CalibrationSkip
+)
+
+// The estimated overhead of the operations performed by the profiler hooks.
+type overheadEstimates struct {
+	// The go version and platform that the estimates were calculated for.
+	Runtime string `json:"runtime"`
+
+	TimeNow    time.Duration `json:"time_now"`
+	TimeSince  time.Duration `json:"time_since"`
+	DeferredFn time.Duration `json:"deferred_fn"`
+	FnCall     time.Duration `json:"fn_call"`
+}
+
+var (
+	calibrateOnce sync.Once
+	calibrated    overheadEstimates
+)
+
+// Set up the overhead estimates used by the profiler hooks according to the
+// calibration mode. If a cache file has been specified, the estimates are
+// loaded from it; if the cache file does not exist or was generated by a
+// different go version or platform, the calibration loop runs and its results
+// are written to the cache file.
+func setupCalibration(mode CalibrationMode, cacheFile string) {
+	var estimates overheadEstimates
+	switch {
+	case mode == CalibrationSkip:
+	case cacheFile != "":
+		var err error
+		estimates, err = loadCalibration(cacheFile)
+		if err != nil {
+			estimates = calibrateOnceAndGet()
+			err = saveCalibration(cacheFile, estimates)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "profiler: could not cache calibration results to %q due to %s\n", cacheFile, err.Error())
+			}
+		}
+	default:
+		estimates = calibrateOnceAndGet()
+	}
+
+	timeNowOverhead = estimates.TimeNow
+	timeSinceOverhead = estimates.TimeSince
+	deferredFnOverhead = estimates.DeferredFn
+	fnCallOverhead = estimates.FnCall
+}
+
+// Run the calibration loop unless it has already run and return the estimates.
+func calibrateOnceAndGet() overheadEstimates {
+	calibrateOnce.Do(func() {
+		calibrated = calibrate()
+	})
+	return calibrated
+}
+
+// Get the go version and platform that calibration results apply to.
+func calibrationRuntime() string {
+	return fmt.Sprintf("%s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// Load cached calibration results and ensure that they apply to the current runtime.
+func loadCalibration(cacheFile string) (overheadEstimates, error) {
+	var estimates overheadEstimates
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return estimates, err
+	}
+
+	err = json.Unmarshal(data, &estimates)
+	if err != nil {
+		return estimates, err
+	}
+
+	if estimates.Runtime != calibrationRuntime() {
+		return estimates, fmt.Errorf("cached calibration results were generated by %q", estimates.Runtime)
+	}
+
+	return estimates, nil
+}
+
+// Write calibration results to a cache file.
+func saveCalibration(cacheFile string, estimates overheadEstimates) error {
+	data, err := json.Marshal(estimates)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cacheFile, data, 0644)
+}
+
+// callibrate attempts to estimate the mean overhead for invoking time.Now(), time.Since(),
+// as well as the mean time spent in function guard code (stack setup, pushing/popping
+// registers, dealing with deferred calls e.t.c).
+//
+// Runtime overhead is generally in the nanosecond range but we need to
+// properly account for it when calculating the total time spent inside a
+// profiled function as it tends to skew our timing calculations when the profiled
+// function is invoked a large number of times.
+//
+// To calculate an estimate, we time N executions of each function and then just
+// calculate the mean execution time. As outliers may skew our results, using
+// the median execution time would be better but calculating it is not a trivial
+// operation due to the space and timing accurace required.
+func calibrate() overheadEstimates {
+	estimates := overheadEstimates{
+		Runtime: calibrationRuntime(),
+	}
+
+	// Benchmark function call time. We use a switch statement to ensure that
+	// the compiler will not inline this function (see https://github.com/golang/go/issues/12312)
+	fnCallBench := func(i int) {
+		switch i {
+		}
+	}
+	tick := time.Now()
+	for i := 0; i < numCalibrationCalls; i++ {
+		fnCallBench(i)
+	}
+	estimates.FnCall = time.Since(tick) / time.Duration(numCalibrationCalls)
+
+	// Benchmark deferred function call time
+	deferBench := func(i int) {
+		defer func() { fnCallBench(i) }()
+	}
+	tick = time.Now()
+	for i := 0; i < numCalibrationCalls; i++ {
+		deferBench(i)
+	}
+	estimates.DeferredFn = time.Since(tick) / time.Duration(numCalibrationCalls)
+
+	// Benchmark time.Now()
+	tick = time.Now()
+	for i := 0; i < numCalibrationCalls; i++ {
+		time.Now()
+	}
+	estimates.TimeNow = estimates.FnCall + time.Since(tick)/time.Duration(numCalibrationCalls)
+
+	// Benchmark time.Since()
+	tick = time.Now()
+	for i := 0; i < numCalibrationCalls; i++ {
+		time.Since(tick)
+	}
+	estimates.TimeSince = estimates.FnCall + time.Since(tick)/time.Duration(numCalibrationCalls)
+
+	return estimates
+}
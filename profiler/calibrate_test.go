@@ -0,0 +1,71 @@
+package profiler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCalibrationCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cacheFile := filepath.Join(tmpDir, "calibration.json")
+	cached := overheadEstimates{
+		Runtime:    calibrationRuntime(),
+		TimeNow:    1 * time.Nanosecond,
+		TimeSince:  2 * time.Nanosecond,
+		DeferredFn: 3 * time.Nanosecond,
+		FnCall:     4 * time.Nanosecond,
+	}
+	err = saveCalibration(cacheFile, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupCalibration(CalibrationOnce, cacheFile)
+	if timeNowOverhead != cached.TimeNow || timeSinceOverhead != cached.TimeSince || deferredFnOverhead != cached.DeferredFn || fnCallOverhead != cached.FnCall {
+		t.Fatalf("expected overhead estimates to be loaded from the cache file; got %v, %v, %v, %v", timeNowOverhead, timeSinceOverhead, deferredFnOverhead, fnCallOverhead)
+	}
+
+	// Caches generated by a different runtime should be ignored and replaced
+	cached.Runtime = "go0.0 plan9/mips"
+	err = saveCalibration(cacheFile, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupCalibration(CalibrationOnce, cacheFile)
+	if expFnCall := calibrateOnceAndGet().FnCall; fnCallOverhead != expFnCall {
+		t.Errorf("expected fn call overhead to be %v; got %v", expFnCall, fnCallOverhead)
+	}
+
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updated overheadEstimates
+	err = json.Unmarshal(data, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != calibrateOnceAndGet() {
+		t.Errorf("expected cache file to be updated with %+v; got %+v", calibrateOnceAndGet(), updated)
+	}
+}
+
+func TestCalibrationSkip(t *testing.T) {
+	setupCalibration(CalibrationOnce, "")
+	setupCalibration(CalibrationSkip, "")
+	defer setupCalibration(CalibrationOnce, "")
+
+	if timeNowOverhead != 0 || timeSinceOverhead != 0 || deferredFnOverhead != 0 || fnCallOverhead != 0 {
+		t.Fatalf("expected overhead estimates to be zero; got %v, %v, %v, %v", timeNowOverhead, timeSinceOverhead, deferredFnOverhead, fnCallOverhead)
+	}
+}
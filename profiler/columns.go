@@ -0,0 +1,172 @@
+package profiler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MetricColumn identifies a call metric that can be displayed as a column of
+// a tabular profile view such as the ones rendered by the prism print and diff
+// commands or the HTML view of the HTTP serve sink.
+type MetricColumn int
+
+// The supported metric columns.
+const (
+	ColumnTotal MetricColumn = iota
+	ColumnMin
+	ColumnMax
+	ColumnMean
+	ColumnMedian
+	ColumnInvocations
+	ColumnP50
+	ColumnP75
+	ColumnP90
+	ColumnP99
+	ColumnStdDev
+	ColumnAsyncWait
+	ColumnSelf
+	ColumnSelfMean
+	ColumnSelfPct
+	// a sentinel value allowing us to iterate all valid metric columns
+	NumMetricColumns
+)
+
+var (
+	metricColumnSplitRegex = regexp.MustCompile(`\s*,\s*`)
+
+	// The name and table header for each metric column.
+	metricColumnNames = map[MetricColumn][2]string{
+		ColumnTotal:       {"total", "total"},
+		ColumnMin:         {"min", "min"},
+		ColumnMax:         {"max", "max"},
+		ColumnMean:        {"mean", "mean"},
+		ColumnMedian:      {"median", "median"},
+		ColumnInvocations: {"invocations", "invoc"},
+		ColumnP50:         {"p50", "p50"},
+		ColumnP75:         {"p75", "p75"},
+		ColumnP90:         {"p90", "p90"},
+		ColumnP99:         {"p99", "p99"},
+		ColumnStdDev:      {"stddev", "stddev"},
+		ColumnAsyncWait:   {"async_wait", "async wait"},
+		ColumnSelf:        {"self", "self"},
+		ColumnSelfMean:    {"self_mean", "self mean"},
+		ColumnSelfPct:     {"self_pct", "self %"},
+	}
+)
+
+// Name returns the name used for selecting this column (e.g. "async_wait").
+func (c MetricColumn) Name() string {
+	return metricColumnNames[c][0]
+}
+
+// Header returns the table header description for this column.
+func (c MetricColumn) Header() string {
+	names, supported := metricColumnNames[c]
+	if !supported {
+		panic("unsupported column type")
+	}
+	return names[1]
+}
+
+// TimeValue returns the time value of this column for the supplied call
+// metrics. The returned flag is false if the column does not contain a time
+// value (e.g. the invocation count).
+func (c MetricColumn) TimeValue(cm *CallMetrics) (time.Duration, bool) {
+	switch c {
+	case ColumnTotal:
+		return cm.TotalTime, true
+	case ColumnMin:
+		return cm.MinTime, true
+	case ColumnMax:
+		return cm.MaxTime, true
+	case ColumnMean:
+		return cm.MeanTime, true
+	case ColumnMedian:
+		return cm.MedianTime, true
+	case ColumnP50:
+		return cm.P50Time, true
+	case ColumnP75:
+		return cm.P75Time, true
+	case ColumnP90:
+		return cm.P90Time, true
+	case ColumnP99:
+		return cm.P99Time, true
+	case ColumnAsyncWait:
+		return cm.AsyncWaitTime, true
+	case ColumnSelf:
+		return cm.SelfTime, true
+	case ColumnSelfMean:
+		return cm.SelfMeanTime, true
+	}
+
+	return 0, false
+}
+
+// PercentBase returns the time value of the profile root call that the value
+// of this column is compared against when displayed as a percentage. The
+// async wait and self times are expressed as a percentage of the total time
+// spent in the root call.
+func (c MetricColumn) PercentBase(root *CallMetrics) time.Duration {
+	switch c {
+	case ColumnAsyncWait, ColumnSelf:
+		return root.TotalTime
+	case ColumnSelfMean:
+		return root.MeanTime
+	}
+
+	val, _ := c.TimeValue(root)
+	return val
+}
+
+// FormatValue formats the value of a column that does not contain a time
+// value. Time values are formatted by the caller using a suitable time unit
+// so FormatValue returns an empty string for them.
+func (c MetricColumn) FormatValue(cm *CallMetrics) string {
+	switch c {
+	case ColumnInvocations:
+		return fmt.Sprintf("%d", cm.Invocations)
+	case ColumnStdDev:
+		return fmt.Sprintf("%3.3f", cm.StdDev)
+	case ColumnSelfPct:
+		percent := 0.0
+		if cm.TotalTime != 0 {
+			percent = 100.0 * float64(cm.SelfTime) / float64(cm.TotalTime)
+		}
+		return fmt.Sprintf("%2.1f%%", percent)
+	}
+
+	return ""
+}
+
+// ParseMetricColumns parses a comma delimited list of column names.
+func ParseMetricColumns(list string) ([]MetricColumn, error) {
+	cols := make([]MetricColumn, 0)
+	for _, colName := range metricColumnSplitRegex.Split(strings.TrimSpace(list), -1) {
+		found := false
+		for col := MetricColumn(0); col < NumMetricColumns; col++ {
+			if colName == col.Name() {
+				cols = append(cols, col)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unsupported column name %q; supported column names are: %s", colName, SupportedMetricColumns())
+		}
+	}
+
+	return cols, nil
+}
+
+// SupportedMetricColumns returns back a string with all supported column names.
+func SupportedMetricColumns() string {
+	set := make([]string, NumMetricColumns)
+	for col := MetricColumn(0); col < NumMetricColumns; col++ {
+		set[col] = col.Name()
+	}
+
+	return strings.Join(set, ", ")
+}
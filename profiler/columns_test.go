@@ -0,0 +1,99 @@
+package profiler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricColumnValues(t *testing.T) {
+	root := &CallMetrics{
+		FnName:        "main",
+		TotalTime:     100 * time.Millisecond,
+		MeanTime:      50 * time.Millisecond,
+		SelfTime:      25 * time.Millisecond,
+		SelfMeanTime:  10 * time.Millisecond,
+		AsyncWaitTime: 5 * time.Millisecond,
+		P99Time:       80 * time.Millisecond,
+		Invocations:   2,
+		StdDev:        1.5,
+	}
+
+	specs := []struct {
+		column     MetricColumn
+		expTime    time.Duration
+		expIsTime  bool
+		expBase    time.Duration
+		expFmtText string
+	}{
+		{ColumnTotal, 100 * time.Millisecond, true, 100 * time.Millisecond, ""},
+		{ColumnP99, 80 * time.Millisecond, true, 80 * time.Millisecond, ""},
+		{ColumnAsyncWait, 5 * time.Millisecond, true, 100 * time.Millisecond, ""},
+		{ColumnSelf, 25 * time.Millisecond, true, 100 * time.Millisecond, ""},
+		{ColumnSelfMean, 10 * time.Millisecond, true, 50 * time.Millisecond, ""},
+		{ColumnInvocations, 0, false, 0, "2"},
+		{ColumnStdDev, 0, false, 0, "1.500"},
+		{ColumnSelfPct, 0, false, 0, "25.0%"},
+	}
+
+	for specIndex, spec := range specs {
+		val, isTime := spec.column.TimeValue(root)
+		if val != spec.expTime || isTime != spec.expIsTime {
+			t.Errorf("[spec %d] expected %s time value to be (%v, %t); got (%v, %t)", specIndex, spec.column.Name(), spec.expTime, spec.expIsTime, val, isTime)
+		}
+		if base := spec.column.PercentBase(root); base != spec.expBase {
+			t.Errorf("[spec %d] expected %s percent base to be %v; got %v", specIndex, spec.column.Name(), spec.expBase, base)
+		}
+		if text := spec.column.FormatValue(root); text != spec.expFmtText {
+			t.Errorf("[spec %d] expected %s formatted value to be %q; got %q", specIndex, spec.column.Name(), spec.expFmtText, text)
+		}
+	}
+}
+
+func TestParseMetricColumns(t *testing.T) {
+	cols, err := ParseMetricColumns(" total , async_wait,self_pct ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expCols := []MetricColumn{ColumnTotal, ColumnAsyncWait, ColumnSelfPct}
+	if len(cols) != len(expCols) {
+		t.Fatalf("expected %d columns; got %d", len(expCols), len(cols))
+	}
+	for index, expCol := range expCols {
+		if cols[index] != expCol {
+			t.Errorf("expected column %d to be %q; got %q", index, expCol.Name(), cols[index].Name())
+		}
+	}
+
+	_, err = ParseMetricColumns("total,bogus")
+	expError := `unsupported column name "bogus"; supported column names are: ` + SupportedMetricColumns()
+	if err == nil || err.Error() != expError {
+		t.Errorf("expected error %q; got %v", expError, err)
+	}
+}
+
+func TestCallMetricsExtrapolate(t *testing.T) {
+	cm := &CallMetrics{
+		FnName:      "main",
+		TotalTime:   10 * time.Millisecond,
+		MeanTime:    5 * time.Millisecond,
+		SelfTime:    4 * time.Millisecond,
+		Invocations: 2,
+		NestedCalls: []*CallMetrics{
+			{FnName: "foo", TotalTime: 6 * time.Millisecond, SelfTime: 6 * time.Millisecond, Invocations: 3},
+		},
+	}
+
+	scaled := cm.Extrapolate(2.5)
+	if scaled.TotalTime != 25*time.Millisecond || scaled.SelfTime != 10*time.Millisecond || scaled.Invocations != 5 {
+		t.Errorf("expected extrapolated totals to be (25ms, 10ms, 5); got (%v, %v, %d)", scaled.TotalTime, scaled.SelfTime, scaled.Invocations)
+	}
+	if scaled.MeanTime != cm.MeanTime {
+		t.Errorf("expected mean time not to be extrapolated; got %v", scaled.MeanTime)
+	}
+	if nested := scaled.NestedCalls[0]; nested.TotalTime != 15*time.Millisecond || nested.Invocations != 8 {
+		t.Errorf("expected extrapolated nested call totals to be (15ms, 8); got (%v, %d)", nested.TotalTime, nested.Invocations)
+	}
+	if cm.TotalTime != 10*time.Millisecond || cm.NestedCalls[0].Invocations != 3 {
+		t.Error("expected extrapolation not to modify the original metrics")
+	}
+}
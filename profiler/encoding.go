@@ -0,0 +1,509 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProfileFormat describes an encoding for serialized profiles.
+type ProfileFormat int
+
+const (
+	// FormatJSON encodes profiles as JSON. This is the default format.
+	FormatJSON ProfileFormat = iota
+
+	// FormatJSONGzip encodes profiles as gzip-compressed JSON.
+	FormatJSONGzip
+
+	// FormatBinary encodes profiles using a compact, versioned binary
+	// encoding. Function names are interned so that each unique name is
+	// only stored once regardless of how many times it appears in the
+	// call tree.
+	FormatBinary
+)
+
+const (
+	// The version of the binary encoding written by EncodeProfile.
+	binaryFormatVersion = 1
+
+	// The max length of any string or list in a binary-encoded profile.
+	maxBinaryLength = 1 << 20
+
+	// The max nesting depth of the call tree in a binary-encoded profile.
+	maxBinaryCallDepth = 10000
+)
+
+var (
+	// The magic bytes at the start of binary and gzip-encoded profiles.
+	binaryFormatMagic = []byte("PRISM")
+	gzipMagic         = []byte{0x1f, 0x8b}
+
+	profileFormatNames = map[ProfileFormat]string{
+		FormatJSON:     "json",
+		FormatJSONGzip: "json.gz",
+		FormatBinary:   "binary",
+	}
+
+	profileFormatExtensions = map[ProfileFormat]string{
+		FormatJSON:     "json",
+		FormatJSONGzip: "json.gz",
+		FormatBinary:   "prism",
+	}
+
+	errInvalidProfileFormat = errors.New(`unsupported profile format; supported formats are "json", "json.gz" and "binary"`)
+)
+
+// String returns the name of the profile format.
+func (f ProfileFormat) String() string {
+	return profileFormatNames[f]
+}
+
+// Extension returns the file extension (without a leading dot) used for
+// profiles stored in this format.
+func (f ProfileFormat) Extension() string {
+	return profileFormatExtensions[f]
+}
+
+// ParseProfileFormat returns the profile format with the specified name.
+func ParseProfileFormat(name string) (ProfileFormat, error) {
+	for format, formatName := range profileFormatNames {
+		if strings.TrimSpace(name) == formatName {
+			return format, nil
+		}
+	}
+
+	return FormatJSON, errInvalidProfileFormat
+}
+
+// ProfileFormatFromPath returns the profile format that corresponds to the
+// extension of the specified file. The second return value is false if the
+// extension does not match any of the supported formats.
+func ProfileFormatFromPath(path string) (ProfileFormat, bool) {
+	// Check longer extensions first so that .json.gz is not matched as .json
+	for _, format := range []ProfileFormat{FormatJSONGzip, FormatBinary, FormatJSON} {
+		if strings.HasSuffix(path, "."+format.Extension()) {
+			return format, true
+		}
+	}
+
+	return FormatJSON, false
+}
+
+// EncodeProfile writes the profile to w using the specified format. Unlike the
+// JSON encoding, the binary encoding also retains the profile ID and creation time.
+func EncodeProfile(w io.Writer, profile *Profile, format ProfileFormat) error {
+	switch format {
+	case FormatJSON, FormatJSONGzip:
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return fmt.Errorf("error marshalling profile: %s", err.Error())
+		}
+		if format == FormatJSON {
+			_, err = w.Write(data)
+			return err
+		}
+
+		zw := gzip.NewWriter(w)
+		_, err = zw.Write(data)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	case FormatBinary:
+		enc := &binaryEncoder{
+			w:       bufio.NewWriter(w),
+			strings: make(map[string]uint64, 0),
+		}
+		enc.encodeProfile(profile)
+		if enc.err != nil {
+			return enc.err
+		}
+		return enc.w.Flush()
+	}
+
+	return errInvalidProfileFormat
+}
+
+// DecodeProfile reads a profile encoded in any of the supported formats. The
+// format is detected by inspecting the leading bytes of the encoded data.
+func DecodeProfile(r io.Reader) (*Profile, error) {
+	br := bufio.NewReader(r)
+	if hasMagic(br, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	if hasMagic(br, binaryFormatMagic) {
+		dec := &binaryDecoder{r: br}
+		profile := dec.decodeProfile()
+		if dec.err != nil {
+			return nil, fmt.Errorf("DecodeProfile: malformed binary profile: %s", dec.err)
+		}
+		return profile, nil
+	}
+
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile *Profile
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, err
+	}
+	if profile == nil || profile.Target == nil {
+		return nil, errors.New("DecodeProfile: profile does not contain any call metrics")
+	}
+	return profile, nil
+}
+
+// IsEncodedProfile checks whether the data starts with the magic bytes of the
+// binary or gzip-encoded profile formats.
+func IsEncodedProfile(data []byte) bool {
+	return bytes.HasPrefix(data, binaryFormatMagic) || bytes.HasPrefix(data, gzipMagic)
+}
+
+// Check whether the reader's next bytes match the supplied magic bytes.
+func hasMagic(br *bufio.Reader, magic []byte) bool {
+	header, _ := br.Peek(len(magic))
+	return bytes.Equal(header, magic)
+}
+
+// binaryEncoder writes profiles in the binary format. Encoding errors are
+// sticky; once an error occurs, all subsequent writes are no-ops.
+type binaryEncoder struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+
+	// The index of each string written so far.
+	strings map[string]uint64
+}
+
+func (e *binaryEncoder) encodeProfile(profile *Profile) {
+	e.write(binaryFormatMagic)
+	e.write([]byte{binaryFormatVersion})
+
+	e.uvarint(profile.ID)
+	e.bool(!profile.CreatedAt.IsZero())
+	if !profile.CreatedAt.IsZero() {
+		e.varint(profile.CreatedAt.UnixNano())
+	}
+	e.string(profile.Label)
+	e.duration(profile.WallTime)
+	e.uvarint(uint64(profile.MergedProfiles))
+	e.float(profile.SampleRate)
+
+	tagKeys := make([]string, 0, len(profile.Tags))
+	for key := range profile.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	e.uvarint(uint64(len(tagKeys)))
+	for _, key := range tagKeys {
+		e.string(key)
+		e.string(profile.Tags[key])
+	}
+
+	e.bool(profile.Target != nil)
+	if profile.Target != nil {
+		e.encodeMetrics(profile.Target)
+	}
+}
+
+func (e *binaryEncoder) encodeMetrics(cm *CallMetrics) {
+	e.string(cm.FnName)
+	for _, d := range []time.Duration{
+		cm.TotalTime, cm.MinTime, cm.MaxTime, cm.MeanTime, cm.MedianTime,
+		cm.P50Time, cm.P75Time, cm.P90Time, cm.P99Time,
+		cm.SelfTime, cm.SelfMeanTime, cm.AsyncWaitTime,
+	} {
+		e.duration(d)
+	}
+	e.float(cm.StdDev)
+	e.uvarint(uint64(cm.Invocations))
+	e.bool(cm.Async)
+
+	e.bool(cm.Histogram != nil)
+	if hist := cm.Histogram; hist != nil {
+		e.uvarint(uint64(hist.Count))
+		e.duration(hist.Sum)
+		e.duration(hist.Min)
+		e.duration(hist.Max)
+		e.float(hist.M2)
+		e.uvarint(uint64(len(hist.Buckets)))
+		for _, bucket := range hist.Buckets {
+			e.varint(int64(bucket.Index))
+			e.uvarint(uint64(bucket.Count))
+		}
+	}
+
+	// Nested call counts are offset by one so that a nil list can be told
+	// apart from an empty one.
+	if cm.NestedCalls == nil {
+		e.uvarint(0)
+		return
+	}
+	e.uvarint(uint64(len(cm.NestedCalls)) + 1)
+	for _, nestedCall := range cm.NestedCalls {
+		e.encodeMetrics(nestedCall)
+	}
+}
+
+func (e *binaryEncoder) write(data []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(data)
+	}
+}
+
+func (e *binaryEncoder) uvarint(v uint64) {
+	e.write(e.buf[:binary.PutUvarint(e.buf[:], v)])
+}
+
+func (e *binaryEncoder) varint(v int64) {
+	e.write(e.buf[:binary.PutVarint(e.buf[:], v)])
+}
+
+func (e *binaryEncoder) duration(d time.Duration) {
+	e.varint(int64(d))
+}
+
+// Floats are written with their bytes reversed so that values with a short
+// mantissa (e.g. small integers) have a compact varint representation.
+func (e *binaryEncoder) float(v float64) {
+	e.uvarint(bits.ReverseBytes64(math.Float64bits(v)))
+}
+
+func (e *binaryEncoder) bool(v bool) {
+	if v {
+		e.write([]byte{1})
+	} else {
+		e.write([]byte{0})
+	}
+}
+
+// Strings are interned. The first occurrence of a string is written as its
+// index (which equals the number of strings written so far) followed by its
+// length and contents. Subsequent occurrences are written as just the index.
+func (e *binaryEncoder) string(s string) {
+	if index, exists := e.strings[s]; exists {
+		e.uvarint(index)
+		return
+	}
+
+	index := uint64(len(e.strings))
+	e.strings[s] = index
+	e.uvarint(index)
+	e.uvarint(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+// binaryDecoder reads profiles in the binary format. Decoding errors are
+// sticky; once an error occurs, all subsequent reads return zero values.
+//
+// As the length prefixes of corrupted input cannot be trusted, lists are
+// grown as their items are decoded instead of being preallocated.
+type binaryDecoder struct {
+	r       *bufio.Reader
+	err     error
+	strings []string
+	depth   int
+}
+
+func (d *binaryDecoder) decodeProfile() *Profile {
+	magic := d.read(len(binaryFormatMagic))
+	version := d.read(1)
+	if d.err != nil {
+		return nil
+	}
+	if !bytes.Equal(magic, binaryFormatMagic) {
+		d.err = errors.New("missing magic bytes")
+		return nil
+	}
+	if version[0] != binaryFormatVersion {
+		d.err = fmt.Errorf("unsupported binary format version %d", version[0])
+		return nil
+	}
+
+	profile := &Profile{
+		ID: d.uvarint(),
+	}
+	if d.bool() {
+		profile.CreatedAt = time.Unix(0, d.varint())
+	}
+	profile.Label = d.string()
+	profile.WallTime = d.duration()
+	profile.MergedProfiles = int(d.uvarint())
+	profile.SampleRate = d.float()
+
+	if numTags := d.count(); numTags > 0 {
+		profile.Tags = make(map[string]string, 0)
+		for i := 0; i < numTags && d.err == nil; i++ {
+			key := d.string()
+			profile.Tags[key] = d.string()
+		}
+	}
+
+	if d.bool() {
+		profile.Target = d.decodeMetrics()
+	}
+	if d.err == nil && profile.Target == nil {
+		d.err = errors.New("profile does not contain any call metrics")
+	}
+
+	return profile
+}
+
+func (d *binaryDecoder) decodeMetrics() *CallMetrics {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxBinaryCallDepth {
+		d.err = fmt.Errorf("call tree exceeds max depth %d", maxBinaryCallDepth)
+		return nil
+	}
+
+	cm := &CallMetrics{
+		FnName: d.string(),
+	}
+	for _, field := range []*time.Duration{
+		&cm.TotalTime, &cm.MinTime, &cm.MaxTime, &cm.MeanTime, &cm.MedianTime,
+		&cm.P50Time, &cm.P75Time, &cm.P90Time, &cm.P99Time,
+		&cm.SelfTime, &cm.SelfMeanTime, &cm.AsyncWaitTime,
+	} {
+		*field = d.duration()
+	}
+	cm.StdDev = d.float()
+	cm.Invocations = int(d.uvarint())
+	cm.Async = d.bool()
+
+	if d.bool() {
+		hist := &Histogram{
+			Count: int64(d.uvarint()),
+			Sum:   d.duration(),
+			Min:   d.duration(),
+			Max:   d.duration(),
+			M2:    d.float(),
+		}
+		if numBuckets := d.count(); numBuckets > 0 {
+			hist.Buckets = make([]HistogramBucket, 0)
+			for i := 0; i < numBuckets && d.err == nil; i++ {
+				hist.Buckets = append(hist.Buckets, HistogramBucket{
+					Index: int32(d.varint()),
+					Count: int64(d.uvarint()),
+				})
+			}
+		}
+		cm.Histogram = hist
+	}
+
+	numNestedCalls := d.count()
+	if numNestedCalls == 0 {
+		return cm
+	}
+	numNestedCalls--
+	cm.NestedCalls = make([]*CallMetrics, 0)
+	for i := 0; i < numNestedCalls && d.err == nil; i++ {
+		cm.NestedCalls = append(cm.NestedCalls, d.decodeMetrics())
+	}
+
+	return cm
+}
+
+func (d *binaryDecoder) read(n int) []byte {
+	buf := make([]byte, n)
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, buf)
+	}
+	return buf
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	// ReadUvarint returns the bytes read so far on overflow; discard them
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return v
+}
+
+func (d *binaryDecoder) duration() time.Duration {
+	return time.Duration(d.varint())
+}
+
+func (d *binaryDecoder) float() float64 {
+	return math.Float64frombits(bits.ReverseBytes64(d.uvarint()))
+}
+
+func (d *binaryDecoder) bool() bool {
+	return d.read(1)[0] != 0
+}
+
+// Read a length prefix. Lengths are capped to avoid allocating huge buffers
+// when decoding corrupted input.
+func (d *binaryDecoder) count() int {
+	n := d.uvarint()
+	if d.err != nil {
+		return 0
+	}
+	if n > maxBinaryLength {
+		d.err = fmt.Errorf("invalid length %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *binaryDecoder) string() string {
+	index := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	switch {
+	case index < uint64(len(d.strings)):
+		return d.strings[index]
+	case index > uint64(len(d.strings)):
+		d.err = fmt.Errorf("invalid string reference %d", index)
+		return ""
+	}
+
+	length := d.count()
+	s := string(d.read(length))
+	if d.err != nil {
+		return ""
+	}
+	d.strings = append(d.strings, s)
+	return s
+}
@@ -0,0 +1,201 @@
+package profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mockEncodableProfile() *Profile {
+	genMetrics := func(fnName string, samples ...time.Duration) *CallMetrics {
+		hist := &Histogram{}
+		for _, sample := range samples {
+			hist.Record(sample)
+		}
+		cm := histogramMetrics(fnName, hist)
+		cm.SelfTime = cm.TotalTime / 3
+		return cm
+	}
+
+	target := genMetrics("github.com/acme/main", 120*time.Millisecond)
+	nested := genMetrics("github.com/acme/worker", 10*time.Millisecond, 12*time.Millisecond, 300*time.Nanosecond)
+	nested.Async = true
+	target.AsyncWaitTime = 5 * time.Millisecond
+	target.NestedCalls = []*CallMetrics{
+		nested,
+		genMetrics("github.com/acme/worker", 42*time.Microsecond),
+	}
+	nested.NestedCalls = []*CallMetrics{genMetrics("github.com/acme/main", time.Millisecond)}
+
+	return &Profile{
+		ID:             42,
+		CreatedAt:      time.Unix(1500000000, 123456789),
+		Label:          "encoded",
+		Tags:           map[string]string{"host": "box", "rev": "abc"},
+		Target:         target,
+		WallTime:       130 * time.Millisecond,
+		MergedProfiles: 3,
+		SampleRate:     2.5,
+	}
+}
+
+func TestEncodeDecodeProfile(t *testing.T) {
+	profile := mockEncodableProfile()
+	expJSON, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make(map[ProfileFormat]int, 0)
+	for _, format := range []ProfileFormat{FormatJSON, FormatJSONGzip, FormatBinary} {
+		var buf bytes.Buffer
+		err = EncodeProfile(&buf, profile, format)
+		if err != nil {
+			t.Fatalf("[%s] %v", format, err)
+		}
+		sizes[format] = buf.Len()
+
+		decoded, err := DecodeProfile(&buf)
+		if err != nil {
+			t.Fatalf("[%s] %v", format, err)
+		}
+
+		decodedJSON, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decodedJSON, expJSON) {
+			t.Errorf("[%s] expected decoded profile to be:\n%s\ngot:\n%s", format, expJSON, decodedJSON)
+		}
+
+		// Only the binary encoding retains the profile ID and creation time
+		if format == FormatBinary && (decoded.ID != profile.ID || !decoded.CreatedAt.Equal(profile.CreatedAt)) {
+			t.Errorf("[%s] expected decoded profile ID and creation time to be %d, %v; got %d, %v", format, profile.ID, profile.CreatedAt, decoded.ID, decoded.CreatedAt)
+		}
+	}
+
+	if sizes[FormatBinary] >= sizes[FormatJSON]/2 {
+		t.Errorf("expected binary encoding (%d bytes) to be less than half the size of the JSON encoding (%d bytes)", sizes[FormatBinary], sizes[FormatJSON])
+	}
+}
+
+func TestDecodeProfileErrors(t *testing.T) {
+	var buf bytes.Buffer
+	err := EncodeProfile(&buf, mockEncodableProfile(), FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	badVersion := append([]byte{}, encoded...)
+	badVersion[len(binaryFormatMagic)] = 99
+
+	// A call that claims to have the max number of nested calls
+	buf = bytes.Buffer{}
+	err = EncodeProfile(&buf, &Profile{Target: &CallMetrics{FnName: "main"}}, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hugeNestedCount := append([]byte{}, buf.Bytes()[:buf.Len()-1]...)
+	hugeNestedCount = binary.AppendUvarint(hugeNestedCount, maxBinaryLength)
+
+	// A call tree that is nested deeper than the max depth
+	deepTarget := &CallMetrics{FnName: "main"}
+	for call, depth := deepTarget, 1; depth <= maxBinaryCallDepth; depth++ {
+		call.NestedCalls = []*CallMetrics{{FnName: "main"}}
+		call = call.NestedCalls[0]
+	}
+	buf = bytes.Buffer{}
+	err = EncodeProfile(&buf, &Profile{Target: deepTarget}, FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooDeep := buf.Bytes()
+
+	specs := []struct {
+		data   []byte
+		expErr string
+	}{
+		{encoded[:len(encoded)/2], "DecodeProfile: malformed binary profile: EOF"},
+		{badVersion, "DecodeProfile: malformed binary profile: unsupported binary format version 99"},
+		{hugeNestedCount, "DecodeProfile: malformed binary profile: EOF"},
+		{tooDeep, "DecodeProfile: malformed binary profile: call tree exceeds max depth 10000"},
+		{[]byte("null"), "DecodeProfile: profile does not contain any call metrics"},
+		{[]byte{0x1f, 0x8b, 0x00}, "unexpected EOF"},
+	}
+
+	for specIndex, spec := range specs {
+		_, err := DecodeProfile(bytes.NewReader(spec.data))
+		if err == nil || !strings.Contains(err.Error(), spec.expErr) {
+			t.Errorf("[spec %d] expected error %q; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func FuzzDecodeProfile(f *testing.F) {
+	for _, format := range []ProfileFormat{FormatJSON, FormatBinary} {
+		var buf bytes.Buffer
+		err := EncodeProfile(&buf, mockEncodableProfile(), format)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(buf.Bytes()[:buf.Len()/2])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		profile, err := DecodeProfile(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// Successfully decoded profiles must survive a round trip
+		var buf bytes.Buffer
+		err = EncodeProfile(&buf, profile, FormatBinary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecodeProfile(&buf)
+		if err != nil {
+			t.Fatalf("could not decode re-encoded profile: %v", err)
+		}
+	})
+}
+
+func TestProfileFormats(t *testing.T) {
+	specs := []struct {
+		name     string
+		path     string
+		format   ProfileFormat
+		knownExt bool
+	}{
+		{"json", "profile-foo-1-2.json", FormatJSON, true},
+		{"json.gz", "profile-foo-1-2.json.gz", FormatJSONGzip, true},
+		{"binary", "profile-foo-1-2.prism", FormatBinary, true},
+		{"", "profile.yml", FormatJSON, false},
+	}
+
+	for specIndex, spec := range specs {
+		if spec.name != "" {
+			format, err := ParseProfileFormat(spec.name)
+			if err != nil || format != spec.format {
+				t.Errorf("[spec %d] expected format %q to be parsed as %v; got %v, %v", specIndex, spec.name, spec.format, format, err)
+			}
+			if format.String() != spec.name {
+				t.Errorf("[spec %d] expected format name to be %q; got %q", specIndex, spec.name, format.String())
+			}
+		}
+
+		format, knownExt := ProfileFormatFromPath(spec.path)
+		if format != spec.format || knownExt != spec.knownExt {
+			t.Errorf("[spec %d] expected format for %q to be %v, %t; got %v, %t", specIndex, spec.path, spec.format, spec.knownExt, format, knownExt)
+		}
+	}
+
+	if _, err := ParseProfileFormat("xml"); err != errInvalidProfileFormat {
+		t.Errorf("expected to get error %v; got %v", errInvalidProfileFormat, err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build (amd64 || arm64) && !gccgo
+// +build amd64 arm64
+// +build !gccgo
+
+package profiler
+
+import "unsafe"
+
+// getg returns a pointer to the runtime g struct for the current goroutine.
+// It is implemented in assembly.
+func getg() unsafe.Pointer
@@ -0,0 +1,12 @@
+//go:build (!amd64 && !arm64) || gccgo
+// +build !amd64,!arm64 gccgo
+
+package profiler
+
+import "unsafe"
+
+// getg is not supported on this platform; threadID always parses the
+// goroutine id out of the goroutine stack trace.
+func getg() unsafe.Pointer {
+	return nil
+}
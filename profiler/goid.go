@@ -2,19 +2,120 @@ package profiler
 
 import (
 	"bytes"
+	"fmt"
+	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"unsafe"
 )
 
 const (
 	base10CutOff = (1<<64 - 1) / 11
+
+	// The number of goroutines used for verifying the goroutine id offset.
+	numGoidProbes = 8
 )
 
 var (
 	goRoutinePrefix = []byte("goroutine ")
+
+	// The offset of the goid field inside the runtime g struct for each go
+	// release. The g struct layout is the same for all 64-bit platforms that
+	// support getg.
+	knownGoidOffsets = map[string]int{
+		"go1.18": 152,
+		"go1.19": 152,
+		"go1.20": 152,
+		"go1.21": 152,
+		"go1.22": 152,
+		"go1.23": 160,
+		"go1.24": 160,
+		"go1.25": 152,
+		"go1.26": 152,
+		"go1.27": 152,
+	}
+
+	// The offset of the goroutine id field inside the runtime g struct or
+	// -1 if it could not be detected. When set, threadID reads the id directly
+	// from the g struct instead of parsing it out of the goroutine stack trace.
+	goidOffset = detectGoidOffset(runtime.Version())
 )
 
+// Detect the current goroutine id.
+func threadID() uint64 {
+	if goidOffset >= 0 {
+		return *(*uint64)(unsafe.Pointer(uintptr(getg()) + uintptr(goidOffset)))
+	}
+	return stackThreadID()
+}
+
+// Lookup the offset of the goroutine id field inside the runtime g struct for
+// the supplied go version. As the layout of the g struct differs between go
+// versions, the offset is only used if the go release is known and the value
+// at the offset matches the goroutine id reported by the stack trace of
+// several goroutines. Otherwise, detectGoidOffset returns -1 and threadID falls
+// back to parsing stack traces.
+func detectGoidOffset(goVersion string) int {
+	if getg() == nil {
+		return -1
+	}
+
+	offset, known := knownGoidOffsets[goRelease(goVersion)]
+	if !known {
+		fmt.Fprintf(os.Stderr, "profiler: unsupported go version %q; falling back to parsing goroutine ids from stack traces\n", goVersion)
+		return -1
+	}
+
+	// Each probe runs in a new goroutine so it observes a different id
+	candidates := filterGoidOffsets([]int{offset})
+	for probe := 0; probe < numGoidProbes && len(candidates) != 0; probe++ {
+		probeCh := make(chan []int)
+		go func() {
+			probeCh <- filterGoidOffsets(candidates)
+		}()
+		candidates = <-probeCh
+	}
+
+	if len(candidates) != 1 {
+		fmt.Fprintf(os.Stderr, "profiler: could not verify the goroutine id offset for go version %q; falling back to parsing goroutine ids from stack traces\n", goVersion)
+		return -1
+	}
+	return offset
+}
+
+// Extract the go release (e.g. "go1.21") from a go version string such as
+// "go1.21.5" or "go1.22rc1". An empty string is returned for development
+// builds and any other unrecognized version strings.
+func goRelease(goVersion string) string {
+	if !strings.HasPrefix(goVersion, "go1.") {
+		return ""
+	}
+
+	end := len("go1.")
+	for end < len(goVersion) && goVersion[end] >= '0' && goVersion[end] <= '9' {
+		end++
+	}
+	return goVersion[:end]
+}
+
+// Filter the list of candidate offsets keeping the ones whose value in the
+// g struct of the current goroutine matches its id.
+func filterGoidOffsets(candidates []int) []int {
+	g := getg()
+	goid := stackThreadID()
+
+	matches := make([]int, 0)
+	for _, offset := range candidates {
+		if *(*uint64)(unsafe.Pointer(uintptr(g) + uintptr(offset))) == goid {
+			matches = append(matches, offset)
+		}
+	}
+
+	return matches
+}
+
 // Implementation copied by https://github.com/tylerb/gls/blob/2ef09cd25215bcab07d95380475175ba9a9fdc40/gotrack.go
 var stackBufPool = sync.Pool{
 	New: func() interface{} {
@@ -23,8 +124,8 @@ var stackBufPool = sync.Pool{
 	},
 }
 
-// Detect the current goroutine id.
-func threadID() uint64 {
+// Detect the current goroutine id by parsing the goroutine stack trace.
+func stackThreadID() uint64 {
 	bp := stackBufPool.Get().(*[]byte)
 	defer stackBufPool.Put(bp)
 	b := *bp
@@ -33,12 +134,12 @@ func threadID() uint64 {
 	b = bytes.TrimPrefix(b, goRoutinePrefix)
 	i := bytes.IndexByte(b, ' ')
 	if i < 0 {
-		panic("threadID(): [BUG] missing space at goRoutinePrefix")
+		panic("stackThreadID(): [BUG] missing space at goRoutinePrefix")
 	}
 	b = b[:i]
 	n, err := parseBase10UintBytes(b, 64)
 	if err != nil {
-		panic("threadID(): [BUG] failed to parse goroutine ID")
+		panic("stackThreadID(): [BUG] failed to parse goroutine ID")
 	}
 	return n
 }
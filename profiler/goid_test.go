@@ -1,9 +1,11 @@
 package profiler
 
 import (
+	"fmt"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -23,6 +25,131 @@ func TestThreadID(t *testing.T) {
 	}
 }
 
+func TestThreadIDFastPath(t *testing.T) {
+	if goidOffset < 0 {
+		t.Skip("goroutine id fast path is not supported on this platform")
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tid, expID := threadID(), stackThreadID(); tid != expID {
+				errCh <- fmt.Errorf("expected threadID() to return %d; got %d", expID, tid)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
+func TestThreadIDFallback(t *testing.T) {
+	defer func(offset int) {
+		goidOffset = offset
+	}(goidOffset)
+	goidOffset = -1
+
+	if tid, expID := threadID(), stackThreadID(); tid != expID {
+		t.Fatalf("expected threadID() to return %d; got %d", expID, tid)
+	}
+}
+
+func TestFilterGoidOffsets(t *testing.T) {
+	if getg() == nil {
+		t.Skip("getg is not supported on this platform")
+	}
+
+	if goidOffset < 0 {
+		t.Skip("goroutine id fast path is not supported by this go version")
+	}
+
+	// An offset that does not contain the goroutine id should be filtered out
+	matches := filterGoidOffsets([]int{goidOffset, goidOffset + 8})
+	if len(matches) != 1 || matches[0] != goidOffset {
+		t.Fatalf("expected filtered offsets to be [%d]; got %v", goidOffset, matches)
+	}
+}
+
+func TestDetectGoidOffset(t *testing.T) {
+	if getg() == nil {
+		t.Skip("getg is not supported on this platform")
+	}
+
+	specs := []struct {
+		GoVersion string
+		ExpOffset int
+	}{
+		{"go1.0.1", -1},
+		{"devel go1.23-0a1b2c3d", -1},
+	}
+
+	if expOffset, known := knownGoidOffsets[goRelease(runtime.Version())]; known {
+		if offset := detectGoidOffset(runtime.Version()); offset != expOffset {
+			t.Errorf("expected detected offset for go version %q to be %d; got %d", runtime.Version(), expOffset, offset)
+		}
+	}
+
+	// Offsets that do not match the goroutine id should be rejected
+	defer func(offsets map[string]int) {
+		knownGoidOffsets = offsets
+	}(knownGoidOffsets)
+	knownGoidOffsets = map[string]int{"go1.0": 0}
+
+	for specIndex, spec := range specs {
+		if offset := detectGoidOffset(spec.GoVersion); offset != spec.ExpOffset {
+			t.Errorf("[spec %d] expected detected offset for go version %q to be %d; got %d", specIndex, spec.GoVersion, spec.ExpOffset, offset)
+		}
+	}
+}
+
+func TestGoRelease(t *testing.T) {
+	specs := []struct {
+		GoVersion  string
+		ExpRelease string
+	}{
+		{"go1.21.5", "go1.21"},
+		{"go1.22rc1", "go1.22"},
+		{"go1.23", "go1.23"},
+		{"devel go1.23-0a1b2c3d", ""},
+		{"gccgo", ""},
+	}
+
+	for specIndex, spec := range specs {
+		if release := goRelease(spec.GoVersion); release != spec.ExpRelease {
+			t.Errorf("[spec %d] expected release for go version %q to be %q; got %q", specIndex, spec.GoVersion, spec.ExpRelease, release)
+		}
+	}
+}
+
+func BenchmarkThreadID(b *testing.B) {
+	defer func(offset int) {
+		goidOffset = offset
+	}(goidOffset)
+
+	b.Run("stack", func(b *testing.B) {
+		goidOffset = -1
+		for i := 0; i < b.N; i++ {
+			threadID()
+		}
+	})
+
+	b.Run("fast", func(b *testing.B) {
+		goidOffset = detectGoidOffset(runtime.Version())
+		if goidOffset < 0 {
+			b.Skip("goroutine id fast path is not supported on this platform")
+		}
+		for i := 0; i < b.N; i++ {
+			threadID()
+		}
+	})
+}
+
 func TestParseBase10UintBytes(t *testing.T) {
 	specs := []struct {
 		Bits   int
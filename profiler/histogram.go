@@ -0,0 +1,218 @@
+package profiler
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+const (
+	// The number of bits used for the linear sub-buckets that each power of 2
+	// range is split into. Durations are recorded with a relative error of at
+	// most 1/2^histogramSubBucketBits.
+	histogramSubBucketBits = 7
+	histogramSubBuckets    = 1 << histogramSubBucketBits
+)
+
+// HistogramBucket tracks the number of recorded durations that were assigned
+// to the histogram bucket with the specified index.
+type HistogramBucket struct {
+	Index int32 `json:"i"`
+	Count int64 `json:"n"`
+}
+
+// Histogram is a bounded-memory log-linear histogram of durations, similar
+// to an HDR histogram. The width of each bucket grows with the magnitude of
+// the durations assigned to it so that durations are recorded with a relative
+// error of at most 1/128 (~0.8%); durations below 256ns are recorded exactly.
+// The count, sum, min, max, mean and standard deviation of the recorded
+// durations are tracked exactly.
+//
+// As the bucket layout is the same for all histograms, histograms can be
+// merged together without any additional loss of accuracy. The zero value
+// is an empty histogram that is ready to use.
+type Histogram struct {
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	Min   time.Duration `json:"min"`
+	Max   time.Duration `json:"max"`
+
+	// The sum of squared differences from the mean of the recorded durations.
+	M2 float64 `json:"m2"`
+
+	// The non-empty histogram buckets sorted by index.
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// Record adds a duration to the histogram. Negative durations are recorded
+// as zero.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if h.Count == 0 || d > h.Max {
+		h.Max = d
+	}
+
+	// Update M2 using Welford's online algorithm
+	oldMean := h.mean()
+	h.Count++
+	h.Sum += d
+	h.M2 += (float64(d) - oldMean) * (float64(d) - h.mean())
+
+	index := histogramBucketIndex(d)
+	pos := sort.Search(len(h.Buckets), func(i int) bool { return h.Buckets[i].Index >= index })
+	if pos < len(h.Buckets) && h.Buckets[pos].Index == index {
+		h.Buckets[pos].Count++
+		return
+	}
+
+	h.Buckets = append(h.Buckets, HistogramBucket{})
+	copy(h.Buckets[pos+1:], h.Buckets[pos:])
+	h.Buckets[pos] = HistogramBucket{Index: index, Count: 1}
+}
+
+// Merge adds the durations recorded by other to the histogram.
+func (h *Histogram) Merge(other *Histogram) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+
+	if h.Count == 0 {
+		*h = *other
+		h.Buckets = append([]HistogramBucket(nil), other.Buckets...)
+		return
+	}
+
+	// Combine M2 values using the parallel variant of Welford's algorithm
+	delta := other.mean() - h.mean()
+	count := h.Count + other.Count
+	h.M2 += other.M2 + delta*delta*float64(h.Count)*float64(other.Count)/float64(count)
+
+	h.Count = count
+	h.Sum += other.Sum
+	if other.Min < h.Min {
+		h.Min = other.Min
+	}
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+
+	merged := make([]HistogramBucket, 0, len(h.Buckets)+len(other.Buckets))
+	i, j := 0, 0
+	for i < len(h.Buckets) || j < len(other.Buckets) {
+		switch {
+		case j == len(other.Buckets) || (i < len(h.Buckets) && h.Buckets[i].Index < other.Buckets[j].Index):
+			merged = append(merged, h.Buckets[i])
+			i++
+		case i == len(h.Buckets) || other.Buckets[j].Index < h.Buckets[i].Index:
+			merged = append(merged, other.Buckets[j])
+			j++
+		default:
+			merged = append(merged, HistogramBucket{Index: h.Buckets[i].Index, Count: h.Buckets[i].Count + other.Buckets[j].Count})
+			i++
+			j++
+		}
+	}
+	h.Buckets = merged
+}
+
+// Mean returns the mean of the recorded durations.
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// StdDev returns the (population) standard deviation of the recorded durations.
+func (h *Histogram) StdDev() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return math.Sqrt(h.M2 / float64(h.Count))
+}
+
+// Quantile returns an estimate of the q-th quantile (0 < q <= 1) of the
+// recorded durations.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	return h.valueAtRank(int64(math.Ceil(float64(h.Count) * q)))
+}
+
+// Median returns an estimate of the median of the recorded durations.
+func (h *Histogram) Median() time.Duration {
+	if h.Count%2 == 0 {
+		return (h.valueAtRank(h.Count/2) + h.valueAtRank(h.Count/2+1)) / 2
+	}
+	return h.valueAtRank(h.Count/2 + 1)
+}
+
+// Get the mean of the recorded durations as a float.
+func (h *Histogram) mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// Get an estimate of the recorded duration with the specified 1-based rank.
+// The estimate is the mid-point of the bucket containing the duration clamped
+// to the recorded min and max values.
+func (h *Histogram) valueAtRank(rank int64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for _, bucket := range h.Buckets {
+		seen += bucket.Count
+		if seen < rank {
+			continue
+		}
+
+		value := histogramBucketValue(bucket.Index)
+		switch {
+		case value < h.Min:
+			return h.Min
+		case value > h.Max:
+			return h.Max
+		}
+		return value
+	}
+
+	return h.Max
+}
+
+// Get the index of the histogram bucket for a non-negative duration.
+// Durations below 2*histogramSubBuckets are mapped to their own bucket. Larger
+// durations are mapped to one of histogramSubBuckets linear buckets for the
+// power of 2 range that they belong to.
+func histogramBucketIndex(d time.Duration) int32 {
+	v := uint64(d)
+	if v < 2*histogramSubBuckets {
+		return int32(v)
+	}
+
+	shift := bits.Len64(v) - (histogramSubBucketBits + 1)
+	return int32(shift<<histogramSubBucketBits) + int32(v>>uint(shift))
+}
+
+// Get the mid-point of the range of durations that map to a histogram bucket.
+func histogramBucketValue(index int32) time.Duration {
+	if index < 2*histogramSubBuckets {
+		return time.Duration(index)
+	}
+
+	shift := uint(index>>histogramSubBucketBits) - 1
+	mantissa := uint64(index) - uint64(shift<<histogramSubBucketBits)
+	lower := mantissa << shift
+	return time.Duration(lower + ((uint64(1)<<shift)-1)/2)
+}
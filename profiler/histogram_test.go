@@ -0,0 +1,140 @@
+package profiler
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Check whether a histogram estimate is within the max relative error of the
+// expected value.
+func withinHistogramError(got, exp time.Duration) bool {
+	return math.Abs(float64(got-exp)) <= float64(exp)/histogramSubBuckets
+}
+
+func TestHistogramBucketIndex(t *testing.T) {
+	specs := []time.Duration{
+		0,
+		1,
+		2*histogramSubBuckets - 1,
+		2 * histogramSubBuckets,
+		1234567,
+		time.Second,
+		time.Hour,
+		time.Duration(math.MaxInt64),
+	}
+
+	for specIndex, spec := range specs {
+		index := histogramBucketIndex(spec)
+		value := histogramBucketValue(index)
+		if spec < 2*histogramSubBuckets && value != spec {
+			t.Errorf("[spec %d] expected value %d to be recorded exactly; got %d", specIndex, spec, value)
+		} else if !withinHistogramError(value, spec) {
+			t.Errorf("[spec %d] expected bucket value for %d to be within the max relative error; got %d", specIndex, spec, value)
+		}
+
+		if index > 0 && histogramBucketIndex(spec-1) > index {
+			t.Errorf("[spec %d] expected bucket indices to be monotonic", specIndex)
+		}
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	samples := make([]time.Duration, 10000)
+	hist := &Histogram{}
+	for index := range samples {
+		samples[index] = time.Duration(rng.ExpFloat64() * float64(time.Millisecond))
+		hist.Record(samples[index])
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	if hist.Min != samples[0] || hist.Max != samples[len(samples)-1] {
+		t.Errorf("expected min/max to be %v/%v; got %v/%v", samples[0], samples[len(samples)-1], hist.Min, hist.Max)
+	}
+
+	for _, q := range []float64{.5, .75, .9, .99} {
+		exp := samples[int(math.Ceil(float64(len(samples))*q))-1]
+		if got := hist.Quantile(q); !withinHistogramError(got, exp) {
+			t.Errorf("expected quantile %.2f to be approximately %v; got %v", q, exp, got)
+		}
+	}
+
+	// Memory usage is bounded by the number of buckets
+	if len(hist.Buckets) > 2048 {
+		t.Errorf("expected histogram to use a bounded number of buckets; got %d", len(hist.Buckets))
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	all, h1, h2 := &Histogram{}, &Histogram{}, &Histogram{}
+	for i := 0; i < 1000; i++ {
+		sample := time.Duration(rng.Int63n(int64(time.Second)))
+		all.Record(sample)
+		if i%3 == 0 {
+			h1.Record(sample)
+		} else {
+			h2.Record(sample)
+		}
+	}
+
+	merged := &Histogram{}
+	merged.Merge(h1)
+	merged.Merge(h2)
+
+	if !reflect.DeepEqual(merged.Buckets, all.Buckets) {
+		t.Error("expected merged histogram buckets to match the buckets of a histogram with all samples")
+	}
+	if merged.Count != all.Count || merged.Sum != all.Sum || merged.Min != all.Min || merged.Max != all.Max {
+		t.Errorf("expected merged count/sum/min/max to be %d/%v/%v/%v; got %d/%v/%v/%v", all.Count, all.Sum, all.Min, all.Max, merged.Count, merged.Sum, merged.Min, merged.Max)
+	}
+	if math.Abs(merged.StdDev()-all.StdDev()) > 1e-6*all.StdDev() {
+		t.Errorf("expected merged stddev to be %f; got %f", all.StdDev(), merged.StdDev())
+	}
+
+	// Merging into an empty histogram must not alias the source buckets
+	merged = &Histogram{}
+	merged.Merge(h1)
+	merged.Record(h1.Min)
+	var h1BucketCount int64
+	for _, bucket := range h1.Buckets {
+		h1BucketCount += bucket.Count
+	}
+	if h1BucketCount != h1.Count {
+		t.Error("expected merged histogram not to share buckets with its source")
+	}
+
+	// Histograms should survive a JSON round-trip
+	data, err := json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded *Histogram
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, all) {
+		t.Error("expected histogram to survive a JSON round-trip")
+	}
+}
+
+func BenchmarkHistogramRecord(b *testing.B) {
+	rng := rand.New(rand.NewSource(42))
+	samples := make([]time.Duration, 1024)
+	for index := range samples {
+		samples[index] = time.Duration(rng.ExpFloat64() * float64(time.Millisecond))
+	}
+
+	hist := &Histogram{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hist.Record(samples[i&1023])
+	}
+}
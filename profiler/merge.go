@@ -0,0 +1,175 @@
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errNoProfilesToMerge = errors.New("MergeProfiles: no profiles specified")
+)
+
+// A mergeNode accumulates the invocation time histograms for a function call
+// across a set of merged profiles.
+type mergeNode struct {
+	fnName        string
+	async         bool
+	hist          *Histogram
+	selfTime      time.Duration
+	asyncWaitTime time.Duration
+
+	// Nested calls in the order they were first encountered.
+	nestedCalls []*mergeNode
+	nameToIndex map[string]int
+}
+
+// MergeProfiles folds a set of profiles captured for the same target into a
+// single profile. Nested calls with the same name and call path are merged
+// together and their metrics are recomputed from the merged invocation time
+// histograms of all merged profiles.
+//
+// MergeProfiles returns an error if the profiles belong to different targets
+// or if any of them does not include invocation time histograms. If all profiles
+// share the same label, it is also applied to the merged profile. Likewise,
+// the merged profile only retains the tags shared by all profiles. If any of the
+// profiles was sampled, the sample rate of the merged profile is set to the
+// mean sample rate of the merged profiles weighted by target invocations.
+func MergeProfiles(profiles ...*Profile) (*Profile, error) {
+	if len(profiles) == 0 {
+		return nil, errNoProfilesToMerge
+	}
+	for index, profile := range profiles {
+		if profile == nil || profile.Target == nil {
+			return nil, fmt.Errorf("MergeProfiles: profile at index %d does not contain any call metrics", index)
+		}
+	}
+
+	merged := &Profile{
+		CreatedAt: profiles[0].CreatedAt,
+		Label:     profiles[0].Label,
+		Tags:      commonTags(profiles),
+	}
+
+	// Track the number of target invocations represented by the merged
+	// profiles so we can calculate the effective sample rate
+	var sampledInvocations, representedInvocations float64
+
+	root := &mergeNode{
+		fnName:      profiles[0].Target.FnName,
+		hist:        &Histogram{},
+		nameToIndex: make(map[string]int, 0),
+	}
+	for _, profile := range profiles {
+		if profile.Target.FnName != root.fnName {
+			return nil, fmt.Errorf("MergeProfiles: cannot merge profiles for different targets %q and %q", root.fnName, profile.Target.FnName)
+		}
+
+		err := root.merge(profile.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		if profile.Label != merged.Label {
+			merged.Label = ""
+		}
+		if profile.CreatedAt.Before(merged.CreatedAt) {
+			merged.CreatedAt = profile.CreatedAt
+		}
+		sampleRate := profile.SampleRate
+		if sampleRate == 0 {
+			sampleRate = 1
+		} else {
+			merged.SampleRate = 1
+		}
+		sampledInvocations += float64(profile.Target.Invocations)
+		representedInvocations += sampleRate * float64(profile.Target.Invocations)
+
+		if profile.MergedProfiles > 0 {
+			merged.MergedProfiles += profile.MergedProfiles
+		} else {
+			merged.MergedProfiles++
+		}
+	}
+
+	if merged.SampleRate != 0 && sampledInvocations > 0 {
+		merged.SampleRate = representedInvocations / sampledInvocations
+	}
+
+	merged.Target = root.metrics()
+	return merged, nil
+}
+
+// Merge the samples for a call metric and its nested calls into this node.
+func (n *mergeNode) merge(cm *CallMetrics) error {
+	if cm.Histogram == nil || cm.Histogram.Count != int64(cm.Invocations) {
+		return fmt.Errorf("MergeProfiles: metrics for %q do not include an invocation time histogram; the profile was probably captured by an older prism version", cm.FnName)
+	}
+
+	n.async = n.async || cm.Async
+	n.hist.Merge(cm.Histogram)
+	n.selfTime += cm.SelfTime
+	n.asyncWaitTime += cm.AsyncWaitTime
+
+	for _, nestedCall := range cm.NestedCalls {
+		index, exists := n.nameToIndex[nestedCall.FnName]
+		if !exists {
+			index = len(n.nestedCalls)
+			n.nestedCalls = append(n.nestedCalls, &mergeNode{
+				fnName:      nestedCall.FnName,
+				hist:        &Histogram{},
+				nameToIndex: make(map[string]int, 0),
+			})
+			n.nameToIndex[nestedCall.FnName] = index
+		}
+
+		err := n.nestedCalls[index].merge(nestedCall)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Generate the aggregated call metrics for this node and its nested calls.
+func (n *mergeNode) metrics() *CallMetrics {
+	cm := histogramMetrics(n.fnName, n.hist)
+	cm.Async = n.async
+	cm.AsyncWaitTime = n.asyncWaitTime
+	cm.SelfTime = n.selfTime
+	if cm.Invocations > 0 {
+		cm.SelfMeanTime = n.selfTime / time.Duration(cm.Invocations)
+	}
+
+	for _, nestedCall := range n.nestedCalls {
+		cm.NestedCalls = append(cm.NestedCalls, nestedCall.metrics())
+	}
+
+	return cm
+}
+
+// Get the tags whose keys and values are shared by all profiles or nil if
+// the profiles do not share any tags.
+func commonTags(profiles []*Profile) map[string]string {
+	var common map[string]string
+	for key, value := range profiles[0].Tags {
+		shared := true
+		for _, profile := range profiles[1:] {
+			if otherValue, exists := profile.Tags[key]; !exists || otherValue != value {
+				shared = false
+				break
+			}
+		}
+
+		if !shared {
+			continue
+		}
+		if common == nil {
+			common = make(map[string]string, 0)
+		}
+		common[key] = value
+	}
+
+	return common
+}
@@ -0,0 +1,205 @@
+package profiler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeProfiles(t *testing.T) {
+	genMetrics := func(fnName string, samples ...time.Duration) *CallMetrics {
+		hist := &Histogram{}
+		for _, sample := range samples {
+			hist.Record(sample)
+		}
+		cm := histogramMetrics(fnName, hist)
+		cm.SelfTime = cm.TotalTime / 2
+		cm.SelfMeanTime = cm.SelfTime / time.Duration(cm.Invocations)
+		return cm
+	}
+
+	p1 := &Profile{
+		CreatedAt: time.Unix(200, 0),
+		Label:     "label",
+		Tags:      map[string]string{"host": "box", "rev": "abc"},
+		Target:    genMetrics("main", 10*time.Millisecond),
+	}
+	p1.Target.NestedCalls = []*CallMetrics{
+		genMetrics("foo", 2*time.Millisecond, 4*time.Millisecond),
+	}
+
+	p2 := &Profile{
+		CreatedAt: time.Unix(100, 0),
+		Label:     "label",
+		Tags:      map[string]string{"host": "box", "rev": "def", "env": "ci"},
+		Target:    genMetrics("main", 30*time.Millisecond, 50*time.Millisecond),
+	}
+	p2.Target.NestedCalls = []*CallMetrics{
+		genMetrics("bar", 8*time.Millisecond),
+		genMetrics("foo", 6*time.Millisecond),
+	}
+
+	merged, err := MergeProfiles(p1, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.MergedProfiles != 2 {
+		t.Errorf("expected merged profile count to be 2; got %d", merged.MergedProfiles)
+	}
+	if merged.Label != "label" {
+		t.Errorf("expected merged profile label to be %q; got %q", "label", merged.Label)
+	}
+	if expTags := map[string]string{"host": "box"}; !reflect.DeepEqual(merged.Tags, expTags) {
+		t.Errorf("expected merged profile tags to be %v; got %v", expTags, merged.Tags)
+	}
+	if !merged.CreatedAt.Equal(p2.CreatedAt) {
+		t.Errorf("expected merged profile creation time to be %v; got %v", p2.CreatedAt, merged.CreatedAt)
+	}
+
+	specs := []struct {
+		cm          *CallMetrics
+		fnName      string
+		invocations int
+		total       time.Duration
+		median      time.Duration
+		min         time.Duration
+		max         time.Duration
+		self        time.Duration
+	}{
+		{merged.Target, "main", 3, 90 * time.Millisecond, 30 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 45 * time.Millisecond},
+		{merged.Target.NestedCalls[0], "foo", 3, 12 * time.Millisecond, 4 * time.Millisecond, 2 * time.Millisecond, 6 * time.Millisecond, 6 * time.Millisecond},
+		{merged.Target.NestedCalls[1], "bar", 1, 8 * time.Millisecond, 8 * time.Millisecond, 8 * time.Millisecond, 8 * time.Millisecond, 4 * time.Millisecond},
+	}
+
+	if len(merged.Target.NestedCalls) != 2 {
+		t.Fatalf("expected merged target to have 2 nested calls; got %d", len(merged.Target.NestedCalls))
+	}
+
+	for specIndex, spec := range specs {
+		if spec.cm.FnName != spec.fnName {
+			t.Errorf("[spec %d] expected fn name to be %q; got %q", specIndex, spec.fnName, spec.cm.FnName)
+		}
+		if spec.cm.Invocations != spec.invocations {
+			t.Errorf("[spec %d] expected invocations to be %d; got %d", specIndex, spec.invocations, spec.cm.Invocations)
+		}
+		if spec.cm.Histogram.Count != int64(spec.invocations) {
+			t.Errorf("[spec %d] expected histogram count to be %d; got %d", specIndex, spec.invocations, spec.cm.Histogram.Count)
+		}
+		if spec.cm.TotalTime != spec.total {
+			t.Errorf("[spec %d] expected total time to be %v; got %v", specIndex, spec.total, spec.cm.TotalTime)
+		}
+		if !withinHistogramError(spec.cm.MedianTime, spec.median) {
+			t.Errorf("[spec %d] expected median time to be approximately %v; got %v", specIndex, spec.median, spec.cm.MedianTime)
+		}
+		if spec.cm.MinTime != spec.min {
+			t.Errorf("[spec %d] expected min time to be %v; got %v", specIndex, spec.min, spec.cm.MinTime)
+		}
+		if spec.cm.MaxTime != spec.max {
+			t.Errorf("[spec %d] expected max time to be %v; got %v", specIndex, spec.max, spec.cm.MaxTime)
+		}
+		if spec.cm.SelfTime != spec.self {
+			t.Errorf("[spec %d] expected self time to be %v; got %v", specIndex, spec.self, spec.cm.SelfTime)
+		}
+		if expSelfMean := spec.self / time.Duration(spec.invocations); spec.cm.SelfMeanTime != expSelfMean {
+			t.Errorf("[spec %d] expected self mean time to be %v; got %v", specIndex, expSelfMean, spec.cm.SelfMeanTime)
+		}
+	}
+
+	// Merging a merged profile should accumulate the merged profile count
+	merged, err = MergeProfiles(merged, p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.MergedProfiles != 3 {
+		t.Errorf("expected merged profile count to be 3; got %d", merged.MergedProfiles)
+	}
+}
+
+func TestMergeSampledProfiles(t *testing.T) {
+	genProfile := func(sampleRate float64) *Profile {
+		hist := &Histogram{}
+		hist.Record(time.Millisecond)
+		return &Profile{
+			SampleRate: sampleRate,
+			Target:     histogramMetrics("main", hist),
+		}
+	}
+
+	merged, err := MergeProfiles(genProfile(0), genProfile(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.SampleRate != 0 {
+		t.Errorf("expected merged sample rate for unsampled profiles to be 0; got %f", merged.SampleRate)
+	}
+
+	// The merged sample rate is the mean rate weighted by target invocations
+	merged, err = MergeProfiles(genProfile(10), genProfile(0), genProfile(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expRate := 5.0; merged.SampleRate != expRate {
+		t.Errorf("expected merged sample rate to be %f; got %f", expRate, merged.SampleRate)
+	}
+}
+
+func TestMergeProfilesWithoutInvocations(t *testing.T) {
+	profiles := []*Profile{
+		{Target: &CallMetrics{FnName: "foo", Histogram: &Histogram{}}},
+		{Target: &CallMetrics{FnName: "foo", Histogram: &Histogram{}}},
+	}
+
+	merged, err := MergeProfiles(profiles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Target.Invocations != 0 || merged.Target.SelfMeanTime != 0 || merged.Target.MeanTime != 0 {
+		t.Fatalf("expected merged metrics without invocations to have zero invocations and mean times; got %d invocations, %s mean, %s self mean", merged.Target.Invocations, merged.Target.MeanTime, merged.Target.SelfMeanTime)
+	}
+}
+
+func TestMergeProfilesErrors(t *testing.T) {
+	specs := []struct {
+		profiles []*Profile
+		expErr   string
+	}{
+		{
+			nil,
+			errNoProfilesToMerge.Error(),
+		},
+		{
+			[]*Profile{
+				{Target: &CallMetrics{FnName: "foo", Invocations: 1, Histogram: &Histogram{Count: 1}}},
+				{Target: &CallMetrics{FnName: "bar", Invocations: 1, Histogram: &Histogram{Count: 1}}},
+			},
+			`MergeProfiles: cannot merge profiles for different targets "foo" and "bar"`,
+		},
+		{
+			[]*Profile{
+				{Target: &CallMetrics{FnName: "foo", Invocations: 1, Histogram: &Histogram{Count: 1}}},
+				{},
+			},
+			"MergeProfiles: profile at index 1 does not contain any call metrics",
+		},
+		{
+			[]*Profile{nil},
+			"MergeProfiles: profile at index 0 does not contain any call metrics",
+		},
+		{
+			[]*Profile{
+				{Target: &CallMetrics{FnName: "foo", Invocations: 1, Histogram: &Histogram{Count: 1}}},
+				{Target: &CallMetrics{FnName: "foo", Invocations: 2}},
+			},
+			`MergeProfiles: metrics for "foo" do not include an invocation time histogram; the profile was probably captured by an older prism version`,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		_, err := MergeProfiles(spec.profiles...)
+		if err == nil || err.Error() != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %q; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package profiler
+
+import "runtime"
+
+// An Option configures the profiler when passed to Init.
+type Option func(*config)
+
+// The profiler configuration assembled from the options passed to Init.
+type config struct {
+	// A label and a set of key/value pairs to be applied to generated profiles.
+	label string
+	tags  map[string]string
+
+	// The number of profiles that can be buffered by the sink.
+	sinkBufferSize int
+
+	// How to estimate the overhead of the profiler hooks and an optional
+	// file for caching the calibration results.
+	calibration      CalibrationMode
+	calibrationCache string
+
+	// The number of background workers that post-process captured call trees.
+	numWorkers int
+
+	// The number of captured call trees that can be queued for post-processing.
+	queueSize int
+
+	// The policy to apply when the post-processing queue is full.
+	backpressure BackpressurePolicy
+
+	// When using BackpressureSample, one in every backpressureSampleRate
+	// call trees that are captured while the queue is full is retained.
+	backpressureSampleRate int
+
+	// Profile one in every samplingEvery invocations of each target and at
+	// most samplingPerSecond invocations per second for each target.
+	samplingEvery     int
+	samplingPerSecond float64
+
+	// The file where Shutdown writes the run statistics.
+	summaryFile string
+}
+
+// Get the default profiler configuration.
+func defaultConfig() config {
+	return config{
+		sinkBufferSize:         defaultSinkBufferSize,
+		calibration:            CalibrationOnce,
+		numWorkers:             runtime.GOMAXPROCS(0),
+		queueSize:              defaultSinkBufferSize,
+		backpressure:           BackpressureBlock,
+		backpressureSampleRate: defaultBackpressureSampleRate,
+	}
+}
+
+// WithLabel sets the label that is applied to all generated profiles.
+func WithLabel(label string) Option {
+	return func(cfg *config) {
+		cfg.label = label
+	}
+}
+
+// WithTags applies a set of key/value pairs to all generated profiles. Tags
+// can be used to record information about the profiled environment such as
+// the host name or the git revision of the profiled project.
+func WithTags(tags map[string]string) Option {
+	return func(cfg *config) {
+		if cfg.tags == nil {
+			cfg.tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			cfg.tags[k] = v
+		}
+	}
+}
+
+// WithBufferSize sets the number of profiles that can be buffered by the
+// sink before shipping a profile blocks. It defaults to 100.
+func WithBufferSize(bufferSize int) Option {
+	return func(cfg *config) {
+		if bufferSize > 0 {
+			cfg.sinkBufferSize = bufferSize
+		}
+	}
+}
+
+// WithCalibration selects how the profiler estimates the overhead of its
+// hooks. It defaults to CalibrationOnce.
+func WithCalibration(mode CalibrationMode) Option {
+	return func(cfg *config) {
+		cfg.calibration = mode
+	}
+}
+
+// WithCalibrationCache loads the calibration results from the specified file
+// instead of running the calibration loop. If the file does not exist or was
+// generated by a different go version or platform, the calibration loop runs
+// and its results are written to the file so that subsequent runs can reuse them.
+func WithCalibrationCache(file string) Option {
+	return func(cfg *config) {
+		cfg.calibrationCache = file
+	}
+}
+
+// WithWorkers sets the number of background workers that post-process
+// captured call trees into profiles. It defaults to GOMAXPROCS.
+func WithWorkers(numWorkers int) Option {
+	return func(cfg *config) {
+		if numWorkers > 0 {
+			cfg.numWorkers = numWorkers
+		}
+	}
+}
+
+// WithQueueSize sets the number of captured call trees that can be queued
+// for post-processing before the backpressure policy is applied.
+func WithQueueSize(queueSize int) Option {
+	return func(cfg *config) {
+		if queueSize >= 0 {
+			cfg.queueSize = queueSize
+		}
+	}
+}
+
+// WithBackpressure sets the policy to apply when the post-processing queue is
+// full. It defaults to BackpressureBlock.
+func WithBackpressure(policy BackpressurePolicy) Option {
+	return func(cfg *config) {
+		cfg.backpressure = policy
+	}
+}
+
+// WithBackpressureSampling selects the BackpressureSample policy and retains
+// one in every sampleRate call trees captured while the post-processing queue
+// is full.
+func WithBackpressureSampling(sampleRate int) Option {
+	return func(cfg *config) {
+		cfg.backpressure = BackpressureSample
+		if sampleRate > 0 {
+			cfg.backpressureSampleRate = sampleRate
+		}
+	}
+}
+
+// WithSampling profiles only one in every n invocations of each profile
+// target. Invocations that are not sampled skip all profiler bookkeeping. The
+// number of invocations represented by each captured profile is recorded in
+// its SampleRate field.
+func WithSampling(n int) Option {
+	return func(cfg *config) {
+		cfg.samplingEvery = n
+	}
+}
+
+// WithSampleRate profiles at most perSecond invocations per second of each
+// profile target. It can be combined with WithSampling in which case an
+// invocation is only profiled if it satisfies both limits.
+func WithSampleRate(perSecond float64) Option {
+	return func(cfg *config) {
+		cfg.samplingPerSecond = perSecond
+	}
+}
+
+// WithSummaryFile instructs Shutdown to write the run statistics reported by
+// Stats as JSON to the specified file once the sink has been closed.
+func WithSummaryFile(file string) Option {
+	return func(cfg *config) {
+		cfg.summaryFile = file
+	}
+}
@@ -0,0 +1,141 @@
+package profiler
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultBackpressureSampleRate = 10
+)
+
+// BackpressurePolicy controls how the profiler behaves when captured call trees
+// are produced faster than the background workers can post-process them.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks the profiled go-routine until the
+	// post-processing queue has room for its call tree. No profiles are lost.
+	BackpressureBlock BackpressurePolicy = iota
+
+	// BackpressureDrop discards call trees that cannot be queued. The number
+	// of discarded profiles is reported by DroppedProfiles.
+	BackpressureDrop
+
+	// BackpressureSample retains one in every N call trees that are captured
+	// while the post-processing queue is full (blocking until it can be
+	// queued) and discards the rest. This keeps a representative sample of
+	// profiles while bounding the time that profiled go-routines are blocked.
+	BackpressureSample
+)
+
+// A captured call tree queued for post-processing.
+type pendingCallTree struct {
+	tid      uint64
+	rootCall *fnCall
+}
+
+// postProcessor manages a pool of workers that convert captured call trees into
+// profiles and ship them to the sink. Post-processing runs outside of the
+// profiled go-routines so that the cost of aggregating metrics is not charged
+// to the profiled application.
+type postProcessor struct {
+	queue      chan pendingCallTree
+	workerWg   sync.WaitGroup
+	policy     BackpressurePolicy
+	sampleRate uint64
+
+	// A mutex for synchronizing enqueue calls with close.
+	mutex  sync.RWMutex
+	closed bool
+
+	// The number of call trees captured while the queue was full, the
+	// number of call trees that were discarded due to backpressure and the
+	// number of call trees that were queued after close was invoked. Must be
+	// accessed atomically.
+	numPressured uint64
+	numDropped   uint64
+	numDiscarded uint64
+}
+
+// Create a post-processor and start its workers.
+func newPostProcessor(cfg config) *postProcessor {
+	p := &postProcessor{
+		queue:      make(chan pendingCallTree, cfg.queueSize),
+		policy:     cfg.backpressure,
+		sampleRate: uint64(cfg.backpressureSampleRate),
+	}
+
+	p.workerWg.Add(cfg.numWorkers)
+	for i := 0; i < cfg.numWorkers; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+// Queue a call tree for post-processing applying the backpressure policy if
+// the queue is full. Call trees queued after the post-processor has been
+// closed (e.g. profiles whose async calls complete after Shutdown) are
+// discarded and counted by discarded.
+func (p *postProcessor) enqueue(tid uint64, rootCall *fnCall) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed {
+		atomic.AddUint64(&p.numDiscarded, 1)
+		rootCall.free()
+		return
+	}
+
+	tree := pendingCallTree{tid: tid, rootCall: rootCall}
+	select {
+	case p.queue <- tree:
+		return
+	default:
+	}
+
+	switch p.policy {
+	case BackpressureDrop:
+		atomic.AddUint64(&p.numDropped, 1)
+	case BackpressureSample:
+		if atomic.AddUint64(&p.numPressured, 1)%p.sampleRate != 0 {
+			atomic.AddUint64(&p.numDropped, 1)
+			return
+		}
+		p.queue <- tree
+	default:
+		p.queue <- tree
+	}
+}
+
+// Stop accepting new call trees and wait for the workers to process any
+// queued call trees.
+func (p *postProcessor) close() {
+	p.mutex.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mutex.Unlock()
+
+	p.workerWg.Wait()
+}
+
+// Get the number of call trees discarded due to backpressure.
+func (p *postProcessor) dropped() uint64 {
+	return atomic.LoadUint64(&p.numDropped)
+}
+
+// Get the number of call trees discarded because they were queued after close.
+func (p *postProcessor) discarded() uint64 {
+	return atomic.LoadUint64(&p.numDiscarded)
+}
+
+func (p *postProcessor) worker() {
+	defer p.workerWg.Done()
+
+	for tree := range p.queue {
+		profile := genProfile(tree.tid, profileLabel, tree.rootCall)
+		tree.rootCall.free()
+		shipProfile(profile)
+	}
+}
@@ -0,0 +1,178 @@
+package profiler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackpressurePolicies(t *testing.T) {
+	numProfiles := 20
+
+	specs := []struct {
+		opts          []Option
+		minDropped    uint64
+		minDelivered  int
+		maxDelivered  int
+		releaseDelay  time.Duration
+		expDescriptor string
+	}{
+		{
+			opts:          []Option{WithWorkers(1), WithQueueSize(1)},
+			minDelivered:  numProfiles,
+			maxDelivered:  numProfiles,
+			releaseDelay:  10 * time.Millisecond,
+			expDescriptor: "block",
+		},
+		{
+			opts:          []Option{WithWorkers(1), WithQueueSize(1), WithBackpressure(BackpressureDrop)},
+			minDropped:    uint64(numProfiles - 2),
+			minDelivered:  1,
+			maxDelivered:  2,
+			expDescriptor: "drop",
+		},
+		{
+			opts:          []Option{WithWorkers(1), WithQueueSize(1), WithBackpressureSampling(5)},
+			minDropped:    1,
+			minDelivered:  2,
+			maxDelivered:  numProfiles - 1,
+			releaseDelay:  10 * time.Millisecond,
+			expDescriptor: "sample",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		sink := newGatedSink()
+		Init(sink, append(spec.opts, WithLabel("profiler-test"))...)
+
+		// Release the sink while profiles are still being generated so
+		// that blocked go-routines can make progress
+		if spec.releaseDelay > 0 {
+			time.AfterFunc(spec.releaseDelay, sink.release)
+		}
+
+		for i := 0; i < numProfiles; i++ {
+			BeginProfile("func1")
+			EndProfile()
+		}
+
+		if spec.releaseDelay == 0 {
+			sink.release()
+		}
+		dropped := DroppedProfiles()
+		Shutdown()
+
+		if stats := Stats(); stats.Dropped != dropped {
+			t.Errorf("[spec %d: %s] expected run stats to report %d dropped profiles; got %d", specIndex, spec.expDescriptor, dropped, stats.Dropped)
+		}
+
+		delivered := len(sink.buffer)
+		if delivered+int(dropped) != numProfiles {
+			t.Errorf("[spec %d: %s] expected delivered (%d) and dropped (%d) profiles to add up to %d", specIndex, spec.expDescriptor, delivered, dropped, numProfiles)
+		}
+		if dropped < spec.minDropped {
+			t.Errorf("[spec %d: %s] expected at least %d dropped profiles; got %d", specIndex, spec.expDescriptor, spec.minDropped, dropped)
+		}
+		if delivered < spec.minDelivered || delivered > spec.maxDelivered {
+			t.Errorf("[spec %d: %s] expected between %d and %d delivered profiles; got %d", specIndex, spec.expDescriptor, spec.minDelivered, spec.maxDelivered, delivered)
+		}
+	}
+}
+
+func TestNestedProfilesArePostProcessed(t *testing.T) {
+	sink := newGatedSink()
+	Init(sink, WithWorkers(1), WithQueueSize(4), WithLabel("profiler-test"))
+
+	// Ending the nested profiles must not block on the gated sink as their
+	// call trees are generated and shipped by the post-processing workers
+	done := make(chan struct{})
+	go func() {
+		BeginProfile("func1")
+		for i := 0; i < 3; i++ {
+			BeginNestedProfile("func2")
+			EndNestedProfile()
+		}
+		EndProfile()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for nested profiles to be queued")
+	}
+
+	sink.release()
+	<-done
+	Shutdown()
+
+	if len(sink.buffer) != 4 {
+		t.Fatalf("expected 4 profiles to be delivered; got %d", len(sink.buffer))
+	}
+
+	numNested := 0
+	for _, profile := range sink.buffer {
+		switch profile.Target.FnName {
+		case "func1":
+			if len(profile.Target.NestedCalls) != 1 || profile.Target.NestedCalls[0].Invocations != 3 {
+				t.Errorf("expected func1 profile to include 3 invocations of func2; got %+v", profile.Target.NestedCalls)
+			}
+		case "func2":
+			numNested++
+		}
+	}
+	if numNested != 3 {
+		t.Errorf("expected 3 func2 profiles; got %d", numNested)
+	}
+}
+
+// A sink that does not consume any profiles until it is released.
+type gatedSink struct {
+	bufferedSink
+	gate chan struct{}
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{
+		bufferedSink: *newBufferedSink(),
+		gate:         make(chan struct{}),
+	}
+}
+
+func (s *gatedSink) Open(_ int) error {
+	s.inputChan = make(chan *Profile, 0)
+	go func() {
+		<-s.gate
+		s.worker()
+	}()
+	return nil
+}
+
+func (s *gatedSink) Close() error {
+	close(s.inputChan)
+	<-s.sigChan
+	close(s.sigChan)
+	return nil
+}
+
+// Start consuming profiles and wait for the sink worker to start.
+func (s *gatedSink) release() {
+	close(s.gate)
+	<-s.sigChan
+}
+
+func TestPostProcessorDiscardsCallTreesAfterClose(t *testing.T) {
+	p := newPostProcessor(defaultConfig())
+	p.close()
+
+	rootCall := makeFnCall("func1")
+	rootCall.enteredAt = time.Now()
+	rootCall.exitedAt = time.Now()
+	p.enqueue(1, rootCall)
+
+	if discarded := p.discarded(); discarded != 1 {
+		t.Fatalf("expected post-processor to discard 1 call tree queued after close; got %d", discarded)
+	}
+	if dropped := p.dropped(); dropped != 0 {
+		t.Fatalf("expected post-processor to report 0 call trees dropped due to backpressure; got %d", dropped)
+	}
+}
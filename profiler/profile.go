@@ -14,67 +14,47 @@ type Profile struct {
 
 	Label  string       `json:"label"`
 	Target *CallMetrics `json:"target"`
-}
 
-type metricsList []*CallMetrics
+	// The tags supplied via the WithTags option when the profile was captured.
+	Tags map[string]string `json:"tags,omitempty"`
 
-func (p metricsList) Len() int           { return len(p) }
-func (p metricsList) Less(i, j int) bool { return p[i].TotalTime < p[j].TotalTime }
-func (p metricsList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+	// The time elapsed between entering the profile target and the exit of
+	// the last call in the profile. This value differs from the target's total
+	// time when the target forks async calls that outlive it. It is only
+	// populated for profiles that include async calls.
+	WallTime time.Duration `json:"wall_time,omitempty"`
 
-// aggregate iterates all CallMetrics in the list and returns a composite CallMetric
-// representing the Group. When the list length is > 1 the returned metric
-// will also contain statistics for mean/median/p50/p75/p90/p99 and sttdev.
-func (p metricsList) aggregate() *CallMetrics {
-	cm := &CallMetrics{
-		FnName:      p[0].FnName,
-		NestedCalls: make([]*CallMetrics, 0),
+	// The number of captured profiles that were combined into this profile
+	// by MergeProfiles. It is not populated for captured profiles.
+	MergedProfiles int `json:"merged_profiles,omitempty"`
 
-		MinTime:     time.Duration(math.MaxInt64),
-		MaxTime:     time.Duration(math.MinInt64),
-		Invocations: len(p),
-	}
-
-	// Pre-sort metrics so we can calculate the percentiles and the median
-	if cm.Invocations > 0 {
-		sort.Sort(p)
-
-		// Calc min/max/total and pXX values
-		callCountF := float64(len(p))
-		p50 := int(math.Ceil(callCountF*.5)) - 1
-		p75 := int(math.Ceil(callCountF*.75)) - 1
-		p90 := int(math.Ceil(callCountF*.90)) - 1
-		p99 := int(math.Ceil(callCountF*.99)) - 1
-
-		cm.MinTime = p[0].TotalTime
-		cm.MaxTime = p[len(p)-1].TotalTime
-		cm.P50Time = p[p50].TotalTime
-		cm.P75Time = p[p75].TotalTime
-		cm.P90Time = p[p90].TotalTime
-		cm.P99Time = p[p99].TotalTime
-
-		for _, metric := range p {
-			cm.TotalTime += metric.TotalTime
-		}
-	}
-
-	// Calc mean
-	cm.MeanTime = cm.TotalTime / time.Duration(cm.Invocations)
+	// The number of target invocations represented by this profile when
+	// sampling is enabled (e.g. 10 if one in every 10 invocations was
+	// profiled). Totals can be extrapolated by multiplying them with this
+	// value. It is not populated if sampling is disabled.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
 
-	// Calc stddev = Sqrt( 1 / N * Sum_i( (total_i - mean)^2 ) )
-	for _, metric := range p {
-		cm.StdDev += math.Pow(float64(metric.TotalTime-cm.MeanTime), 2.0)
-	}
-	cm.StdDev = math.Sqrt(cm.StdDev / float64(cm.Invocations))
+// histogramMetrics generates a CallMetrics instance whose invocation time
+// statistics are populated from the supplied histogram.
+func histogramMetrics(fnName string, hist *Histogram) *CallMetrics {
+	return &CallMetrics{
+		FnName:      fnName,
+		NestedCalls: make([]*CallMetrics, 0),
 
-	// Calc median
-	if cm.Invocations%2 == 0 {
-		cm.MedianTime = (p[(cm.Invocations/2-1)].TotalTime + p[cm.Invocations/2].TotalTime) / 2
-	} else {
-		cm.MedianTime = p[cm.Invocations/2].TotalTime
+		TotalTime:   hist.Sum,
+		MinTime:     hist.Min,
+		MaxTime:     hist.Max,
+		MeanTime:    hist.Mean(),
+		MedianTime:  hist.Median(),
+		P50Time:     hist.Quantile(.5),
+		P75Time:     hist.Quantile(.75),
+		P90Time:     hist.Quantile(.90),
+		P99Time:     hist.Quantile(.99),
+		StdDev:      hist.StdDev(),
+		Invocations: int(hist.Count),
+		Histogram:   hist,
 	}
-
-	return cm
 }
 
 // CallMetrics encapsulates all collected metrics about a function call that is
@@ -105,9 +85,47 @@ type CallMetrics struct {
 	// The number of times a scope was entered by the same parent function call.
 	Invocations int `json:"invocations"`
 
+	// Total and mean time spent in this call excluding the time spent in
+	// its nested calls (also known as self or exclusive time). Async nested
+	// calls run concurrently with this call so their time is not excluded.
+	SelfTime     time.Duration `json:"self_time"`
+	SelfMeanTime time.Duration `json:"self_mean_time"`
+
+	// A histogram of the total time for each invocation. Median and
+	// percentile values are estimated from the histogram. It also allows
+	// MergeProfiles to recompute the metrics for a set of merged profiles.
+	Histogram *Histogram `json:"histogram,omitempty"`
+
+	// Set if this call was executed by a go-routine forked by its parent call.
+	Async bool `json:"async,omitempty"`
+
+	// The total time that this call spent waiting for (i.e. running concurrently
+	// with) the async calls that it forked.
+	AsyncWaitTime time.Duration `json:"async_wait_time,omitempty"`
+
 	NestedCalls []*CallMetrics `json:"calls"`
 }
 
+// Extrapolate generates a copy of a sampled call metrics tree where the total
+// time and invocation count metrics are scaled by sampleRate so that they
+// estimate the totals for all (sampled and non-sampled) target invocations.
+// Per-invocation metrics such as the mean or percentile values are not
+// affected by sampling.
+func (cm *CallMetrics) Extrapolate(sampleRate float64) *CallMetrics {
+	scaled := *cm
+	scaled.TotalTime = time.Duration(float64(cm.TotalTime) * sampleRate)
+	scaled.SelfTime = time.Duration(float64(cm.SelfTime) * sampleRate)
+	scaled.AsyncWaitTime = time.Duration(float64(cm.AsyncWaitTime) * sampleRate)
+	scaled.Invocations = int(math.Round(float64(cm.Invocations) * sampleRate))
+
+	scaled.NestedCalls = make([]*CallMetrics, len(cm.NestedCalls))
+	for index, nestedCall := range cm.NestedCalls {
+		scaled.NestedCalls[index] = nestedCall.Extrapolate(sampleRate)
+	}
+
+	return &scaled
+}
+
 type fnCall struct {
 	fnName string
 
@@ -124,9 +142,55 @@ type fnCall struct {
 	// The call via which this call was reached.
 	parent *fnCall
 
+	// The root of the call tree that this call belongs to.
+	root *fnCall
+
 	// The call group index this call belongs to. This field is populated
 	// by the aggregateMetrics() call.
 	callGroupIndex int
+
+	// The call that forked the go-routine executing this call. This field
+	// is only set for the root call of an async call tree (see Async).
+	asyncParent *fnCall
+
+	// The number of async calls forked from this call tree that have not
+	// completed yet. This field is only used by call tree roots and nested
+	// profile roots.
+	pendingAsync int
+
+	// Set when a call tree root or a nested profile root has exited while its
+	// async calls are still pending. The last async call to complete finalizes
+	// the call tree or ships the nested profile.
+	ended bool
+
+	// The ID of the go-routine that executed this call tree root.
+	tid uint64
+
+	// Set by the go-routine that owns a call tree root when it forks its
+	// first async call. Once set, the owning go-routine must hold treeMutex
+	// while modifying the call tree as completed async call trees may be
+	// concurrently attached to it. This field is only used by call tree roots.
+	hasAsync bool
+
+	// A mutex for synchronizing access to the call tree with async call
+	// trees that are being attached to it. This field is only used by call
+	// tree roots.
+	treeMutex sync.Mutex
+
+	// The number of target invocations represented by the profile generated
+	// for this call when sampling is enabled. This field is only used by
+	// profile roots.
+	sampleRate float64
+
+	// Set for nested profile roots that were not sampled. These calls are
+	// tracked as regular calls of the parent profile but do not generate
+	// a profile of their own.
+	unsampled bool
+
+	// Set for sampled profile roots that are nested into another profile.
+	// Their call tree is shipped as a separate profile once they exit and
+	// any async calls forked by them complete.
+	nestedProfile bool
 }
 
 var callPool = sync.Pool{
@@ -142,6 +206,14 @@ func makeFnCall(fnName string) *fnCall {
 	call.profilerOverhead = 0
 	call.nestedCalls = make([]*fnCall, 0)
 	call.parent = nil
+	call.root = call
+	call.asyncParent = nil
+	call.pendingAsync = 0
+	call.ended = false
+	call.hasAsync = false
+	call.sampleRate = 0
+	call.unsampled = false
+	call.nestedProfile = false
 
 	return call
 }
@@ -156,12 +228,145 @@ func (fn *fnCall) free() {
 	callPool.Put(fn)
 }
 
+// Copy this call and its nested calls into a new call tree allocated from the
+// call pool. The copy retains the fields used by genProfile so it can be
+// post-processed and freed independently of the original call tree.
+func (fn *fnCall) snapshot() *fnCall {
+	call := makeFnCall(fn.fnName)
+	call.enteredAt = fn.enteredAt
+	call.exitedAt = fn.exitedAt
+	call.profilerOverhead = fn.profilerOverhead
+	call.asyncParent = fn.asyncParent
+	call.sampleRate = fn.sampleRate
+	for _, nestedCall := range fn.nestedCalls {
+		call.nestCall(nestedCall.snapshot())
+	}
+
+	return call
+}
+
 // Append a fnCall instance to the set of nested calls.
 func (fn *fnCall) nestCall(call *fnCall) {
 	call.parent = fn
+	call.root = fn.root
 	fn.nestedCalls = append(fn.nestedCalls, call)
 }
 
+// Calculate the time spent in this call excluding the profiler overhead.
+func (fn *fnCall) totalTime() time.Duration {
+	// Our overhead calculation codes uses the mean fn call overhead
+	// estimated by a calibration loop. This may cause the estimated total
+	// time to become negative due to jitter so we need to ensure we track
+	// at least 1ns of total time
+	totalTime := fn.exitedAt.Sub(fn.enteredAt) - fn.profilerOverhead
+	if totalTime <= 0 {
+		totalTime = 1 * time.Nanosecond
+	}
+
+	return totalTime
+}
+
+// Calculate the time spent in this call excluding the time spent in any
+// nested calls that were executed by the same go-routine.
+func (fn *fnCall) selfTime() time.Duration {
+	selfTime := fn.totalTime()
+	for _, call := range fn.nestedCalls {
+		if call.asyncParent != nil {
+			continue
+		}
+		selfTime -= call.totalTime()
+	}
+
+	if selfTime < 0 {
+		selfTime = 0
+	}
+	return selfTime
+}
+
+// Acquire the lock for the call tree that this call belongs to if the call
+// tree has forked any async calls. Call trees without async calls are only
+// ever accessed by the go-routine that owns them so no locking is required.
+// The returned flag must be passed to unlockTree.
+func (fn *fnCall) lockTree() bool {
+	if !fn.root.hasAsync {
+		return false
+	}
+	fn.root.treeMutex.Lock()
+	return true
+}
+
+// Release a call tree lock acquired by lockTree.
+func (fn *fnCall) unlockTree(locked bool) {
+	if locked {
+		fn.root.treeMutex.Unlock()
+	}
+}
+
+// Calculate the time that this call spent running concurrently with the async
+// calls it forked. Overlapping async calls are only accounted once.
+func (fn *fnCall) asyncWaitTime() time.Duration {
+	type interval struct {
+		from, to time.Time
+	}
+
+	intervals := make([]interval, 0)
+	for _, call := range fn.nestedCalls {
+		if call.asyncParent == nil {
+			continue
+		}
+
+		from, to := call.enteredAt, call.exitedAt
+		if from.Before(fn.enteredAt) {
+			from = fn.enteredAt
+		}
+		if to.After(fn.exitedAt) {
+			to = fn.exitedAt
+		}
+		if to.After(from) {
+			intervals = append(intervals, interval{from, to})
+		}
+	}
+
+	if len(intervals) == 0 {
+		return 0
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].from.Before(intervals[j].from)
+	})
+
+	var waitTime time.Duration
+	cur := intervals[0]
+	for _, next := range intervals[1:] {
+		if next.from.After(cur.to) {
+			waitTime += cur.to.Sub(cur.from)
+			cur = next
+			continue
+		}
+		if next.to.After(cur.to) {
+			cur.to = next.to
+		}
+	}
+
+	return waitTime + cur.to.Sub(cur.from)
+}
+
+// Scan the call tree and return back the latest exit time and a flag indicating
+// whether the tree contains any async calls.
+func (fn *fnCall) lastExit() (exitedAt time.Time, hasAsync bool) {
+	exitedAt = fn.exitedAt
+	hasAsync = fn.asyncParent != nil
+	for _, call := range fn.nestedCalls {
+		callExitedAt, callHasAsync := call.lastExit()
+		if callExitedAt.After(exitedAt) {
+			exitedAt = callExitedAt
+		}
+		hasAsync = hasAsync || callHasAsync
+	}
+
+	return exitedAt, hasAsync
+}
+
 type callGroup struct {
 	calls        []*fnCall
 	nestedGroups []*callGroup
@@ -297,26 +502,21 @@ func (t *callGroupTree) linkGroups() {
 	}
 }
 
-// groupMetrics generates a CallMetrics instance summarizing the individual
-// CallMetrics for each fnCall instance in the given callGroup.
+// groupMetrics generates a CallMetrics instance summarizing the invocation
+// times for each fnCall instance in the given callGroup.
 func (t *callGroupTree) groupMetrics(cg *callGroup) *CallMetrics {
-	groupCallMetrics := make(metricsList, len(cg.calls))
-	for callIndex, call := range cg.calls {
-		// Our overhead calculation codes uses the mean fn call overhead
-		// estimated by a calibration loop. This may cause the estimated total
-		// time to become negative due to jitter so we need to ensure we track
-		// at least 1ns of total time
-		totalTime := call.exitedAt.Sub(call.enteredAt) - call.profilerOverhead
-		if totalTime <= 0 {
-			totalTime = 1 * time.Nanosecond
-		}
-
-		groupCallMetrics[callIndex] = &CallMetrics{
-			FnName:    call.fnName,
-			TotalTime: totalTime,
-		}
+	var asyncWaitTime, selfTime time.Duration
+	hist := &Histogram{}
+	for _, call := range cg.calls {
+		hist.Record(call.totalTime())
+		asyncWaitTime += call.asyncWaitTime()
+		selfTime += call.selfTime()
 	}
-	cm := groupCallMetrics.aggregate()
+	cm := histogramMetrics(cg.calls[0].fnName, hist)
+	cm.Async = cg.calls[0].asyncParent != nil
+	cm.AsyncWaitTime = asyncWaitTime
+	cm.SelfTime = selfTime
+	cm.SelfMeanTime = selfTime / time.Duration(cm.Invocations)
 
 	// Iterate nested groups and append one aggregated metric per group
 	for _, nestedGroup := range cg.nestedGroups {
@@ -330,10 +530,18 @@ func (t *callGroupTree) groupMetrics(cg *callGroup) *CallMetrics {
 // genProfile post-processes the data captured by the profiler into a Profile
 // instance consisting of a tree structure of CallMetrics instances.
 func genProfile(ID uint64, label string, rootFnCall *fnCall) *Profile {
-	return &Profile{
-		ID:        ID,
-		CreatedAt: rootFnCall.enteredAt,
-		Label:     label,
-		Target:    aggregateMetrics(rootFnCall),
+	profile := &Profile{
+		ID:         ID,
+		CreatedAt:  rootFnCall.enteredAt,
+		Label:      label,
+		Tags:       profileTags,
+		Target:     aggregateMetrics(rootFnCall),
+		SampleRate: rootFnCall.sampleRate,
+	}
+
+	if exitedAt, hasAsync := rootFnCall.lastExit(); hasAsync {
+		profile.WallTime = exitedAt.Sub(rootFnCall.enteredAt)
 	}
+
+	return profile
 }
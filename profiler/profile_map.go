@@ -0,0 +1,58 @@
+package profiler
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const (
+	// The default number of shards for the active profile map. Must be a power of 2.
+	defaultProfileMapShards = 64
+
+	// The assumed CPU cache line size used for padding shards.
+	cacheLineSize = 64
+)
+
+// profileMap maps go-routine IDs to the call that is currently active in each
+// go-routine. To avoid serializing all profiled go-routines on a single lock,
+// the map is split into a number of independently locked shards. As go-routine
+// IDs are allocated sequentially, concurrently running go-routines are spread
+// evenly across shards.
+type profileMap struct {
+	shards []profileShard
+	mask   uint64
+}
+
+// A profileShard holds the active calls for a subset of go-routine IDs.
+type profileShard struct {
+	sync.Mutex
+	calls map[uint64]*fnCall
+
+	// Pad shards to a full cache line to prevent false sharing
+	_ [cacheLineSize - (unsafe.Sizeof(sync.Mutex{})+unsafe.Sizeof(map[uint64]*fnCall(nil)))%cacheLineSize]byte
+}
+
+// Create a new profileMap with the specified number of shards. The number of
+// shards is rounded up to the next power of 2.
+func newProfileMap(numShards int) *profileMap {
+	size := 1
+	for size < numShards {
+		size <<= 1
+	}
+
+	m := &profileMap{
+		shards: make([]profileShard, size),
+		mask:   uint64(size - 1),
+	}
+	for index := range m.shards {
+		m.shards[index].calls = make(map[uint64]*fnCall, 0)
+	}
+
+	return m
+}
+
+// Get the shard responsible for the specified go-routine ID. The caller must
+// lock the shard before accessing its calls.
+func (m *profileMap) shard(tid uint64) *profileShard {
+	return &m.shards[tid&m.mask]
+}
@@ -0,0 +1,42 @@
+package profiler
+
+import "testing"
+
+func TestNewProfileMap(t *testing.T) {
+	specs := []struct {
+		NumShards    int
+		ExpNumShards int
+	}{
+		{0, 1},
+		{1, 1},
+		{3, 4},
+		{64, 64},
+		{100, 128},
+	}
+
+	for specIndex, spec := range specs {
+		m := newProfileMap(spec.NumShards)
+		if len(m.shards) != spec.ExpNumShards {
+			t.Errorf("[spec %d] expected map to contain %d shards; got %d", specIndex, spec.ExpNumShards, len(m.shards))
+			continue
+		}
+
+		for shardIndex := range m.shards {
+			if m.shards[shardIndex].calls == nil {
+				t.Errorf("[spec %d] expected shard %d to be initialized", specIndex, shardIndex)
+			}
+		}
+	}
+}
+
+func TestProfileMapShardSelection(t *testing.T) {
+	m := newProfileMap(4)
+
+	// Sequential go-routine IDs should be spread across all shards
+	for tid := uint64(0); tid < 8; tid++ {
+		expShard := &m.shards[tid%4]
+		if m.shard(tid) != expShard {
+			t.Errorf("expected tid %d to be mapped to shard %d", tid, tid%4)
+		}
+	}
+}
@@ -7,36 +7,36 @@ import (
 	"time"
 )
 
-func TestGroupMetrics(t *testing.T) {
+func TestHistogramMetrics(t *testing.T) {
 	fnName := "testFn"
 	numMetrics := 100
 
-	metrics := metricsList{}
+	hist := &Histogram{}
 	for i := 0; i < numMetrics; i++ {
-		metrics = append(
-			metrics,
-			&CallMetrics{
-				FnName:    fnName,
-				TotalTime: time.Duration(i) * time.Millisecond,
-			},
-		)
+		hist.Record(time.Duration(i) * time.Millisecond)
 	}
 
-	groupedMetric := metrics.aggregate()
+	groupedMetric := histogramMetrics(fnName, hist)
+
+	// These values are tracked exactly
 	expValues := map[string]time.Duration{
 		// This is an arithmetic series so S = n/2 * (a_0 + a_n)
-		"total_time": time.Duration(numMetrics/2) * (metrics[0].TotalTime + metrics[numMetrics-1].TotalTime),
+		"total_time": time.Duration(numMetrics/2) * time.Duration(numMetrics-1) * time.Millisecond,
 		//
 		"min_time": 0,
-		"max_time": metrics[numMetrics-1].TotalTime,
+		"max_time": time.Duration(numMetrics-1) * time.Millisecond,
 		//
-		"mean_time":   metrics[0].TotalTime + metrics[numMetrics-1].TotalTime/2,
-		"median_time": (metrics[(numMetrics/2)-1].TotalTime + metrics[numMetrics/2].TotalTime) / 2,
+		"mean_time": time.Duration(numMetrics-1) * time.Millisecond / 2,
+	}
+
+	// These values are estimated by the histogram
+	expApproxValues := map[string]time.Duration{
+		"median_time": time.Duration(numMetrics-1) * time.Millisecond / 2,
 		//
-		"p50_time": metrics[50-1].TotalTime,
-		"p75_time": metrics[75-1].TotalTime,
-		"p90_time": metrics[90-1].TotalTime,
-		"p99_time": metrics[99-1].TotalTime,
+		"p50_time": time.Duration(50-1) * time.Millisecond,
+		"p75_time": time.Duration(75-1) * time.Millisecond,
+		"p90_time": time.Duration(90-1) * time.Millisecond,
+		"p99_time": time.Duration(99-1) * time.Millisecond,
 	}
 
 	dataDump, _ := json.Marshal(groupedMetric)
@@ -47,19 +47,20 @@ func TestGroupMetrics(t *testing.T) {
 			t.Errorf("expected group metric key %q to be %v; got %v", k, expVal, dataMap[k])
 		}
 	}
+	for k, expVal := range expApproxValues {
+		if !withinHistogramError(dataMap[k], expVal) {
+			t.Errorf("expected group metric key %q to be approximately %v; got %v", k, expVal, dataMap[k])
+		}
+	}
 
 	// arithmetic series stddev: |d| * sqrt( (n-1)(n+1) / 12 )
 	expStdDev := float64(time.Millisecond) * math.Sqrt(float64((numMetrics-1)*(numMetrics+1))/12.0)
-	if groupedMetric.StdDev != expStdDev {
+	if math.Abs(groupedMetric.StdDev-expStdDev) > 1e-6*expStdDev {
 		t.Errorf("expected stddev to be %f; got %f", expStdDev, groupedMetric.StdDev)
 	}
 
-	// append one more entry to calc median time with odd number of metrics
-	metrics = append(metrics, &CallMetrics{TotalTime: time.Duration(numMetrics) * time.Millisecond})
-	groupedMetric = metrics.aggregate()
-	expMedian := metrics[len(metrics)/2].TotalTime
-	if groupedMetric.MedianTime != expMedian {
-		t.Errorf("expected median time with odd number of metrics to be %v; got %v", expMedian, groupedMetric.MedianTime)
+	if groupedMetric.Invocations != numMetrics || groupedMetric.Histogram != hist {
+		t.Errorf("expected metric to include %d invocations and the source histogram", numMetrics)
 	}
 }
 
@@ -126,6 +127,17 @@ func TestGenProfile(t *testing.T) {
 		t.Fatalf("expected func1 total time (sans any overhead) to be %d; got %d", expRootTotalTime, profile.Target.TotalTime)
 	}
 
+	// Self time should exclude the time spent in nested calls
+	if profile.Target.SelfTime != timeInRoot || profile.Target.SelfMeanTime != timeInRoot {
+		t.Fatalf("expected func1 self time and mean self time to be %d; got %d and %d", timeInRoot, profile.Target.SelfTime, profile.Target.SelfMeanTime)
+	}
+
+	nestedMetrics := profile.Target.NestedCalls[0]
+	expSelfMeanTime := totalTimeInNestedCalls / time.Duration(numNestedCalls)
+	if nestedMetrics.SelfTime != totalTimeInNestedCalls || nestedMetrics.SelfMeanTime != expSelfMeanTime {
+		t.Fatalf("expected func2 self time to be %d and mean self time to be %d; got %d and %d", totalTimeInNestedCalls, expSelfMeanTime, nestedMetrics.SelfTime, nestedMetrics.SelfMeanTime)
+	}
+
 	nestedCalls := root.nestedCalls
 	root.free()
 	if root.nestedCalls != nil {
@@ -2,125 +2,132 @@ package profiler
 
 import (
 	"fmt"
-	"sync"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	defaultSinkBufferSize = 100
-	numCalibrationCalls   = 10000000
+
+	// The max time that Shutdown waits for pending async calls to complete.
+	asyncShutdownTimeout = 5 * time.Second
 )
 
 var (
-	// A mutex for protecting access to the activeProfiles map.
-	profileMutex sync.Mutex
-
 	// A label to be applied to generated profiles.
 	profileLabel string
 
+	// A set of key/value pairs to be applied to generated profiles.
+	profileTags map[string]string
+
 	// We maintain a dedicated call stack for each profiled goroutine. Each
 	// map entry points to the currently entered function scope.
-	activeProfiles map[uint64]*fnCall
+	activeProfiles *profileMap
 
 	// A sink for emitted profile entries.
 	outputSink Sink
 
-	// Function call invokation overhead; calculated by calibrate() and triggered by init()
-	timeNowOverhead, timeSinceOverhead, deferredFnOverhead, fnCallOverhead time.Duration
-)
+	// A pool of workers that convert captured call trees into profiles.
+	processor *postProcessor
 
-func init() {
-	calibrate()
-}
+	// Decides which target invocations are profiled; nil if sampling is disabled.
+	profileSampler *sampler
 
-// callibrate attempts to estimate the mean overhead for invoking time.Now(), time.Since(),
-// as well as the mean time spent in function guard code (stack setup, pushing/popping
-// registers, dealing with deferred calls e.t.c).
-//
-// Runtime overhead is generally in the nanosecond range but we need to
-// properly account for it when calculating the total time spent inside a
-// profiled function as it tends to skew our timing calculations when the profiled
-// function is invoked a large number of times.
-//
-// To calculate an estimate, we time N executions of each function and then just
-// calculate the mean execution time. As outliers may skew our results, using
-// the median execution time would be better but calculating it is not a trivial
-// operation due to the space and timing accurace required.
-func calibrate() {
-	// Benchmark function call time. We use a switch statement to ensure that
-	// the compiler will not inline this function (see https://github.com/golang/go/issues/12312)
-	fnCallBench := func(i int) {
-		switch i {
-		}
-	}
-	tick := time.Now()
-	for i := 0; i < numCalibrationCalls; i++ {
-		fnCallBench(i)
-	}
-	fnCallOverhead = time.Since(tick) / time.Duration(numCalibrationCalls)
+	// The file where Shutdown writes the run statistics; empty if not set.
+	summaryFile string
 
-	// Benchmark deferred function call time
-	deferBench := func(i int) {
-		defer func() { fnCallBench(i) }()
-	}
-	tick = time.Now()
-	for i := 0; i < numCalibrationCalls; i++ {
-		deferBench(i)
-	}
-	deferredFnOverhead = time.Since(tick) / time.Duration(numCalibrationCalls)
+	// The number of forked async calls that have not completed yet. Must
+	// be accessed atomically.
+	pendingAsyncCalls int64
 
-	// Benchmark time.Now()
-	tick = time.Now()
-	for i := 0; i < numCalibrationCalls; i++ {
-		time.Now()
-	}
-	timeNowOverhead = fnCallOverhead + time.Since(tick)/time.Duration(numCalibrationCalls)
+	// Function call invokation overhead; calculated by calibrate() and set up by Init()
+	timeNowOverhead, timeSinceOverhead, deferredFnOverhead, fnCallOverhead time.Duration
+)
 
-	// Benchmark time.Since()
-	tick = time.Now()
-	for i := 0; i < numCalibrationCalls; i++ {
-		time.Since(tick)
+// Init handles the initialization of the prism profiler. This method must be
+// called before invoking any other method from this package. The profiler
+// behavior can be customized by passing one or more Option values.
+//
+// Unless calibration is disabled via WithCalibration, the first call to Init
+// runs a calibration loop for estimating the overhead of the profiler hooks.
+func Init(sink Sink, opts ...Option) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	timeSinceOverhead = fnCallOverhead + time.Since(tick)/time.Duration(numCalibrationCalls)
-}
 
-// Init handles the initialization of the prism profiler. This method must be
-// called before invoking any other method from this package.
-func Init(sink Sink, capturedProfileLabel string) {
-	err := sink.Open(defaultSinkBufferSize)
+	setupCalibration(cfg.calibration, cfg.calibrationCache)
+
+	err := sink.Open(cfg.sinkBufferSize)
 	if err != nil {
 		err = fmt.Errorf("profiler: error initializing sink: %s", err)
 		panic(err)
 	}
 
 	outputSink = sink
-	activeProfiles = make(map[uint64]*fnCall, 0)
-	profileLabel = capturedProfileLabel
+	processor = newPostProcessor(cfg)
+	profileSampler = newSampler(cfg.samplingEvery, cfg.samplingPerSecond)
+	summaryFile = cfg.summaryFile
+	activeProfiles = newProfileMap(defaultProfileMapShards)
+	profileLabel = cfg.label
+	profileTags = cfg.tags
+	atomic.StoreInt64(&pendingAsyncCalls, 0)
 }
 
 // Shutdown waits for shippers to fully dequeue any buffered profiles and shuts
 // them down. This method should be called by main() before the program exits
 // to ensure that no profile data is lost if the program executes too fast.
+//
+// If any async calls are still running, Shutdown waits up to 5 seconds for
+// them to complete. Profiles that are finalized after Shutdown returns are discarded
+// and included in the dropped profile count reported by Stats.
+//
+// If a summary file was specified via WithSummaryFile, Shutdown writes the run
+// statistics to it after closing the sink.
 func Shutdown() {
+	waitForAsyncCalls(asyncShutdownTimeout)
+
+	// Wait for queued call trees to be processed
+	processor.close()
+	if dropped := processor.dropped(); dropped > 0 {
+		fmt.Fprintf(os.Stderr, "profiler: dropped %d profiles due to backpressure\n", dropped)
+	}
+
 	err := outputSink.Close()
 	if err != nil {
 		err = fmt.Errorf("profiler: error shutting downg sink: %s", err)
 		panic(err)
 	}
+
+	if summaryFile != "" {
+		err = writeStats(summaryFile, Stats())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "profiler: could not write run summary to %q due to %s\n", summaryFile, err.Error())
+		}
+	}
 }
 
-// BeginProfile creates a new profile.
+// BeginProfile creates a new profile. If sampling is enabled and this
+// invocation is not sampled, BeginProfile is a no-op.
 func BeginProfile(rootFnName string) {
 	tick := time.Now()
 
+	sampled, sampleRate := profileSampler.sample(rootFnName, tick)
+	if !sampled {
+		return
+	}
+
 	tid := threadID()
 
 	rootCall := makeFnCall(rootFnName)
 	rootCall.enteredAt = tick
+	rootCall.sampleRate = sampleRate
 
-	profileMutex.Lock()
-	activeProfiles[tid] = rootCall
-	profileMutex.Unlock()
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	shard.calls[tid] = rootCall
+	shard.Unlock()
 
 	rootCall.profilerOverhead += timeNowOverhead + timeSinceOverhead + fnCallOverhead + time.Since(tick)
 }
@@ -130,25 +137,179 @@ func EndProfile() {
 	tick := time.Now()
 	tid := threadID()
 
-	profileMutex.Lock()
-	rootCall := activeProfiles[tid]
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	rootCall := shard.calls[tid]
 	if rootCall == nil {
 		// No active profile for this threadID; skip
-		profileMutex.Unlock()
+		shard.Unlock()
 		return
 	}
 
-	delete(activeProfiles, tid)
-	profileMutex.Unlock()
+	delete(shard.calls, tid)
+	shard.Unlock()
 
-	// Generate profile;
+	// Generate and ship profile
 	rootCall.exitedAt = time.Now()
 	rootCall.profilerOverhead += 2*timeNowOverhead + timeSinceOverhead + deferredFnOverhead + time.Since(tick)
-	profile := genProfile(tid, profileLabel, rootCall)
-	rootCall.free()
+	finalizeCallTree(tid, rootCall)
+}
 
-	// Ship profile
-	outputSink.Input() <- profile
+// BeginNestedProfile creates a new profile. If the current go-routine is already
+// capturing a profile, the profile root is also nested into the active profile
+// so that the call shows up in both profiles.
+//
+// If sampling is enabled and this invocation is not sampled, the call is only
+// tracked as part of the active profile (if any) and no new profile is created.
+func BeginNestedProfile(rootFnName string) {
+	tick := time.Now()
+	sampled, sampleRate := profileSampler.sample(rootFnName, tick)
+	tid := threadID()
+
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	parentCall := shard.calls[tid]
+	if !sampled && parentCall == nil {
+		shard.Unlock()
+		return
+	}
+
+	rootCall := makeFnCall(rootFnName)
+	rootCall.enteredAt = tick
+	rootCall.sampleRate = sampleRate
+	rootCall.unsampled = !sampled
+
+	if parentCall != nil {
+		rootCall.nestedProfile = sampled
+		locked := parentCall.lockTree()
+		parentCall.nestCall(rootCall)
+		parentCall.unlockTree(locked)
+	}
+	shard.calls[tid] = rootCall
+	shard.Unlock()
+
+	rootCall.profilerOverhead += timeNowOverhead + timeSinceOverhead + fnCallOverhead + time.Since(tick)
+}
+
+// EndNestedProfile finalizes and ships a profile created by BeginNestedProfile.
+// If the profile was nested into another profile, the call scope is exited
+// and the parent profile remains active.
+func EndNestedProfile() {
+	tick := time.Now()
+	tid := threadID()
+
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	rootCall := shard.calls[tid]
+	if rootCall == nil {
+		// No active profile for this threadID; skip
+		shard.Unlock()
+		return
+	}
+
+	if rootCall.parent == nil {
+		delete(shard.calls, tid)
+	} else {
+		shard.calls[tid] = rootCall.parent
+	}
+	shard.Unlock()
+
+	// If this call was not sampled, exit its scope like Leave does
+	if rootCall.unsampled {
+		rootCall.exitedAt = time.Now()
+		rootCall.profilerOverhead += 2*timeNowOverhead + timeSinceOverhead + deferredFnOverhead + 2*fnCallOverhead + time.Since(tick)
+		rootCall.parent.profilerOverhead += rootCall.profilerOverhead
+		return
+	}
+
+	rootCall.exitedAt = time.Now()
+	rootCall.profilerOverhead += 2*timeNowOverhead + timeSinceOverhead + deferredFnOverhead + time.Since(tick)
+
+	// If this is a top-level profile, generate and ship it once any async
+	// calls forked by it complete.
+	if rootCall.parent == nil {
+		finalizeCallTree(tid, rootCall)
+		return
+	}
+
+	// Otherwise, the call tree is still referenced by the parent profile so
+	// we queue a snapshot of it for post-processing. The snapshot is taken
+	// while holding the call tree lock to prevent completed async calls from
+	// being attached to it. If any async calls forked by this call are still
+	// running, the snapshot is deferred until the last of them completes. The
+	// time spent taking the snapshot is accounted as overhead for the parent.
+	locked := rootCall.lockTree()
+	rootCall.tid = tid
+	if rootCall.pendingAsync > 0 {
+		rootCall.ended = true
+		rootCall.unlockTree(locked)
+	} else {
+		snapshot := rootCall.snapshot()
+		rootCall.unlockTree(locked)
+		processor.enqueue(tid, snapshot)
+	}
+
+	rootCall.parent.profilerOverhead += rootCall.profilerOverhead + timeSinceOverhead + 2*fnCallOverhead + time.Since(rootCall.exitedAt)
+}
+
+// finalizeCallTree is invoked when the root of a call tree exits. If any async
+// calls forked from the call tree are still running, the finalization is
+// deferred until the last of them completes. Profile call trees are then
+// queued for post-processing by a background worker whereas async call trees
+// are attached to the call that forked them.
+func finalizeCallTree(tid uint64, rootCall *fnCall) {
+	rootCall.treeMutex.Lock()
+	rootCall.tid = tid
+	if rootCall.pendingAsync > 0 {
+		rootCall.ended = true
+		rootCall.treeMutex.Unlock()
+		return
+	}
+	rootCall.treeMutex.Unlock()
+
+	if rootCall.asyncParent == nil {
+		processor.enqueue(tid, rootCall)
+		return
+	}
+
+	// Attach async call tree to the forking call and check whether the
+	// call tree that the forking call belongs to can now be finalized
+	parentRoot := rootCall.asyncParent.root
+	parentRoot.treeMutex.Lock()
+	rootCall.asyncParent.nestCall(rootCall)
+	parentRoot.pendingAsync--
+	nestedSnapshots := releaseNestedProfiles(rootCall.asyncParent)
+	finalizeParent := parentRoot.pendingAsync == 0 && parentRoot.ended
+	parentRoot.treeMutex.Unlock()
+
+	for _, snapshot := range nestedSnapshots {
+		processor.enqueue(snapshot.tid, snapshot)
+	}
+
+	if finalizeParent {
+		finalizeCallTree(parentRoot.tid, parentRoot)
+	}
+}
+
+// Decrement the pending async calls of the nested profile roots that enclose
+// call and return snapshots for the nested profiles that have exited and have
+// no more pending async calls. The caller must hold the call tree lock.
+func releaseNestedProfiles(call *fnCall) []*fnCall {
+	var snapshots []*fnCall
+	for ; call != nil; call = call.parent {
+		if !call.nestedProfile {
+			continue
+		}
+
+		call.pendingAsync--
+		if call.pendingAsync == 0 && call.ended {
+			snapshot := call.snapshot()
+			snapshot.tid = call.tid
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	return snapshots
 }
 
 // Enter adds a new nested function call to the profile linked to the current go-routine ID.
@@ -156,20 +317,23 @@ func Enter(fnName string) {
 	tick := time.Now()
 	tid := threadID()
 
-	profileMutex.Lock()
-	parentCall := activeProfiles[tid]
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	parentCall := shard.calls[tid]
 	if parentCall == nil {
 		// No active profile for this threadID; skip
-		profileMutex.Unlock()
+		shard.Unlock()
 		return
 	}
 
 	call := makeFnCall(fnName)
 	call.enteredAt = tick
+	locked := parentCall.lockTree()
 	parentCall.nestCall(call)
+	parentCall.unlockTree(locked)
 
-	activeProfiles[tid] = call
-	profileMutex.Unlock()
+	shard.calls[tid] = call
+	shard.Unlock()
 
 	// Update overhead estimate
 	call.profilerOverhead += timeNowOverhead + timeSinceOverhead + fnCallOverhead + time.Since(tick)
@@ -180,22 +344,23 @@ func Leave() {
 	tick := time.Now()
 	tid := threadID()
 
-	profileMutex.Lock()
-	call := activeProfiles[tid]
+	shard := activeProfiles.shard(tid)
+	shard.Lock()
+	call := shard.calls[tid]
 	if call == nil {
 		// No active profile for this threadID; skip
-		profileMutex.Unlock()
+		shard.Unlock()
 		return
 	}
 
 	if call.parent == nil {
-		profileMutex.Unlock()
+		shard.Unlock()
 		panic(fmt.Sprintf("profiler: [BUG] attempted to exit an active profile (tid %d)", tid))
 	}
 
 	// Exit current scope
-	activeProfiles[tid] = call.parent
-	profileMutex.Unlock()
+	shard.calls[tid] = call.parent
+	shard.Unlock()
 
 	// Update exit timestamp and overhead estimate for the parent. We also add in
 	// an extra fnCallOverhead to account for the pointer dereferencing code for
@@ -204,3 +369,31 @@ func Leave() {
 	call.profilerOverhead += 2*timeNowOverhead + timeSinceOverhead + deferredFnOverhead + 2*fnCallOverhead + time.Since(tick)
 	call.parent.profilerOverhead += call.profilerOverhead
 }
+
+// DroppedProfiles returns the number of captured profiles that were discarded
+// because the post-processing queue was full. Profiles are only discarded when
+// using the BackpressureDrop or BackpressureSample policies.
+func DroppedProfiles() uint64 {
+	if processor == nil {
+		return 0
+	}
+	return processor.dropped()
+}
+
+// Send a profile to the output sink. Profiles are only shipped by the
+// post-processing workers which complete before Shutdown closes the sink.
+func shipProfile(profile *Profile) {
+	outputSink.Input() <- profile
+}
+
+// Wait until all pending async calls complete or the timeout expires.
+func waitForAsyncCalls(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := atomic.LoadInt64(&pendingAsyncCalls)
+		if pending == 0 || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,6 +1,12 @@
 package profiler
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -10,7 +16,7 @@ func TestProfiler(t *testing.T) {
 	nestedCallName := "func2"
 
 	sink := newBufferedSink()
-	Init(sink, "profiler-test")
+	Init(sink, WithLabel("profiler-test"))
 
 	BeginProfile("func1")
 	<-time.After(5 * time.Millisecond)
@@ -71,6 +77,328 @@ func TestProfiler(t *testing.T) {
 	}
 }
 
+func TestProfileLabelAndTags(t *testing.T) {
+	tags := map[string]string{"host": "box"}
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"), WithTags(tags), WithBufferSize(1))
+
+	// Modifying the supplied map should not affect captured profiles
+	tags["host"] = "other"
+
+	BeginProfile("func1")
+	EndProfile()
+	Shutdown()
+
+	if len(sink.buffer) != 1 {
+		t.Fatalf("expected sink to capture 1 entry; got %d", len(sink.buffer))
+	}
+
+	profile := sink.buffer[0]
+	if profile.Label != "profiler-test" {
+		t.Errorf("expected profile label to be %q; got %q", "profiler-test", profile.Label)
+	}
+	if expTags := map[string]string{"host": "box"}; !reflect.DeepEqual(profile.Tags, expTags) {
+		t.Errorf("expected profile tags to be %v; got %v", expTags, profile.Tags)
+	}
+}
+
+func TestNestedProfiles(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+
+	// A nested profile invoked without an active profile should behave
+	// like a regular profile
+	BeginNestedProfile("func2")
+	Enter("func3")
+	Leave()
+	EndNestedProfile()
+
+	// A nested profile invoked while another profile is active should
+	// be shipped separately and also be nested into the active profile
+	BeginProfile("func1")
+	BeginNestedProfile("func2")
+	Enter("func3")
+	Leave()
+	EndNestedProfile()
+	Enter("func4")
+	Leave()
+	EndProfile()
+
+	Shutdown()
+
+	expEntries := 3
+	if len(sink.buffer) != expEntries {
+		t.Fatalf("expected sink to capture %d entries; got %d", expEntries, len(sink.buffer))
+	}
+
+	specs := []struct {
+		Profile       *Profile
+		ExpTarget     string
+		ExpNestedCall []string
+	}{
+		{sink.buffer[0], "func2", []string{"func3"}},
+		{sink.buffer[1], "func2", []string{"func3"}},
+		{sink.buffer[2], "func1", []string{"func2", "func4"}},
+	}
+
+	for specIndex, spec := range specs {
+		if spec.Profile.Target.FnName != spec.ExpTarget {
+			t.Errorf("[spec %d] expected profile target to be %q; got %q", specIndex, spec.ExpTarget, spec.Profile.Target.FnName)
+			continue
+		}
+
+		if len(spec.Profile.Target.NestedCalls) != len(spec.ExpNestedCall) {
+			t.Errorf("[spec %d] expected profile target to capture %d unique nested calls; got %d", specIndex, len(spec.ExpNestedCall), len(spec.Profile.Target.NestedCalls))
+			continue
+		}
+
+		for callIndex, nestedCall := range spec.Profile.Target.NestedCalls {
+			if nestedCall.FnName != spec.ExpNestedCall[callIndex] {
+				t.Errorf("[spec %d] expected nested call %d to be %q; got %q", specIndex, callIndex, spec.ExpNestedCall[callIndex], nestedCall.FnName)
+			}
+		}
+	}
+
+	// The nested profile should also include the calls made by the nested target
+	nestedTarget := sink.buffer[2].Target.NestedCalls[0]
+	if len(nestedTarget.NestedCalls) != 1 || nestedTarget.NestedCalls[0].FnName != "func3" {
+		t.Fatalf("expected nested profile target func2 to include nested call func3 in the func1 profile")
+	}
+}
+
+func BenchmarkHooks(b *testing.B) {
+	defer func(offset int) {
+		goidOffset = offset
+	}(goidOffset)
+
+	specs := []struct {
+		Name     string
+		FastPath bool
+	}{
+		{"stack-thread-id", false},
+		{"fast-thread-id", true},
+	}
+
+	detectedOffset := goidOffset
+	for _, spec := range specs {
+		b.Run(spec.Name, func(b *testing.B) {
+			goidOffset = -1
+			if spec.FastPath {
+				if detectedOffset < 0 {
+					b.Skip("goroutine id fast path is not supported on this platform")
+				}
+				goidOffset = detectedOffset
+			}
+
+			sink := newBufferedSink()
+			Init(sink, WithLabel("profiler-bench"))
+			defer Shutdown()
+
+			BeginProfile("bench")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				Enter("func1")
+				Leave()
+			}
+			b.StopTimer()
+			EndProfile()
+		})
+	}
+}
+
+func TestConcurrentProfiles(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"))
+
+	numWorkers := 32
+	numCalls := 50
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for worker := 0; worker < numWorkers; worker++ {
+		go func() {
+			defer wg.Done()
+
+			BeginProfile("func1")
+			for call := 0; call < numCalls; call++ {
+				Enter("func2")
+				BeginNestedProfile("func3")
+				Enter("func4")
+				Leave()
+				EndNestedProfile()
+				Leave()
+			}
+			EndProfile()
+		}()
+	}
+	wg.Wait()
+	Shutdown()
+
+	// Each worker ships one profile per nested profile invocation and one for func1
+	expEntries := numWorkers * (numCalls + 1)
+	if len(sink.buffer) != expEntries {
+		t.Fatalf("expected sink to capture %d entries; got %d", expEntries, len(sink.buffer))
+	}
+
+	tids := make(map[uint64]struct{}, 0)
+	for _, profile := range sink.buffer {
+		if profile.Target.FnName != "func1" {
+			continue
+		}
+		tids[profile.ID] = struct{}{}
+
+		if len(profile.Target.NestedCalls) != 1 || profile.Target.NestedCalls[0].Invocations != numCalls {
+			t.Fatalf("expected profile for tid %d to include %d invocations of func2", profile.ID, numCalls)
+		}
+		nestedTarget := profile.Target.NestedCalls[0].NestedCalls
+		if len(nestedTarget) != 1 || nestedTarget[0].FnName != "func3" || nestedTarget[0].Invocations != numCalls {
+			t.Fatalf("expected profile for tid %d to include %d invocations of func3", profile.ID, numCalls)
+		}
+	}
+
+	if len(tids) != numWorkers {
+		t.Fatalf("expected to capture func1 profiles from %d distinct go-routines; got %d", numWorkers, len(tids))
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	summaryFile := filepath.Join(tmpDir, "summary.json")
+	sink := &statsSink{bufferedSink: *newBufferedSink()}
+	Init(sink, WithLabel("profiler-test"), WithSummaryFile(summaryFile))
+
+	BeginProfile("func1")
+	EndProfile()
+
+	// Profiles finalized after Shutdown are discarded
+	BeginProfile("func2")
+	Shutdown()
+	EndProfile()
+
+	data, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats RunStats
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expStats := RunStats{Sink: SinkStats{Received: 1, Written: 1}}
+	if stats != expStats {
+		t.Errorf("expected run summary to be %+v; got %+v", expStats, stats)
+	}
+
+	expStats.Dropped = 1
+	if stats = Stats(); stats != expStats {
+		t.Errorf("expected run stats to be %+v; got %+v", expStats, stats)
+	}
+	if lost := stats.Lost(); lost != 1 {
+		t.Errorf("expected lost profile count to be 1; got %d", lost)
+	}
+}
+
+// A bufferedSink that reports stats.
+type statsSink struct {
+	bufferedSink
+}
+
+func (s *statsSink) Stats() SinkStats {
+	return SinkStats{
+		Received: uint64(len(s.buffer)),
+		Written:  uint64(len(s.buffer)),
+	}
+}
+
+func TestSampledProfiles(t *testing.T) {
+	sink := newBufferedSink()
+	Init(sink, WithLabel("profiler-test"), WithSampling(2))
+
+	for iteration := 0; iteration < 3; iteration++ {
+		BeginProfile("func1")
+		for call := 0; call < 2; call++ {
+			BeginNestedProfile("func2")
+			Enter("func3")
+			Leave()
+			EndNestedProfile()
+		}
+		EndProfile()
+	}
+	Shutdown()
+
+	// func1 is sampled on the 1st and 3rd iteration. func2 is sampled on
+	// its 1st, 3rd and 6th invocation; its 2nd and 5th invocations are
+	// tracked as part of the func1 profile and the 4th is skipped.
+	expRates := map[string][]float64{
+		"func1": {1, 2},
+		"func2": {1, 2, 2},
+	}
+
+	rates := make(map[string][]float64, 0)
+	for _, profile := range sink.buffer {
+		fnName := profile.Target.FnName
+		rates[fnName] = append(rates[fnName], profile.SampleRate)
+
+		if fnName != "func1" {
+			continue
+		}
+		if len(profile.Target.NestedCalls) != 1 || profile.Target.NestedCalls[0].Invocations != 2 {
+			t.Fatalf("expected sampled func1 profile to include 2 invocations of func2")
+		}
+		if nested := profile.Target.NestedCalls[0].NestedCalls; len(nested) != 1 || nested[0].Invocations != 2 {
+			t.Fatalf("expected sampled func1 profile to include 2 invocations of func3")
+		}
+	}
+
+	for fnName, expFnRates := range expRates {
+		fnRates := rates[fnName]
+		sort.Float64s(fnRates)
+		if !reflect.DeepEqual(fnRates, expFnRates) {
+			t.Errorf("expected %q profiles to have sample rates %v; got %v", fnName, expFnRates, fnRates)
+		}
+	}
+}
+
+func BenchmarkConcurrentHooks(b *testing.B) {
+	specs := []struct {
+		Name      string
+		NumShards int
+	}{
+		{"single-shard", 1},
+		{"sharded", defaultProfileMapShards},
+	}
+
+	for _, spec := range specs {
+		b.Run(spec.Name, func(b *testing.B) {
+			sink := newBufferedSink()
+			Init(sink, WithLabel("profiler-bench"))
+			defer Shutdown()
+
+			// A single shard is equivalent to guarding all profiles with a global lock
+			activeProfiles = newProfileMap(spec.NumShards)
+
+			// Run many more profiled go-routines than CPUs
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				BeginProfile("bench")
+				for pb.Next() {
+					Enter("func1")
+					Leave()
+				}
+				EndProfile()
+			})
+		})
+	}
+}
+
 type bufferedSink struct {
 	sigChan   chan struct{}
 	inputChan chan *Profile
@@ -0,0 +1,96 @@
+package profiler
+
+import (
+	"sync"
+	"time"
+)
+
+// sampler decides which invocations of each profile target should be profiled.
+// Sampling decisions are made independently for each target.
+type sampler struct {
+	// Profile one in every `every` invocations of each target.
+	every int
+
+	// The max number of profiles per second to capture for each target.
+	perSecond float64
+
+	// A map of target names to *targetSampler instances.
+	targets sync.Map
+}
+
+// The sampling state for a particular profile target.
+type targetSampler struct {
+	sync.Mutex
+
+	// The number of invocations since the last sampled invocation and
+	// whether any invocation has been sampled yet.
+	seen    int
+	sampled bool
+
+	// A token bucket for limiting the number of sampled invocations per second.
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Create a new sampler that profiles one in every `every` invocations and at
+// most perSecond invocations per second for each target. If neither limit is
+// set, newSampler returns a nil sampler which profiles all invocations.
+func newSampler(every int, perSecond float64) *sampler {
+	if every <= 1 && perSecond <= 0 {
+		return nil
+	}
+
+	return &sampler{
+		every:     every,
+		perSecond: perSecond,
+	}
+}
+
+// Check whether an invocation of the specified target at time now should be
+// profiled. For sampled invocations, sample also returns back the number of
+// target invocations (including this one) represented by the profile. Invoking
+// sample on a nil sampler always returns true.
+func (s *sampler) sample(target string, now time.Time) (bool, float64) {
+	if s == nil {
+		return true, 0
+	}
+
+	ts, exists := s.targets.Load(target)
+	if !exists {
+		ts, _ = s.targets.LoadOrStore(target, &targetSampler{
+			tokens:     1,
+			lastRefill: now,
+		})
+	}
+
+	return ts.(*targetSampler).sample(s.every, s.perSecond, now)
+}
+
+func (ts *targetSampler) sample(every int, perSecond float64, now time.Time) (bool, float64) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	// Always sample the first invocation and then every Nth invocation
+	ts.seen++
+	if ts.sampled && ts.seen < every {
+		return false, 0
+	}
+
+	if perSecond > 0 {
+		ts.tokens += now.Sub(ts.lastRefill).Seconds() * perSecond
+		if ts.tokens > 1 {
+			ts.tokens = 1
+		}
+		ts.lastRefill = now
+
+		if ts.tokens < 1 {
+			return false, 0
+		}
+		ts.tokens--
+	}
+
+	rate := float64(ts.seen)
+	ts.seen = 0
+	ts.sampled = true
+	return true, rate
+}
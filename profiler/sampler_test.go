@@ -0,0 +1,63 @@
+package profiler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSamplerDisabled(t *testing.T) {
+	s := newSampler(1, 0)
+	if s != nil {
+		t.Fatal("expected newSampler to return a nil sampler when sampling is disabled")
+	}
+
+	sampled, rate := s.sample("foo", time.Now())
+	if !sampled || rate != 0 {
+		t.Fatalf("expected nil sampler to sample all invocations with a zero rate; got %t, %f", sampled, rate)
+	}
+}
+
+func TestSamplerEveryN(t *testing.T) {
+	s := newSampler(3, 0)
+	now := time.Now()
+
+	// The first invocation and every 3rd invocation after it should be sampled
+	expRates := []float64{1, 0, 0, 3, 0, 0, 3}
+	for index, expRate := range expRates {
+		sampled, rate := s.sample("foo", now)
+		if sampled != (expRate != 0) || rate != expRate {
+			t.Errorf("[invocation %d] expected sampled=%t with rate %f; got sampled=%t with rate %f", index, expRate != 0, expRate, sampled, rate)
+		}
+	}
+
+	// Targets are sampled independently
+	sampled, rate := s.sample("bar", now)
+	if !sampled || rate != 1 {
+		t.Errorf("expected first invocation of another target to be sampled with rate 1; got sampled=%t with rate %f", sampled, rate)
+	}
+}
+
+func TestSamplerPerSecond(t *testing.T) {
+	s := newSampler(0, 2)
+	now := time.Now()
+
+	specs := []struct {
+		offset  time.Duration
+		expRate float64
+	}{
+		{0, 1},
+		{100 * time.Millisecond, 0},
+		{300 * time.Millisecond, 0},
+		// 0.6 sec elapsed since first sample; bucket is full again
+		{600 * time.Millisecond, 3},
+		{700 * time.Millisecond, 0},
+		{1200 * time.Millisecond, 2},
+	}
+
+	for specIndex, spec := range specs {
+		sampled, rate := s.sample("foo", now.Add(spec.offset))
+		if sampled != (spec.expRate != 0) || rate != spec.expRate {
+			t.Errorf("[spec %d] expected sampled=%t with rate %f; got sampled=%t with rate %f", specIndex, spec.expRate != 0, spec.expRate, sampled, rate)
+		}
+	}
+}
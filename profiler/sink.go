@@ -11,3 +11,12 @@ type Sink interface {
 	// Get a channel for piping profile entries to the sink.
 	Input() chan<- *Profile
 }
+
+// StatsReporter is implemented by sinks that keep track of the number of
+// profiles that they received, persisted or failed to persist.
+type StatsReporter interface {
+	// Get the current sink statistics. It must be safe to call Stats
+	// concurrently with the sink processing profiles and after the sink
+	// has been closed.
+	Stats() SinkStats
+}
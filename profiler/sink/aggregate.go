@@ -0,0 +1,146 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+type aggregatingSink struct {
+	statsCounter
+	inner         profiler.Sink
+	flushInterval time.Duration
+	sigChan       chan struct{}
+	inputChan     chan *profiler.Profile
+
+	// The profiles received since the last flush merged by target name.
+	// The targetOrder slice tracks the order in which targets were first
+	// seen so that flushes are deterministic.
+	pending     map[string]*profiler.Profile
+	targetOrder []string
+}
+
+// NewAggregatingSink creates a profile entry sink instance which merges
+// incoming profiles for the same target as they arrive and forwards a single
+// consolidated profile per target to the inner sink every flushInterval. Any
+// pending profiles are also flushed when the sink is closed. If flushInterval
+// is not positive, profiles are only flushed when the sink is closed.
+//
+// The inner sink is opened and closed by the aggregating sink.
+func NewAggregatingSink(inner profiler.Sink, flushInterval time.Duration) profiler.Sink {
+	return &aggregatingSink{
+		inner:         inner,
+		flushInterval: flushInterval,
+		sigChan:       make(chan struct{}, 0),
+		pending:       make(map[string]*profiler.Profile, 0),
+	}
+}
+
+// Initialize the sink.
+func (s *aggregatingSink) Open(inputBufferSize int) error {
+	err := s.inner.Open(inputBufferSize)
+	if err != nil {
+		return err
+	}
+
+	s.inputChan = make(chan *profiler.Profile, inputBufferSize)
+
+	// start worker and wait for ready signal
+	go s.worker()
+	<-s.sigChan
+	return nil
+}
+
+// Shutdown the sink.
+func (s *aggregatingSink) Close() error {
+	// Signal worker to exit and wait for confirmation
+	close(s.inputChan)
+	<-s.sigChan
+	close(s.sigChan)
+
+	return s.inner.Close()
+}
+
+// Get a channel for piping profile entries to the sink.
+func (s *aggregatingSink) Input() chan<- *profiler.Profile {
+	return s.inputChan
+}
+
+// Get the sink statistics. The received count includes all profiles received
+// by the aggregating sink whereas the written and dropped counts refer to the
+// consolidated profiles processed by the inner sink (if it reports stats).
+// Errors from both sinks are included in the errored count.
+func (s *aggregatingSink) Stats() profiler.SinkStats {
+	stats := s.statsCounter.Stats()
+	if reporter, ok := s.inner.(profiler.StatsReporter); ok {
+		innerStats := reporter.Stats()
+		stats.Written = innerStats.Written
+		stats.Dropped = innerStats.Dropped
+		stats.Errored += innerStats.Errored
+	}
+
+	return stats
+}
+
+func (s *aggregatingSink) worker() {
+	// Signal that worker has started
+	s.sigChan <- struct{}{}
+	defer func() {
+		// Flush any pending profiles and signal that we have stopped
+		s.flush()
+		s.sigChan <- struct{}{}
+	}()
+
+	var flushChan <-chan time.Time
+	if s.flushInterval > 0 {
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		flushChan = ticker.C
+	}
+
+	for {
+		select {
+		case profile, sinkOpen := <-s.inputChan:
+			if !sinkOpen {
+				return
+			}
+
+			s.incReceived()
+			s.add(profile)
+		case <-flushChan:
+			s.flush()
+		}
+	}
+}
+
+// Fold a profile into the pending merged profile for its target so that
+// memory usage does not grow with the number of received profiles.
+func (s *aggregatingSink) add(profile *profiler.Profile) {
+	fnName := profile.Target.FnName
+	acc, exists := s.pending[fnName]
+	if !exists {
+		s.targetOrder = append(s.targetOrder, fnName)
+		s.pending[fnName] = profile
+		return
+	}
+
+	merged, err := profiler.MergeProfiles(acc, profile)
+	if err != nil {
+		s.addErrored(1)
+		fmt.Fprintf(os.Stderr, "profiler: could not aggregate profile for %q due to %s; dropping profile\n", fnName, err.Error())
+		return
+	}
+	s.pending[fnName] = merged
+}
+
+// Forward the pending merged profile for each target to the inner sink.
+func (s *aggregatingSink) flush() {
+	for _, fnName := range s.targetOrder {
+		s.inner.Input() <- s.pending[fnName]
+	}
+
+	s.pending = make(map[string]*profiler.Profile, 0)
+	s.targetOrder = s.targetOrder[:0]
+}
@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+// A sink that collects the profiles it receives so tests can inspect them. A
+// signal is emitted to the buffered sigChan for each received profile.
+type captureSink struct {
+	sigChan   chan struct{}
+	inputChan chan *profiler.Profile
+	profiles  []*profiler.Profile
+	closed    bool
+}
+
+func newCaptureSink() *captureSink {
+	return &captureSink{
+		sigChan: make(chan struct{}, 100),
+	}
+}
+
+func (s *captureSink) Open(inputBufferSize int) error {
+	s.inputChan = make(chan *profiler.Profile, inputBufferSize)
+	go func() {
+		for profile := range s.inputChan {
+			s.profiles = append(s.profiles, profile)
+			s.sigChan <- struct{}{}
+		}
+		close(s.sigChan)
+	}()
+	return nil
+}
+
+func (s *captureSink) Close() error {
+	close(s.inputChan)
+	for range s.sigChan {
+	}
+	s.closed = true
+	return nil
+}
+
+func (s *captureSink) Input() chan<- *profiler.Profile {
+	return s.inputChan
+}
+
+func mockSampledProfile(fnName string, samples ...time.Duration) *profiler.Profile {
+	hist := &profiler.Histogram{}
+	for _, sample := range samples {
+		hist.Record(sample)
+	}
+
+	return &profiler.Profile{
+		Target: &profiler.CallMetrics{
+			FnName:      fnName,
+			TotalTime:   hist.Sum,
+			Invocations: len(samples),
+			Histogram:   hist,
+		},
+	}
+}
+
+func TestAggregatingSinkFlushOnClose(t *testing.T) {
+	inner := newCaptureSink()
+	s := NewAggregatingSink(inner, 0)
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Input() <- mockSampledProfile("foo", 10*time.Millisecond)
+	s.Input() <- mockSampledProfile("bar", 5*time.Millisecond)
+	s.Input() <- mockSampledProfile("foo", 20*time.Millisecond, 30*time.Millisecond)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !inner.closed {
+		t.Error("expected inner sink to be closed")
+	}
+
+	expStats := profiler.SinkStats{Received: 3}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+
+	specs := []struct {
+		fnName      string
+		invocations int
+		total       time.Duration
+		merged      int
+	}{
+		{"foo", 3, 60 * time.Millisecond, 2},
+		{"bar", 1, 5 * time.Millisecond, 0},
+	}
+
+	if len(inner.profiles) != len(specs) {
+		t.Fatalf("expected inner sink to receive %d profiles; got %d", len(specs), len(inner.profiles))
+	}
+
+	for specIndex, spec := range specs {
+		profile := inner.profiles[specIndex]
+		if profile.Target.FnName != spec.fnName {
+			t.Errorf("[spec %d] expected target name to be %q; got %q", specIndex, spec.fnName, profile.Target.FnName)
+		}
+		if profile.Target.Invocations != spec.invocations {
+			t.Errorf("[spec %d] expected invocations to be %d; got %d", specIndex, spec.invocations, profile.Target.Invocations)
+		}
+		if profile.Target.TotalTime != spec.total {
+			t.Errorf("[spec %d] expected total time to be %v; got %v", specIndex, spec.total, profile.Target.TotalTime)
+		}
+		if profile.MergedProfiles != spec.merged {
+			t.Errorf("[spec %d] expected merged profile count to be %d; got %d", specIndex, spec.merged, profile.MergedProfiles)
+		}
+	}
+}
+
+func TestAggregatingSinkPeriodicFlush(t *testing.T) {
+	inner := newCaptureSink()
+	s := NewAggregatingSink(inner, 10*time.Millisecond)
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Input() <- mockSampledProfile("foo", 10*time.Millisecond)
+	s.Input() <- mockSampledProfile("foo", 20*time.Millisecond)
+
+	// Wait for the flushed profile to reach the inner sink
+	select {
+	case <-inner.sigChan:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for periodic flush")
+	}
+
+	s.Input() <- mockSampledProfile("foo", 30*time.Millisecond)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Depending on timing, the first two profiles may end up in separate
+	// flushes but all invocations must be accounted for
+	if len(inner.profiles) < 2 {
+		t.Fatalf("expected inner sink to receive at least 2 profiles; got %d", len(inner.profiles))
+	}
+
+	invocations := 0
+	for _, profile := range inner.profiles {
+		invocations += profile.Target.Invocations
+	}
+	if invocations != 3 {
+		t.Errorf("expected flushed profiles to contain 3 invocations; got %d", invocations)
+	}
+}
+
+func TestAggregatingSinkMergeError(t *testing.T) {
+	inner := newCaptureSink()
+	s := NewAggregatingSink(inner, 0)
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Input() <- mockSampledProfile("foo", 10*time.Millisecond)
+	s.Input() <- &profiler.Profile{Target: &profiler.CallMetrics{FnName: "foo", Invocations: 1}}
+	s.Input() <- mockSampledProfile("foo", 20*time.Millisecond)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the profile without an invocation time histogram should be dropped
+	expStats := profiler.SinkStats{Received: 3, Errored: 1}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+
+	if len(inner.profiles) != 1 {
+		t.Fatalf("expected inner sink to receive 1 profile; got %d", len(inner.profiles))
+	}
+	if profile := inner.profiles[0]; profile.Target.Invocations != 2 || profile.MergedProfiles != 2 {
+		t.Errorf("expected merged profile to contain 2 profiles with 2 invocations; got %d profiles with %d invocations", profile.MergedProfiles, profile.Target.Invocations)
+	}
+}
@@ -3,13 +3,15 @@ package sink
 import "github.com/geckoboard/prism/profiler"
 
 type discardSink struct {
+	statsCounter
 	sigChan      chan struct{}
 	inputChan    chan *profiler.Profile
 	numDiscarded int
 }
 
 // NewDiscardSink creates a profile entry sink instance which discards all
-// incoming profile entries.
+// incoming profile entries. Discarded entries are reported as dropped by the
+// sink's Stats method.
 func NewDiscardSink() profiler.Sink {
 	return &discardSink{
 		sigChan: make(chan struct{}, 0),
@@ -54,5 +56,7 @@ func (s *discardSink) worker() {
 			return
 		}
 		s.numDiscarded++
+		s.incReceived()
+		s.incDropped()
 	}
 }
@@ -27,4 +27,9 @@ func TestDiscardSink(t *testing.T) {
 	if numDiscarded != numEntries {
 		t.Errorf("expected sink discarded entry count to be %d; got %d", numEntries, numDiscarded)
 	}
+
+	expStats := profiler.SinkStats{Received: uint64(numEntries), Dropped: uint64(numEntries)}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
 }
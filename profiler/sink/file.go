@@ -1,11 +1,11 @@
 package sink
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	"github.com/geckoboard/prism/profiler"
 )
@@ -15,18 +15,76 @@ var (
 	badCharRegex  = regexp.MustCompile(`[\./\\]`)
 )
 
+// FileSinkOptions configures the retention and output format of a sink
+// created by NewFileSinkWithOptions. Zero-valued limits are not enforced.
+type FileSinkOptions struct {
+	// The max number of profile files to retain in the output folder.
+	MaxFiles int
+
+	// The max total size in bytes of the profile files in the output folder.
+	MaxBytes int64
+
+	// The max age of the profile files in the output folder. Expired files
+	// are deleted when the sink is opened or closed and whenever a profile
+	// is written; an idle sink does not delete files in the meantime.
+	MaxAge time.Duration
+
+	// The encoding for profile files. Defaults to profiler.FormatJSON.
+	Format profiler.ProfileFormat
+
+	// Append profiles for each target to a single JSON Lines stream named
+	// profile-target.jsonl instead of writing one file per profile. The
+	// Format option does not apply to streams.
+	JSONLines bool
+
+	// When using JSONLines, rotate a stream once its size would exceed
+	// MaxStreamBytes. Rotated streams are renamed to
+	// profile-target.timestamp.jsonl. Defaults to 10MB; if MaxBytes is set,
+	// it is capped to MaxBytes so that a single stream cannot exceed it.
+	MaxStreamBytes int64
+}
+
 type fileSink struct {
+	statsCounter
 	outputDir string
+	opts      FileSinkOptions
 	sigChan   chan struct{}
 	inputChan chan *profiler.Profile
+
+	// The retention policy for profile files; nil if no limits are set.
+	retention *retentionPolicy
+
+	// The open JSON Lines streams for each target.
+	streams map[string]*profileStream
 }
 
 // NewFileSink creates a new profile entry sink instance which stores profiles
-// to disk at the folder specified by outputDir.
+// to disk at the folder specified by outputDir. Profiles that cannot be stored
+// are reported as errored by the sink's Stats method.
 func NewFileSink(outputDir string) profiler.Sink {
+	return NewFileSinkWithOptions(outputDir, FileSinkOptions{})
+}
+
+// NewFileSinkWithOptions creates a file sink that enforces the retention
+// limits specified by opts. Whenever a limit is exceeded, the oldest profile
+// files in outputDir (including any files written by previous runs) are
+// deleted until the limits are satisfied again. Active JSON Lines streams
+// count towards the MaxFiles and MaxBytes limits but are never deleted; only
+// rotated streams are evicted to make room for them.
+func NewFileSinkWithOptions(outputDir string, opts FileSinkOptions) profiler.Sink {
+	if opts.JSONLines && opts.MaxStreamBytes <= 0 {
+		opts.MaxStreamBytes = defaultMaxStreamBytes
+	}
+	if opts.JSONLines && opts.MaxBytes > 0 && opts.MaxStreamBytes > opts.MaxBytes {
+		opts.MaxStreamBytes = opts.MaxBytes
+	}
+
 	return &fileSink{
 		outputDir: outputDir,
+		opts:      opts,
 		sigChan:   make(chan struct{}, 0),
+		retention: newRetentionPolicy(opts),
+		streams:   make(map[string]*profileStream, 0),
 	}
 }
 
@@ -39,6 +97,14 @@ func (s *fileSink) Open(inputBufferSize int) error {
 	}
 	fmt.Fprintf(os.Stderr, "profiler: saving profiles to %s\n", s.outputDir)
 
+	// Track any profile files written by previous runs and apply the
+	// retention limits to them
+	err = s.retention.scan(s.outputDir)
+	if err != nil {
+		return err
+	}
+	s.retention.enforce(time.Now())
+
 	s.inputChan = make(chan *profiler.Profile, inputBufferSize)
 
 	// start worker and wait for ready signal
@@ -53,7 +119,12 @@ func (s *fileSink) Close() error {
 	close(s.inputChan)
 	<-s.sigChan
 	close(s.sigChan)
-	return nil
+
+	s.retention.enforce(time.Now())
+	if evicted := s.retention.evicted(); evicted > 0 {
+		fmt.Fprintf(os.Stderr, "profiler: deleted %d old profile files to enforce retention limits\n", evicted)
+	}
+	return s.closeStreams()
 }
 
 // Get a channel for piping profile entries to the sink.
@@ -75,23 +146,48 @@ func (s *fileSink) worker() {
 			return
 		}
 
-		fpath := outputFile(s.outputDir, profile, "json")
-		f, err := os.Create(fpath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "profiler: could not create output file %q due to %s; dropping profile\n", fpath, err.Error())
-			continue
-		}
+		s.incReceived()
 
-		data, err := json.Marshal(profile)
+		var err error
+		if s.opts.JSONLines {
+			err = s.appendToStream(profile)
+		} else {
+			fpath := outputFile(s.outputDir, profile, s.opts.Format.Extension())
+			err = writeProfile(fpath, profile, s.opts.Format)
+			if err == nil {
+				s.retention.track(fpath)
+			}
+		}
+		s.retention.enforce(time.Now())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "profiler: error marshalling profile: %s; dropping profile\n", err.Error())
+			s.addErrored(1)
+			fmt.Fprintf(os.Stderr, "profiler: %s; dropping profile\n", err.Error())
 			continue
 		}
-		f.Write(data)
-		f.Close()
+		s.incWritten()
 	}
 }
 
+// Write a profile to a file using the specified encoding.
+func writeProfile(fpath string, profile *profiler.Profile, format profiler.ProfileFormat) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("could not create output file %q due to %s", fpath, err.Error())
+	}
+
+	err = profiler.EncodeProfile(f, profile, format)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a truncated profile behind
+		os.Remove(fpath)
+		return fmt.Errorf("could not write output file %q due to %s", fpath, err.Error())
+	}
+
+	return nil
+}
+
 // Construct the path to a profile file for this entry. This function will
 // also pass the path through filepath.Clean to ensure that the proper slashes
 // are used depending on the host OS.
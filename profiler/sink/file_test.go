@@ -1,13 +1,16 @@
 package sink
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/geckoboard/prism/profiler"
 )
@@ -57,6 +60,11 @@ func TestFileSink(t *testing.T) {
 		t.Errorf("expected number of written files to be %d; got %d", numEntries, len(fileList))
 	}
 
+	expStats := profiler.SinkStats{Received: uint64(numEntries), Written: uint64(numEntries)}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+
 	for _, fpath := range fileList {
 		fname := strings.TrimSuffix(fpath[len(tmpDir)+1:], ".json")
 		if !strings.HasPrefix(fname, profilePrefix) {
@@ -69,3 +77,333 @@ func TestFileSink(t *testing.T) {
 		}
 	}
 }
+
+func TestFileSinkWriteErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := NewFileSink(tmpDir)
+	err = s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the output folder so that profiles cannot be written
+	os.RemoveAll(tmpDir)
+
+	s.Input() <- &profiler.Profile{
+		Target: &profiler.CallMetrics{FnName: "foo"},
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expStats := profiler.SinkStats{Received: 1, Errored: 1}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+}
+
+func TestWriteProfileRemovesPartialFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// NaN values cannot be encoded as JSON
+	fpath := filepath.Join(tmpDir, profilePrefix+"foo-0-0.json")
+	err = writeProfile(fpath, &profiler.Profile{
+		Target: &profiler.CallMetrics{FnName: "foo", StdDev: math.NaN()},
+	}, profiler.FormatJSON)
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if _, err = os.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("expected partially written profile file to be removed; got %v", err)
+	}
+}
+
+func TestFileSinkRetentionOnOpen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	oldFile := filepath.Join(tmpDir, profilePrefix+"foo-0-0.json")
+	err = ioutil.WriteFile(oldFile, []byte(`{}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(oldFile, oldTime, oldTime)
+
+	s := NewFileSinkWithOptions(tmpDir, FileSinkOptions{MaxAge: time.Hour})
+	err = s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired files are deleted even if the sink never receives a profile
+	if _, err = os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("expected expired profile file to be deleted when opening the sink; got %v", err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted := s.(*fileSink).retention.evicted(); evicted != 1 {
+		t.Errorf("expected sink to delete 1 file; got %d", evicted)
+	}
+}
+
+func TestFileSinkRetention(t *testing.T) {
+	// All generated profiles have the same encoded size
+	data, err := json.Marshal(&profiler.Profile{Target: &profiler.CallMetrics{FnName: "foo-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profileSize := int64(len(data))
+
+	specs := []struct {
+		opts        FileSinkOptions
+		expFiles    []string
+		expEvicted  int
+		expMaxBytes int64
+	}{
+		// The file left over by a previous run is the oldest one
+		{FileSinkOptions{MaxFiles: 3}, []string{"foo-3", "foo-4", "foo-5"}, 3, 0},
+		{FileSinkOptions{MaxBytes: 2*profileSize + 1}, []string{"foo-4", "foo-5"}, 4, 2*profileSize + 1},
+		{FileSinkOptions{MaxAge: time.Hour}, []string{"foo-1", "foo-2", "foo-3", "foo-4", "foo-5"}, 1, 0},
+	}
+
+	for specIndex, spec := range specs {
+		tmpDir, err := ioutil.TempDir("", "prism-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		oldFile := filepath.Join(tmpDir, profilePrefix+"foo-0-0.json")
+		err = ioutil.WriteFile(oldFile, []byte(`{}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldTime := time.Now().Add(-2 * time.Hour)
+		os.Chtimes(oldFile, oldTime, oldTime)
+
+		s := NewFileSinkWithOptions(tmpDir, spec.opts)
+		err = s.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 5; i++ {
+			s.Input() <- &profiler.Profile{
+				CreatedAt: time.Unix(0, int64(i)),
+				Target:    &profiler.CallMetrics{FnName: fmt.Sprintf("foo-%d", i)},
+			}
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileList, err := filepath.Glob(tmpDir + "/*.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fnNames []string
+		var totalBytes int64
+		for _, fpath := range fileList {
+			info, err := os.Stat(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			totalBytes += info.Size()
+
+			name := strings.TrimPrefix(filepath.Base(fpath), profilePrefix)
+			fnNames = append(fnNames, name[:len("foo-1")])
+		}
+
+		if got, exp := strings.Join(fnNames, ","), strings.Join(spec.expFiles, ","); got != exp {
+			t.Errorf("[spec %d] expected retained profiles to be %s; got %s", specIndex, exp, got)
+		}
+		if spec.expMaxBytes > 0 && totalBytes > spec.expMaxBytes {
+			t.Errorf("[spec %d] expected retained profiles to use at most %d bytes; got %d", specIndex, spec.expMaxBytes, totalBytes)
+		}
+		if evicted := s.(*fileSink).retention.evicted(); evicted != spec.expEvicted {
+			t.Errorf("[spec %d] expected sink to delete %d files; got %d", specIndex, spec.expEvicted, evicted)
+		}
+	}
+}
+
+func TestFileSinkJSONLines(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := NewFileSinkWithOptions(tmpDir, FileSinkOptions{JSONLines: true, MaxStreamBytes: 1000, MaxFiles: 4})
+	err = s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numEntries := 10
+	for i := 0; i < numEntries; i++ {
+		s.Input() <- mockSampledProfile("foo/bar.baz", time.Millisecond)
+	}
+	s.Input() <- mockSampledProfile("other", time.Millisecond)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeFile := filepath.Join(tmpDir, profilePrefix+"foo_bar_baz.jsonl")
+	rotatedFiles, err := filepath.Glob(filepath.Join(tmpDir, profilePrefix+"foo_bar_baz.*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotatedFiles) != 2 {
+		t.Fatalf("expected 2 rotated streams to be retained; got %d", len(rotatedFiles))
+	}
+	if _, err = os.Stat(filepath.Join(tmpDir, profilePrefix+"other.jsonl")); err != nil {
+		t.Errorf("expected a separate stream for the other target; got %v", err)
+	}
+
+	for _, fpath := range append(rotatedFiles, activeFile) {
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 1000 {
+			t.Errorf("[%s] expected stream size to be at most 1000 bytes; got %d", fpath, len(data))
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var profile *profiler.Profile
+			err = json.Unmarshal([]byte(line), &profile)
+			if err != nil {
+				t.Fatalf("[%s] could not decode profile line %q: %v", fpath, line, err)
+			}
+			if profile.Target.FnName != "foo/bar.baz" {
+				t.Errorf("[%s] expected profile target to be %q; got %q", fpath, "foo/bar.baz", profile.Target.FnName)
+			}
+		}
+	}
+
+	expStats := profiler.SinkStats{Received: uint64(numEntries + 1), Written: uint64(numEntries + 1)}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+}
+
+func TestFileSinkJSONLinesRetention(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// An active stream left over by a previous run counts towards the limits
+	leftoverStream := filepath.Join(tmpDir, profilePrefix+"leftover.jsonl")
+	err = ioutil.WriteFile(leftoverStream, []byte(strings.Repeat(" ", 500)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxBytes := int64(2500)
+	s := NewFileSinkWithOptions(tmpDir, FileSinkOptions{JSONLines: true, MaxBytes: maxBytes})
+	if maxStreamBytes := s.(*fileSink).opts.MaxStreamBytes; maxStreamBytes != maxBytes {
+		t.Errorf("expected max stream size to be capped to %d; got %d", maxBytes, maxStreamBytes)
+	}
+	s.(*fileSink).opts.MaxStreamBytes = 1000
+
+	err = s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		s.Input() <- mockSampledProfile("foo", time.Millisecond)
+		s.Input() <- mockSampledProfile("bar", time.Millisecond)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams, err := filepath.Glob(filepath.Join(tmpDir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var totalBytes int64
+	for _, fpath := range streams {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalBytes += info.Size()
+	}
+	if totalBytes > maxBytes {
+		t.Errorf("expected streams to use at most %d bytes; got %d", maxBytes, totalBytes)
+	}
+
+	// Active streams are never deleted
+	for _, fnName := range []string{"leftover", "foo", "bar"} {
+		if _, err = os.Stat(filepath.Join(tmpDir, profilePrefix+fnName+".jsonl")); err != nil {
+			t.Errorf("expected active stream for %q to be retained; got %v", fnName, err)
+		}
+	}
+}
+
+func TestFileSinkFormats(t *testing.T) {
+	for _, format := range []profiler.ProfileFormat{profiler.FormatJSONGzip, profiler.FormatBinary} {
+		tmpDir, err := ioutil.TempDir("", "prism-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		s := NewFileSinkWithOptions(tmpDir, FileSinkOptions{Format: format})
+		err = s.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Input() <- mockSampledProfile("foo/bar.baz", time.Millisecond)
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileList, err := filepath.Glob(tmpDir + "/*." + format.Extension())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fileList) != 1 {
+			t.Fatalf("[%s] expected 1 profile file to be written; got %d", format, len(fileList))
+		}
+
+		f, err := os.Open(fileList[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile, err := profiler.DecodeProfile(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("[%s] could not decode profile: %v", format, err)
+		}
+		if profile.Target.FnName != "foo/bar.baz" {
+			t.Errorf("[%s] expected profile target to be %q; got %q", format, "foo/bar.baz", profile.Target.FnName)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+const (
+	defaultHTTPBatchSize       = 50
+	defaultHTTPFlushInterval   = time.Second
+	defaultHTTPMaxBuffered     = 1000
+	defaultHTTPMaxRetries      = 5
+	defaultHTTPRetryBackoff    = 100 * time.Millisecond
+	defaultHTTPMaxRetryBackoff = 5 * time.Second
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultHTTPCloseTimeout    = 5 * time.Second
+
+	// The max size of a request body accepted by the HTTP receiver.
+	defaultHTTPMaxBodyBytes = 32 * 1024 * 1024
+)
+
+// HTTPSinkOptions configures the batching and retry behavior of a sink
+// created by NewHTTPSink. Zero-valued fields are replaced by their defaults.
+type HTTPSinkOptions struct {
+	// The max number of profiles included in each request. Defaults to 50.
+	BatchSize int
+
+	// The max time that a profile waits in the buffer before being sent
+	// even if the batch is not full. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// The max number of profiles that can be buffered while waiting to be
+	// sent. Once the buffer is full, the oldest buffered profiles are
+	// dropped to make room for new ones. Defaults to 1000.
+	MaxBufferedProfiles int
+
+	// The max number of times that a failed request is retried before the
+	// profiles in it are reported as errored. Defaults to 5. Set to a
+	// negative value to disable retries.
+	MaxRetries int
+
+	// The delay before the first retry. The delay doubles after each
+	// failed attempt up to MaxRetryBackoff. Defaults to 100ms and 5s.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// The timeout for each request. Defaults to 10s. It is ignored if a
+	// custom Client is specified.
+	Timeout time.Duration
+
+	// The max time that Close waits for buffered profiles to be sent.
+	// Defaults to 5s.
+	CloseTimeout time.Duration
+
+	// An optional client for sending requests.
+	Client *http.Client
+}
+
+// Populate zero-valued options with their defaults.
+func (opts HTTPSinkOptions) withDefaults() HTTPSinkOptions {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultHTTPBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultHTTPFlushInterval
+	}
+	if opts.MaxBufferedProfiles <= 0 {
+		opts.MaxBufferedProfiles = defaultHTTPMaxBuffered
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultHTTPMaxRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultHTTPRetryBackoff
+	}
+	if opts.MaxRetryBackoff <= 0 {
+		opts.MaxRetryBackoff = defaultHTTPMaxRetryBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultHTTPTimeout
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = defaultHTTPCloseTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	return opts
+}
+
+// The wire format for a profile sent by the HTTP sink. The profile ID and
+// creation time are not part of the profile JSON encoding so they are sent
+// alongside it; the receiver needs them to name the stored profile files.
+type httpProfile struct {
+	ID        uint64            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Profile   *profiler.Profile `json:"profile"`
+}
+
+type httpSink struct {
+	statsCounter
+	url       string
+	opts      HTTPSinkOptions
+	sigChan   chan struct{}
+	inputChan chan *profiler.Profile
+
+	// Profiles waiting to be sent. The worker signals flushChan when a
+	// full batch is available and closes doneChan once the input is closed.
+	mutex     sync.Mutex
+	buffer    []*profiler.Profile
+	flushChan chan struct{}
+	doneChan  chan struct{}
+
+	// A context for all requests which is cancelled once the close
+	// timeout expires.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewHTTPSink creates a new profile entry sink instance which buffers profiles
+// and POSTs them in batches to the specified url as gzip-compressed JSON.
+// Requests that fail due to network errors or 5xx/429 responses are retried
+// with exponential backoff. Profiles that could not be sent after all retries
+// are reported as errored by the sink's Stats method while profiles evicted
+// from the bounded buffer are reported as dropped.
+//
+// The prism collect command provides a receiver that stores incoming profiles
+// to disk; custom receivers can be built using NewHTTPReceiver.
+func NewHTTPSink(url string, opts HTTPSinkOptions) profiler.Sink {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &httpSink{
+		url:       url,
+		opts:      opts.withDefaults(),
+		sigChan:   make(chan struct{}, 0),
+		flushChan: make(chan struct{}, 1),
+		doneChan:  make(chan struct{}, 0),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Initialize the sink.
+func (s *httpSink) Open(inputBufferSize int) error {
+	fmt.Fprintf(os.Stderr, "profiler: sending profiles to %s\n", s.url)
+
+	s.inputChan = make(chan *profiler.Profile, inputBufferSize)
+
+	// start workers and wait for ready signals
+	go s.worker()
+	go s.sender()
+	<-s.sigChan
+	<-s.sigChan
+	return nil
+}
+
+// Shutdown the sink. Failed requests are no longer retried once the sink is
+// closing. Close blocks until all buffered profiles have been sent or the
+// close timeout expires; any profiles that are still buffered at that point
+// are reported as errored.
+func (s *httpSink) Close() error {
+	// Signal workers to exit and wait for confirmation
+	close(s.inputChan)
+	timer := time.AfterFunc(s.opts.CloseTimeout, s.cancel)
+	<-s.sigChan
+	<-s.sigChan
+	timer.Stop()
+	s.cancel()
+	close(s.sigChan)
+	return nil
+}
+
+// Get a channel for piping profile entries to the sink.
+func (s *httpSink) Input() chan<- *profiler.Profile {
+	return s.inputChan
+}
+
+// Move incoming profiles to the buffer and notify the sender when a full
+// batch is available.
+func (s *httpSink) worker() {
+	// Signal that worker has started
+	s.sigChan <- struct{}{}
+	defer func() {
+		// Signal the sender to drain the buffer and that we have stopped
+		close(s.doneChan)
+		s.sigChan <- struct{}{}
+	}()
+
+	for {
+		profile, sinkOpen := <-s.inputChan
+		if !sinkOpen {
+			return
+		}
+
+		s.incReceived()
+
+		s.mutex.Lock()
+		if len(s.buffer) == s.opts.MaxBufferedProfiles {
+			s.buffer[0] = nil
+			s.buffer = s.buffer[1:]
+			s.incDropped()
+		}
+		s.buffer = append(s.buffer, profile)
+		batchReady := len(s.buffer) >= s.opts.BatchSize
+		s.mutex.Unlock()
+
+		if batchReady {
+			select {
+			case s.flushChan <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Send buffered profiles whenever a full batch is available or the flush
+// interval elapses. Once the worker exits, any remaining profiles are sent.
+func (s *httpSink) sender() {
+	// Signal that sender has started
+	s.sigChan <- struct{}{}
+	defer func() {
+		// Signal that we have stopped
+		s.sigChan <- struct{}{}
+	}()
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.flushChan:
+			s.flush(false)
+		case <-ticker.C:
+			s.flush(true)
+		case <-s.doneChan:
+			s.flush(true)
+			return
+		}
+	}
+}
+
+// Send the buffered profiles in batches. Unless partial is set, only full
+// batches are sent.
+func (s *httpSink) flush(partial bool) {
+	for {
+		s.mutex.Lock()
+		batchSize := len(s.buffer)
+		if batchSize > s.opts.BatchSize {
+			batchSize = s.opts.BatchSize
+		}
+		if batchSize == 0 || (!partial && batchSize < s.opts.BatchSize) {
+			s.mutex.Unlock()
+			return
+		}
+
+		// Give up on the remaining profiles if the close timeout has expired
+		if s.ctx.Err() != nil {
+			numQueued := len(s.buffer)
+			s.buffer = nil
+			s.mutex.Unlock()
+			s.addErrored(uint64(numQueued))
+			fmt.Fprintf(os.Stderr, "profiler: could not send %d profiles to %s before the sink was closed; dropping profiles\n", numQueued, s.url)
+			return
+		}
+		batch := make([]*profiler.Profile, batchSize)
+		copy(batch, s.buffer)
+		s.buffer = s.buffer[batchSize:]
+		s.mutex.Unlock()
+
+		err := s.sendWithRetries(batch)
+		if err != nil {
+			s.addErrored(uint64(len(batch)))
+			fmt.Fprintf(os.Stderr, "profiler: could not send %d profiles to %s due to %s; dropping profiles\n", len(batch), s.url, err.Error())
+			continue
+		}
+
+		for range batch {
+			s.incWritten()
+		}
+	}
+}
+
+// Send a batch of profiles retrying failed requests with exponential backoff
+// until the retries are exhausted or the sink is closing.
+func (s *httpSink) sendWithRetries(batch []*profiler.Profile) error {
+	payload, err := encodeHTTPBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.send(payload)
+		if err == nil || !retry || attempt >= s.opts.MaxRetries || s.closing() {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.doneChan:
+			return err
+		}
+		backoff *= 2
+		if backoff > s.opts.MaxRetryBackoff {
+			backoff = s.opts.MaxRetryBackoff
+		}
+	}
+}
+
+// Check whether the sink is being closed.
+func (s *httpSink) closing() bool {
+	select {
+	case <-s.doneChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// POST an encoded batch of profiles. If the request fails, send also reports
+// whether it should be retried.
+func (s *httpSink) send(payload []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	res, err := s.opts.Client.Do(req.WithContext(s.ctx))
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("unexpected response status %q", res.Status)
+	}
+
+	return false, fmt.Errorf("unexpected response status %q", res.Status)
+}
+
+// Encode a batch of profiles as gzip-compressed JSON.
+func encodeHTTPBatch(batch []*profiler.Profile) ([]byte, error) {
+	wireBatch := make([]httpProfile, len(batch))
+	for index, profile := range batch {
+		wireBatch[index] = httpProfile{
+			ID:        profile.ID,
+			CreatedAt: profile.CreatedAt,
+			Profile:   profile,
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	err := json.NewEncoder(zw).Encode(wireBatch)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling profiles: %s", err.Error())
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode a batch of profiles sent by an HTTP sink.
+func decodeHTTPBatch(r io.Reader, gzipped bool) ([]*profiler.Profile, error) {
+	if gzipped {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var wireBatch []httpProfile
+	err := json.NewDecoder(r).Decode(&wireBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]*profiler.Profile, 0, len(wireBatch))
+	for _, wireProfile := range wireBatch {
+		if wireProfile.Profile == nil || wireProfile.Profile.Target == nil {
+			return nil, fmt.Errorf("batch contains a profile without a target")
+		}
+
+		wireProfile.Profile.ID = wireProfile.ID
+		wireProfile.Profile.CreatedAt = wireProfile.CreatedAt
+		batch = append(batch, wireProfile.Profile)
+	}
+
+	return batch, nil
+}
+
+type httpReceiver struct {
+	sink         profiler.Sink
+	maxBodyBytes int64
+}
+
+// NewHTTPReceiver returns an http.Handler that accepts profile batches POSTed
+// by an HTTP sink and pipes the received profiles to the supplied sink.
+// Requests with a body larger than 32MB are rejected. The caller is
+// responsible for opening the sink before serving requests and closing it
+// once the server has shut down.
+func NewHTTPReceiver(sink profiler.Sink) http.Handler {
+	return &httpReceiver{
+		sink:         sink,
+		maxBodyBytes: defaultHTTPMaxBodyBytes,
+	}
+}
+
+// Handle a POSTed batch of profiles.
+func (h *httpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gzipped := strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip")
+	batch, err := decodeHTTPBatch(http.MaxBytesReader(w, r.Body, h.maxBodyBytes), gzipped)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode profiles: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	for _, profile := range batch {
+		h.sink.Input() <- profile
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
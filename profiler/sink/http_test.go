@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+func TestHTTPSink(t *testing.T) {
+	inner := newCaptureSink()
+	inner.Open(10)
+
+	var numRequests int32
+	receiver := NewHTTPReceiver(inner)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected request body to be gzip-encoded")
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	s := NewHTTPSink(server.URL, HTTPSinkOptions{BatchSize: 2, FlushInterval: time.Hour})
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Unix(0, 1234).UTC()
+	for id := 0; id < 5; id++ {
+		profile := mockSampledProfile("foo", time.Millisecond)
+		profile.ID = uint64(id)
+		profile.CreatedAt = createdAt
+		s.Input() <- profile
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Close()
+
+	// Two full batches are sent as they fill up and the remaining profile is sent on close
+	if expRequests := int32(3); numRequests != expRequests {
+		t.Errorf("expected sink to send %d requests; got %d", expRequests, numRequests)
+	}
+
+	if len(inner.profiles) != 5 {
+		t.Fatalf("expected receiver to receive 5 profiles; got %d", len(inner.profiles))
+	}
+	for index, profile := range inner.profiles {
+		if profile.ID != uint64(index) {
+			t.Errorf("[profile %d] expected ID to be %d; got %d", index, index, profile.ID)
+		}
+		if !profile.CreatedAt.Equal(createdAt) {
+			t.Errorf("[profile %d] expected creation time to be %v; got %v", index, createdAt, profile.CreatedAt)
+		}
+		if profile.Target.FnName != "foo" || profile.Target.Histogram == nil {
+			t.Errorf("[profile %d] expected profile metrics to be preserved; got %+v", index, profile.Target)
+		}
+	}
+
+	expStats := profiler.SinkStats{Received: 5, Written: 5}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	specs := []struct {
+		maxRetries  int
+		failures    []int
+		expRequests int32
+		expStats    profiler.SinkStats
+	}{
+		// Server errors are retried
+		{2, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, profiler.SinkStats{Received: 2, Written: 2}},
+		// Retries are exhausted
+		{2, []int{500, 500, 500, 500}, 3, profiler.SinkStats{Received: 2, Errored: 2}},
+		// Client errors are not retried
+		{2, []int{http.StatusBadRequest}, 1, profiler.SinkStats{Received: 2, Errored: 2}},
+		// Retries are disabled
+		{-1, []int{500}, 1, profiler.SinkStats{Received: 2, Errored: 2}},
+	}
+
+	for specIndex, spec := range specs {
+		inner := newCaptureSink()
+		inner.Open(10)
+
+		var numRequests int32
+		receiver := NewHTTPReceiver(inner)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempt := atomic.AddInt32(&numRequests, 1)
+			if int(attempt) <= len(spec.failures) {
+				w.WriteHeader(spec.failures[attempt-1])
+				return
+			}
+			receiver.ServeHTTP(w, r)
+		}))
+
+		s := NewHTTPSink(server.URL, HTTPSinkOptions{BatchSize: 2, MaxRetries: spec.maxRetries, RetryBackoff: time.Millisecond})
+		err := s.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Input() <- mockSampledProfile("foo", time.Millisecond)
+		s.Input() <- mockSampledProfile("foo", time.Millisecond)
+
+		// Failed requests are not retried once the sink is closing so wait
+		// for the batch to be processed before closing the sink
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			stats := s.(profiler.StatsReporter).Stats()
+			if stats.Written+stats.Errored == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		s.Close()
+		inner.Close()
+		server.Close()
+
+		if numRequests != spec.expRequests {
+			t.Errorf("[spec %d] expected sink to send %d requests; got %d", specIndex, spec.expRequests, numRequests)
+		}
+		if stats := s.(profiler.StatsReporter).Stats(); stats != spec.expStats {
+			t.Errorf("[spec %d] expected sink stats to be %+v; got %+v", specIndex, spec.expStats, stats)
+		}
+		if expReceived := int(spec.expStats.Written); len(inner.profiles) != expReceived {
+			t.Errorf("[spec %d] expected receiver to receive %d profiles; got %d", specIndex, expReceived, len(inner.profiles))
+		}
+	}
+}
+
+func TestHTTPSinkBufferLimit(t *testing.T) {
+	inner := newCaptureSink()
+	inner.Open(10)
+
+	// Block the first request until we release the gate
+	gate := make(chan struct{})
+	blocked := make(chan struct{})
+	var numRequests int32
+	receiver := NewHTTPReceiver(inner)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numRequests, 1) == 1 {
+			close(blocked)
+			<-gate
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	s := NewHTTPSink(server.URL, HTTPSinkOptions{BatchSize: 1, MaxBufferedProfiles: 2})
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Input() <- mockSampledProfile("first", time.Millisecond)
+	<-blocked
+
+	// While the first request is blocked the buffer can only hold 2 of these profiles
+	for _, fnName := range []string{"evicted", "second", "third"} {
+		s.Input() <- mockSampledProfile(fnName, time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.(profiler.StatsReporter).Stats().Dropped == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	s.Close()
+	inner.Close()
+
+	expStats := profiler.SinkStats{Received: 4, Written: 3, Dropped: 1}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+
+	var fnNames []string
+	for _, profile := range inner.profiles {
+		fnNames = append(fnNames, profile.Target.FnName)
+	}
+	if got := strings.Join(fnNames, ","); got != "first,second,third" {
+		t.Errorf("expected receiver to receive profiles first,second,third; got %s", got)
+	}
+}
+
+func TestHTTPSinkCloseTimeout(t *testing.T) {
+	// Block all requests until the client gives up on them
+	var numRequests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s := NewHTTPSink(server.URL, HTTPSinkOptions{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Hour,
+		CloseTimeout:  50 * time.Millisecond,
+	})
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Input() <- mockSampledProfile("foo", time.Millisecond)
+	}
+
+	closedChan := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closedChan)
+	}()
+
+	select {
+	case <-closedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sink to close")
+	}
+
+	// The in-flight request is cancelled and is not retried while the
+	// remaining profiles are never sent
+	if got := atomic.LoadInt32(&numRequests); got != 1 {
+		t.Errorf("expected sink to send 1 request; got %d", got)
+	}
+	expStats := profiler.SinkStats{Received: 3, Errored: 3}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+}
+
+func TestHTTPReceiverErrors(t *testing.T) {
+	specs := []struct {
+		method    string
+		body      string
+		expStatus int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "not json", http.StatusBadRequest},
+		{http.MethodPost, `[{"id": 1}]`, http.StatusBadRequest},
+		{http.MethodPost, `[]`, http.StatusNoContent},
+		{http.MethodPost, `[` + strings.Repeat(" ", 1024) + `]`, http.StatusBadRequest},
+	}
+
+	receiver := NewHTTPReceiver(newCaptureSink())
+	receiver.(*httpReceiver).maxBodyBytes = 1024
+	for specIndex, spec := range specs {
+		w := httptest.NewRecorder()
+		receiver.ServeHTTP(w, httptest.NewRequest(spec.method, "/", strings.NewReader(spec.body)))
+		if w.Code != spec.expStatus {
+			t.Errorf("[spec %d] expected response status to be %d; got %d", specIndex, spec.expStatus, w.Code)
+		}
+	}
+}
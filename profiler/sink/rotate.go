@@ -0,0 +1,287 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+const (
+	defaultMaxStreamBytes = 10 * 1024 * 1024
+
+	streamExtension = "jsonl"
+)
+
+// A profile file tracked by a retention policy.
+type retainedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// retentionPolicy tracks the profile files in the sink output folder ordered
+// from oldest to newest and deletes the oldest ones whenever a limit is
+// exceeded. Active JSON Lines streams count towards the file and size limits
+// but are never deleted. All methods are safe to call on a nil policy; they
+// are no-ops.
+type retentionPolicy struct {
+	maxFiles int
+	maxBytes int64
+	maxAge   time.Duration
+
+	files      []retainedFile
+	totalBytes int64
+	numEvicted int
+
+	// The size of each active stream keyed by its path.
+	streams     map[string]int64
+	streamBytes int64
+}
+
+// Create a retention policy for the file sink options or return nil if the
+// options do not specify any limits.
+func newRetentionPolicy(opts FileSinkOptions) *retentionPolicy {
+	if opts.MaxFiles <= 0 && opts.MaxBytes <= 0 && opts.MaxAge <= 0 {
+		return nil
+	}
+
+	return &retentionPolicy{
+		maxFiles: opts.MaxFiles,
+		maxBytes: opts.MaxBytes,
+		maxAge:   opts.MaxAge,
+		streams:  make(map[string]int64, 0),
+	}
+}
+
+// Track the profile files that already exist in dir. Active JSON Lines
+// streams are only accounted for as they may still be appended to.
+func (p *retentionPolicy) scan(dir string) error {
+	if p == nil {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	existing := make([]retainedFile, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, profilePrefix) {
+			continue
+		}
+
+		if strings.HasSuffix(name, "."+streamExtension) {
+			if !isRotatedStream(name) {
+				p.trackStream(filepath.Join(dir, name), entry.Size())
+				continue
+			}
+		} else if _, isProfile := profiler.ProfileFormatFromPath(name); !isProfile {
+			continue
+		}
+
+		existing = append(existing, retainedFile{
+			path:    filepath.Join(dir, name),
+			size:    entry.Size(),
+			modTime: entry.ModTime(),
+		})
+	}
+
+	sort.SliceStable(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+	for _, file := range existing {
+		p.add(file)
+	}
+
+	return nil
+}
+
+// Start tracking a newly written profile file.
+func (p *retentionPolicy) track(path string) {
+	if p == nil {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	p.add(retainedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+}
+
+// Update the size of an active stream.
+func (p *retentionPolicy) trackStream(path string, size int64) {
+	if p == nil {
+		return
+	}
+
+	p.streamBytes += size - p.streams[path]
+	p.streams[path] = size
+}
+
+func (p *retentionPolicy) add(file retainedFile) {
+	p.files = append(p.files, file)
+	p.totalBytes += file.size
+}
+
+// Delete the oldest tracked files until all retention limits are satisfied.
+func (p *retentionPolicy) enforce(now time.Time) {
+	if p == nil {
+		return
+	}
+
+	evictCount := 0
+	for ; evictCount < len(p.files); evictCount++ {
+		numFiles := len(p.files) - evictCount + len(p.streams)
+		file := p.files[evictCount]
+
+		overFiles := p.maxFiles > 0 && numFiles > p.maxFiles
+		overBytes := p.maxBytes > 0 && p.totalBytes+p.streamBytes > p.maxBytes
+		overAge := p.maxAge > 0 && now.Sub(file.modTime) > p.maxAge
+		if !overFiles && !overBytes && !overAge {
+			break
+		}
+
+		err := os.Remove(file.path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "profiler: could not delete old profile file %q due to %s\n", file.path, err.Error())
+		}
+		p.totalBytes -= file.size
+		p.numEvicted++
+	}
+
+	if evictCount > 0 {
+		p.files = append(p.files[:0], p.files[evictCount:]...)
+	}
+}
+
+// Get the number of files deleted by the policy.
+func (p *retentionPolicy) evicted() int {
+	if p == nil {
+		return 0
+	}
+	return p.numEvicted
+}
+
+// An append-only JSON Lines stream for the profiles of a single target.
+type profileStream struct {
+	path string
+	f    *os.File
+	size int64
+}
+
+// Get the path to the active JSON Lines stream for a target.
+func streamFile(outputDir, fnName string) string {
+	return filepath.Join(
+		outputDir,
+		fmt.Sprintf("%s%s.%s", profilePrefix, badCharRegex.ReplaceAllString(fnName, "_"), streamExtension),
+	)
+}
+
+// Get the path that an active stream is renamed to when it is rotated. Target
+// names never contain dots so the rotation timestamp can be told apart.
+func rotatedStreamFile(activePath string, rotatedAt time.Time) string {
+	return fmt.Sprintf("%s.%d.%s", strings.TrimSuffix(activePath, "."+streamExtension), rotatedAt.UnixNano(), streamExtension)
+}
+
+// Check whether a stream file name refers to a rotated stream.
+func isRotatedStream(name string) bool {
+	return strings.Contains(strings.TrimSuffix(name, "."+streamExtension), ".")
+}
+
+// Append a profile to the JSON Lines stream for its target, rotating the
+// stream if the profile would make it exceed the max stream size.
+func (s *fileSink) appendToStream(profile *profiler.Profile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("error marshalling profile: %s", err.Error())
+	}
+	data = append(data, '\n')
+
+	fnName := profile.Target.FnName
+	stream, exists := s.streams[fnName]
+	if !exists {
+		stream, err = openStream(streamFile(s.outputDir, fnName))
+		if err != nil {
+			return err
+		}
+		s.streams[fnName] = stream
+		s.retention.trackStream(stream.path, stream.size)
+	}
+
+	if stream.size > 0 && stream.size+int64(len(data)) > s.opts.MaxStreamBytes {
+		stream, err = s.rotateStream(stream)
+		if err != nil {
+			delete(s.streams, fnName)
+			return err
+		}
+		s.streams[fnName] = stream
+	}
+
+	_, err = stream.f.Write(data)
+	if err != nil {
+		return fmt.Errorf("could not append to output file %q due to %s", stream.path, err.Error())
+	}
+	stream.size += int64(len(data))
+	s.retention.trackStream(stream.path, stream.size)
+
+	return nil
+}
+
+// Close and rename an active stream and open a new stream in its place.
+func (s *fileSink) rotateStream(stream *profileStream) (*profileStream, error) {
+	err := stream.f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close output file %q due to %s", stream.path, err.Error())
+	}
+
+	rotatedPath := rotatedStreamFile(stream.path, time.Now())
+	err = os.Rename(stream.path, rotatedPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not rotate output file %q due to %s", stream.path, err.Error())
+	}
+	s.retention.trackStream(stream.path, 0)
+	s.retention.track(rotatedPath)
+
+	return openStream(stream.path)
+}
+
+// Close all open streams.
+func (s *fileSink) closeStreams() error {
+	var err error
+	for fnName, stream := range s.streams {
+		if closeErr := stream.f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.streams, fnName)
+	}
+
+	return err
+}
+
+// Open a stream for appending. If the stream file already exists, new
+// profiles are appended to it.
+func openStream(path string) (*profileStream, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open output file %q due to %s", path, err.Error())
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &profileStream{path: path, f: f, size: info.Size()}, nil
+}
@@ -0,0 +1,383 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+const (
+	// The rolling window covered by the served aggregates. The window is
+	// split into a number of slots which expire as the window moves.
+	serveWindow      = 5 * time.Minute
+	serveWindowSlots = 10
+
+	// The columns rendered by the HTML view unless overridden via the
+	// columns query parameter; they match the print command defaults.
+	defaultServeColumns = "total,min,mean,max,invocations"
+)
+
+var (
+	serveTemplate = template.Must(template.New("profiles").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>prism live profiles</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 2px 8px; font-family: monospace; text-align: right; white-space: pre; }
+th:first-child, td:first-child { text-align: left; }
+tr:nth-child(even) { background: #f4f4f4; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>prism live profiles</h1>
+<p>Aggregated profiles captured since {{.Since.Format "2006-01-02 15:04:05 MST"}}; the page refreshes every 5 seconds.</p>
+{{if .Errored}}<p class="error">{{.Errored}} profile(s) could not be aggregated and were dropped; last error: {{.LastError}}</p>{{end}}
+{{range .MergeErrors}}<p class="error">{{.}}</p>{{end}}
+{{if not .Tables}}<p>No profiles have been captured yet.</p>{{end}}
+{{range .Tables}}<table>
+<tr><th>{{.Header}}</th>{{range $.Headers}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Call}}</td>{{range .Values}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+)
+
+// A slot in the rolling window holding the merged profiles for each target
+// that were received while the slot was active.
+type serveSlot struct {
+	start    time.Time
+	profiles map[string]*profiler.Profile
+}
+
+// The JSON document served by the sink. The errored count and last error
+// report the profiles that could not be aggregated whereas the merge errors
+// list the targets whose window slots could not be merged together; only
+// the latest slot is served for them.
+type servedProfiles struct {
+	Since       time.Time           `json:"since"`
+	Profiles    []*profiler.Profile `json:"profiles"`
+	Errored     uint64              `json:"errored"`
+	LastError   string              `json:"last_error,omitempty"`
+	MergeErrors []string            `json:"merge_errors,omitempty"`
+}
+
+type httpServeSink struct {
+	statsCounter
+	addr      string
+	sigChan   chan struct{}
+	inputChan chan *profiler.Profile
+	listener  net.Listener
+	server    *http.Server
+
+	// The rolling window slots sorted by their start time and the last
+	// error encountered while aggregating a profile.
+	mutex     sync.Mutex
+	slots     []*serveSlot
+	lastError string
+
+	// A function for obtaining the current time; overridden by tests.
+	now func() time.Time
+}
+
+// NewHTTPServeSink creates a profile entry sink instance which keeps a rolling
+// aggregate of the profiles captured for each target during the last 5
+// minutes and serves it over HTTP on the specified address. The aggregates
+// are served as JSON at /profiles.json and as an HTML call stack table at /.
+// The HTML view displays the same columns as the print command; they can be
+// selected using the columns query parameter (e.g. /?columns=total,p50,p99).
+//
+// The totals of sampled profiles are extrapolated using their sample rate in
+// the HTML view. Profiles that cannot be merged into the aggregate are reported
+// as errored by the sink's Stats method and both views.
+func NewHTTPServeSink(addr string) profiler.Sink {
+	return &httpServeSink{
+		addr:    addr,
+		sigChan: make(chan struct{}, 0),
+		now:     time.Now,
+	}
+}
+
+// Initialize the sink.
+func (s *httpServeSink) Open(inputBufferSize int) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profiles.json", s.serveJSON)
+	mux.HandleFunc("/", s.serveHTML)
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(listener)
+	fmt.Fprintf(os.Stderr, "profiler: serving live profiles at http://%s/\n", listener.Addr())
+
+	s.inputChan = make(chan *profiler.Profile, inputBufferSize)
+
+	// start worker and wait for ready signal
+	go s.worker()
+	<-s.sigChan
+	return nil
+}
+
+// Shutdown the sink and the HTTP server.
+func (s *httpServeSink) Close() error {
+	// Signal worker to exit and wait for confirmation
+	close(s.inputChan)
+	<-s.sigChan
+	close(s.sigChan)
+
+	return s.server.Shutdown(context.Background())
+}
+
+// Get a channel for piping profile entries to the sink.
+func (s *httpServeSink) Input() chan<- *profiler.Profile {
+	return s.inputChan
+}
+
+func (s *httpServeSink) worker() {
+	// Signal that worker has started
+	s.sigChan <- struct{}{}
+	defer func() {
+		// Signal that we have stopped
+		s.sigChan <- struct{}{}
+	}()
+
+	for {
+		profile, sinkOpen := <-s.inputChan
+		if !sinkOpen {
+			return
+		}
+
+		s.incReceived()
+
+		err := s.add(profile)
+		if err != nil {
+			s.addErrored(1)
+			s.mutex.Lock()
+			s.lastError = fmt.Sprintf("could not aggregate profile for %q: %s", profile.Target.FnName, err.Error())
+			s.mutex.Unlock()
+			fmt.Fprintf(os.Stderr, "profiler: could not aggregate profile for %q due to %s; dropping profile\n", profile.Target.FnName, err.Error())
+			continue
+		}
+		s.incWritten()
+	}
+}
+
+// Merge a profile into the active window slot.
+func (s *httpServeSink) add(profile *profiler.Profile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.expireSlots(now)
+
+	slotStart := now.Truncate(serveWindow / serveWindowSlots)
+	if len(s.slots) == 0 || !s.slots[len(s.slots)-1].start.Equal(slotStart) {
+		s.slots = append(s.slots, &serveSlot{
+			start:    slotStart,
+			profiles: make(map[string]*profiler.Profile, 0),
+		})
+	}
+	slot := s.slots[len(s.slots)-1]
+
+	fnName := profile.Target.FnName
+	if existing, exists := slot.profiles[fnName]; exists {
+		merged, err := profiler.MergeProfiles(existing, profile)
+		if err != nil {
+			return err
+		}
+		profile = merged
+	}
+	slot.profiles[fnName] = profile
+
+	return nil
+}
+
+// Drop slots that have fallen out of the rolling window. Must be called
+// while holding the mutex.
+func (s *httpServeSink) expireSlots(now time.Time) {
+	expired := 0
+	for ; expired < len(s.slots); expired++ {
+		if now.Sub(s.slots[expired].start) < serveWindow {
+			break
+		}
+	}
+	s.slots = s.slots[expired:]
+}
+
+// Merge the profiles from all window slots and return back the aggregated
+// profile for each target sorted by target name as well as the start of the
+// window that they cover. If the profiles for a target cannot be merged, the
+// profile from the latest window slot is returned and the error is reported
+// in the MergeErrors field.
+func (s *httpServeSink) aggregate() servedProfiles {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.expireSlots(now)
+
+	served := servedProfiles{
+		Since:     now,
+		Errored:   s.Stats().Errored,
+		LastError: s.lastError,
+	}
+	if len(s.slots) != 0 {
+		served.Since = s.slots[0].start
+	}
+
+	targetProfiles := make(map[string][]*profiler.Profile, 0)
+	for _, slot := range s.slots {
+		for fnName, profile := range slot.profiles {
+			targetProfiles[fnName] = append(targetProfiles[fnName], profile)
+		}
+	}
+
+	fnNames := make([]string, 0, len(targetProfiles))
+	for fnName := range targetProfiles {
+		fnNames = append(fnNames, fnName)
+	}
+	sort.Strings(fnNames)
+
+	served.Profiles = make([]*profiler.Profile, 0, len(fnNames))
+	for _, fnName := range fnNames {
+		profiles := targetProfiles[fnName]
+		merged := profiles[len(profiles)-1]
+		if len(profiles) > 1 {
+			mergedSlots, err := profiler.MergeProfiles(profiles...)
+			if err != nil {
+				served.MergeErrors = append(served.MergeErrors, fmt.Sprintf("could not merge profiles for %q: %s; only showing the latest profiles", fnName, err.Error()))
+			} else {
+				merged = mergedSlots
+			}
+		}
+		served.Profiles = append(served.Profiles, merged)
+	}
+
+	return served
+}
+
+// Serve the aggregated profiles as JSON.
+func (s *httpServeSink) serveJSON(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.aggregate())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// A rendered row of the HTML view.
+type serveRow struct {
+	Call   string
+	Values []string
+}
+
+// A rendered call stack table of the HTML view.
+type serveTable struct {
+	Header string
+	Rows   []serveRow
+}
+
+// Serve the aggregated profiles as a set of HTML call stack tables.
+func (s *httpServeSink) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	columnList := r.URL.Query().Get("columns")
+	if columnList == "" {
+		columnList = defaultServeColumns
+	}
+	columns, err := profiler.ParseMetricColumns(columnList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := make([]string, len(columns))
+	for index, column := range columns {
+		headers[index] = column.Header()
+	}
+
+	served := s.aggregate()
+	tables := make([]serveTable, len(served.Profiles))
+	for index, profile := range served.Profiles {
+		target := profile.Target
+		header := "call stack"
+		if profile.Label != "" {
+			header = fmt.Sprintf("%s - call stack", profile.Label)
+		}
+		if profile.MergedProfiles > 1 {
+			header += fmt.Sprintf(" (merged %d profiles)", profile.MergedProfiles)
+		}
+		if profile.SampleRate > 1 {
+			header += fmt.Sprintf(" (sampled 1 in %.1f; totals extrapolated)", profile.SampleRate)
+			target = target.Extrapolate(profile.SampleRate)
+		}
+
+		tables[index] = serveTable{Header: header}
+		appendServeRows(&tables[index], 0, target, columns)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = serveTemplate.Execute(w, struct {
+		servedProfiles
+		Headers []string
+		Tables  []serveTable
+	}{served, headers, tables})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "profiler: could not render live profiles due to %s\n", err.Error())
+	}
+}
+
+// Append a row for the call metrics and recursively process nested calls.
+func appendServeRows(table *serveTable, depth int, cm *profiler.CallMetrics, columns []profiler.MetricColumn) {
+	call := strings.Repeat("| ", depth)
+	if len(cm.NestedCalls) == 0 {
+		call += "- "
+	} else {
+		call += "+ "
+	}
+
+	row := serveRow{
+		Call:   call + cm.FnName,
+		Values: make([]string, len(columns)),
+	}
+	for index, column := range columns {
+		if val, isTime := column.TimeValue(cm); isTime {
+			row.Values[index] = fmtServeTime(val)
+			continue
+		}
+		row.Values[index] = column.FormatValue(cm)
+	}
+	table.Rows = append(table.Rows, row)
+
+	for _, nestedCall := range cm.NestedCalls {
+		appendServeRows(table, depth+1, nestedCall, columns)
+	}
+}
+
+// Format a time value in milliseconds.
+func fmtServeTime(t time.Duration) string {
+	return fmt.Sprintf("%.2f ms", float64(t.Nanoseconds())/1.0e6)
+}
@@ -0,0 +1,270 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+// A clock that can be safely advanced while the sink worker is running.
+type mockClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *mockClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestHTTPServeSink(t *testing.T) {
+	clock := &mockClock{now: time.Unix(1000*60, 0)}
+	s := NewHTTPServeSink("127.0.0.1:0")
+	serveSink := s.(*httpServeSink)
+	serveSink.now = clock.Now
+
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	baseURL := "http://" + serveSink.listener.Addr().String()
+
+	s.Input() <- mockSampledProfile("foo", 10*time.Millisecond)
+	s.Input() <- mockSampledProfile("bar", 5*time.Millisecond)
+	clock.Advance(3 * time.Minute)
+	s.Input() <- mockSampledProfile("foo", 20*time.Millisecond)
+	waitForWritten(t, serveSink, 3)
+
+	served := getServedProfiles(t, baseURL)
+	if len(served.Profiles) != 2 {
+		t.Fatalf("expected 2 aggregated profiles; got %d", len(served.Profiles))
+	}
+	if fnName := served.Profiles[0].Target.FnName; fnName != "bar" {
+		t.Errorf("expected first profile target to be %q; got %q", "bar", fnName)
+	}
+	foo := served.Profiles[1]
+	if foo.Target.Invocations != 2 || foo.MergedProfiles != 2 {
+		t.Errorf("expected foo aggregate to merge 2 profiles with 2 invocations; got %d profiles with %d invocations", foo.MergedProfiles, foo.Target.Invocations)
+	}
+	if foo.Target.TotalTime != 30*time.Millisecond {
+		t.Errorf("expected foo aggregate total time to be 30ms; got %v", foo.Target.TotalTime)
+	}
+
+	// Once the window moves past the first slot, its profiles are no longer included
+	clock.Advance(2*time.Minute + time.Second)
+	served = getServedProfiles(t, baseURL)
+	if len(served.Profiles) != 1 || served.Profiles[0].Target.TotalTime != 20*time.Millisecond {
+		t.Fatalf("expected only the latest foo profile to remain in the window; got %+v", served.Profiles)
+	}
+
+	expStats := profiler.SinkStats{Received: 3, Written: 3}
+	if stats := s.(profiler.StatsReporter).Stats(); stats != expStats {
+		t.Errorf("expected sink stats to be %+v; got %+v", expStats, stats)
+	}
+}
+
+func TestHTTPServeSinkHTML(t *testing.T) {
+	s := NewHTTPServeSink("127.0.0.1:0")
+	serveSink := s.(*httpServeSink)
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	baseURL := "http://" + serveSink.listener.Addr().String()
+
+	profile := mockSampledProfile("main", 10*time.Millisecond)
+	profile.Label = "live"
+	profile.Target.NestedCalls = []*profiler.CallMetrics{
+		mockSampledProfile("<foo>", 4*time.Millisecond).Target,
+	}
+	s.Input() <- profile
+	waitForWritten(t, serveSink, 1)
+
+	specs := []struct {
+		query       string
+		expStatus   int
+		expContains []string
+	}{
+		{"", http.StatusOK, []string{"<th>live - call stack</th>", "<th>invoc</th>", "<td>&#43; main</td>", "<td>| - &lt;foo&gt;</td>", "<td>10.00 ms</td>"}},
+		{"?columns=p99,self_pct", http.StatusOK, []string{"<th>p99</th><th>self %</th>"}},
+		{"?columns=total,bogus", http.StatusBadRequest, []string{`unsupported column name "bogus"`}},
+	}
+
+	for specIndex, spec := range specs {
+		res, err := http.Get(baseURL + "/" + spec.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != spec.expStatus {
+			t.Errorf("[spec %d] expected response status to be %d; got %d", specIndex, spec.expStatus, res.StatusCode)
+			continue
+		}
+		for _, expContent := range spec.expContains {
+			if !strings.Contains(string(body), expContent) {
+				t.Errorf("[spec %d] expected response to contain %q; got:\n%s", specIndex, expContent, body)
+			}
+		}
+	}
+}
+
+func TestHTTPServeSinkExtrapolatesSampledProfiles(t *testing.T) {
+	s := NewHTTPServeSink("127.0.0.1:0")
+	serveSink := s.(*httpServeSink)
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	baseURL := "http://" + serveSink.listener.Addr().String()
+
+	profile := mockSampledProfile("main", 10*time.Millisecond)
+	profile.SampleRate = 4
+	s.Input() <- profile
+	waitForWritten(t, serveSink, 1)
+
+	body := getServedHTML(t, baseURL+"/?columns=total,invocations")
+	expContains := []string{
+		"<th>call stack (sampled 1 in 4.0; totals extrapolated)</th>",
+		"<td>- main</td><td>40.00 ms</td><td>4</td>",
+	}
+	for _, expContent := range expContains {
+		if !strings.Contains(body, expContent) {
+			t.Errorf("expected response to contain %q; got:\n%s", expContent, body)
+		}
+	}
+
+	// The JSON view serves the captured metrics as-is
+	served := getServedProfiles(t, baseURL)
+	if total := served.Profiles[0].Target.TotalTime; total != 10*time.Millisecond {
+		t.Errorf("expected served total time to be 10ms; got %v", total)
+	}
+}
+
+func TestHTTPServeSinkReportsErrors(t *testing.T) {
+	clock := &mockClock{now: time.Unix(1000*60, 0)}
+	s := NewHTTPServeSink("127.0.0.1:0")
+	serveSink := s.(*httpServeSink)
+	serveSink.now = clock.Now
+
+	err := s.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	baseURL := "http://" + serveSink.listener.Addr().String()
+
+	// Profiles without a histogram cannot be merged with other profiles
+	legacyProfile := func() *profiler.Profile {
+		profile := mockSampledProfile("foo", 10*time.Millisecond)
+		profile.Target.Histogram = nil
+		return profile
+	}
+
+	// The second profile cannot be merged into the active slot and is dropped
+	s.Input() <- legacyProfile()
+	s.Input() <- legacyProfile()
+	waitForWritten(t, serveSink, 1)
+	waitForErrored(t, serveSink, 1)
+
+	// Profiles in different slots fail to merge when aggregated
+	clock.Advance(time.Minute)
+	s.Input() <- legacyProfile()
+	waitForWritten(t, serveSink, 2)
+
+	served := getServedProfiles(t, baseURL)
+	if served.Errored != 1 {
+		t.Errorf("expected errored count to be 1; got %d", served.Errored)
+	}
+	if !strings.Contains(served.LastError, "could not aggregate profile for \"foo\"") {
+		t.Errorf("expected last error to describe the dropped profile; got %q", served.LastError)
+	}
+	if len(served.MergeErrors) != 1 || !strings.Contains(served.MergeErrors[0], "could not merge profiles for \"foo\"") {
+		t.Errorf("expected a merge error for foo; got %v", served.MergeErrors)
+	}
+	if len(served.Profiles) != 1 || served.Profiles[0].Target.Invocations != 1 {
+		t.Errorf("expected the latest foo profile to be served; got %+v", served.Profiles)
+	}
+
+	body := getServedHTML(t, baseURL+"/")
+	expContains := []string{
+		"1 profile(s) could not be aggregated and were dropped; last error: could not aggregate profile for &#34;foo&#34;",
+		"could not merge profiles for &#34;foo&#34;",
+	}
+	for _, expContent := range expContains {
+		if !strings.Contains(body, expContent) {
+			t.Errorf("expected response to contain %q; got:\n%s", expContent, body)
+		}
+	}
+}
+
+// Wait until the sink worker has failed to aggregate the expected number of profiles.
+func waitForErrored(t *testing.T, s *httpServeSink, expErrored uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Errored < expErrored {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for sink to report %d errored profiles", expErrored)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func getServedHTML(t *testing.T, url string) string {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// Wait until the sink worker has aggregated the expected number of profiles.
+func waitForWritten(t *testing.T, s *httpServeSink, expWritten uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Written < expWritten {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for sink to aggregate %d profiles", expWritten)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func getServedProfiles(t *testing.T, baseURL string) servedProfiles {
+	res, err := http.Get(baseURL + "/profiles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var served servedProfiles
+	err = json.NewDecoder(res.Body).Decode(&served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return served
+}
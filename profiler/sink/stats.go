@@ -0,0 +1,34 @@
+package sink
+
+import (
+	"sync/atomic"
+
+	"github.com/geckoboard/prism/profiler"
+)
+
+// statsCounter tracks the statistics reported by a sink's Stats method. Sinks
+// embed it to implement the profiler.StatsReporter interface. All methods are
+// safe for concurrent use.
+type statsCounter struct {
+	received uint64
+	written  uint64
+	dropped  uint64
+	errored  uint64
+}
+
+// Stats returns back the current sink statistics.
+func (c *statsCounter) Stats() profiler.SinkStats {
+	return profiler.SinkStats{
+		Received: atomic.LoadUint64(&c.received),
+		Written:  atomic.LoadUint64(&c.written),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+		Errored:  atomic.LoadUint64(&c.errored),
+	}
+}
+
+func (c *statsCounter) incReceived() { atomic.AddUint64(&c.received, 1) }
+func (c *statsCounter) incWritten()  { atomic.AddUint64(&c.written, 1) }
+func (c *statsCounter) incDropped()  { atomic.AddUint64(&c.dropped, 1) }
+func (c *statsCounter) addErrored(n uint64) {
+	atomic.AddUint64(&c.errored, n)
+}
@@ -0,0 +1,64 @@
+package profiler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// SinkStats summarizes the profiles processed by a sink.
+type SinkStats struct {
+	// The number of profiles that the sink received via its input channel.
+	Received uint64 `json:"received"`
+
+	// The number of profiles that were successfully persisted.
+	Written uint64 `json:"written"`
+
+	// The number of profiles that were intentionally discarded.
+	Dropped uint64 `json:"dropped"`
+
+	// The number of profiles that could not be persisted due to an error.
+	Errored uint64 `json:"errored"`
+}
+
+// RunStats summarizes the profiles captured by the profiler.
+type RunStats struct {
+	// The number of profiles discarded by the profiler before reaching the
+	// sink, either due to backpressure or because they were finalized
+	// after Shutdown was invoked.
+	Dropped uint64 `json:"dropped"`
+
+	// The statistics reported by the sink. They are only populated if the
+	// sink implements the StatsReporter interface.
+	Sink SinkStats `json:"sink"`
+}
+
+// Lost returns the total number of profiles that were lost either by the
+// profiler or its sink.
+func (s RunStats) Lost() uint64 {
+	return s.Dropped + s.Sink.Dropped + s.Sink.Errored
+}
+
+// Stats returns back the statistics for the profiles captured since Init
+// was invoked. Stats remain available after Shutdown.
+func Stats() RunStats {
+	var stats RunStats
+	if processor != nil {
+		stats.Dropped = processor.dropped() + processor.discarded()
+	}
+
+	if reporter, ok := outputSink.(StatsReporter); ok {
+		stats.Sink = reporter.Stats()
+	}
+
+	return stats
+}
+
+// Write the profiler statistics to a JSON file.
+func writeStats(file string, stats RunStats) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+
+	"github.com/geckoboard/prism/tools"
+)
+
+// A copy of the profiler package sources. They are linked into patched go
+// modules so that prism binaries installed without the prism source tree
+// can still profile module-based projects.
+//
+//go:embed profiler/*.go profiler/*.s profiler/sink/*.go
+var profilerSources embed.FS
+
+func init() {
+	tools.ProfilerSources = profilerSources
+}
@@ -2,7 +2,10 @@ package tools
 
 import (
 	"bytes"
+	"fmt"
 	"go/ast"
+	"go/token"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
@@ -23,6 +26,10 @@ type funcVisitor struct {
 	// The unique list of functions that we need to hook indexed by FQN.
 	uniqueTargetMap map[string]*CallGraphNode
 
+	// A map of function literal locations (see anonFuncKey) to the FQN
+	// of the anonymous SSA functions that represent them.
+	anonFuncNames map[string]string
+
 	// Flag indicating whether the AST was modified.
 	modifiedAST bool
 
@@ -30,11 +37,24 @@ type funcVisitor struct {
 	patchCount int
 }
 
-// Create a new function node visitor.
-func newFuncVisitor(uniqueTargetMap map[string]*CallGraphNode, patchFn PatchFunc) *funcVisitor {
+// A visitor for function literals nested inside a function declaration or a
+// package-level declaration.
+type funcLitVisitor struct {
+	*funcVisitor
+
+	// The FQN of the function declaration that encloses the visited nodes.
+	// Function literals used in package-level declarations are enclosed by
+	// the package init function.
+	enclosingFnName string
+}
+
+// Create a new function node visitor. The optional anonFuncNames map is used
+// for matching function literals to their anonymous SSA function names.
+func newFuncVisitor(uniqueTargetMap map[string]*CallGraphNode, anonFuncNames map[string]string, patchFn PatchFunc) *funcVisitor {
 	return &funcVisitor{
 		patchFn:         patchFn,
 		uniqueTargetMap: uniqueTargetMap,
+		anonFuncNames:   anonFuncNames,
 	}
 }
 
@@ -65,25 +85,51 @@ func (v *funcVisitor) Process(parsedFile *parsedGoFile) (modifiedAST bool, patch
 // Implements ast.Visitor. Recursively looks for AST nodes that correspond to our
 // targets and applies a PatchFunc.
 func (v *funcVisitor) Visit(node ast.Node) ast.Visitor {
-	// We are only interested in function nodes
-	fnDecl, isFnNode := node.(*ast.FuncDecl)
-	if !isFnNode {
+	switch decl := node.(type) {
+	case *ast.FuncDecl:
+		// Ignore forward function declarations
+		if decl.Body == nil {
+			return nil
+		}
+
+		// Check if we need to hook this function and then visit any
+		// function literals defined inside it
+		fqName := qualifiedNodeName(decl, v.parsedFile.pkgName)
+		v.patch(fqName, decl.Body)
+		return &funcLitVisitor{funcVisitor: v, enclosingFnName: fqName}
+	case *ast.GenDecl:
+		return &funcLitVisitor{funcVisitor: v, enclosingFnName: v.parsedFile.pkgName + "/init"}
+	}
+
+	return v
+}
+
+// Implements ast.Visitor. Recursively looks for function literals that
+// correspond to our targets and applies a PatchFunc.
+func (v *funcLitVisitor) Visit(node ast.Node) ast.Visitor {
+	fnLit, isFnLit := node.(*ast.FuncLit)
+	if !isFnLit {
 		return v
 	}
 
-	// Ignore forward function declarations
-	if fnDecl.Body == nil {
-		return nil
+	pos := v.parsedFile.fset.Position(fnLit.Pos())
+	fqName, exists := v.anonFuncNames[anonFuncKey(v.enclosingFnName, pos)]
+	if exists {
+		v.patch(fqName, fnLit.Body)
 	}
 
-	// Check if we need to hook this function
-	fqName := qualifiedNodeName(fnDecl, v.parsedFile.pkgName)
+	return v
+}
+
+// Apply the patch function to the body of the function with the given FQN if
+// it is one of our targets.
+func (v *funcVisitor) patch(fqName string, body *ast.BlockStmt) {
 	cgNode, isTarget := v.uniqueTargetMap[fqName]
 	if !isTarget {
-		return nil
+		return
 	}
 
-	modified, extraImports := v.patchFn(cgNode, fnDecl.Body)
+	modified, extraImports := v.patchFn(cgNode, body)
 	if modified {
 		v.modifiedAST = true
 		v.patchCount++
@@ -93,8 +139,6 @@ func (v *funcVisitor) Visit(node ast.Node) ast.Visitor {
 			v.extraImports[name] = struct{}{}
 		}
 	}
-
-	return nil
 }
 
 // Returns the fully qualified name for function declaration given its AST node.
@@ -121,3 +165,11 @@ func qualifiedNodeName(fnDecl *ast.FuncDecl, pkgName string) string {
 	buf.WriteString(fnDecl.Name.Name)
 	return buf.String()
 }
+
+// Generate a key for looking up the anonymous function name for a function
+// literal located at pos. Function literals are identified by the FQN of the
+// enclosing top-level function, the name of the file where they are defined
+// and their line/column offset.
+func anonFuncKey(enclosingFnName string, pos token.Position) string {
+	return fmt.Sprintf("%s@%s:%d:%d", enclosingFnName, filepath.Base(pos.Filename), pos.Line, pos.Column)
+}
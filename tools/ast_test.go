@@ -51,6 +51,7 @@ func TestFuncVisitorImport(t *testing.T) {
 	}
 	visitor := newFuncVisitor(
 		targetMap,
+		nil,
 		func(_ *CallGraphNode, _ *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
 			return true, []string{
 				"github.com/foo/bar",
@@ -1,6 +1,8 @@
 package tools
 
 import (
+	"go/ast"
+	"go/token"
 	"strings"
 
 	"golang.org/x/tools/go/callgraph"
@@ -12,10 +14,29 @@ import (
 // a Target root node via one or more hops.
 type CallGraphNode struct {
 	// A fully qualified function name reachable through a ProfileTarget.
-	Name string
-
-	// Number of hops from the callgraph entrypoint (root).
-	Depth int
+	Name string `json:"name"`
+
+	// Number of hops from the callgraph entrypoint (root) along the shortest
+	// call path.
+	Depth int `json:"depth"`
+
+	// The fully qualified names of the graph nodes that are directly invoked
+	// by this node. As each node is only visited once, a callee may appear
+	// earlier in the callgraph than the node that invokes it.
+	Callees []string `json:"callees,omitempty"`
+
+	// Set when merging callgraphs for profile targets (Depth = 0) that are
+	// also reachable from another profile target or from themselves. Such
+	// targets begin their own profile and are also nested into any profile
+	// that is active when they are invoked.
+	NestedTarget bool `json:"-"`
+
+	// The offsets (relative to the opening brace of the function body) of
+	// the go statements that invoke a generic function without explicitly
+	// instantiating it. As their type arguments are inferred from the call
+	// arguments, such functions cannot be passed as a value to the async
+	// profiler wrapper.
+	genericGoStmts map[token.Pos]struct{}
 }
 
 // CallGraph is a slice of callgraph nodes obtained by performing
@@ -32,6 +53,10 @@ type ProfileTarget struct {
 	// The fully qualified package name for the analyzed go package.
 	PkgPrefix string
 
+	// The glob or regex pattern that selected this target. This field is
+	// empty if the target was specified using its fully qualified name.
+	Pattern string
+
 	// The SSA representation of the target. We rely on this to perform
 	// RTA analysis so we can discover any reachable functions from this endpoint
 	ssaFunc *ssa.Function
@@ -70,13 +95,16 @@ func (pt *ProfileTarget) CallGraph() CallGraph {
 		}
 		calleeCache[target] = struct{}{}
 
-		cg = append(cg, &CallGraphNode{
-			Name:  target,
-			Depth: depth,
-		})
+		cgNode := &CallGraphNode{
+			Name:           target,
+			Depth:          depth,
+			genericGoStmts: genericGoStmtOffsets(node.Func),
+		}
+		cg = append(cg, cgNode)
 
 		// Visit edges
 		for _, outEdge := range node.Out {
+			cgNode.addCallee(ssaQualifiedFuncName(outEdge.Callee.Func), pt.PkgPrefix)
 			visitFn(outEdge.Callee, depth+1)
 		}
 	}
@@ -85,10 +113,104 @@ func (pt *ProfileTarget) CallGraph() CallGraph {
 	rtaRes := rta.Analyze([]*ssa.Function{pt.ssaFunc}, true)
 	visitFn(rtaRes.CallGraph.Root, 0)
 
+	// The traversal above assigns depths in visit order; a node reachable via
+	// several paths may be visited through a longer one first.
+	cg.assignShortestDepths()
+
 	return cg
 }
 
+// Set the depth of each node to the number of hops along the shortest call
+// path from the callgraph root (the first node) using a breadth-first search
+// over the node callees.
+func (cg CallGraph) assignShortestDepths() {
+	if len(cg) == 0 {
+		return
+	}
+
+	nodes := make(map[string]*CallGraphNode, len(cg))
+	for _, cgNode := range cg {
+		nodes[cgNode.Name] = cgNode
+	}
+
+	visited := map[string]struct{}{cg[0].Name: {}}
+	cg[0].Depth = 0
+	queue := []*CallGraphNode{cg[0]}
+	for len(queue) > 0 {
+		cgNode := queue[0]
+		queue = queue[1:]
+
+		for _, callee := range cgNode.Callees {
+			calleeNode := nodes[callee]
+			if calleeNode == nil {
+				continue
+			}
+			if _, exists := visited[callee]; exists {
+				continue
+			}
+			visited[callee] = struct{}{}
+			calleeNode.Depth = cgNode.Depth + 1
+			queue = append(queue, calleeNode)
+		}
+	}
+}
+
+// Collect the offsets of the go statements in fn whose callee is a generic
+// function (methods of generic types are not included as their type arguments
+// are bound to the receiver). The offsets are relative to the opening brace
+// of the function body so they can be matched against the go statements in a
+// separately parsed AST for the same function.
+func genericGoStmtOffsets(fn *ssa.Function) map[token.Pos]struct{} {
+	var body *ast.BlockStmt
+	switch syntax := fn.Syntax().(type) {
+	case *ast.FuncDecl:
+		body = syntax.Body
+	case *ast.FuncLit:
+		body = syntax.Body
+	}
+	if body == nil {
+		return nil
+	}
+
+	var offsets map[token.Pos]struct{}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instrs {
+			goInstr, isGo := instr.(*ssa.Go)
+			if !isGo {
+				continue
+			}
+
+			callee := goInstr.Call.StaticCallee()
+			if callee == nil || callee.Signature.Recv() != nil || len(callee.TypeArgs()) == 0 {
+				continue
+			}
+
+			if offsets == nil {
+				offsets = make(map[token.Pos]struct{}, 0)
+			}
+			offsets[goInstr.Pos()-body.Lbrace] = struct{}{}
+		}
+	}
+
+	return offsets
+}
+
 // Check if target can be include in callgraph.
 func includeInGraph(target string, pkgPrefix string) bool {
 	return strings.HasPrefix(target, pkgPrefix)
 }
+
+// Register callee as a direct callee of this node. Callees excluded from the
+// callgraph and callees that have already been registered are ignored.
+func (n *CallGraphNode) addCallee(callee string, pkgPrefix string) {
+	if !includeInGraph(callee, pkgPrefix) {
+		return
+	}
+
+	for _, existing := range n.Callees {
+		if existing == callee {
+			return
+		}
+	}
+	n.Callees = append(n.Callees, callee)
+}
@@ -0,0 +1,136 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CallGraphFilter prunes nodes from the callgraph of a profile target so that
+// they are not instrumented. Nodes can be pruned based on their depth, their
+// fully qualified function name or the package they belong to. The root node
+// of a callgraph (i.e. the profile target) is never pruned.
+//
+// Pruning a node does not prune the functions reachable through it; these
+// are still instrumented unless they are also matched by the filter.
+//
+// The filter keeps track of the unique function names that it included or
+// excluded so that callers can report them via Counts.
+type CallGraphFilter struct {
+	// The max depth of instrumented nodes. A negative value disables the depth limit.
+	maxDepth int
+
+	// Nodes whose FQ name matches any of these regexes are excluded.
+	excludeFn []*regexp.Regexp
+
+	// Nodes whose FQ package name matches any of these regexes are excluded.
+	excludePkg []*regexp.Regexp
+
+	// The set of function names included and excluded by the filter.
+	included map[string]struct{}
+	excluded map[string]struct{}
+}
+
+// NewCallGraphFilter creates a new filter from the supplied depth limit and
+// function/package exclusion regexes. A negative maxDepth disables the depth
+// limit. If the filter would not prune any nodes, NewCallGraphFilter returns
+// a nil filter which is safe to use.
+func NewCallGraphFilter(maxDepth int, excludeFnRegex, excludePkgRegex []string) (*CallGraphFilter, error) {
+	if maxDepth < 0 && len(excludeFnRegex) == 0 && len(excludePkgRegex) == 0 {
+		return nil, nil
+	}
+
+	excludeFn, err := compileRegexList("exclude-fn", excludeFnRegex)
+	if err != nil {
+		return nil, err
+	}
+	excludePkg, err := compileRegexList("exclude-pkg", excludePkgRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CallGraphFilter{
+		maxDepth:   maxDepth,
+		excludeFn:  excludeFn,
+		excludePkg: excludePkg,
+		included:   make(map[string]struct{}, 0),
+		excluded:   make(map[string]struct{}, 0),
+	}, nil
+}
+
+// Prune returns back a new callgraph containing the nodes of cg that are not
+// excluded by the filter. Invoking Prune on a nil filter returns back cg.
+func (f *CallGraphFilter) Prune(cg CallGraph) CallGraph {
+	if f == nil {
+		return cg
+	}
+
+	pruned := make(CallGraph, 0, len(cg))
+	for _, cgNode := range cg {
+		if cgNode.Depth != 0 && f.exclude(cgNode) {
+			f.excluded[cgNode.Name] = struct{}{}
+			continue
+		}
+
+		f.included[cgNode.Name] = struct{}{}
+		pruned = append(pruned, cgNode)
+	}
+
+	return pruned
+}
+
+// Counts returns back the number of unique functions that were included and
+// excluded by all Prune calls so far. Functions that were excluded from one
+// callgraph but included in another are counted as included.
+func (f *CallGraphFilter) Counts() (included, excluded int) {
+	if f == nil {
+		return 0, 0
+	}
+
+	for name := range f.excluded {
+		if _, isIncluded := f.included[name]; !isIncluded {
+			excluded++
+		}
+	}
+
+	return len(f.included), excluded
+}
+
+// Check whether a callgraph node should be excluded.
+func (f *CallGraphFilter) exclude(cgNode *CallGraphNode) bool {
+	if f.maxDepth >= 0 && cgNode.Depth > f.maxDepth {
+		return true
+	}
+
+	for _, regex := range f.excludeFn {
+		if regex.MatchString(cgNode.Name) {
+			return true
+		}
+	}
+
+	pkgName := cgNode.Name
+	if sepIndex := strings.LastIndex(pkgName, "/"); sepIndex != -1 {
+		pkgName = pkgName[:sepIndex]
+	}
+	for _, regex := range f.excludePkg {
+		if regex.MatchString(pkgName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compile a list of regexes specified via the argument called argName.
+func compileRegexList(argName string, regexList []string) ([]*regexp.Regexp, error) {
+	var err error
+	compiled := make([]*regexp.Regexp, len(regexList))
+	for index, regex := range regexList {
+		compiled[index], err = regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("CallGraphFilter: could not compile regex for %s arg %q: %s", argName, regex, err)
+		}
+	}
+
+	return compiled, nil
+}
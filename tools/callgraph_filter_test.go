@@ -0,0 +1,147 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCallGraphFilterPrune(t *testing.T) {
+	cg := CallGraph{
+		{Name: "github.com/acme/api/main", Depth: 0},
+		{Name: "github.com/acme/api/handlers/Users.ServeHTTP", Depth: 1},
+		{Name: "github.com/acme/api/store/Users.Get", Depth: 2},
+		{Name: "github.com/acme/api/store/encode", Depth: 3},
+		{Name: "github.com/acme/api/log/Printf", Depth: 2},
+	}
+
+	specs := []struct {
+		MaxDepth    int
+		ExcludeFn   []string
+		ExcludePkg  []string
+		ExpNames    []string
+		ExpExcluded int
+	}{
+		{
+			MaxDepth:    1,
+			ExpNames:    []string{"github.com/acme/api/main", "github.com/acme/api/handlers/Users.ServeHTTP"},
+			ExpExcluded: 3,
+		},
+		{
+			MaxDepth:    -1,
+			ExcludeFn:   []string{`Users\.Get$`, `main`},
+			ExpNames:    []string{"github.com/acme/api/main", "github.com/acme/api/handlers/Users.ServeHTTP", "github.com/acme/api/store/encode", "github.com/acme/api/log/Printf"},
+			ExpExcluded: 1,
+		},
+		{
+			MaxDepth:    -1,
+			ExcludePkg:  []string{`/log$`, `^github.com/acme/api/store$`},
+			ExpNames:    []string{"github.com/acme/api/main", "github.com/acme/api/handlers/Users.ServeHTTP"},
+			ExpExcluded: 3,
+		},
+		{
+			MaxDepth:    2,
+			ExcludePkg:  []string{`/log$`},
+			ExpNames:    []string{"github.com/acme/api/main", "github.com/acme/api/handlers/Users.ServeHTTP", "github.com/acme/api/store/Users.Get"},
+			ExpExcluded: 2,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		filter, err := NewCallGraphFilter(spec.MaxDepth, spec.ExcludeFn, spec.ExcludePkg)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		pruned := filter.Prune(cg)
+		names := make([]string, len(pruned))
+		for index, node := range pruned {
+			names[index] = node.Name
+		}
+
+		if !reflect.DeepEqual(names, spec.ExpNames) {
+			t.Errorf("[spec %d] expected pruned callgraph to contain %v; got %v", specIndex, spec.ExpNames, names)
+		}
+
+		included, excluded := filter.Counts()
+		if included != len(spec.ExpNames) || excluded != spec.ExpExcluded {
+			t.Errorf("[spec %d] expected filter counts to be (%d, %d); got (%d, %d)", specIndex, len(spec.ExpNames), spec.ExpExcluded, included, excluded)
+		}
+	}
+}
+
+func TestCallGraphFilterPruneWithShortcutCalls(t *testing.T) {
+	// The target calls B both directly and via A; B is visited through A first.
+	cg := CallGraph{
+		{Name: "github.com/acme/api/main", Depth: 0, Callees: []string{"github.com/acme/api/A", "github.com/acme/api/B"}},
+		{Name: "github.com/acme/api/A", Depth: 1, Callees: []string{"github.com/acme/api/B"}},
+		{Name: "github.com/acme/api/B", Depth: 2, Callees: []string{"github.com/acme/api/C"}},
+		{Name: "github.com/acme/api/C", Depth: 3},
+	}
+	cg.assignShortestDepths()
+
+	expDepths := []int{0, 1, 1, 2}
+	for index, node := range cg {
+		if node.Depth != expDepths[index] {
+			t.Errorf("expected depth for %q to be %d; got %d", node.Name, expDepths[index], node.Depth)
+		}
+	}
+
+	filter, err := NewCallGraphFilter(1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned := filter.Prune(cg)
+	names := make([]string, len(pruned))
+	for index, node := range pruned {
+		names[index] = node.Name
+	}
+	expNames := []string{"github.com/acme/api/main", "github.com/acme/api/A", "github.com/acme/api/B"}
+	if !reflect.DeepEqual(names, expNames) {
+		t.Errorf("expected pruned callgraph to contain %v; got %v", expNames, names)
+	}
+}
+
+func TestCallGraphFilterCountsAcrossCallGraphs(t *testing.T) {
+	filter, err := NewCallGraphFilter(0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// B is excluded from the first callgraph but is the root of the second
+	filter.Prune(CallGraph{{Name: "A", Depth: 0}, {Name: "B", Depth: 1}, {Name: "C", Depth: 2}})
+	filter.Prune(CallGraph{{Name: "B", Depth: 0}, {Name: "C", Depth: 1}})
+
+	included, excluded := filter.Counts()
+	if included != 2 || excluded != 1 {
+		t.Fatalf("expected filter counts to be (2, 1); got (%d, %d)", included, excluded)
+	}
+}
+
+func TestNilCallGraphFilter(t *testing.T) {
+	filter, err := NewCallGraphFilter(-1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != nil {
+		t.Fatal("expected to get a nil filter when no filter options are specified")
+	}
+
+	cg := CallGraph{{Name: "A", Depth: 0}, {Name: "B", Depth: 1}}
+	if pruned := filter.Prune(cg); !reflect.DeepEqual(pruned, cg) {
+		t.Fatalf("expected nil filter to return the callgraph unmodified; got %v", pruned)
+	}
+
+	if included, excluded := filter.Counts(); included != 0 || excluded != 0 {
+		t.Fatalf("expected nil filter counts to be (0, 0); got (%d, %d)", included, excluded)
+	}
+}
+
+func TestNewCallGraphFilterWithInvalidRegex(t *testing.T) {
+	_, err := NewCallGraphFilter(-1, []string{"("}, nil)
+	expError := "CallGraphFilter: could not compile regex for exclude-fn arg \"(\": error parsing regexp: missing closing ): `(`"
+	if err == nil || err.Error() != expError {
+		t.Fatalf("expected to get error %q; got %v", expError, err)
+	}
+}
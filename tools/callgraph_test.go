@@ -2,6 +2,7 @@ package tools
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -9,7 +10,7 @@ func TestCallgraphGeneration(t *testing.T) {
 	wsDir, pkgDir, pkgName := mockPackage(t)
 	defer os.RemoveAll(wsDir)
 
-	candidates, err := ssaCandidates(pkgDir, pkgName, wsDir)
+	candidates, err := ssaCandidates(pkgDir, pkgName, loadEnv("", wsDir), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,7 +37,16 @@ func TestCallgraphGeneration(t *testing.T) {
 		t.Fatalf("expected callgraph from main() to have %d nodes; got %d", len(expGraphNodeNames), len(graphNodes))
 	}
 
+	expCallees := [][]string{
+		{pkgName + "/DoStuff"},
+		{pkgName + "/A.DoStuff"},
+		nil,
+	}
+
 	for depth, node := range graphNodes {
+		if !reflect.DeepEqual(node.Callees, expCallees[depth]) {
+			t.Errorf("expected node at depth %d to have callees %v; got %v", depth, expCallees[depth], node.Callees)
+		}
 		if node.Depth != depth {
 			t.Errorf("node depth mismatch; expected %d; got %d", depth, node.Depth)
 		}
@@ -0,0 +1,201 @@
+package tools
+
+import (
+	"go/token"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// The max number of suggestions included in Find errors.
+	maxSuggestions = 3
+)
+
+// TargetCandidate describes a function that can be used as a profile target.
+type TargetCandidate struct {
+	// The fully qualified function name to be used as a profile target.
+	QualifiedName string
+
+	// The location of the function definition. Synthetic functions (e.g.
+	// package initializers) have no source location so the Filename field
+	// of the position is empty.
+	Position token.Position
+}
+
+// Candidates returns back the list of functions that can be used as profile
+// targets sorted by their fully qualified name.
+func (pkg *GoPackage) Candidates() []TargetCandidate {
+	candidates := make([]TargetCandidate, 0, len(pkg.ssaFuncCandidates))
+	for fqName, ssaFn := range pkg.ssaFuncCandidates {
+		candidate := TargetCandidate{QualifiedName: fqName}
+		if ssaFn.Synthetic == "" && ssaFn.Pos().IsValid() {
+			candidate.Position = ssaFn.Prog.Fset.Position(ssaFn.Pos())
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].QualifiedName < candidates[j].QualifiedName
+	})
+	return candidates
+}
+
+// FuzzyFilter returns the subset of candidates whose fully qualified names
+// fuzzy-match the filter. A name matches if it contains all filter characters
+// in the same order (ignoring case). Results are ranked so that names with the
+// tightest match (e.g. names containing the filter as a substring) appear first.
+func FuzzyFilter(candidates []TargetCandidate, filter string) []TargetCandidate {
+	type scoredCandidate struct {
+		TargetCandidate
+		score int
+	}
+
+	scored := make([]scoredCandidate, 0)
+	for _, candidate := range candidates {
+		score, matched := fuzzyMatch(filter, candidate.QualifiedName)
+		if matched {
+			scored = append(scored, scoredCandidate{candidate, score})
+		}
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score < scored[j].score
+		}
+		return scored[i].QualifiedName < scored[j].QualifiedName
+	})
+
+	filtered := make([]TargetCandidate, len(scored))
+	for index, candidate := range scored {
+		filtered[index] = candidate.TargetCandidate
+	}
+	return filtered
+}
+
+// Check whether the filter characters appear in order inside name (ignoring
+// case) and return a score for the match. The score is the number of extra
+// characters interleaved between the first and last matched character; lower
+// scores indicate a better match.
+func fuzzyMatch(filter, name string) (score int, matched bool) {
+	filter = strings.ToLower(filter)
+	name = strings.ToLower(name)
+	if filter == "" {
+		return 0, true
+	}
+
+	// Substring matches are always the best match
+	if strings.Contains(name, filter) {
+		return 0, true
+	}
+
+	// Greedily match filter characters and keep the span of the match
+	filterRunes := []rune(filter)
+	matchStart, matchEnd, filterIndex := -1, -1, 0
+	for byteIndex, r := range name {
+		if r != filterRunes[filterIndex] {
+			continue
+		}
+
+		if matchStart == -1 {
+			matchStart = byteIndex
+		}
+		filterIndex++
+		if filterIndex == len(filterRunes) {
+			matchEnd = byteIndex
+			break
+		}
+	}
+
+	if matchEnd == -1 {
+		return 0, false
+	}
+
+	return utf8.RuneCountInString(name[matchStart:matchEnd+1]) - len(filterRunes), true
+}
+
+// Suggest up to maxSuggestions candidate names that are close to the given
+// target. The target is normalized in the same way as the SSA function names
+// (i.e. parentheses and star operators are stripped) before comparing it to
+// the candidate list using the Levenshtein distance.
+func (pkg *GoPackage) suggestTargets(target string) []string {
+	normalized := strings.ToLower(stripCharRegex.ReplaceAllString(target, ""))
+	maxDistance := utf8.RuneCountInString(normalized) / 4
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	type suggestion struct {
+		name     string
+		distance int
+	}
+
+	suggestions := make([]suggestion, 0)
+	for candidate, ssaFn := range pkg.ssaFuncCandidates {
+		if ssaFn.Synthetic != "" {
+			continue
+		}
+
+		distance := levenshtein(normalized, strings.ToLower(candidate))
+		if distance <= maxDistance {
+			suggestions = append(suggestions, suggestion{candidate, distance})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+
+	names := make([]string, len(suggestions))
+	for index, s := range suggestions {
+		names[index] = s.name
+	}
+	return names
+}
+
+// Calculate the Levenshtein edit distance between two strings.
+func levenshtein(a, b string) int {
+	aRunes, bRunes := []rune(a), []rune(b)
+	prevRow := make([]int, len(bRunes)+1)
+	curRow := make([]int, len(bRunes)+1)
+	for j := range prevRow {
+		prevRow[j] = j
+	}
+
+	for i := 1; i <= len(aRunes); i++ {
+		curRow[0] = i
+		for j := 1; j <= len(bRunes); j++ {
+			cost := 1
+			if aRunes[i-1] == bRunes[j-1] {
+				cost = 0
+			}
+
+			curRow[j] = minInt(
+				prevRow[j]+1,
+				curRow[j-1]+1,
+				prevRow[j-1]+cost,
+			)
+		}
+		prevRow, curRow = curRow, prevRow
+	}
+
+	return prevRow[len(bRunes)]
+}
+
+// Return the min of a list of integers.
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
@@ -0,0 +1,169 @@
+package tools
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCandidates(t *testing.T) {
+	wsDir, pkgDir, pkgName := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := pkg.Candidates()
+	expNames := []string{
+		pkgName + "/A.DoStuff",
+		pkgName + "/DoStuff",
+		pkgName + "/init",
+		pkgName + "/main",
+	}
+	if len(candidates) != len(expNames) {
+		t.Fatalf("expected to get %d candidates; got %d", len(expNames), len(candidates))
+	}
+
+	for index, candidate := range candidates {
+		if candidate.QualifiedName != expNames[index] {
+			t.Errorf("[candidate %d] expected name to be %q; got %q", index, expNames[index], candidate.QualifiedName)
+		}
+
+		isSynthetic := strings.HasSuffix(candidate.QualifiedName, "/init")
+		if hasPosition := candidate.Position.Filename != ""; hasPosition == isSynthetic {
+			t.Errorf("[candidate %d] expected position to be set: %t; got %v", index, !isSynthetic, candidate.Position)
+		}
+		if !isSynthetic && (!strings.HasPrefix(candidate.Position.Filename, pkgDir) || candidate.Position.Line == 0) {
+			t.Errorf("[candidate %d] expected position to point to a line in %s; got %v", index, pkgDir, candidate.Position)
+		}
+	}
+}
+
+func TestFuzzyFilter(t *testing.T) {
+	candidates := []TargetCandidate{
+		{QualifiedName: "github.com/acme/api/handlers/Users.ServeHTTP"},
+		{QualifiedName: "github.com/acme/api/store/Users.Get"},
+		{QualifiedName: "github.com/acme/api/store/Users.GetByID"},
+		{QualifiedName: "github.com/acme/api/main"},
+	}
+
+	specs := []struct {
+		Filter   string
+		ExpNames []string
+	}{
+		{"", []string{
+			"github.com/acme/api/handlers/Users.ServeHTTP",
+			"github.com/acme/api/main",
+			"github.com/acme/api/store/Users.Get",
+			"github.com/acme/api/store/Users.GetByID",
+		}},
+		// Substring matches rank first
+		{"users.get", []string{
+			"github.com/acme/api/store/Users.Get",
+			"github.com/acme/api/store/Users.GetByID",
+		}},
+		// Tighter subsequence matches rank before looser ones
+		{"usget", []string{
+			"github.com/acme/api/store/Users.Get",
+			"github.com/acme/api/store/Users.GetByID",
+		}},
+		{"servehttp", []string{
+			"github.com/acme/api/handlers/Users.ServeHTTP",
+		}},
+		{"stid", []string{
+			"github.com/acme/api/store/Users.GetByID",
+		}},
+		{"missing", []string{}},
+	}
+
+	for specIndex, spec := range specs {
+		filtered := FuzzyFilter(candidates, spec.Filter)
+		names := make([]string, len(filtered))
+		for index, candidate := range filtered {
+			names[index] = candidate.QualifiedName
+		}
+
+		if !reflect.DeepEqual(names, spec.ExpNames) {
+			t.Errorf("[spec %d] expected filter %q to return %v; got %v", specIndex, spec.Filter, spec.ExpNames, names)
+		}
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	specs := []struct {
+		Filter     string
+		Name       string
+		ExpScore   int
+		ExpMatched bool
+	}{
+		{"dostuff", "pkg/A.DoStuff", 0, true},
+		{"ads", "pkg/A.DoStuff", 2, true},
+		{"adsf", "pkg/A.DoStuff", 4, true},
+		{"fa", "pkg/A.DoStuff", 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		score, matched := fuzzyMatch(spec.Filter, spec.Name)
+		if matched != spec.ExpMatched {
+			t.Errorf("[spec %d] expected match of %q against %q to be %t", specIndex, spec.Filter, spec.Name, spec.ExpMatched)
+			continue
+		}
+
+		if matched && score != spec.ExpScore {
+			t.Errorf("[spec %d] expected score to be %d; got %d", specIndex, spec.ExpScore, score)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	specs := []struct {
+		A, B        string
+		ExpDistance int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"A.DoStuff", "A.DoStuff", 0},
+		{"A.DoStuf", "A.DoStuff", 1},
+	}
+
+	for specIndex, spec := range specs {
+		if distance := levenshtein(spec.A, spec.B); distance != spec.ExpDistance {
+			t.Errorf("[spec %d] expected distance between %q and %q to be %d; got %d", specIndex, spec.A, spec.B, spec.ExpDistance, distance)
+		}
+	}
+}
+
+func TestFindSuggestsCloseMatches(t *testing.T) {
+	wsDir, pkgDir, pkgName := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		Target   string
+		ExpError string
+	}{
+		{
+			pkgName + "/A.doStuf",
+			`GoPackage.Find: no match for profile target "` + pkgName + `/A.doStuf"; did you mean: ` + pkgName + "/A.DoStuff, " + pkgName + "/DoStuff",
+		},
+		{
+			pkgName + ".DoStuff",
+			`GoPackage.Find: no match for profile target "` + pkgName + `.DoStuff"; did you mean: ` + pkgName + "/DoStuff, " + pkgName + "/A.DoStuff",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		_, err = pkg.Find(spec.Target)
+		if err == nil || err.Error() != spec.ExpError {
+			t.Errorf("[spec %d] expected to get error %q; got %v", specIndex, spec.ExpError, err)
+		}
+	}
+}
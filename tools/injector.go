@@ -4,15 +4,147 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
 )
 
 var (
 	profilerImports = []string{"prismProfiler github.com/geckoboard/prism/profiler"}
 	sinkImports     = []string{"prismSink github.com/geckoboard/prism/profiler/sink"}
+
+	// The names of the exported profiler constants for each profile format.
+	profileFormatConsts = map[profiler.ProfileFormat]string{
+		profiler.FormatJSON:     "FormatJSON",
+		profiler.FormatJSONGzip: "FormatJSONGzip",
+		profiler.FormatBinary:   "FormatBinary",
+	}
+
+	// Builtin functions that cannot be passed as function values.
+	builtinFuncs = map[string]struct{}{
+		"clear":   struct{}{},
+		"close":   struct{}{},
+		"copy":    struct{}{},
+		"delete":  struct{}{},
+		"panic":   struct{}{},
+		"print":   struct{}{},
+		"println": struct{}{},
+		"recover": struct{}{},
+	}
 )
 
+// BootstrapOptions configures the profiler init code injected by InjectProfilerBootstrap.
+// Zero-valued fields are omitted from the generated Init call so that the
+// profiler defaults apply.
+type BootstrapOptions struct {
+	// The folder where the file sink writes captured profiles.
+	ProfileDir string
+
+	// The retention limits for the profile files written by the file sink
+	// and whether profiles are appended to a JSON Lines stream per target.
+	MaxFiles  int
+	MaxBytes  int64
+	MaxAge    time.Duration
+	JSONLines bool
+
+	// The encoding for profile files written by the file sink.
+	Format profiler.ProfileFormat
+
+	// A label and a set of key/value pairs applied to captured profiles.
+	Label string
+	Tags  map[string]string
+
+	// The file where the profiler writes its run statistics when shutting down.
+	SummaryFile string
+
+	// The number of profiles that can be buffered by the sink.
+	BufferSize int
+
+	// Skip the profiler calibration loop or cache its results to a file.
+	SkipCalibration  bool
+	CalibrationCache string
+
+	// Profile one in every SampleEvery invocations and at most SampleRate
+	// invocations per second of each profile target.
+	SampleEvery int
+	SampleRate  float64
+}
+
+// Generate the profiler Init call for the supplied options.
+func (opts BootstrapOptions) initCall() string {
+	args := []string{opts.sinkCall()}
+	if opts.Label != "" {
+		args = append(args, fmt.Sprintf("prismProfiler.WithLabel(%q)", opts.Label))
+	}
+	if len(opts.Tags) != 0 {
+		keys := make([]string, 0, len(opts.Tags))
+		for key := range opts.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		tags := make([]string, len(keys))
+		for index, key := range keys {
+			tags[index] = fmt.Sprintf("%q: %q", key, opts.Tags[key])
+		}
+		args = append(args, fmt.Sprintf("prismProfiler.WithTags(map[string]string{%s})", strings.Join(tags, ", ")))
+	}
+	if opts.SummaryFile != "" {
+		args = append(args, fmt.Sprintf("prismProfiler.WithSummaryFile(%q)", opts.SummaryFile))
+	}
+	if opts.BufferSize > 0 {
+		args = append(args, fmt.Sprintf("prismProfiler.WithBufferSize(%d)", opts.BufferSize))
+	}
+	if opts.SkipCalibration {
+		args = append(args, "prismProfiler.WithCalibration(prismProfiler.CalibrationSkip)")
+	} else if opts.CalibrationCache != "" {
+		args = append(args, fmt.Sprintf("prismProfiler.WithCalibrationCache(%q)", opts.CalibrationCache))
+	}
+	if opts.SampleEvery > 1 {
+		args = append(args, fmt.Sprintf("prismProfiler.WithSampling(%d)", opts.SampleEvery))
+	}
+	if opts.SampleRate > 0 {
+		args = append(args, fmt.Sprintf("prismProfiler.WithSampleRate(%s)", strconv.FormatFloat(opts.SampleRate, 'g', -1, 64)))
+	}
+
+	return fmt.Sprintf("prismProfiler.Init(%s)", strings.Join(args, ", "))
+}
+
+// Generate the file sink constructor call for the supplied options.
+func (opts BootstrapOptions) sinkCall() string {
+	sinkOpts := make([]string, 0)
+	if opts.MaxFiles > 0 {
+		sinkOpts = append(sinkOpts, fmt.Sprintf("MaxFiles: %d", opts.MaxFiles))
+	}
+	if opts.MaxBytes > 0 {
+		sinkOpts = append(sinkOpts, fmt.Sprintf("MaxBytes: %d", opts.MaxBytes))
+	}
+	if opts.MaxAge > 0 {
+		// Use an untyped constant so the patched file does not need to import time
+		sinkOpts = append(sinkOpts, fmt.Sprintf("MaxAge: %d", int64(opts.MaxAge)))
+	}
+	if opts.JSONLines {
+		sinkOpts = append(sinkOpts, "JSONLines: true")
+	}
+	if formatConst, exists := profileFormatConsts[opts.Format]; exists && opts.Format != profiler.FormatJSON {
+		sinkOpts = append(sinkOpts, "Format: prismProfiler."+formatConst)
+	}
+
+	if len(sinkOpts) == 0 {
+		return fmt.Sprintf("prismSink.NewFileSink(%q)", opts.ProfileDir)
+	}
+	return fmt.Sprintf("prismSink.NewFileSinkWithOptions(%q, prismSink.FileSinkOptions{%s})", opts.ProfileDir, strings.Join(sinkOpts, ", "))
+}
+
 // InjectProfilerBootstrap returns a PatchFunc that injects our profiler init code the main function of the target package.
-func InjectProfilerBootstrap(profileDir, profileLabel string) PatchFunc {
+// The generated Init call passes the profiler options that correspond to the non-zero fields of opts.
+func InjectProfilerBootstrap(opts BootstrapOptions) PatchFunc {
+	initCall := opts.initCall()
+
 	return func(cgNode *CallGraphNode, fnDeclNode *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
 		imports := append(profilerImports, sinkImports...)
 		fnDeclNode.List = append(
@@ -21,7 +153,7 @@ func InjectProfilerBootstrap(profileDir, profileLabel string) PatchFunc {
 					X: &ast.BasicLit{
 						ValuePos: token.NoPos,
 						Kind:     token.STRING,
-						Value:    fmt.Sprintf("prismProfiler.Init(prismSink.NewFileSink(%q), %q)", profileDir, profileLabel),
+						Value:    initCall,
 					},
 				},
 				&ast.ExprStmt{
@@ -43,7 +175,7 @@ func InjectProfilerBootstrap(profileDir, profileLabel string) PatchFunc {
 // functions that are reachable from the profile targets that the user specified.
 func InjectProfiler() PatchFunc {
 	return func(cgNode *CallGraphNode, fnDeclNode *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
-		enterFn, leaveFn := profileFnName(cgNode.Depth)
+		enterFn, leaveFn := profileFnName(cgNode)
 
 		// Append our instrumentation calls to the top of the function
 		fnDeclNode.List = append(
@@ -70,11 +202,86 @@ func InjectProfiler() PatchFunc {
 	}
 }
 
+// InjectAsyncProfiler returns a PatchFunc that works like InjectProfiler but
+// also rewrites any go statements in the patched functions so that the profile
+// that is active when the go-routine is spawned is propagated to it. Any
+// profiled calls made by the spawned go-routine are then recorded as an async
+// call nested under the function that spawned it.
+//
+// Go statements inside function literals are only rewritten if the function
+// literal is itself a patched function. Go statements that invoke a generic
+// function without explicitly instantiating it are left untouched as generic
+// functions cannot be used as values unless they are instantiated.
+func InjectAsyncProfiler() PatchFunc {
+	injectFn := InjectProfiler()
+	return func(cgNode *CallGraphNode, fnDeclNode *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
+		rewriteGoStmts(fnDeclNode, cgNode.genericGoStmts)
+		return injectFn(cgNode, fnDeclNode)
+	}
+}
+
+// Rewrite each go statement in the block so that the invoked function is
+// wrapped by a call to prismProfiler.Async. Function literals are not visited.
+// The genericGoStmts set contains the offsets (relative to the block's opening
+// brace) of go statements whose callee is a generic function; they are only
+// rewritten if the callee is explicitly instantiated.
+func rewriteGoStmts(block *ast.BlockStmt, genericGoStmts map[token.Pos]struct{}) {
+	ast.Inspect(block, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.GoStmt:
+			if ident, isIdent := n.Call.Fun.(*ast.Ident); isIdent {
+				if _, isBuiltin := builtinFuncs[ident.Name]; isBuiltin {
+					return true
+				}
+			}
+
+			if _, isGeneric := genericGoStmts[n.Go-block.Lbrace]; isGeneric && !isInstantiation(n.Call.Fun) {
+				return true
+			}
+
+			callName := "go " + types.ExprString(n.Call.Fun)
+			if _, isFuncLit := n.Call.Fun.(*ast.FuncLit); isFuncLit {
+				callName = "go func literal"
+			}
+
+			n.Call.Fun = &ast.CallExpr{
+				Fun: ast.NewIdent("prismProfiler.Async"),
+				Args: []ast.Expr{
+					n.Call.Fun,
+					&ast.BasicLit{
+						ValuePos: token.NoPos,
+						Kind:     token.STRING,
+						Value:    strconv.Quote(callName),
+					},
+				},
+			}
+		}
+
+		return true
+	})
+}
+
+// Check whether expr explicitly instantiates a generic function (e.g. "process[int]").
+func isInstantiation(expr ast.Expr) bool {
+	switch expr.(type) {
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
+}
+
 // Return the appropriate profiler enter/exit function names depending on whether
 // a profile target is a user-specified target (depth=0) or a target discovered
-// by analyzing the callgraph from a user-specified target.
-func profileFnName(depth int) (enterFn, leaveFn string) {
-	if depth == 0 {
+// by analyzing the callgraph from a user-specified target. User-specified
+// targets that are reachable from other targets use the nested profile hooks
+// so they can also be nested into the profile that is active when they are invoked.
+func profileFnName(cgNode *CallGraphNode) (enterFn, leaveFn string) {
+	switch {
+	case cgNode.Depth == 0 && cgNode.NestedTarget:
+		return "BeginNestedProfile", "EndNestedProfile"
+	case cgNode.Depth == 0:
 		return "BeginProfile", "EndProfile"
 	}
 
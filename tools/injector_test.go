@@ -1,54 +1,92 @@
 package tools
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/geckoboard/prism/profiler"
 )
 
 func TestInjectProfilerBootstrap(t *testing.T) {
-	profileDir := "/tmp/foo"
-	profileLabel := "label"
-	injectFn := InjectProfilerBootstrap(profileDir, profileLabel)
-
-	cgNode := &CallGraphNode{
-		Name:  "main",
-		Depth: 0,
+	specs := []struct {
+		opts    BootstrapOptions
+		expInit string
+	}{
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo"},
+			`prismProfiler.Init(prismSink.NewFileSink("/tmp/foo"))`,
+		},
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo", Label: "label", SummaryFile: "/tmp/summary.json"},
+			`prismProfiler.Init(prismSink.NewFileSink("/tmp/foo"), prismProfiler.WithLabel("label"), prismProfiler.WithSummaryFile("/tmp/summary.json"))`,
+		},
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo", Tags: map[string]string{"rev": "abc", "host": "box"}, BufferSize: 512, SkipCalibration: true},
+			`prismProfiler.Init(prismSink.NewFileSink("/tmp/foo"), prismProfiler.WithTags(map[string]string{"host": "box", "rev": "abc"}), prismProfiler.WithBufferSize(512), prismProfiler.WithCalibration(prismProfiler.CalibrationSkip))`,
+		},
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo", CalibrationCache: "/tmp/calibration.json", SampleEvery: 10, SampleRate: 2.5},
+			`prismProfiler.Init(prismSink.NewFileSink("/tmp/foo"), prismProfiler.WithCalibrationCache("/tmp/calibration.json"), prismProfiler.WithSampling(10), prismProfiler.WithSampleRate(2.5))`,
+		},
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo", MaxFiles: 100, MaxBytes: 1024, MaxAge: time.Hour, JSONLines: true},
+			`prismProfiler.Init(prismSink.NewFileSinkWithOptions("/tmp/foo", prismSink.FileSinkOptions{MaxFiles: 100, MaxBytes: 1024, MaxAge: 3600000000000, JSONLines: true}))`,
+		},
+		{
+			BootstrapOptions{ProfileDir: "/tmp/foo", Format: profiler.FormatBinary},
+			`prismProfiler.Init(prismSink.NewFileSinkWithOptions("/tmp/foo", prismSink.FileSinkOptions{Format: prismProfiler.FormatBinary}))`,
+		},
 	}
 
-	stmt := &ast.BlockStmt{
-		List: make([]ast.Stmt, 0),
-	}
+	for specIndex, spec := range specs {
+		injectFn := InjectProfilerBootstrap(spec.opts)
 
-	modifiedAST, extraImports := injectFn(cgNode, stmt)
+		cgNode := &CallGraphNode{
+			Name:  "main",
+			Depth: 0,
+		}
 
-	if !modifiedAST {
-		t.Fatal("expected injector to modify the AST")
-	}
+		stmt := &ast.BlockStmt{
+			List: make([]ast.Stmt, 0),
+		}
 
-	expImports := append(profilerImports, sinkImports...)
-	if !importsMatch(extraImports, expImports) {
-		t.Fatalf("injector did not return the expected imports; got %v", extraImports)
-	}
+		modifiedAST, extraImports := injectFn(cgNode, stmt)
 
-	expStmtCount := 2
-	if len(stmt.List) != expStmtCount {
-		t.Fatalf("expected injector to append %d statements; got %d", expStmtCount, len(stmt.List))
-	}
+		if !modifiedAST {
+			t.Fatalf("[spec %d] expected injector to modify the AST", specIndex)
+		}
 
-	expStmts := []string{
-		fmt.Sprintf("prismProfiler.Init(prismSink.NewFileSink(%q), %q)", profileDir, profileLabel),
-		"defer prismProfiler.Shutdown()",
-	}
-	for stmtIndex, expStmt := range expStmts {
-		expr, err := extractExpr(stmt.List[stmtIndex])
-		if err != nil {
-			t.Errorf("[stmt %d] : %v", stmtIndex, err)
-			continue
+		expImports := append(profilerImports, sinkImports...)
+		if !importsMatch(extraImports, expImports) {
+			t.Fatalf("[spec %d] injector did not return the expected imports; got %v", specIndex, extraImports)
 		}
 
-		if expr != expStmt {
-			t.Errorf("[stmt %d] expected expression to be %q; got %q", stmtIndex, expStmt, expr)
+		expStmtCount := 2
+		if len(stmt.List) != expStmtCount {
+			t.Fatalf("[spec %d] expected injector to append %d statements; got %d", specIndex, expStmtCount, len(stmt.List))
+		}
+
+		expStmts := []string{
+			spec.expInit,
+			"defer prismProfiler.Shutdown()",
+		}
+		for stmtIndex, expStmt := range expStmts {
+			expr, err := extractExpr(stmt.List[stmtIndex])
+			if err != nil {
+				t.Errorf("[spec %d] [stmt %d] : %v", specIndex, stmtIndex, err)
+				continue
+			}
+
+			if expr != expStmt {
+				t.Errorf("[spec %d] [stmt %d] expected expression to be %q; got %q", specIndex, stmtIndex, expStmt, expr)
+			}
 		}
 	}
 }
@@ -98,19 +136,80 @@ func TestInjectProfiler(t *testing.T) {
 	}
 }
 
+func TestInjectAsyncProfiler(t *testing.T) {
+	src := `package foo
+
+func DoStuff(ch chan int) {
+	go worker(1, ch)
+	go s.worker(ch)
+	go func(ch chan int) {
+		go worker(2, ch)
+	}(ch)
+	go close(ch)
+	defer worker(3, ch)
+}
+`
+	expSrc := `package foo
+
+func DoStuff(ch chan int) {
+	prismProfiler.Enter("foo/DoStuff")
+	defer prismProfiler.Leave()
+	go prismProfiler.Async(worker, "go worker")(1, ch)
+	go prismProfiler.Async(s.worker, "go s.worker")(ch)
+	go prismProfiler.Async(func(ch chan int) {
+		go worker(2, ch)
+	}, "go func literal")(ch)
+	go close(ch)
+	defer worker(3, ch)
+}
+`
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "foo.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnDecl := f.Decls[0].(*ast.FuncDecl)
+
+	injectFn := InjectAsyncProfiler()
+	modifiedAST, extraImports := injectFn(&CallGraphNode{Name: "foo/DoStuff", Depth: 1}, fnDecl.Body)
+	if !modifiedAST {
+		t.Fatal("expected injector to modify the AST")
+	}
+	if !importsMatch(extraImports, profilerImports) {
+		t.Fatalf("injector did not return the expected imports; got %v", extraImports)
+	}
+
+	var buf bytes.Buffer
+	err = printer.Fprint(&buf, fset, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Injected statements are not positioned so normalize whitespace before comparing
+	normalize := func(src string) string {
+		return strings.Join(strings.Fields(src), " ")
+	}
+	if normalize(buf.String()) != normalize(expSrc) {
+		t.Fatalf("expected patched source to be:\n%s\ngot:\n%s", expSrc, buf.String())
+	}
+}
+
 func TestProfileFnSelection(t *testing.T) {
 	specs := []struct {
-		Depth      int
-		ExpEnterFn string
-		ExpLeaveFn string
+		Depth        int
+		NestedTarget bool
+		ExpEnterFn   string
+		ExpLeaveFn   string
 	}{
-		{0, "BeginProfile", "EndProfile"},
-		{1, "Enter", "Leave"},
-		{2, "Enter", "Leave"},
+		{0, false, "BeginProfile", "EndProfile"},
+		{0, true, "BeginNestedProfile", "EndNestedProfile"},
+		{1, false, "Enter", "Leave"},
+		{2, false, "Enter", "Leave"},
 	}
 
 	for specIndex, spec := range specs {
-		enterFn, leaveFn := profileFnName(spec.Depth)
+		enterFn, leaveFn := profileFnName(&CallGraphNode{Depth: spec.Depth, NestedTarget: spec.NestedTarget})
 		if enterFn != spec.ExpEnterFn {
 			t.Errorf("[spec %d] expected enter fn to be %q; got %q", specIndex, spec.ExpEnterFn, enterFn)
 			continue
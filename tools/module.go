@@ -0,0 +1,277 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+const (
+	// The module path for prism; injected profiler imports are resolved against it.
+	prismModulePath = "github.com/geckoboard/prism"
+
+	// The pseudo-version used when adding a requirement for the profiler
+	// module. Its value is irrelevant as the requirement is always replaced
+	// by a local copy of the profiler sources.
+	prismPseudoVersion = "v0.0.0-00010101000000-000000000000"
+
+	// The folder (relative to the work dir passed to LinkProfiler) where
+	// a copy of the profiler packages is stored. The leading underscore
+	// ensures that the go tool ignores it when expanding package patterns.
+	profilerShimDir = "_prism"
+)
+
+var (
+	// The packages that need to be available to the patched project.
+	profilerPackages = []string{"profiler", "profiler/sink"}
+
+	// ProfilerSources provides the sources for the profiler packages that
+	// are linked into patched go modules. The prism binary populates it
+	// with a copy of the sources embedded at build time. If left nil, the
+	// sources are looked up in the prism source tree or in GOPATH.
+	ProfilerSources fs.FS
+
+	errProfilerSourcesNotFound = errors.New("could not locate the sources for the prism profiler packages; rebuild prism from a checkout of " + prismModulePath + " so that they are embedded in the prism binary")
+)
+
+// FindModuleRoot walks up the folder hierarchy starting at pathToPackage looking
+// for a go.mod file and returns back the folder that contains it. If the
+// package is not part of a go module, FindModuleRoot returns an empty string.
+func FindModuleRoot(pathToPackage string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(pathToPackage))
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !info.IsDir() {
+			return dir, nil
+		}
+
+		parentDir := filepath.Dir(dir)
+		if parentDir == dir {
+			return "", nil
+		}
+		dir = parentDir
+	}
+}
+
+// Parse the go.mod file inside moduleRoot and return the module path.
+func modulePath(moduleRoot string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		return "", err
+	}
+
+	modPath := modfile.ModulePath(data)
+	if modPath == "" {
+		return "", fmt.Errorf("could not detect module path in %s", filepath.Join(moduleRoot, "go.mod"))
+	}
+
+	return modPath, nil
+}
+
+// Construct the fully qualified package name for a folder inside a go module
+// by concatenating the module path with the folder path relative to the module
+// root. Packages in the module's vendor folder are named after their original
+// import path.
+func moduleQualifiedPkgName(moduleRoot, absPackageDir string) (string, error) {
+	modPath, err := modulePath(moduleRoot)
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := filepath.Rel(moduleRoot, absPackageDir)
+	if err != nil {
+		return "", err
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	switch {
+	case relPath == ".":
+		return modPath, nil
+	case strings.HasPrefix(relPath, "vendor/"):
+		return strings.TrimPrefix(relPath, "vendor/"), nil
+	}
+
+	return modPath + "/" + relPath, nil
+}
+
+// LinkProfiler ensures that the profiler imports injected by Patch can be
+// resolved when building a package that is part of a go module. It stores a
+// copy of the prism profiler packages inside workDir and adds a replace
+// directive pointing to them to the module's go.mod file. If an overlay has
+// been enabled, the module's go.mod file is left untouched and the modified
+// version is written to the overlay folder instead.
+//
+// Packages that are not part of a go module pick up the profiler packages
+// via GOPATH so LinkProfiler is a no-op for them.
+func (pkg *GoPackage) LinkProfiler(workDir string) error {
+	if pkg.ModuleRoot == "" {
+		return nil
+	}
+
+	modFile := filepath.Join(pkg.ModuleRoot, "go.mod")
+	data, err := ioutil.ReadFile(modFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := modfile.Parse(modFile, data, nil)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do if we are profiling prism itself
+	if f.Module != nil && f.Module.Mod.Path == prismModulePath {
+		return nil
+	}
+
+	srcFS, err := profilerSources()
+	if err != nil {
+		return err
+	}
+
+	shimDir, err := filepath.Abs(filepath.Join(workDir, profilerShimDir))
+	if err != nil {
+		return err
+	}
+
+	err = copyProfilerSources(srcFS, shimDir)
+	if err != nil {
+		return err
+	}
+
+	err = f.AddRequire(prismModulePath, prismPseudoVersion)
+	if err != nil {
+		return err
+	}
+	err = f.AddReplace(prismModulePath, "", shimDir, "")
+	if err != nil {
+		return err
+	}
+	f.Cleanup()
+
+	data, err = f.Format()
+	if err != nil {
+		return err
+	}
+
+	if pkg.overlay == nil {
+		return ioutil.WriteFile(modFile, data, 0644)
+	}
+
+	// Write the updated go.mod and a copy of go.sum to the overlay folder
+	pkg.overlay.modFile = filepath.Join(pkg.overlay.dir, overlayModFile)
+	err = ioutil.WriteFile(pkg.overlay.modFile, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	sumFile := filepath.Join(pkg.ModuleRoot, "go.sum")
+	if _, err = os.Stat(sumFile); os.IsNotExist(err) {
+		return nil
+	}
+	return copyFile(sumFile, filepath.Join(pkg.overlay.dir, overlaySumFile))
+}
+
+// Get the sources for the profiler packages. The sources embedded in the
+// prism binary take precedence; if they are not available, we check the
+// location of the sources that prism was built from and then fall back to
+// scanning GOPATH.
+func profilerSources() (fs.FS, error) {
+	if ProfilerSources != nil {
+		return ProfilerSources, nil
+	}
+
+	candidates := make([]string, 0)
+	if _, thisFile, _, ok := runtime.Caller(0); ok {
+		candidates = append(candidates, filepath.Dir(filepath.Dir(thisFile)))
+	}
+	for _, goPath := range filepath.SplitList(build.Default.GOPATH) {
+		candidates = append(candidates, filepath.Join(goPath, "src", filepath.FromSlash(prismModulePath)))
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(filepath.Join(candidate, "profiler")); err == nil && info.IsDir() {
+			return os.DirFS(candidate), nil
+		}
+	}
+
+	return nil, errProfilerSourcesNotFound
+}
+
+// Copy the non-test go and assembly files for the profiler packages from
+// srcFS into dstDir and generate a go.mod file for them.
+func copyProfilerSources(srcFS fs.FS, dstDir string) error {
+	for _, pkgPath := range profilerPackages {
+		pkgDstDir := filepath.Join(dstDir, filepath.FromSlash(pkgPath))
+		err := os.MkdirAll(pkgDstDir, os.ModeDir|os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		goFiles, err := fs.Glob(srcFS, path.Join(pkgPath, "*.go"))
+		if err != nil {
+			return err
+		}
+		asmFiles, err := fs.Glob(srcFS, path.Join(pkgPath, "*.s"))
+		if err != nil {
+			return err
+		}
+		goFiles = append(goFiles, asmFiles...)
+
+		if len(goFiles) == 0 {
+			return errProfilerSourcesNotFound
+		}
+
+		for _, goFile := range goFiles {
+			if strings.HasSuffix(goFile, "_test.go") {
+				continue
+			}
+
+			data, err := fs.ReadFile(srcFS, goFile)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(filepath.Join(pkgDstDir, path.Base(goFile)), data, 0644)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return ioutil.WriteFile(
+		filepath.Join(dstDir, "go.mod"),
+		[]byte(fmt.Sprintf("module %s\n\ngo 1.18\n", prismModulePath)),
+		0644,
+	)
+}
+
+// Copy the contents of file src to dst.
+func copyFile(src, dst string) error {
+	fSrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fSrc.Close()
+
+	fDst, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer fDst.Close()
+
+	_, err = io.Copy(fDst, fSrc)
+	return err
+}
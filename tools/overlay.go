@@ -0,0 +1,117 @@
+package tools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// The name of the overlay description file passed to go build via the -overlay flag.
+	overlayFile = "overlay.json"
+
+	// The name of the go.mod replacement passed to go build via the -modfile flag.
+	// The go tool expects the matching go.sum file to be called prism.sum.
+	overlayModFile = "prism.mod"
+	overlaySumFile = "prism.sum"
+
+	// The folder (relative to the overlay dir) where patched files are stored.
+	overlaySrcDir = "src"
+)
+
+// overlay tracks the set of patched package files that should replace the
+// original package sources when building the project.
+type overlay struct {
+	// The folder where patched files and the overlay description are stored.
+	dir string
+
+	// A map of absolute paths for the original files to the absolute path of
+	// their patched copies.
+	replace map[string]string
+
+	// The path to a go.mod replacement file; empty unless LinkProfiler
+	// needed to modify the module's go.mod file.
+	modFile string
+}
+
+// EnableOverlay configures the package so that Patch and LinkProfiler never
+// modify the package sources. Instead, any modified file is written to
+// overlayDir together with an overlay description file that allows the go tool
+// to build the package using the patched files. The flags that need to be
+// passed to the go tool are returned by BuildFlags.
+func (pkg *GoPackage) EnableOverlay(overlayDir string) error {
+	absOverlayDir, err := filepath.Abs(overlayDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(absOverlayDir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	pkg.overlay = &overlay{
+		dir:     absOverlayDir,
+		replace: make(map[string]string, 0),
+	}
+
+	return nil
+}
+
+// BuildFlags returns back the list of flags that need to be passed to the go
+// tool when building a package patched with an overlay. If no overlay has
+// been enabled, BuildFlags returns an empty slice.
+func (pkg *GoPackage) BuildFlags() []string {
+	flags := make([]string, 0)
+	if pkg.overlay == nil {
+		return flags
+	}
+
+	flags = append(flags, "-overlay="+filepath.Join(pkg.overlay.dir, overlayFile))
+	if pkg.overlay.modFile != "" {
+		flags = append(flags, "-modfile="+pkg.overlay.modFile)
+	}
+
+	return flags
+}
+
+// Register filePath with the overlay and return back the path where its patched
+// version should be written to. The patched file path mirrors the location
+// of filePath relative to pathToPackage.
+func (o *overlay) add(pathToPackage, filePath string) (string, error) {
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := filepath.Rel(pathToPackage, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	dstPath := filepath.Join(o.dir, overlaySrcDir, relPath)
+	err = os.MkdirAll(filepath.Dir(dstPath), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	o.replace[absFilePath] = dstPath
+	return dstPath, nil
+}
+
+// Write the overlay description in the JSON format expected by go build.
+func (o *overlay) save() error {
+	data, err := json.MarshalIndent(
+		struct {
+			Replace map[string]string
+		}{o.replace},
+		"",
+		"  ",
+	)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(o.dir, overlayFile), data, 0644)
+}
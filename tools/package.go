@@ -17,6 +17,9 @@ import (
 
 var (
 	stripCharRegex = regexp.MustCompile(`[()*]`)
+
+	// SSA names user-defined init functions using an "init#N" format.
+	initFuncSuffixRegex = regexp.MustCompile(`#[0-9]+$`)
 )
 
 // PatchFunc is a function used to modify the AST for a go function matching a profile target. The
@@ -34,6 +37,10 @@ type PatchCmd struct {
 
 	// The patch function to apply to functions matching the target.
 	PatchFn PatchFunc
+
+	// An optional filter for pruning the callgraph of each target before
+	// applying the patch function.
+	Filter *CallGraphFilter
 }
 
 // Represents the contents of a parsed go file.
@@ -62,27 +69,53 @@ type GoPackage struct {
 	// only contains functions that can be used as profile injection points.
 	ssaFuncCandidates map[string]*ssa.Function
 
+	// A map of function literal locations to the FQ names of the anonymous
+	// SSA functions that represent them.
+	anonFuncNames map[string]string
+
 	// The GOPATH for loading package dependencies. We intentionally override it
 	// so that the workspace path where this package's sources exist is included first.
+	// This field is only populated for packages that are not part of a go module.
 	GOPATH string
+
+	// The folder containing the go.mod file for the module that this package
+	// belongs to. This field is empty if the package is not part of a go module.
+	ModuleRoot string
+
+	// If set, patched files are written to the overlay instead of
+	// overwriting the package sources.
+	overlay *overlay
 }
 
-// NewGoPackage analyzes all go files in pathToPackage as well as any other packages that are
-// referenced by them and constructs a static single-assignment representation of
-// the underlying code.
-func NewGoPackage(pathToPackage string) (*GoPackage, error) {
+// NewGoPackage analyzes all go files in pathToPackage and any of its sub-packages
+// as well as any other packages that are referenced by them and constructs a
+// static single-assignment representation of the underlying code. The optional
+// buildTags are taken into account when selecting the files to be analyzed.
+//
+// If pathToPackage belongs to a go module, its dependencies are resolved using
+// module-aware loading. Otherwise, pathToPackage is expected to reside inside
+// a go workspace.
+func NewGoPackage(pathToPackage string, buildTags ...string) (*GoPackage, error) {
 	// Detect FQN for project base package
 	fqPkgPrefix, err := qualifiedPkgName(pathToPackage)
 	if err != nil {
 		return nil, err
 	}
 
-	adjustedGoPath, err := adjustGoPath(pathToPackage)
+	moduleRoot, err := FindModuleRoot(pathToPackage)
 	if err != nil {
 		return nil, err
 	}
 
-	candidates, err := ssaCandidates(pathToPackage, fqPkgPrefix, adjustedGoPath)
+	var adjustedGoPath string
+	if moduleRoot == "" {
+		adjustedGoPath, err = adjustGoPath(pathToPackage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	candidates, err := ssaCandidates(pathToPackage, fqPkgPrefix, loadEnv(moduleRoot, adjustedGoPath), buildTags)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +124,9 @@ func NewGoPackage(pathToPackage string) (*GoPackage, error) {
 		pathToPackage:     pathToPackage,
 		PkgPrefix:         fqPkgPrefix,
 		ssaFuncCandidates: candidates,
+		anonFuncNames:     anonFuncNames(candidates),
 		GOPATH:            adjustedGoPath,
+		ModuleRoot:        moduleRoot,
 	}, nil
 }
 
@@ -120,26 +155,54 @@ func NewGoPackage(pathToPackage string) (*GoPackage, error) {
 // The injector targets for the two functions are defined as:
 //  github.com/geckoboard/foo/MoreStuff
 //  github.com/geckoboard/foo/Foo.DoStuff
+//
+// Targets may also be specified as patterns that expand to all matching
+// functions. Targets containing any of the '*', '?' or '[' characters are
+// treated as glob patterns (see path.Match) whereas targets starting with
+// the "re:" prefix are treated as regular expressions. For example, both of
+// the following patterns match the two functions defined above:
+//  github.com/geckoboard/foo/*
+//  re:^github.com/geckoboard/foo/.*Stuff$
 func (pkg *GoPackage) Find(targetList ...string) ([]ProfileTarget, error) {
-	profileTargets := make([]ProfileTarget, len(targetList))
-	var entrypointSSA *ssa.Function
-	for targetIndex, target := range targetList {
-		entrypointSSA = nil
-		for candidate, ssaFn := range pkg.ssaFuncCandidates {
-			if candidate == target {
-				entrypointSSA = ssaFn
-				break
-			}
+	profileTargets := make([]ProfileTarget, 0, len(targetList))
+	selectedTargets := make(map[string]struct{}, 0)
+	for _, target := range targetList {
+		pattern, err := parseTargetPattern(target)
+		if err != nil {
+			return nil, fmt.Errorf("GoPackage.Find: invalid profile target pattern %q: %s", target, err)
 		}
 
-		if entrypointSSA == nil {
-			return nil, fmt.Errorf("GoPackage.Find: no match for profile target %q", target)
+		var matches []string
+		var targetPattern string
+		if pattern == nil {
+			if _, exists := pkg.ssaFuncCandidates[target]; !exists {
+				if suggestions := pkg.suggestTargets(target); len(suggestions) != 0 {
+					return nil, fmt.Errorf("GoPackage.Find: no match for profile target %q; did you mean: %s", target, strings.Join(suggestions, ", "))
+				}
+				return nil, fmt.Errorf("GoPackage.Find: no match for profile target %q", target)
+			}
+			matches = []string{target}
+		} else {
+			matches = pkg.matchCandidates(pattern)
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("GoPackage.Find: no match for profile target pattern %q", target)
+			}
+			targetPattern = target
 		}
 
-		profileTargets[targetIndex] = ProfileTarget{
-			QualifiedName: target,
-			PkgPrefix:     pkg.PkgPrefix,
-			ssaFunc:       entrypointSSA,
+		for _, match := range matches {
+			// Skip targets already selected by a previous entry in the target list
+			if _, selected := selectedTargets[match]; selected {
+				continue
+			}
+			selectedTargets[match] = struct{}{}
+
+			profileTargets = append(profileTargets, ProfileTarget{
+				QualifiedName: match,
+				PkgPrefix:     pkg.PkgPrefix,
+				Pattern:       targetPattern,
+				ssaFunc:       pkg.ssaFuncCandidates[match],
+			})
 		}
 	}
 
@@ -151,7 +214,7 @@ func (pkg *GoPackage) Find(targetList ...string) ([]ProfileTarget, error) {
 // list of targets.
 //
 // This function will automatically overwrite any files that are modified by the
-// given patch function.
+// given patch function unless an overlay has been enabled via EnableOverlay.
 func (pkg *GoPackage) Patch(vendorPkgRegex []string, patchCmds ...PatchCmd) (updatedFiles int, patchCount int, err error) {
 	// Parse package sources
 	parsedFiles, err := parsePackageSources(pkg.pathToPackage, vendorPkgRegex)
@@ -162,7 +225,7 @@ func (pkg *GoPackage) Patch(vendorPkgRegex []string, patchCmds ...PatchCmd) (upd
 	// Expand the callgraph of hook targets and generate a visitor for each patch cmd
 	visitors := make([]*funcVisitor, len(patchCmds))
 	for cmdIndex, cmd := range patchCmds {
-		visitors[cmdIndex] = newFuncVisitor(uniqueTargetMap(cmd.Targets), cmd.PatchFn)
+		visitors[cmdIndex] = newFuncVisitor(uniqueTargetMap(cmd.Targets, cmd.Filter), pkg.anonFuncNames, cmd.PatchFn)
 	}
 
 	totalPatchCount := 0
@@ -178,29 +241,90 @@ func (pkg *GoPackage) Patch(vendorPkgRegex []string, patchCmds ...PatchCmd) (upd
 
 		// If the file was updated write it back to disk
 		if modifiedAST {
-			f, err := os.Create(parsedFile.filePath)
+			err = pkg.writePatchedFile(parsedFile)
 			if err != nil {
 				return 0, 0, err
 			}
-			printer.Fprint(f, parsedFile.fset, parsedFile.astFile)
-			f.Close()
 			updatedFiles++
 		}
 	}
 
+	if pkg.overlay != nil {
+		err = pkg.overlay.save()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
 	return updatedFiles, totalPatchCount, err
 }
 
-// For each profile target, discover all reachable functions in its callgraph and
-// generate a map where keys are the FQ name of each callgraph node and values
-// are the callgraph nodes.
-func uniqueTargetMap(targets []ProfileTarget) map[string]*CallGraphNode {
-	uniqueTargets := make(map[string]*CallGraphNode, 0)
-	for _, target := range targets {
+// Write the modified AST for a parsed file back to disk. If an overlay has
+// been enabled, the file is written to the overlay folder instead.
+func (pkg *GoPackage) writePatchedFile(parsedFile *parsedGoFile) error {
+	dstPath := parsedFile.filePath
+	if pkg.overlay != nil {
+		var err error
+		dstPath, err = pkg.overlay.add(pkg.pathToPackage, parsedFile.filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return printer.Fprint(f, parsedFile.fset, parsedFile.astFile)
+}
+
+// For each profile target, discover all reachable functions in its callgraph,
+// prune them using the supplied filter and generate a map where keys are the FQ
+// name of each callgraph node and values are the callgraph nodes.
+//
+// When a function appears in more than one callgraph, the nodes are merged
+// using the following rules so that the result does not depend on the order of
+// the targets:
+//  - the merged node is assigned the min depth of all merged nodes. As a result,
+//    profile targets always retain a depth of 0.
+//  - profile targets that can be reached via a call from any callgraph
+//    (including their own) are flagged as nested targets.
+func uniqueTargetMap(targets []ProfileTarget, filter *CallGraphFilter) map[string]*CallGraphNode {
+	graphs := make([]CallGraph, len(targets))
+	reachable := make(map[string]struct{}, 0)
+	for index, target := range targets {
 		cg := target.CallGraph()
+
+		// Pruned nodes are still invoked at runtime so we need to collect
+		// the callees before applying the filter
 		for _, cgNode := range cg {
-			uniqueTargets[cgNode.Name] = cgNode
+			for _, callee := range cgNode.Callees {
+				reachable[callee] = struct{}{}
+			}
+		}
+
+		graphs[index] = filter.Prune(cg)
+	}
+
+	uniqueTargets := make(map[string]*CallGraphNode, 0)
+	for _, cg := range graphs {
+		for _, cgNode := range cg {
+			existing := uniqueTargets[cgNode.Name]
+			if existing == nil || cgNode.Depth < existing.Depth {
+				merged := *cgNode
+				uniqueTargets[cgNode.Name] = &merged
+			}
+		}
+	}
+
+	for _, target := range targets {
+		cgNode := uniqueTargets[target.QualifiedName]
+		if cgNode == nil {
+			continue
 		}
+		_, cgNode.NestedTarget = reachable[target.QualifiedName]
 	}
 
 	return uniqueTargets
@@ -1,12 +1,18 @@
 package tools
 
 import (
+	"encoding/json"
 	"fmt"
 	"go/ast"
+	"io/fs"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestNewGoPackage(t *testing.T) {
@@ -37,6 +43,107 @@ func TestNewGoPackage(t *testing.T) {
 	}
 }
 
+func TestNewGoPackageInModule(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkg.PkgPrefix != pkgName {
+		t.Fatalf("expected PkgPrefix to be %q; got %q", pkgName, pkg.PkgPrefix)
+	}
+
+	expModuleRoot, _ := filepath.Abs(moduleDir)
+	if pkg.ModuleRoot != expModuleRoot {
+		t.Fatalf("expected ModuleRoot to be %q; got %q", expModuleRoot, pkg.ModuleRoot)
+	}
+
+	if pkg.GOPATH != "" {
+		t.Fatalf("expected GOPATH to be empty for packages inside a module; got %q", pkg.GOPATH)
+	}
+
+	_, err = pkg.Find(pkgName+"/main", pkgName+"/other/DoStuff")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkProfiler(t *testing.T) {
+	moduleDir, pkgDir, _ := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	workDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.LinkProfiler(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modData, err := ioutil.ReadFile(moduleDir + "/go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shimDir, _ := filepath.Abs(filepath.Join(workDir, profilerShimDir))
+	expDirectives := []string{
+		fmt.Sprintf("require %s %s", prismModulePath, prismPseudoVersion),
+		fmt.Sprintf("replace %s => %s", prismModulePath, shimDir),
+	}
+	for _, expDirective := range expDirectives {
+		if !strings.Contains(string(modData), expDirective) {
+			t.Errorf("expected go.mod to contain %q; got:\n%s", expDirective, string(modData))
+		}
+	}
+
+	for _, pkgPath := range profilerPackages {
+		goFiles, _ := filepath.Glob(filepath.Join(shimDir, pkgPath, "*.go"))
+		if len(goFiles) == 0 {
+			t.Errorf("expected profiler package %q to be copied to %s", pkgPath, shimDir)
+		}
+		for _, goFile := range goFiles {
+			if strings.HasSuffix(goFile, "_test.go") {
+				t.Errorf("unexpected test file %s in profiler package copy", goFile)
+			}
+		}
+	}
+
+	asmFiles, _ := filepath.Glob(filepath.Join(shimDir, "profiler", "*.s"))
+	if len(asmFiles) == 0 {
+		t.Errorf("expected profiler package assembly files to be copied to %s", shimDir)
+	}
+}
+
+func TestLinkProfilerOutsideModule(t *testing.T) {
+	wsDir, pkgDir, _ := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.LinkProfiler(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(wsDir, profilerShimDir)); !os.IsNotExist(err) {
+		t.Fatal("expected LinkProfiler to be a no-op for packages outside a module")
+	}
+}
+
 func TestFindTarget(t *testing.T) {
 	wsDir, pkgDir, pkgName := mockPackage(t)
 	defer os.RemoveAll(wsDir)
@@ -120,6 +227,142 @@ func TestPatchPackageExcludingDeps(t *testing.T) {
 	}
 }
 
+func TestPatchPackageWithCallGraphFilter(t *testing.T) {
+	wsDir, pkgDir, pkgName := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetList, err := pkg.Find(pkgName + "/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := NewCallGraphFilter(1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patchedFuncs := make([]string, 0)
+	dummyPatchCmd := PatchCmd{
+		Targets: targetList,
+		PatchFn: func(cgNode *CallGraphNode, _ *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
+			patchedFuncs = append(patchedFuncs, cgNode.Name)
+			return true, nil
+		},
+		Filter: filter,
+	}
+	_, patchCount, err := pkg.Patch([]string{}, dummyPatchCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter should prune A.DoStuff which is 2 hops away from main
+	expPatchCount := 2
+	if patchCount != expPatchCount {
+		t.Fatalf("expected Patch() to apply %d patches; got %d (%v)", expPatchCount, patchCount, patchedFuncs)
+	}
+
+	if included, excluded := filter.Counts(); included != 2 || excluded != 1 {
+		t.Fatalf("expected filter counts to be (2, 1); got (%d, %d)", included, excluded)
+	}
+}
+
+func TestUniqueTargetMapWithOverlappingTargets(t *testing.T) {
+	wsDir, pkgDir, pkgName := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type expNode struct {
+		Depth        int
+		NestedTarget bool
+	}
+	expNodes := map[string]expNode{
+		pkgName + "/main":      {0, false},
+		pkgName + "/DoStuff":   {1, false},
+		pkgName + "/A.DoStuff": {0, true},
+	}
+
+	// The merged nodes should not depend on the target order
+	specs := [][]string{
+		{pkgName + "/main", pkgName + "/A.DoStuff"},
+		{pkgName + "/A.DoStuff", pkgName + "/main"},
+	}
+
+	for specIndex, spec := range specs {
+		targetList, err := pkg.Find(spec...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		targetMap := uniqueTargetMap(targetList, nil)
+		if len(targetMap) != len(expNodes) {
+			t.Errorf("[spec %d] expected target map to contain %d entries; got %d", specIndex, len(expNodes), len(targetMap))
+			continue
+		}
+
+		for name, exp := range expNodes {
+			cgNode := targetMap[name]
+			if cgNode == nil {
+				t.Errorf("[spec %d] expected target map to contain an entry for %q", specIndex, name)
+				continue
+			}
+
+			if cgNode.Depth != exp.Depth || cgNode.NestedTarget != exp.NestedTarget {
+				t.Errorf("[spec %d] expected node %q to have depth %d and nested target flag %t; got %d, %t", specIndex, name, exp.Depth, exp.NestedTarget, cgNode.Depth, cgNode.NestedTarget)
+			}
+		}
+	}
+}
+
+func TestPatchFunctionLiterals(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModuleWithClosures(t)
+	defer os.RemoveAll(moduleDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetList, err := pkg.Find(pkgName+"/DoStuff", pkgName+"/init$1", pkgName+"/init#1$1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patchedFuncs := make(map[string]int, 0)
+	dummyPatchCmd := PatchCmd{
+		Targets: targetList,
+		PatchFn: func(cgNode *CallGraphNode, _ *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
+			patchedFuncs[cgNode.Name] = cgNode.Depth
+			return true, nil
+		},
+	}
+	_, _, err = pkg.Patch([]string{}, dummyPatchCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// work() is reachable from both targets so it gets the min depth
+	expPatchedFuncs := map[string]int{
+		pkgName + "/DoStuff":     0,
+		pkgName + "/DoStuff$1":   1,
+		pkgName + "/DoStuff$1$1": 2,
+		pkgName + "/work":        1,
+		pkgName + "/init$1":      0,
+		pkgName + "/init#1$1":    0,
+	}
+	if !reflect.DeepEqual(patchedFuncs, expPatchedFuncs) {
+		t.Fatalf("expected Patch() to patch %v; got %v", expPatchedFuncs, patchedFuncs)
+	}
+}
+
 func TestPatchPackageIncludingGodeps(t *testing.T) {
 	wsDir, pkgDir, pkgName := mockPackageWithVendoredDeps(t, true)
 	defer os.RemoveAll(wsDir)
@@ -234,3 +477,246 @@ func TestPatchPackageWithInvalidVendorRegex(t *testing.T) {
 		t.Fatalf("expected to get a regex compilation error; got %v", err)
 	}
 }
+
+func TestPatchPackageWithOverlay(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	overlayDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(overlayDir)
+
+	origSrc, err := ioutil.ReadFile(pkgDir + "src.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origMod, err := ioutil.ReadFile(pkgDir + "go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.EnableOverlay(overlayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.LinkProfiler(overlayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetList, err := pkg.Find(pkgName + "/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dummyPatchCmd := PatchCmd{
+		Targets: targetList,
+		PatchFn: func(_ *CallGraphNode, fnDecl *ast.BlockStmt) (modifiedAST bool, extraImports []string) {
+			fnDecl.List = nil
+			return true, nil
+		},
+	}
+	updatedFiles, _, err := pkg.Patch(nil, dummyPatchCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expUpdatedFiles := 2
+	if updatedFiles != expUpdatedFiles {
+		t.Fatalf("expected Patch() to update %d files; got %d", expUpdatedFiles, updatedFiles)
+	}
+
+	// Original files should not be modified
+	if src, _ := ioutil.ReadFile(pkgDir + "src.go"); string(src) != string(origSrc) {
+		t.Fatal("expected Patch() to leave the original package sources untouched")
+	}
+	if mod, _ := ioutil.ReadFile(pkgDir + "go.mod"); string(mod) != string(origMod) {
+		t.Fatal("expected LinkProfiler() to leave the original go.mod untouched")
+	}
+
+	// Check overlay contents
+	data, err := ioutil.ReadFile(filepath.Join(overlayDir, overlayFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlaySpec struct {
+		Replace map[string]string
+	}
+	err = json.Unmarshal(data, &overlaySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(overlaySpec.Replace) != expUpdatedFiles {
+		t.Fatalf("expected overlay to replace %d files; got %d", expUpdatedFiles, len(overlaySpec.Replace))
+	}
+
+	absPkgDir, _ := filepath.Abs(pkgDir)
+	for _, file := range []string{"src.go", "other/src.go"} {
+		origPath := filepath.Join(absPkgDir, file)
+		patchedPath := overlaySpec.Replace[origPath]
+		expPatchedPath := filepath.Join(overlayDir, overlaySrcDir, file)
+		if patchedPath != expPatchedPath {
+			t.Errorf("expected overlay to replace %q with %q; got %q", origPath, expPatchedPath, patchedPath)
+		}
+		if _, err = os.Stat(patchedPath); err != nil {
+			t.Errorf("expected patched file %q to exist; got %v", patchedPath, err)
+		}
+	}
+
+	expFlags := []string{
+		"-overlay=" + filepath.Join(overlayDir, overlayFile),
+		"-modfile=" + filepath.Join(overlayDir, overlayModFile),
+	}
+	if flags := pkg.BuildFlags(); !reflect.DeepEqual(flags, expFlags) {
+		t.Fatalf("expected build flags to be %v; got %v", expFlags, flags)
+	}
+}
+
+func TestLinkProfilerWithEmbeddedSources(t *testing.T) {
+	moduleDir, pkgDir, _ := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	workDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	defer func(origSources fs.FS) { ProfilerSources = origSources }(ProfilerSources)
+	ProfilerSources = fstest.MapFS{
+		"profiler/profiler.go":      &fstest.MapFile{Data: []byte("package profiler\n")},
+		"profiler/profiler_test.go": &fstest.MapFile{Data: []byte("package profiler\n")},
+		"profiler/getg_amd64.s":     &fstest.MapFile{Data: []byte("// asm\n")},
+		"profiler/sink/sink.go":     &fstest.MapFile{Data: []byte("package sink\n")},
+	}
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.LinkProfiler(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shimDir := filepath.Join(workDir, profilerShimDir)
+	expFiles := []string{"go.mod", "profiler/profiler.go", "profiler/getg_amd64.s", "profiler/sink/sink.go"}
+	for _, expFile := range expFiles {
+		if _, err = os.Stat(filepath.Join(shimDir, filepath.FromSlash(expFile))); err != nil {
+			t.Errorf("expected embedded source %q to be copied to %s; got %v", expFile, shimDir, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(shimDir, "profiler", "profiler_test.go")); !os.IsNotExist(err) {
+		t.Error("unexpected test file in profiler package copy")
+	}
+}
+
+func TestLinkProfilerWithMissingSources(t *testing.T) {
+	moduleDir, pkgDir, _ := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	workDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	defer func(origSources fs.FS) { ProfilerSources = origSources }(ProfilerSources)
+	ProfilerSources = fstest.MapFS{}
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pkg.LinkProfiler(workDir)
+	if err != errProfilerSourcesNotFound {
+		t.Fatalf("expected to get errProfilerSourcesNotFound; got %v", err)
+	}
+}
+
+func TestPatchGenericGoStmtsWithAsyncProfiler(t *testing.T) {
+	pkgName := "github.com/geckoboard/prism-mock"
+	moduleDir := writeMockModule(t, map[string]string{
+		"go.mod": `
+module ` + pkgName + `
+
+go 1.18
+`,
+		"src.go": `
+package main
+
+import "sync"
+
+var wg sync.WaitGroup
+
+func process[T any](items []T) {
+	defer wg.Done()
+}
+
+func worker(id int) {
+	defer wg.Done()
+}
+
+func DoStuff() {
+	items := []int{1, 2}
+	wg.Add(4)
+	go process(items)
+	go process[int](items)
+	go worker(1)
+	go func() {
+		defer wg.Done()
+	}()
+	wg.Wait()
+}
+
+func main() {
+	DoStuff()
+}
+`,
+	})
+	defer os.RemoveAll(moduleDir)
+
+	pkg, err := NewGoPackage(moduleDir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetList, err := pkg.Find(pkgName + "/DoStuff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = pkg.Patch(nil, PatchCmd{Targets: targetList, PatchFn: InjectAsyncProfiler()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := ioutil.ReadFile(moduleDir + "/src.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Generic functions can only be wrapped if they are explicitly instantiated
+	expStmts := []string{
+		`go process(items)`,
+		`go prismProfiler.Async(process[int], "go process[int]")(items)`,
+		`go prismProfiler.Async(worker, "go worker")(1)`,
+		`go prismProfiler.Async(func() {`,
+	}
+	for _, expStmt := range expStmts {
+		if !strings.Contains(string(src), expStmt) {
+			t.Errorf("expected patched source to contain %q; got:\n%s", expStmt, src)
+		}
+	}
+}
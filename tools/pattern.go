@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// Profile targets starting with this prefix are treated as regular expressions.
+	regexTargetPrefix = "re:"
+
+	// Profile targets containing any of these characters are treated as glob patterns.
+	globTargetChars = "*?["
+
+	// The separator used by SSA in the names of anonymous functions (e.g. "DoStuff$1").
+	closureNameSeparator = "$"
+)
+
+// targetPattern matches fully qualified function names against a glob or
+// regular expression profile target.
+type targetPattern struct {
+	// A glob pattern using the syntax supported by path.Match. A '*' character
+	// matches any sequence of characters except the '/' separator.
+	glob string
+
+	// A compiled regular expression; nil if this is a glob pattern.
+	regex *regexp.Regexp
+}
+
+// Parse a profile target into a targetPattern. If the target does not contain
+// a glob pattern and does not start with the regex prefix then parseTargetPattern
+// returns a nil targetPattern to indicate that the target should be matched
+// exactly.
+func parseTargetPattern(target string) (*targetPattern, error) {
+	if strings.HasPrefix(target, regexTargetPrefix) {
+		regex, err := regexp.Compile(strings.TrimPrefix(target, regexTargetPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return &targetPattern{regex: regex}, nil
+	}
+
+	if !strings.ContainsAny(target, globTargetChars) {
+		return nil, nil
+	}
+
+	// Validate glob syntax
+	if _, err := path.Match(target, ""); err != nil {
+		return nil, err
+	}
+	return &targetPattern{glob: target}, nil
+}
+
+// Match returns true if the fully qualified function name matches the pattern.
+func (p *targetPattern) Match(fqName string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(fqName)
+	}
+
+	matched, _ := path.Match(p.glob, fqName)
+	return matched
+}
+
+// MatchesClosures returns true if the pattern explicitly refers to anonymous
+// functions by including the SSA closure name separator.
+func (p *targetPattern) MatchesClosures() bool {
+	if p.regex != nil {
+		return strings.Contains(p.regex.String(), `\`+closureNameSeparator)
+	}
+
+	return strings.Contains(p.glob, closureNameSeparator)
+}
+
+// Return the sorted list of SSA function candidates whose fully qualified
+// names match the given pattern. Any synthetic functions (e.g. wrappers
+// generated by the compiler) are excluded from the match list. Anonymous
+// functions are only included if the pattern explicitly refers to them; they
+// are otherwise instrumented via the callgraph of their enclosing function.
+func (pkg *GoPackage) matchCandidates(pattern *targetPattern) []string {
+	matches := make([]string, 0)
+	matchClosures := pattern.MatchesClosures()
+	for candidate, ssaFn := range pkg.ssaFuncCandidates {
+		if ssaFn.Synthetic != "" || (ssaFn.Parent() != nil && !matchClosures) || !pattern.Match(candidate) {
+			continue
+		}
+		matches = append(matches, candidate)
+	}
+
+	sort.Strings(matches)
+	return matches
+}
@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetPattern(t *testing.T) {
+	specs := []struct {
+		Target     string
+		ExpPattern bool
+		ExpError   bool
+	}{
+		{"github.com/foo/bar/DoStuff", false, false},
+		{"github.com/foo/bar/*.DoStuff", true, false},
+		{"github.com/foo/bar/DoStuf?", true, false},
+		{"github.com/foo/bar/[AB].DoStuff", true, false},
+		{"github.com/foo/bar/[AB.DoStuff", false, true},
+		{"re:^github.com/foo/bar/.*", true, false},
+		{"re:^github.com/foo/bar/(.*", false, true},
+	}
+
+	for specIndex, spec := range specs {
+		pattern, err := parseTargetPattern(spec.Target)
+		if spec.ExpError {
+			if err == nil {
+				t.Errorf("[spec %d] expected to get an error", specIndex)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if (pattern != nil) != spec.ExpPattern {
+			t.Errorf("[spec %d] expected target to be parsed as a pattern: %t", specIndex, spec.ExpPattern)
+		}
+	}
+}
+
+func TestTargetPatternMatch(t *testing.T) {
+	specs := []struct {
+		Target   string
+		FqName   string
+		ExpMatch bool
+	}{
+		{"github.com/acme/api/handlers/*.Serve*", "github.com/acme/api/handlers/Users.ServeHTTP", true},
+		{"github.com/acme/api/handlers/*.Serve*", "github.com/acme/api/handlers/Users.Handle", false},
+		// Glob wildcards do not match the package separator
+		{"github.com/acme/api/*", "github.com/acme/api/handlers/Users.ServeHTTP", false},
+		{`re:^github.com/acme/api/store/.*\.Get`, "github.com/acme/api/store/Users.GetByID", true},
+		{`re:^github.com/acme/api/store/.*\.Get`, "github.com/acme/api/store/Users.Delete", false},
+		{`re:.*\.Get`, "github.com/acme/api/store/Users.GetByID", true},
+	}
+
+	for specIndex, spec := range specs {
+		pattern, err := parseTargetPattern(spec.Target)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if match := pattern.Match(spec.FqName); match != spec.ExpMatch {
+			t.Errorf("[spec %d] expected match of %q against %q to be %t; got %t", specIndex, spec.FqName, spec.Target, spec.ExpMatch, match)
+		}
+	}
+}
+
+func TestFindTargetPatterns(t *testing.T) {
+	wsDir, pkgDir, pkgName := mockPackage(t)
+	defer os.RemoveAll(wsDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		Targets    []string
+		ExpTargets []string
+	}{
+		{
+			[]string{pkgName + "/*DoStuff"},
+			[]string{pkgName + "/A.DoStuff", pkgName + "/DoStuff"},
+		},
+		{
+			[]string{"re:^" + pkgName + `/A\.`},
+			[]string{pkgName + "/A.DoStuff"},
+		},
+		// Targets selected by more than one entry should only be included
+		// once; synthetic functions like the package initializer are never
+		// selected by a pattern
+		{
+			[]string{pkgName + "/main", pkgName + "/*", "re:DoStuff$"},
+			[]string{pkgName + "/main", pkgName + "/A.DoStuff", pkgName + "/DoStuff"},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		targetList, err := pkg.Find(spec.Targets...)
+		if err != nil {
+			t.Errorf("[spec %d] %s", specIndex, err)
+			continue
+		}
+
+		targetNames := make([]string, len(targetList))
+		for index, target := range targetList {
+			targetNames[index] = target.QualifiedName
+			if target.ssaFunc == nil {
+				t.Errorf("[spec %d] expected target %q to have a non-nil SSA function", specIndex, target.QualifiedName)
+			}
+		}
+
+		if !reflect.DeepEqual(targetNames, spec.ExpTargets) {
+			t.Errorf("[spec %d] expected targets %v to expand to %v; got %v", specIndex, spec.Targets, spec.ExpTargets, targetNames)
+		}
+	}
+
+	_, err = pkg.Find(pkgName + "/*.Missing")
+	expError := `GoPackage.Find: no match for profile target pattern "` + pkgName + `/*.Missing"`
+	if err == nil || err.Error() != expError {
+		t.Fatalf("expected to get error %q; got: %v", expError, err)
+	}
+}
+
+func TestFindTargetPatternsWithClosures(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModuleWithClosures(t)
+	defer os.RemoveAll(moduleDir)
+
+	pkg, err := NewGoPackage(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		Targets    []string
+		ExpTargets []string
+	}{
+		// Anonymous functions are not selected unless the pattern
+		// explicitly refers to them
+		{
+			[]string{pkgName + "/*"},
+			[]string{pkgName + "/DoStuff", pkgName + "/init#1", pkgName + "/main", pkgName + "/work"},
+		},
+		{
+			[]string{"re:^" + pkgName + "/DoStuff"},
+			[]string{pkgName + "/DoStuff"},
+		},
+		{
+			[]string{pkgName + "/DoStuff$?"},
+			[]string{pkgName + "/DoStuff$1"},
+		},
+		{
+			[]string{"re:^" + pkgName + `/DoStuff\$`},
+			[]string{pkgName + "/DoStuff$1", pkgName + "/DoStuff$1$1"},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		targetList, err := pkg.Find(spec.Targets...)
+		if err != nil {
+			t.Errorf("[spec %d] %s", specIndex, err)
+			continue
+		}
+
+		targetNames := make([]string, len(targetList))
+		for index, target := range targetList {
+			targetNames[index] = target.QualifiedName
+		}
+
+		if !reflect.DeepEqual(targetNames, spec.ExpTargets) {
+			t.Errorf("[spec %d] expected targets %v to expand to %v; got %v", specIndex, spec.Targets, spec.ExpTargets, targetNames)
+		}
+	}
+}
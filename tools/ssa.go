@@ -2,18 +2,28 @@ package tools
 
 import (
 	"fmt"
-	"go/build"
+	"os"
 	"path/filepath"
 	"strings"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/go/ssa"
 	"golang.org/x/tools/go/ssa/ssautil"
 )
 
-// Collect the set of go files that comprise a package and its included
-// sub-packages and create a static single-assignment representation
-// of the source code.
+const (
+	// The information that needs to be loaded by go/packages so we can
+	// construct the SSA representation of the loaded packages.
+	loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+		packages.NeedImports | packages.NeedDeps | packages.NeedTypes |
+		packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedTypesSizes
+)
+
+// Load all packages under pathToPackage (including any nested sub-packages)
+// together with their dependencies and create a static single-assignment
+// representation of the source code. The env and buildTags arguments are passed
+// to the go tool when resolving packages so that build constraints and cgo
+// settings are applied in the same way as when building the project.
 //
 // Process the list of SSA function representations exposed by the program and
 // select the entries that can be used as injector targets. An entry is considered
@@ -21,28 +31,53 @@ import (
 // package name.
 //
 // The function maps valid entries to their fully qualified names and returns them as a map.
-func ssaCandidates(pathToPackage, fqPkgPrefix, goPath string) (map[string]*ssa.Function, error) {
-	// Fetch all package-wide go files and pass them to a loader
-	goFiles, err := filepath.Glob(fmt.Sprintf("%s*.go", pathToPackage))
+func ssaCandidates(pathToPackage, fqPkgPrefix string, env, buildTags []string) (map[string]*ssa.Function, error) {
+	cfg := &packages.Config{
+		Mode: loadMode,
+		Dir:  pathToPackage,
+		Env:  env,
+	}
+	if len(buildTags) != 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(buildTags, ",")}
+	}
+
+	loadedPkgs, err := packages.Load(cfg, "./...")
 	if err != nil {
 		return nil, err
 	}
 
-	var conf loader.Config
-	conf.CreateFromFilenames(fqPkgPrefix, goFiles...)
-	conf.Build = &build.Default
-	conf.Build.GOPATH = goPath
-	conf.Cwd = pathToPackage
-	loadedProg, err := conf.Load()
+	// Report the first error encountered while loading packages
+	packages.Visit(loadedPkgs, nil, func(pkg *packages.Package) {
+		if err == nil && len(pkg.Errors) != 0 {
+			err = pkg.Errors[0]
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	// Convert to SSA format
-	ssaProg := ssautil.CreateProgram(loadedProg, ssa.BuilderMode(0))
+	ssaProg, _ := ssautil.AllPackages(loadedPkgs, ssa.BuilderMode(0))
 	ssaProg.Build()
 
-	// Build candidate map
+	return filterCandidates(ssaProg, fqPkgPrefix), nil
+}
+
+// Generate the environment for the go tool invocations performed while loading
+// packages. Packages inside a go module are loaded in module-aware mode; for
+// any other package we use the supplied GOPATH.
+func loadEnv(moduleRoot, goPath string) []string {
+	if moduleRoot != "" {
+		return append(os.Environ(), "GO111MODULE=on")
+	}
+
+	return append(os.Environ(), "GO111MODULE=off", "GOPATH="+goPath)
+}
+
+// Select the SSA functions that can be used as injector targets. An entry is
+// considered to be a valid target if its fully qualified name starts with the
+// supplied package name.
+func filterCandidates(ssaProg *ssa.Program, fqPkgPrefix string) map[string]*ssa.Function {
 	candidates := make(map[string]*ssa.Function, 0)
 	for ssaFn := range ssautil.AllFunctions(ssaProg) {
 		target := ssaQualifiedFuncName(ssaFn)
@@ -50,7 +85,32 @@ func ssaCandidates(pathToPackage, fqPkgPrefix, goPath string) (map[string]*ssa.F
 			candidates[target] = ssaFn
 		}
 	}
-	return candidates, nil
+	return candidates
+}
+
+// Map the location of each anonymous function in the candidate list to its
+// fully qualified name (e.g. "github.com/foo/bar/DoStuff$1"). The location
+// keys are generated by anonFuncKey using the top-level function that encloses
+// the anonymous function. As the AST does not distinguish between multiple
+// user-defined init functions, the "#N" suffix is stripped from their names.
+func anonFuncNames(candidates map[string]*ssa.Function) map[string]string {
+	anonFuncs := make(map[string]string, 0)
+	for fqName, ssaFn := range candidates {
+		if ssaFn.Parent() == nil || !ssaFn.Pos().IsValid() {
+			continue
+		}
+
+		enclosingFn := ssaFn.Parent()
+		for enclosingFn.Parent() != nil {
+			enclosingFn = enclosingFn.Parent()
+		}
+
+		enclosingFnName := initFuncSuffixRegex.ReplaceAllString(ssaQualifiedFuncName(enclosingFn), "")
+		pos := ssaFn.Prog.Fset.Position(ssaFn.Pos())
+		anonFuncs[anonFuncKey(enclosingFnName, pos)] = fqName
+	}
+
+	return anonFuncs
 }
 
 // Generate fully qualified name for SSA function representation that includes
@@ -71,16 +131,29 @@ func ssaQualifiedFuncName(fn *ssa.Function) string {
 	return normalized
 }
 
-// Construct fully qualified package name from a file path by stripping the
-// go workspace location from its absolute path representation.
+// Construct fully qualified package name from a file path. If the path belongs
+// to a go module, the name is derived from the module path defined in its go.mod
+// file. Otherwise, the name is obtained by stripping the go workspace location
+// from its absolute path representation.
 func qualifiedPkgName(pathToPackage string) (string, error) {
 	absPackageDir, err := filepath.Abs(filepath.Dir(pathToPackage))
 	if err != nil {
 		return "", err
 	}
 
-	skipLen := strings.Index(absPackageDir, "/src/") + 5
-	return absPackageDir[skipLen:], nil
+	moduleRoot, err := FindModuleRoot(pathToPackage)
+	if err != nil {
+		return "", err
+	}
+	if moduleRoot != "" {
+		return moduleQualifiedPkgName(moduleRoot, absPackageDir)
+	}
+
+	skipLen := strings.Index(absPackageDir, "/src/")
+	if skipLen == -1 {
+		return "", fmt.Errorf("%s is neither part of a go module nor located inside a go workspace", absPackageDir)
+	}
+	return absPackageDir[skipLen+5:], nil
 }
 
 // Get the go workspace location from an absolute package path.
@@ -91,5 +164,8 @@ func packageWorkspace(pathToPackage string) (string, error) {
 	}
 
 	skipLen := strings.Index(absPackageDir, "/src/")
+	if skipLen == -1 {
+		return "", fmt.Errorf("%s is not located inside a go workspace", absPackageDir)
+	}
 	return absPackageDir[:skipLen], nil
 }
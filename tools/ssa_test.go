@@ -1,8 +1,11 @@
 package tools
 
 import (
+	"go/token"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -32,6 +35,47 @@ func TestQualifiedPkgName(t *testing.T) {
 	}
 }
 
+func TestQualifiedPkgNameInModule(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	specs := []struct {
+		Path       string
+		ExpPkgName string
+	}{
+		{pkgDir, pkgName},
+		{pkgDir + "src.go", pkgName},
+		{pkgDir + "other/", pkgName + "/other"},
+		{pkgDir + "other/src.go", pkgName + "/other"},
+		{pkgDir + "vendor/github.com/foo/bar/src.go", "github.com/foo/bar"},
+	}
+
+	for specIndex, spec := range specs {
+		pkgName, err := qualifiedPkgName(spec.Path)
+		if err != nil {
+			t.Errorf("[spec %d] %s", specIndex, err)
+			continue
+		}
+
+		if pkgName != spec.ExpPkgName {
+			t.Errorf("[spec %d] expected qualified package name to be %q; got %q", specIndex, spec.ExpPkgName, pkgName)
+		}
+	}
+}
+
+func TestQualifiedPkgNameOutsideWorkspace(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = qualifiedPkgName(tmpDir + "/")
+	if err == nil || !strings.Contains(err.Error(), "neither part of a go module nor located inside a go workspace") {
+		t.Fatalf("expected to get an error for a package outside of a module or workspace; got %v", err)
+	}
+}
+
 func TestPackageWorkspace(t *testing.T) {
 	_, pathToTestFile, _, ok := runtime.Caller(0)
 	if !ok {
@@ -60,7 +104,7 @@ func TestSSACandidates(t *testing.T) {
 	wsDir, pkgDir, pkgName := mockPackage(t)
 	defer os.RemoveAll(wsDir)
 
-	candidates, err := ssaCandidates(pkgDir, pkgName, wsDir)
+	candidates, err := ssaCandidates(pkgDir, pkgName, loadEnv("", wsDir), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,6 +128,114 @@ func TestSSACandidates(t *testing.T) {
 	}
 }
 
+func TestSSACandidatesInModule(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	candidates, err := ssaCandidates(pkgDir, pkgName, loadEnv(moduleDir, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validFqNames := map[string]struct{}{
+		pkgName + "/A.DoStuff":     struct{}{},
+		pkgName + "/DoStuff":       struct{}{},
+		pkgName + "/main":          struct{}{},
+		pkgName + "/init":          struct{}{},
+		pkgName + "/other/DoStuff": struct{}{},
+		pkgName + "/other/init":    struct{}{},
+	}
+	if len(candidates) != len(validFqNames) {
+		t.Fatalf("expected to get back %d SSA function candidates; got %d", len(validFqNames), len(candidates))
+	}
+
+	for fqName := range candidates {
+		if _, valid := validFqNames[fqName]; !valid {
+			t.Errorf("unexpected fq name %q", fqName)
+		}
+	}
+}
+
+func TestAnonFuncNames(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModuleWithClosures(t)
+	defer os.RemoveAll(moduleDir)
+
+	candidates, err := ssaCandidates(pkgDir, pkgName, loadEnv(moduleDir, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcFile := moduleDir + "/src.go"
+	expNames := map[string]string{
+		anonFuncKey(pkgName+"/init", token.Position{Filename: srcFile, Line: 6, Column: 15}):    pkgName + "/init$1",
+		anonFuncKey(pkgName+"/DoStuff", token.Position{Filename: srcFile, Line: 16, Column: 5}): pkgName + "/DoStuff$1",
+		anonFuncKey(pkgName+"/DoStuff", token.Position{Filename: srcFile, Line: 18, Column: 3}): pkgName + "/DoStuff$1$1",
+		anonFuncKey(pkgName+"/init", token.Position{Filename: srcFile, Line: 31, Column: 2}):    pkgName + "/init#1$1",
+	}
+
+	anonFuncs := anonFuncNames(candidates)
+	if !reflect.DeepEqual(anonFuncs, expNames) {
+		t.Fatalf("expected anonymous function names to be %v; got %v", expNames, anonFuncs)
+	}
+}
+
+func TestSSACandidatesWithBuildTagsAndUnreachedSubPackages(t *testing.T) {
+	moduleDir, pkgDir, pkgName := mockModule(t)
+	defer os.RemoveAll(moduleDir)
+
+	extraFiles := map[string]string{
+		// Sub-package that is not imported by the root package
+		"unused/src.go": `
+package unused
+
+func DoStuff(){
+}
+`,
+		// File that is only included when the "prism" build tag is set
+		"tagged.go": `
+// +build prism
+
+package main
+
+func Tagged(){
+}
+`,
+	}
+	for name, src := range extraFiles {
+		file := filepath.Join(moduleDir, name)
+		os.MkdirAll(filepath.Dir(file), os.ModeDir|os.ModePerm)
+		err := ioutil.WriteFile(file, []byte(src), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	specs := []struct {
+		BuildTags []string
+		ExpTagged bool
+	}{
+		{nil, false},
+		{[]string{"prism"}, true},
+		{[]string{"foo", "prism"}, true},
+	}
+
+	for specIndex, spec := range specs {
+		candidates, err := ssaCandidates(pkgDir, pkgName, loadEnv(moduleDir, ""), spec.BuildTags)
+		if err != nil {
+			t.Errorf("[spec %d] %s", specIndex, err)
+			continue
+		}
+
+		if _, found := candidates[pkgName+"/unused/DoStuff"]; !found {
+			t.Errorf("[spec %d] expected function from unreached sub-package to be included in candidate list", specIndex)
+		}
+
+		if _, found := candidates[pkgName+"/Tagged"]; found != spec.ExpTagged {
+			t.Errorf("[spec %d] expected tagged function presence in candidate list to be %t; got %t", specIndex, spec.ExpTagged, found)
+		}
+	}
+}
+
 func mockPackage(t *testing.T) (workspaceDir, pkgDir, pkgName string) {
 	pkgName = "prism-mock"
 	otherPkgName := "other"
@@ -146,13 +298,16 @@ func main(){
 }
 
 func mockPackageWithVendoredDeps(t *testing.T, useGodeps bool) (workspaceDir, pkgDir, pkgName string) {
-	var otherPkgName string
+	var otherPkgName, otherPkgImport string
 	pkgName = "prism-mock"
 
 	if useGodeps {
 		otherPkgName = pkgName + "/Godeps/_workspace/other/pkg"
+		otherPkgImport = otherPkgName
 	} else {
+		// Packages in the vendor folder are imported using their original path
 		otherPkgName = pkgName + "/vendor/other/pkg"
+		otherPkgImport = "other/pkg"
 	}
 
 	pkgData := map[string]string{
@@ -165,7 +320,7 @@ func DoStuff(){
 		pkgName: `
 package main
 
-import other "` + otherPkgName + `"
+import other "` + otherPkgImport + `"
 
 type A struct {
 }
@@ -212,3 +367,122 @@ func main(){
 	pkgDir = workspaceDir + "/src/" + pkgName + "/"
 	return workspaceDir, pkgDir, pkgName
 }
+
+func mockModule(t *testing.T) (moduleDir, pkgDir, pkgName string) {
+	pkgName = "github.com/geckoboard/prism-mock"
+	pkgData := map[string]string{
+		"go.mod": `
+module ` + pkgName + `
+
+go 1.16
+`,
+		"other/src.go": `
+package other
+
+func DoStuff(){
+}
+	`,
+		"src.go": `
+package main
+
+import "` + pkgName + `/other"
+
+type A struct {
+}
+
+func(a *A) DoStuff(){
+	other.DoStuff()
+}
+
+func DoStuff(){
+	a := &A{}
+	a.DoStuff()
+
+	// The callgraph generator should not visit this function a second time
+	a.DoStuff()
+}
+
+func main(){
+	DoStuff()
+}
+`,
+	}
+
+	moduleDir = writeMockModule(t, pkgData)
+	return moduleDir, moduleDir + "/", pkgName
+}
+
+func mockModuleWithClosures(t *testing.T) (moduleDir, pkgDir, pkgName string) {
+	pkgName = "github.com/geckoboard/prism-mock"
+	pkgData := map[string]string{
+		"go.mod": `
+module ` + pkgName + `
+
+go 1.16
+`,
+		"src.go": `
+package main
+
+import "sync"
+
+var handler = func() {
+	work()
+}
+
+func work(){
+}
+
+func DoStuff(){
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		func() {
+			work()
+		}()
+	}()
+	wg.Wait()
+}
+
+func main(){
+	DoStuff()
+	handler()
+}
+
+func init(){
+	func() {
+		work()
+	}()
+}
+`,
+	}
+
+	moduleDir = writeMockModule(t, pkgData)
+	return moduleDir, moduleDir + "/", pkgName
+}
+
+// Create a temp folder and populate it with the supplied map of file names
+// to file contents.
+func writeMockModule(t *testing.T, pkgData map[string]string) string {
+	moduleDir, err := ioutil.TempDir("", "prism-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, src := range pkgData {
+		file := moduleDir + "/" + name
+		err = os.MkdirAll(filepath.Dir(file), os.ModeDir|os.ModePerm)
+		if err != nil {
+			os.RemoveAll(moduleDir)
+			t.Fatalf("error creating module folder for %q: %s", name, err)
+		}
+
+		err = ioutil.WriteFile(file, []byte(src), os.ModePerm)
+		if err != nil {
+			os.RemoveAll(moduleDir)
+			t.Fatalf("error creating module contents for %q: %s", name, err)
+		}
+	}
+
+	return moduleDir
+}